@@ -0,0 +1,197 @@
+// Package audit has structs and methods for keeping an
+// append-only audit trail of the requests which change
+// the databases: who made them, when, what they were to,
+// how they turned out, and the hashes of the documents
+// they changed before and after. The trail is written as
+// JSON Lines to a file which is rotated when it grows too
+// large, and can be searched by user, path and time.
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The format of the suffix rotated audit files are named with,
+// which sorts them from oldest to newest.
+const ROTATED_FORMAT = "20060102T150405.000000000"
+
+// An entry records one mutating request.
+type Entry struct {
+	Time   int64  `json:"time"`             // The time the request finished, in Unix milliseconds.
+	User   string `json:"user"`             // The user who made the request, or "" if the token was invalid.
+	Method string `json:"method"`           // The method of the request.
+	Path   string `json:"path"`             // The path of the request.
+	Query  string `json:"query,omitempty"`  // The query of the request, if any.
+	Status int    `json:"status"`           // The status code of the response.
+	Target string `json:"target,omitempty"` // The path of the document created by a POST, if any.
+	Before string `json:"before,omitempty"` // The SHA-256 hash of the document before the request, if there was one.
+	After  string `json:"after,omitempty"`  // The SHA-256 hash of the document after the request, if there is one.
+}
+
+// A filter selects entries of the audit trail.
+type Filter struct {
+	User   string    // The user who made the requests, or "" for every user.
+	Prefix string    // The prefix of the paths of the requests, or "" for every path.
+	From   time.Time // The earliest time of the requests, or zero for no limit.
+	To     time.Time // The latest time of the requests, or zero for no limit.
+}
+
+// Tells if an entry is selected by the filter.
+func (f Filter) matches(entry Entry) bool {
+	at := time.UnixMilli(entry.Time)
+	return (f.User == "" || entry.User == f.User) &&
+		strings.HasPrefix(entry.Path, f.Prefix) &&
+		(f.From.IsZero() || !at.Before(f.From)) &&
+		(f.To.IsZero() || !at.After(f.To))
+}
+
+// A log is the audit trail, kept in a file which is renamed
+// with the time once it reaches its maximum size, so a new
+// one can be started. Rotated files are never removed.
+type Log struct {
+	mu       *sync.Mutex // Guards file and size.
+	name     string      // The name of the current file.
+	maxBytes int64       // The size past which the file is rotated.
+	file     *os.File    // The current file, opened for appending.
+	size     int64       // The size of the current file.
+}
+
+// Opens the audit trail in the file name, creating it if it does not
+// exist, to be rotated once it would grow past maxBytes.
+func Open(name string, maxBytes int64) (*Log, error) {
+	l := &Log{mu: &sync.Mutex{}, name: name, maxBytes: maxBytes}
+	err := l.open()
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Opens the current file for appending. Must be called with the lock held.
+func (l *Log) open() error {
+	file, err := os.OpenFile(l.name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	l.file = file
+	l.size = info.Size()
+	return nil
+}
+
+// Appends an entry to the audit trail, rotating the file first if
+// the entry would take it past its maximum size.
+func (l *Log) Append(entry Entry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.size > 0 && l.size+int64(len(line)) > l.maxBytes {
+		err = l.rotate()
+		if err != nil {
+			return err
+		}
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	return err
+}
+
+// Renames the current file with the time and starts a new one.
+// Must be called with the lock held.
+func (l *Log) rotate() error {
+	err := l.file.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(l.name, l.name+"."+time.Now().UTC().Format(ROTATED_FORMAT))
+	if err != nil {
+		return err
+	}
+	return l.open()
+}
+
+// Finds the entries of the audit trail selected by filter,
+// from oldest to newest. The lock is only held while the files
+// are listed, so entries keep being appended during the search;
+// those appended after it started are left out.
+func (l *Log) Query(filter Filter) ([]Entry, error) {
+	l.mu.Lock()
+	rotated, err := filepath.Glob(l.name + ".*")
+	if err != nil {
+		l.mu.Unlock()
+		return nil, err
+	}
+	// The open file is still read in full if it is rotated during the search
+	current, err := os.Open(l.name)
+	size := l.size
+	l.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	defer current.Close()
+	sort.Strings(rotated)
+
+	entries := make([]Entry, 0)
+	for _, name := range rotated {
+		entries, err = readFile(name, filter, entries)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return readEntries(io.LimitReader(current, size), filter, entries)
+}
+
+// Appends the entries in the file name selected by filter to entries.
+func readFile(name string, filter Filter, entries []Entry) ([]Entry, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return readEntries(file, filter, entries)
+}
+
+// Appends the entries read from reader selected by filter to entries.
+func readEntries(reader io.Reader, filter Filter, entries []Entry) ([]Entry, error) {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry Entry
+		err := json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			return nil, err
+		}
+		if filter.matches(entry) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// Closes the audit trail.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.file.Close()
+}
@@ -0,0 +1,204 @@
+package audit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/authorization"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/collectionholder"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/dbhandler"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// An empty struct to implement validate token.
+type tokenAuthenticator struct{}
+
+// A simple implementation of validate token for testing, where the token is the username.
+func (tokenAuthenticator) ValidateToken(w http.ResponseWriter, r *http.Request) (bool, string) {
+	return true, strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+// Gets the hash of a document body.
+func hashOf(body string) string {
+	hash := sha256.Sum256([]byte(body))
+	return hex.EncodeToString(hash[:])
+}
+
+// Tests that entries are found across rotated files.
+func TestLog(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "audit.log")
+	log, err := Open(name, 200)
+	if err != nil {
+		t.Fatalf("expected no errors, got %s", err.Error())
+	}
+
+	start := time.Now().UnixMilli()
+	for i := 0; i < 10; i++ {
+		user := []string{"alice", "bob"}[i%2]
+		err = log.Append(Entry{Time: start + int64(i), User: user, Method: http.MethodPut, Path: "/v1/db/doc", Status: 201})
+		if err != nil {
+			t.Fatalf("expected no errors, got %s", err.Error())
+		}
+	}
+	rotated, _ := filepath.Glob(name + ".*")
+	if len(rotated) == 0 {
+		t.Errorf("Expected the file to be rotated")
+	}
+
+	data := []struct {
+		filter Filter
+		count  int
+	}{
+		{Filter{}, 10},
+		{Filter{User: "alice"}, 5},
+		{Filter{Prefix: "/v1/db/"}, 10},
+		{Filter{Prefix: "/v1/other/"}, 0},
+		{Filter{From: time.UnixMilli(start + 2), To: time.UnixMilli(start + 5)}, 4},
+	}
+	for i, d := range data {
+		entries, err := log.Query(d.filter)
+		if err != nil {
+			t.Fatalf("expected no errors, got %s", err.Error())
+		}
+		if len(entries) != d.count {
+			t.Errorf("Test %d: Expected %d entries, got %d", i, d.count, len(entries))
+		}
+		for j := 1; j < len(entries); j++ {
+			if entries[j].Time < entries[j-1].Time {
+				t.Errorf("Test %d: Expected entries from oldest to newest", i)
+			}
+		}
+	}
+	log.Close()
+
+	// Entries are kept when reopened
+	log, err = Open(name, 200)
+	if err != nil {
+		t.Fatalf("expected no errors, got %s", err.Error())
+	}
+	defer log.Close()
+	entries, _ := log.Query(Filter{})
+	if len(entries) != 10 {
+		t.Errorf("Expected 10 entries after reopening, got %d", len(entries))
+	}
+}
+
+// Tests that the trail is searched while entries are appended and
+// the file is rotated, without losing the entries from before.
+func TestQueryWhileAppending(t *testing.T) {
+	log, err := Open(filepath.Join(t.TempDir(), "audit.log"), 200)
+	if err != nil {
+		t.Fatalf("expected no errors, got %s", err.Error())
+	}
+	defer log.Close()
+
+	start := time.Now().UnixMilli()
+	for i := 0; i < 10; i++ {
+		log.Append(Entry{Time: start + int64(i), User: "alice", Method: http.MethodPut, Path: "/v1/db/doc", Status: 201})
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 10; i < 100; i++ {
+			log.Append(Entry{Time: start + int64(i), User: "alice", Method: http.MethodPut, Path: "/v1/db/doc", Status: 201})
+		}
+	}()
+
+	for i := 0; i < 20; i++ {
+		entries, err := log.Query(Filter{})
+		if err != nil {
+			t.Fatalf("expected no errors, got %s", err.Error())
+		}
+		if len(entries) < 10 {
+			t.Fatalf("Expected at least the first 10 entries, got %d", len(entries))
+		}
+		for j := range entries {
+			if entries[j].Time != start+int64(j) {
+				t.Fatalf("Expected entries in order without gaps, got %d at %d", entries[j].Time-start, j)
+			}
+		}
+	}
+	<-done
+}
+
+// Tests that mutating requests to a dbhandler are recorded, and
+// that only admins may search the trail.
+func TestMiddleware(t *testing.T) {
+	testschema, _ := jsonschema.CompileString("schema.json", "{\"type\":\"object\"}")
+	databases := collectionholder.New()
+	testhandler := dbhandler.New(&databases, testschema, tokenAuthenticator{})
+	log, err := Open(filepath.Join(t.TempDir(), "audit.log"), 1024*1024)
+	if err != nil {
+		t.Fatalf("expected no errors, got %s", err.Error())
+	}
+	defer log.Close()
+	auditor := Wrap(&testhandler, tokenAuthenticator{}, log)
+	roles := authorization.New()
+	roles.Assign("root", authorization.ALL_DATABASES, authorization.ROLE_ADMIN)
+	auditor.EnforceRoles(&roles)
+
+	// Sends a request as a user, returning the response.
+	serve := func(user string, method string, path string, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+user)
+		w := httptest.NewRecorder()
+		auditor.ServeHTTP(w, r)
+		return w
+	}
+
+	serve("root", http.MethodPut, "/v1/db1", "")
+	serve("alice", http.MethodPut, "/v1/db1/doc", "{\"a\":1}")
+	serve("alice", http.MethodGet, "/v1/db1/doc", "")
+	serve("bob", http.MethodPatch, "/v1/db1/doc", "[{\"op\":\"ObjectAdd\",\"path\":\"/b\",\"value\":2}]")
+	posted := serve("bob", http.MethodPost, "/v1/db1/", "{\"c\":3}")
+	serve("bob", http.MethodPut, "/v1/db1/doc", "[]")
+	serve("alice", http.MethodDelete, "/v1/db1/doc", "")
+
+	var uri map[string]string
+	json.Unmarshal(posted.Body.Bytes(), &uri)
+	expected := []Entry{
+		{User: "root", Method: http.MethodPut, Path: "/v1/db1", Status: 201},
+		{User: "alice", Method: http.MethodPut, Path: "/v1/db1/doc", Status: 201, After: hashOf("{\"a\":1}")},
+		{User: "bob", Method: http.MethodPatch, Path: "/v1/db1/doc", Status: 200, Before: hashOf("{\"a\":1}"), After: hashOf("{\"a\":1,\"b\":2}")},
+		{User: "bob", Method: http.MethodPost, Path: "/v1/db1/", Status: 201, Target: uri["uri"], After: hashOf("{\"c\":3}")},
+		{User: "bob", Method: http.MethodPut, Path: "/v1/db1/doc", Status: 400, Before: hashOf("{\"a\":1,\"b\":2}"), After: hashOf("{\"a\":1,\"b\":2}")},
+		{User: "alice", Method: http.MethodDelete, Path: "/v1/db1/doc", Status: 204, Before: hashOf("{\"a\":1,\"b\":2}")},
+	}
+
+	// Only admins may search the trail
+	if code := serve("alice", http.MethodGet, "/v1/_audit", "").Code; code != 403 {
+		t.Errorf("Expected non-admins to be refused, got %d", code)
+	}
+	if code := serve("root", http.MethodGet, "/v1/_audit?from=yesterday", "").Code; code != 400 {
+		t.Errorf("Expected a bad time to be refused, got %d", code)
+	}
+	w := serve("root", http.MethodGet, "/v1/_audit", "")
+	var entries []Entry
+	err = json.Unmarshal(w.Body.Bytes(), &entries)
+	if w.Code != 200 || err != nil {
+		t.Fatalf("Expected entries, got %s with code %d", w.Body.String(), w.Code)
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("Expected %d entries, got %v", len(expected), entries)
+	}
+	for i, entry := range entries {
+		entry.Time = 0
+		if entry != expected[i] {
+			t.Errorf("Test %d: Expected %v, got %v", i, expected[i], entry)
+		}
+	}
+
+	w = serve("root", http.MethodGet, "/v1/_audit?user=bob&prefix=/v1/db1/doc", "")
+	json.Unmarshal(w.Body.Bytes(), &entries)
+	if len(entries) != 2 {
+		t.Errorf("Expected 2 entries of bob on the document, got %v", entries)
+	}
+}
@@ -0,0 +1,190 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/authorization"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/errorMessage"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/interfaces"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/paths"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/structs"
+)
+
+// A middleware records every mutating request to the handler it
+// wraps in an audit trail, and serves GET requests to /v1/_audit,
+// which search the trail.
+type Middleware struct {
+	next          interfaces.Auditable     // The handler whose requests are audited.
+	authenticator interfaces.Authenticator // An authenticator for finding who made requests.
+	log           *Log                     // The audit trail.
+	roles         *authorization.Roles     // The roles of users, or nil if roles are not enforced.
+}
+
+// Creates a middleware recording the mutating requests to next in log.
+func Wrap(next interfaces.Auditable, authenticator interfaces.Authenticator, log *Log) *Middleware {
+	return &Middleware{next, authenticator, log, nil}
+}
+
+// Restricts searching the audit trail to users with the admin role on
+// every database. Without roles, every user may search the trail.
+func (m *Middleware) EnforceRoles(roles *authorization.Roles) {
+	m.roles = roles
+}
+
+// A status recorder passes a response on to the client,
+// remembering its status code and, if asked to, its body.
+type statusRecorder struct {
+	http.ResponseWriter
+	status   int          // The status code of the response, 0 if not yet written.
+	body     bytes.Buffer // The body of the response, if kept.
+	keepBody bool         // Whether to keep the body.
+}
+
+// Records the status code of the response.
+func (s *statusRecorder) WriteHeader(statusCode int) {
+	if s.status == 0 {
+		s.status = statusCode
+	}
+	s.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Records part of the body of the response, if kept.
+func (s *statusRecorder) Write(data []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	if s.keepBody {
+		s.body.Write(data)
+	}
+	return s.ResponseWriter.Write(data)
+}
+
+// A discard writer drops a response, for finding who made a request
+// without writing the error of an invalid token twice.
+type discardWriter struct {
+	header http.Header
+}
+
+// Returns the header of the dropped response.
+func (d *discardWriter) Header() http.Header {
+	return d.header
+}
+
+// Drops the status code of the response.
+func (d *discardWriter) WriteHeader(int) {}
+
+// Drops part of the body of the response.
+func (d *discardWriter) Write(data []byte) (int, error) {
+	return len(data), nil
+}
+
+// Serves a request, recording it in the audit trail if it changes
+// the databases. The hashes of the document a request is to are taken
+// just before and after it is handled, so another request to the same
+// document at the same time may be reflected in them.
+func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if paths.IsAuditRequest(r.URL.Path) && r.Method != http.MethodOptions {
+		m.serveAudit(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut, http.MethodPost, http.MethodPatch, http.MethodDelete:
+	default:
+		m.next.ServeHTTP(w, r)
+		return
+	}
+
+	_, username := m.authenticator.ValidateToken(&discardWriter{make(http.Header)}, r)
+	entry := Entry{User: username, Method: r.Method, Path: r.URL.Path, Query: r.URL.RawQuery}
+	entry.Before, _ = m.next.DocumentHash(entry.Path)
+
+	// The name of a posted document is only known from the response
+	recorder := &statusRecorder{ResponseWriter: w, keepBody: r.Method == http.MethodPost}
+	m.next.ServeHTTP(recorder, r)
+	entry.Status = recorder.status
+	if entry.Status == 0 {
+		entry.Status = http.StatusOK
+	}
+
+	var output structs.PutOutput
+	if r.Method == http.MethodPost && entry.Status == http.StatusCreated && json.Unmarshal(recorder.body.Bytes(), &output) == nil && output.Uri != entry.Path {
+		entry.Target = output.Uri
+		entry.After, _ = m.next.DocumentHash(output.Uri)
+	} else {
+		entry.After, _ = m.next.DocumentHash(entry.Path)
+	}
+
+	entry.Time = time.Now().UnixMilli()
+	err := m.log.Append(entry)
+	if err != nil {
+		// The request has already been handled
+		slog.Error("Audit: could not record request", "path", entry.Path, "error", err)
+	}
+}
+
+// Serves a GET request to /v1/_audit, which only admins may make,
+// with the entries of the audit trail as a JSON array. The entries
+// are filtered by the user, prefix, from and to queries, the last
+// two in Unix milliseconds.
+func (m *Middleware) serveAudit(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	valid, username := m.authenticator.ValidateToken(w, r)
+	if !valid {
+		return
+	}
+	if m.roles != nil && !m.roles.Allows(username, authorization.ALL_DATABASES, authorization.ROLE_ADMIN) {
+		slog.Info("Non-admin attempted to search the audit trail", "user", username)
+		errorMessage.Respond(w, r, "Forbidden: admin role on * required", http.StatusForbidden)
+		return
+	}
+	if r.Method != http.MethodGet {
+		slog.Info("User used unsupported method on audit", "method", r.Method)
+		msg := fmt.Sprintf("unsupported method on audit: %s", r.Method)
+		errorMessage.Respond(w, r, msg, http.StatusBadRequest)
+		return
+	}
+
+	queries := r.URL.Query()
+	filter := Filter{User: queries.Get("user"), Prefix: queries.Get("prefix")}
+	for _, bound := range []struct {
+		name string
+		at   *time.Time
+	}{{"from", &filter.From}, {"to", &filter.To}} {
+		if queries.Get(bound.name) == "" {
+			continue
+		}
+		millis, err := strconv.ParseInt(queries.Get(bound.name), 10, 64)
+		if err != nil {
+			slog.Info("Audit: bad time bound", "name", bound.name, "value", queries.Get(bound.name))
+			msg := fmt.Sprintf("%s must be a time in Unix milliseconds", bound.name)
+			errorMessage.Respond(w, r, msg, http.StatusBadRequest)
+			return
+		}
+		*bound.at = time.UnixMilli(millis)
+	}
+
+	entries, err := m.log.Query(filter)
+	if err != nil {
+		slog.Error("Audit: could not read the audit trail", "error", err)
+		errorMessage.Respond(w, r, "could not read the audit trail", http.StatusInternalServerError)
+		return
+	}
+	jsonResponse, err := json.Marshal(entries)
+	if err != nil {
+		// This should never happen
+		slog.Error("Audit: error marshaling", "error", err)
+		errorMessage.Respond(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonResponse)
+}
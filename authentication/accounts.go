@@ -0,0 +1,165 @@
+package authentication
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/authorization"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/errorMessage"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/structs"
+)
+
+// Serves requests under /auth/users, which only admins may make.
+// A POST to /auth/users with a body of {"username": ..., "password": ...}
+// registers a user, and a PUT to /auth/users/<username>/password with
+// a body of {"password": ...} changes the password of a user.
+func (a *Authenticator) serveUsers(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if !a.requireAdmin(w, r) {
+		// handled in method
+		return
+	}
+
+	rest := strings.TrimPrefix(r.URL.Path, USERS_PATH)
+	if rest == "" || rest == "/" {
+		if r.Method != http.MethodPost {
+			slog.Info("User used unsupported method on users", "method", r.Method)
+			msg := fmt.Sprintf("unsupported method on users: %s", r.Method)
+			errorMessage.Respond(w, r, msg, http.StatusBadRequest)
+			return
+		}
+		a.register(w, r)
+		return
+	}
+
+	username, found := strings.CutSuffix(strings.TrimPrefix(rest, "/"), "/password")
+	if !found || username == "" || strings.Contains(username, "/") {
+		slog.Info("User requested unknown users path", "path", r.URL.Path)
+		errorMessage.Respond(w, r, "Unknown users path", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPut {
+		slog.Info("User used unsupported method on password", "method", r.Method)
+		msg := fmt.Sprintf("unsupported method on password: %s", r.Method)
+		errorMessage.Respond(w, r, msg, http.StatusBadRequest)
+		return
+	}
+	a.changePassword(w, r, username)
+}
+
+// Tells if the request is from an admin, with the admin role on every
+// database. Without roles, there are no admins. If not, writes an
+// error to the client.
+func (a *Authenticator) requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	valid, username := a.ValidateToken(w, r)
+	if !valid {
+		return false
+	}
+	if a.roles == nil {
+		slog.Info("Admin request without roles enforced", "user", username)
+		errorMessage.Respond(w, r, "Forbidden: roles are not enforced on this server, so there are no admins", http.StatusForbidden)
+		return false
+	}
+	if a.roles.Allows(username, authorization.ALL_DATABASES, authorization.ROLE_ADMIN) {
+		return true
+	}
+
+	slog.Info("Non-admin attempted to manage users", "user", username)
+	errorMessage.Respond(w, r, "Forbidden: admin role required", http.StatusForbidden)
+	return false
+}
+
+// Registers a new user with a password.
+func (a *Authenticator) register(w http.ResponseWriter, r *http.Request) {
+	userInfo, ok := readUserInfo(w, r)
+	if !ok {
+		// handled in method
+		return
+	}
+	username := userInfo["username"]
+	if username == "" || strings.Contains(username, "/") {
+		slog.Info("Register: bad username", "user", username)
+		errorMessage.Respond(w, r, "No username in request body", http.StatusBadRequest)
+		return
+	}
+
+	err := a.users.register(username, userInfo["password"])
+	if err != nil {
+		a.respondUserError(w, r, "Register", err)
+		return
+	}
+
+	jsonResponse, err := json.Marshal(structs.PutOutput{Uri: USERS_PATH + "/" + username})
+	if err != nil {
+		// This should never happen
+		slog.Error("Register: error marshaling", "error", err)
+		errorMessage.Respond(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("Register: success", "user", username)
+	w.Header().Set("Location", USERS_PATH+"/"+username)
+	w.WriteHeader(http.StatusCreated)
+	w.Write(jsonResponse)
+}
+
+// Changes the password of a user.
+func (a *Authenticator) changePassword(w http.ResponseWriter, r *http.Request, username string) {
+	userInfo, ok := readUserInfo(w, r)
+	if !ok {
+		// handled in method
+		return
+	}
+
+	err := a.users.setPassword(username, userInfo["password"])
+	if err != nil {
+		a.respondUserError(w, r, "Change password", err)
+		return
+	}
+
+	slog.Info("Change password: success", "user", username)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Reads the JSON object of strings in the body of a request.
+// On error, writes a response and returns false.
+func readUserInfo(w http.ResponseWriter, r *http.Request) (map[string]string, bool) {
+	desc, err := io.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		slog.Error("Users: error reading the request body", "error", err)
+		errorMessage.Respond(w, r, "error reading the request body", http.StatusBadRequest)
+		return nil, false
+	}
+
+	var userInfo map[string]string
+	err = json.Unmarshal(desc, &userInfo)
+	if err != nil {
+		slog.Info("Users: error unmarshaling request", "error", err)
+		errorMessage.Respond(w, r, "invalid format, expected {\"username\": ..., \"password\": ...}", http.StatusBadRequest)
+		return nil, false
+	}
+	return userInfo, true
+}
+
+// Writes the response to an error changing the user store.
+func (a *Authenticator) respondUserError(w http.ResponseWriter, r *http.Request, op string, err error) {
+	switch {
+	case errors.Is(err, errShortPass):
+		msg := fmt.Sprintf("Password must be at least %d characters", MIN_PASSWORD_LENGTH)
+		errorMessage.Respond(w, r, msg, http.StatusBadRequest)
+	case errors.Is(err, errUserExists):
+		errorMessage.Respond(w, r, "User already exists", http.StatusConflict)
+	case errors.Is(err, errNoUser):
+		errorMessage.Respond(w, r, "User does not exist", http.StatusNotFound)
+	default:
+		slog.Error(op+": could not save users", "error", err)
+		errorMessage.Respond(w, r, "could not save users", http.StatusInternalServerError)
+	}
+}
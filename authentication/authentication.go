@@ -1,21 +1,26 @@
 // Package authentication has structs and methods
 // for enabling login and logout functionality per
-// the owlDB specifications. Implements the handler
-// interface, expects input urls to start with "/auth."
+// the owlDB specifications, and for managing the
+// password-based accounts users log in with.
+// Implements the handler interface, expects input
+// urls to start with "/auth."
 package authentication
 
 import (
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/authorization"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group20/errorMessage"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group20/options"
 )
@@ -24,46 +29,141 @@ import (
 // to log in and out of the owlDB and to verify users
 // are allowed to use this db.
 type Authenticator struct {
-	sessions *sync.Map
+	sessions  *sync.Map            // The sessions of logged in users, by token.
+	signed    *sync.Map            // The sessions of signed tokens issued by this server, by refresh id.
+	revoked   *sync.Map            // When each revoked signed token expires, by refresh id.
+	refreshes *sync.Map            // The refresh tokens of logged in users, by refresh token.
+	users     *userStore           // The accounts users log in with.
+	roles     *authorization.Roles // The roles of users, or nil if roles are not enforced.
+	keys      *keyRing             // The keys tokens are signed with, or nil to keep tokens in sessions.
+	lifetimes Lifetimes            // How long tokens last.
+	done      chan struct{}        // Closed to stop the reaper.
 }
 
+// The path of the users endpoint, under which accounts are managed.
+const USERS_PATH = "/auth/users"
+
 // A session info carries an individual users data
-// about their session, including username and when
-// their session expires.
+// about their session, including username, when their
+// session was created, when it expires and when it was
+// last used.
 type sessionInfo struct {
 	username  string
+	createdAt time.Time
 	expiresAt time.Time
+	lastUsed  *atomic.Int64 // When the token was last validated, in Unix milliseconds, or 0 if never.
+	refresh   string        // The refresh token issued with the token, if any.
+}
+
+// Creates the session info of a token for username lasting lifetime.
+func newSession(username string, lifetime time.Duration, refresh string) sessionInfo {
+	now := time.Now()
+	return sessionInfo{username, now, now.Add(lifetime), &atomic.Int64{}, refresh}
 }
 
-// Creates a new authenticator object
+// Creates a new authenticator object, with no accounts
 func New() Authenticator {
-	return Authenticator{&sync.Map{}}
+	return Authenticator{
+		sessions:  &sync.Map{},
+		signed:    &sync.Map{},
+		revoked:   &sync.Map{},
+		refreshes: &sync.Map{},
+		users:     newUserStore(),
+		lifetimes: DEFAULT_LIFETIMES,
+		done:      make(chan struct{}),
+	}
+}
+
+// Loads the accounts users log in with from a file,
+// which changes to the accounts are saved back to.
+func (a *Authenticator) LoadUsers(file string) error {
+	users, err := loadUserStore(file)
+	if err != nil {
+		return err
+	}
+
+	a.users = users
+	return nil
+}
+
+// Issues signed tokens on login, with the keys in a file, instead of
+// keeping tokens in the sessions map. Signed tokens carry the username,
+// roles and expiry of the user, so they are verified without a lookup,
+// survive restarts, and are accepted by any server sharing the keys.
+// The roles are those in the roles file when the token was issued and
+// are advisory only: requests are always authorized against the live
+// roles file, so role changes apply at once, even to tokens already
+// issued. The server still records the signed tokens it issues, by the
+// id of their refresh token, so that they can be listed and revoked;
+// revocations are kept in memory, so they do not outlive the server.
+func (a *Authenticator) LoadSigningKeys(file string) error {
+	keys, err := loadKeyRing(file)
+	if err != nil {
+		return err
+	}
+
+	a.keys = keys
+	return nil
+}
+
+// Restricts managing accounts, sessions and keys to users with the
+// admin role on every database. Without roles, no user may manage them.
+func (a *Authenticator) EnforceRoles(roles *authorization.Roles) {
+	a.roles = roles
 }
 
 // Installs a map of usernames to login tokens into this
-// authenticator. These user's sessions will last 24 hours.
+// authenticator. These user's sessions will last as long
+// as the installed lifetime, 24 hours by default.
 func (a *Authenticator) InstallUsers(users map[string]string) {
 	// Iterate over all user/token pairs.
 	for user, token := range users {
-		a.sessions.Store(token, sessionInfo{user, time.Now().Add(24 * time.Hour)})
+		a.sessions.Store(token, newSession(user, a.lifetimes.Installed, ""))
 	}
 }
 
 // Serves http requests with the path starting with /auth. Logs in
 // on a post request, logs out on a delete, and sends options if requested.
+// Requests under /auth/users manage accounts, requests to /auth/keys
+// rotate signing keys, a post to /auth/refresh refreshes a login, and
+// requests under /auth/sessions manage the sessions of every user.
 func (a *Authenticator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		options.Options(w, r)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, USERS_PATH) {
+		a.serveUsers(w, r)
+		return
+	}
+	if r.URL.Path == SESSIONS_PATH || strings.HasPrefix(r.URL.Path, SESSIONS_PATH+"/") {
+		a.serveSessions(w, r)
+		return
+	}
+	if r.URL.Path == REFRESH_PATH {
+		a.refresh(w, r)
+		return
+	}
+	if r.URL.Path == KEYS_PATH {
+		a.serveKeys(w, r)
+		return
+	}
+	if r.URL.Path != "/auth" {
+		slog.Info("User requested unknown auth path", "path", r.URL.Path)
+		errorMessage.Respond(w, r, "Unknown auth path", http.StatusNotFound)
+		return
+	}
+
 	switch r.Method {
 	case http.MethodPost:
 		a.login(w, r)
 	case http.MethodDelete:
 		a.logout(w, r)
-	case http.MethodOptions:
-		options.Options(w, r)
 	default:
 		// If user used method we do not support.
 		slog.Info("User used unsupported method", "method", r.Method)
 		msg := fmt.Sprintf("unsupported method: %s", r.Method)
-		errorMessage.ErrorResponse(w, msg, http.StatusBadRequest)
+		errorMessage.Respond(w, r, msg, http.StatusBadRequest)
 	}
 }
 
@@ -93,33 +193,58 @@ func (a *Authenticator) ValidateToken(w http.ResponseWriter, r *http.Request) (b
 	if len(parts) != 2 || parts[0] != "Bearer" || parts[1] == "" {
 		// Missing or malformed bearer token
 		slog.Info("ValidateToken: missing or malformed bearer token", "token", authValue)
-		errorMessage.ErrorResponse(w, "Missing or malformed bearer token", http.StatusUnauthorized)
+		errorMessage.RespondCode(w, r, errorMessage.CODE_MISSING_TOKEN, "Missing or malformed bearer token", http.StatusUnauthorized)
 		return false, ""
 	}
 
 	token := parts[1]
 
+	// Verify signed tokens by their signature, unless revoked here
+	if a.keys != nil && strings.Count(token, ".") == 2 {
+		claims, err := a.keys.verify(token)
+		switch {
+		case err == nil && a.isRevoked(claims.RefreshID):
+			slog.Info("ValidateToken: signed token was revoked")
+			errorMessage.RespondCode(w, r, errorMessage.CODE_INVALID_TOKEN, "Invalid bearer token", http.StatusUnauthorized)
+		case err == nil:
+			info, found := a.signed.Load(claims.RefreshID)
+			if found {
+				info.(sessionInfo).lastUsed.Store(time.Now().UnixMilli())
+			}
+			return true, claims.Subject
+		case errors.Is(err, errExpired):
+			slog.Info("ValidateToken: signed token has expired")
+			errorMessage.RespondCode(w, r, errorMessage.CODE_EXPIRED_TOKEN, "Expired bearer token", http.StatusUnauthorized)
+		default:
+			slog.Info("ValidateToken: signed token is invalid", "error", err)
+			errorMessage.RespondCode(w, r, errorMessage.CODE_INVALID_TOKEN, "Invalid bearer token", http.StatusUnauthorized)
+		}
+		return false, ""
+	}
+
 	// Validate token and expiration in sessions map
 	userInfo, ok := a.sessions.Load(token)
 	if ok {
 		if !userInfo.(sessionInfo).expiresAt.After(time.Now()) {
 			// token has expired
 			slog.Info("ValidateToken: token has expired")
-			errorMessage.ErrorResponse(w, "Expired bearer token", http.StatusUnauthorized)
+			errorMessage.RespondCode(w, r, errorMessage.CODE_EXPIRED_TOKEN, "Expired bearer token", http.StatusUnauthorized)
 			return false, ""
 		} else {
 			// token is valid
+			userInfo.(sessionInfo).lastUsed.Store(time.Now().UnixMilli())
 			return true, userInfo.(sessionInfo).username
 		}
 	} else {
 		// token does not exist
 		slog.Info("ValidateToken: token does not exist")
-		errorMessage.ErrorResponse(w, "Invalid bearer token", http.StatusUnauthorized)
+		errorMessage.RespondCode(w, r, errorMessage.CODE_INVALID_TOKEN, "Invalid bearer token", http.StatusUnauthorized)
 		return false, ""
 	}
 }
 
-// Logs the user who made the input request into the owlDB system.
+// Logs the user who made the input request into the owlDB system,
+// if the request carries their password.
 func (a *Authenticator) login(w http.ResponseWriter, r *http.Request) {
 	// Set headers of response
 	w.Header().Set("Content-Type", "application/json")
@@ -130,14 +255,14 @@ func (a *Authenticator) login(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 	if err != nil {
 		slog.Error("Login: error reading the request body", "error", err)
-		errorMessage.ErrorResponse(w, "error reading the login request body", http.StatusBadRequest)
+		errorMessage.Respond(w, r, "error reading the login request body", http.StatusBadRequest)
 		return
 	}
 	var userInfo map[string]string
 	err = json.Unmarshal(desc, &userInfo)
 	if err != nil {
 		slog.Error("Login: error unmarshaling request", "error", err)
-		errorMessage.ErrorResponse(w, "error unmarshaling login request", http.StatusBadRequest)
+		errorMessage.Respond(w, r, "error unmarshaling login request", http.StatusBadRequest)
 		return
 	}
 
@@ -145,36 +270,22 @@ func (a *Authenticator) login(w http.ResponseWriter, r *http.Request) {
 	username := userInfo["username"]
 	if username == "" {
 		slog.Info("Login: no username in request body")
-		errorMessage.ErrorResponse(w, "No username in request body", http.StatusBadRequest)
+		errorMessage.Respond(w, r, "No username in request body", http.StatusBadRequest)
 		return
 	}
-
-	// Generate a cryptographically secure, random token
-	token, err := generateToken()
-	if err != nil {
-		// This should never happen
-		slog.Error("Login: token not successfully generated", "error", err)
-		errorMessage.ErrorResponse(w, "Login: token not successfully generated", http.StatusInternalServerError)
+	if !a.users.verify(username, userInfo["password"]) {
+		slog.Info("Login: wrong username or password", "user", username)
+		errorMessage.Respond(w, r, "Invalid username or password", http.StatusUnauthorized)
 		return
 	}
 
-	// Add the user to the sessions map and its authorization expires one hour later
-	a.sessions.Store(token, sessionInfo{username, time.Now().Add(1 * time.Hour)})
-
-	// Return the token to the user
-	jsonToken, err := json.Marshal(map[string]string{"token": token})
-	if err != nil {
-		// This should never happen
-		slog.Error("Login: error marshaling", "error", err)
-		errorMessage.ErrorResponse(w, "error marshaling token", http.StatusInternalServerError)
-		return
-	}
-	w.WriteHeader(http.StatusOK)
-	w.Write(jsonToken)
+	a.issue(w, r, username)
 	slog.Info("Login: success", "user", username)
 }
 
-// Logs the user who made this request out of the owlDB system.
+// Logs the user who made this request out of the owlDB system,
+// ending the refresh token issued with their token. Signed tokens
+// are revoked by the id of their refresh token, which they carry.
 func (a *Authenticator) logout(w http.ResponseWriter, r *http.Request) {
 	// Set headers of response
 	w.Header().Set("Content-Type", "application/json")
@@ -186,9 +297,29 @@ func (a *Authenticator) logout(w http.ResponseWriter, r *http.Request) {
 		authValue := r.Header.Get("Authorization")
 		parts := strings.Split(authValue, " ")
 		token := parts[1]
-		a.sessions.Delete(token)
+		info, loaded := a.sessions.LoadAndDelete(token)
+		if loaded && info.(sessionInfo).refresh != "" {
+			a.refreshes.Delete(info.(sessionInfo).refresh)
+		}
+		if a.keys != nil && !loaded {
+			claims, err := a.keys.verify(token)
+			if err == nil && claims.RefreshID != "" && !a.revokeSigned(claims.RefreshID) {
+				// Issued by another server sharing the keys
+				a.revoked.Store(claims.RefreshID, time.Unix(claims.ExpiresAt, 0))
+			}
+		}
 
 		w.WriteHeader(http.StatusNoContent)
 		slog.Info("Logout: user is successfully removed", "token", token)
 	}
 }
+
+// Gets the claims of a signed token for username, which expires at
+// expiresAt and is issued with the refresh token whose id is refreshID.
+func (a *Authenticator) claimsOf(username string, expiresAt time.Time, refreshID string) tokenClaims {
+	claims := tokenClaims{Subject: username, IssuedAt: time.Now().Unix(), ExpiresAt: expiresAt.Unix(), RefreshID: refreshID}
+	if a.roles != nil {
+		claims.Roles = a.roles.Of(username)
+	}
+	return claims
+}
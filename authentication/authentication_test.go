@@ -1,12 +1,19 @@
 package authentication
 
 import (
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/authorization"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/structs"
 )
 
 type test struct {
@@ -48,7 +55,18 @@ func TestAuthentication(t *testing.T) {
 		index++
 	}
 
-	loginTest := test{httptest.NewRequest(http.MethodPost, "/auth", strings.NewReader("{\"username\":\"jingwu\"}")), httptest.NewRecorder(), "Successfully Logged in", 200}
+	// Login: Unauthorized (no such user, wrong password)
+	testAuthenticator.users.register("jingwu", "correct horse")
+	for _, body := range []string{"{\"username\":\"nobody\",\"password\":\"correct horse\"}", "{\"username\":\"jingwu\"}", "{\"username\":\"jingwu\",\"password\":\"wrong horse\"}"} {
+		w := httptest.NewRecorder()
+		testAuthenticator.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/auth", strings.NewReader(body)))
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("Test %d: Expected error code %d got %d", index, http.StatusUnauthorized, w.Code)
+		}
+		index++
+	}
+
+	loginTest := test{httptest.NewRequest(http.MethodPost, "/auth", strings.NewReader("{\"username\":\"jingwu\",\"password\":\"correct horse\"}")), httptest.NewRecorder(), "Successfully Logged in", 200}
 
 	// Get login information out.
 	testAuthenticator.ServeHTTP(loginTest.w, loginTest.r)
@@ -131,3 +149,455 @@ func TestAuthentication(t *testing.T) {
 	}
 	index++
 }
+
+// Tests the password hash against the PBKDF2-HMAC-SHA256 test vectors of RFC 7914.
+func TestHashPassword(t *testing.T) {
+	hash := hex.EncodeToString(hashPassword("passwd", []byte("salt"), 1))
+	if hash != "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc" {
+		t.Errorf("Expected the RFC 7914 hash, got %s", hash)
+	}
+}
+
+// Tests registering users and changing passwords as an admin.
+func TestUsers(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "users.json")
+	testAuthenticator := New()
+	err := testAuthenticator.LoadUsers(file)
+	if err != nil {
+		t.Fatalf("expected no errors, got %s", err.Error())
+	}
+	roles := authorization.New()
+	roles.Assign("root", authorization.ALL_DATABASES, authorization.ROLE_ADMIN)
+	testAuthenticator.EnforceRoles(&roles)
+	testAuthenticator.InstallUsers(map[string]string{"root": "roottoken", "alice": "alicetoken"})
+
+	// Sends a request with a token, returning the response code.
+	serve := func(auth *Authenticator, token string, method string, path string, body string) int {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		auth.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	data := []struct {
+		token  string
+		method string
+		path   string
+		body   string
+		code   int
+	}{
+		{"", http.MethodPost, "/auth/users", "{\"username\":\"bob\",\"password\":\"bobsecret\"}", 401},
+		{"alicetoken", http.MethodPost, "/auth/users", "{\"username\":\"bob\",\"password\":\"bobsecret\"}", 403},
+		{"roottoken", http.MethodPost, "/auth/users", "{\"username\":\"bob\",\"password\":\"short\"}", 400},
+		{"roottoken", http.MethodPost, "/auth/users", "{\"username\":\"bob\",\"password\":\"bobsecret\"}", 201},
+		{"roottoken", http.MethodPost, "/auth/users", "{\"username\":\"bob\",\"password\":\"bobsecret\"}", 409},
+		{"", http.MethodPost, "/auth", "{\"username\":\"bob\",\"password\":\"bobsecret\"}", 200},
+		{"alicetoken", http.MethodPut, "/auth/users/bob/password", "{\"password\":\"newsecret\"}", 403},
+		{"roottoken", http.MethodPut, "/auth/users/carol/password", "{\"password\":\"newsecret\"}", 404},
+		{"roottoken", http.MethodPut, "/auth/users/bob/password", "{\"password\":\"newsecret\"}", 204},
+		{"", http.MethodPost, "/auth", "{\"username\":\"bob\",\"password\":\"bobsecret\"}", 401},
+		{"roottoken", http.MethodGet, "/auth/users", "", 400},
+		{"roottoken", http.MethodGet, "/auth/other", "", 404},
+	}
+	for i, d := range data {
+		code := serve(&testAuthenticator, d.token, d.method, d.path, d.body)
+		if code != d.code {
+			t.Errorf("Test %d: Expected response code %d got %d", i, d.code, code)
+		}
+	}
+
+	// Accounts are saved to the file
+	reloaded := New()
+	err = reloaded.LoadUsers(file)
+	if err != nil {
+		t.Fatalf("expected no errors, got %s", err.Error())
+	}
+	code := serve(&reloaded, "", http.MethodPost, "/auth", "{\"username\":\"bob\",\"password\":\"newsecret\"}")
+	if code != 200 {
+		t.Errorf("Expected login with the new password, got %d", code)
+	}
+
+	// Without roles, no user is an admin
+	reloaded.InstallUsers(map[string]string{"alice": "alicetoken"})
+	for i, path := range []string{"/auth/users/bob/password", "/auth/sessions", "/auth/keys"} {
+		code = serve(&reloaded, "alicetoken", http.MethodPut, path, "{\"password\":\"alicesecret\"}")
+		if code != http.StatusForbidden {
+			t.Errorf("Test %d: Expected response code 403 got %d", i, code)
+		}
+	}
+}
+
+// Tests logging in with signed tokens, and rotating the signing key.
+func TestSignedTokens(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "keys.json")
+	testAuthenticator := New()
+	err := testAuthenticator.LoadSigningKeys(file)
+	if err != nil {
+		t.Fatalf("expected no errors, got %s", err.Error())
+	}
+	testAuthenticator.users.register("jingwu", "correct horse")
+	roles := authorization.New()
+	roles.Assign("jingwu", authorization.ALL_DATABASES, authorization.ROLE_ADMIN)
+	testAuthenticator.EnforceRoles(&roles)
+
+	// Logs in, returning the token.
+	login := func() string {
+		w := httptest.NewRecorder()
+		testAuthenticator.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/auth", strings.NewReader("{\"username\":\"jingwu\",\"password\":\"correct horse\"}")))
+		var tokenMap map[string]string
+		json.Unmarshal(w.Body.Bytes(), &tokenMap)
+		if strings.Count(tokenMap["token"], ".") != 2 {
+			t.Fatalf("Expected a signed token, got %s", w.Body.String())
+		}
+		return tokenMap["token"]
+	}
+
+	// Validates a token with an authenticator, returning the username and response code.
+	validate := func(auth *Authenticator, token string) (string, int) {
+		r := httptest.NewRequest(http.MethodGet, "/v1/db", http.NoBody)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		_, username := auth.ValidateToken(w, r)
+		return username, w.Code
+	}
+
+	token := login()
+	username, code := validate(&testAuthenticator, token)
+	if username != "jingwu" || code != 200 {
+		t.Errorf("Expected username jingwu, got %q with code %d", username, code)
+	}
+	claims, _ := testAuthenticator.keys.verify(token)
+	if claims.Roles[authorization.ALL_DATABASES] != authorization.ROLE_ADMIN {
+		t.Errorf("Expected the token to carry the admin role, got %v", claims.Roles)
+	}
+
+	// Tampered, unsigned and expired tokens are refused
+	parts := strings.Split(token, ".")
+	none := base64.RawURLEncoding.EncodeToString([]byte("{\"alg\":\"none\",\"typ\":\"JWT\"}"))
+	expired, _ := testAuthenticator.keys.sign(tokenClaims{Subject: "jingwu", ExpiresAt: time.Now().Add(-time.Minute).Unix()})
+	for i, bad := range []string{parts[0] + "." + parts[1] + "x." + parts[2], none + "." + parts[1] + ".", expired} {
+		username, code = validate(&testAuthenticator, bad)
+		if username != "" || code != http.StatusUnauthorized {
+			t.Errorf("Test %d: Expected code 401, got %q with code %d", i, username, code)
+		}
+	}
+
+	// After a rotation, old tokens stay valid and new tokens use the new key
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/auth/keys", http.NoBody)
+	r.Header.Set("Authorization", "Bearer "+token)
+	testAuthenticator.ServeHTTP(w, r)
+	if w.Code != 200 {
+		t.Fatalf("Expected rotation to succeed, got %d", w.Code)
+	}
+	if token2 := login(); strings.Split(token2, ".")[0] == parts[0] {
+		t.Errorf("Expected a new key id after rotation")
+	}
+
+	// Another server with the same keys accepts the tokens
+	other := New()
+	err = other.LoadSigningKeys(file)
+	if err != nil {
+		t.Fatalf("expected no errors, got %s", err.Error())
+	}
+	username, code = validate(&other, token)
+	if username != "jingwu" || code != 200 {
+		t.Errorf("Expected username jingwu, got %q with code %d", username, code)
+	}
+}
+
+// Tests refreshing tokens, and reaping expired ones.
+func TestRefresh(t *testing.T) {
+	testAuthenticator := New()
+	testAuthenticator.users.register("jingwu", "correct horse")
+
+	// Posts a body to a path, returning the tokens and response code.
+	post := func(path string, body string) (map[string]string, int) {
+		w := httptest.NewRecorder()
+		testAuthenticator.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+		var tokenMap map[string]string
+		json.Unmarshal(w.Body.Bytes(), &tokenMap)
+		return tokenMap, w.Code
+	}
+
+	// Tells if a token is valid.
+	valid := func(token string) bool {
+		r := httptest.NewRequest(http.MethodGet, "/v1/db", http.NoBody)
+		r.Header.Set("Authorization", "Bearer "+token)
+		ok, _ := testAuthenticator.ValidateToken(httptest.NewRecorder(), r)
+		return ok
+	}
+
+	login, code := post("/auth", "{\"username\":\"jingwu\",\"password\":\"correct horse\"}")
+	if code != 200 || login["refreshToken"] == "" {
+		t.Fatalf("Expected a refresh token, got %v with code %d", login, code)
+	}
+
+	// A refresh ends the old token, and the refresh token is used up
+	refreshed, code := post("/auth/refresh", "{\"refreshToken\":\""+login["refreshToken"]+"\"}")
+	if code != 200 || !valid(refreshed["token"]) || valid(login["token"]) {
+		t.Errorf("Expected the refreshed token alone to be valid, got code %d", code)
+	}
+	_, code = post("/auth/refresh", "{\"refreshToken\":\""+login["refreshToken"]+"\"}")
+	if code != http.StatusUnauthorized {
+		t.Errorf("Expected reusing a refresh token to fail, got %d", code)
+	}
+	_, code = post("/auth/refresh", "{}")
+	if code != http.StatusBadRequest {
+		t.Errorf("Expected a missing refresh token to fail, got %d", code)
+	}
+
+	// Logging out ends the refresh token
+	r := httptest.NewRequest(http.MethodDelete, "/auth", http.NoBody)
+	r.Header.Set("Authorization", "Bearer "+refreshed["token"])
+	testAuthenticator.ServeHTTP(httptest.NewRecorder(), r)
+	_, code = post("/auth/refresh", "{\"refreshToken\":\""+refreshed["refreshToken"]+"\"}")
+	if code != http.StatusUnauthorized {
+		t.Errorf("Expected refreshing after logout to fail, got %d", code)
+	}
+
+	// Expired tokens are refused and reaped
+	testAuthenticator.SetLifetimes(Lifetimes{time.Millisecond, time.Millisecond, time.Millisecond})
+	testAuthenticator.InstallUsers(map[string]string{"jingwu": "installed"})
+	login, _ = post("/auth", "{\"username\":\"jingwu\",\"password\":\"correct horse\"}")
+	time.Sleep(5 * time.Millisecond)
+	if valid("installed") || valid(login["token"]) {
+		t.Errorf("Expected expired tokens to be invalid")
+	}
+	_, code = post("/auth/refresh", "{\"refreshToken\":\""+login["refreshToken"]+"\"}")
+	if code != http.StatusUnauthorized {
+		t.Errorf("Expected an expired refresh token to fail, got %d", code)
+	}
+	testAuthenticator.reap()
+	count := 0
+	testAuthenticator.sessions.Range(func(_, _ any) bool { count++; return true })
+	testAuthenticator.refreshes.Range(func(_, _ any) bool { count++; return true })
+	if count != 0 {
+		t.Errorf("Expected every token to be reaped, got %d left", count)
+	}
+}
+
+// Tests that logging out with a signed token revokes it and ends its
+// refresh token.
+func TestSignedLogout(t *testing.T) {
+	testAuthenticator := New()
+	err := testAuthenticator.LoadSigningKeys(filepath.Join(t.TempDir(), "keys.json"))
+	if err != nil {
+		t.Fatalf("expected no errors, got %s", err.Error())
+	}
+	testAuthenticator.users.register("jingwu", "correct horse")
+
+	// Posts a body to a path, returning the tokens and response code.
+	post := func(path string, body string) (map[string]string, int) {
+		w := httptest.NewRecorder()
+		testAuthenticator.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+		var tokenMap map[string]string
+		json.Unmarshal(w.Body.Bytes(), &tokenMap)
+		return tokenMap, w.Code
+	}
+
+	login, code := post("/auth", "{\"username\":\"jingwu\",\"password\":\"correct horse\"}")
+	if code != 200 || strings.Count(login["token"], ".") != 2 || login["refreshToken"] == "" {
+		t.Fatalf("Expected a signed token and a refresh token, got %v with code %d", login, code)
+	}
+	other, _ := post("/auth", "{\"username\":\"jingwu\",\"password\":\"correct horse\"}")
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodDelete, "/auth", http.NoBody)
+	r.Header.Set("Authorization", "Bearer "+login["token"])
+	testAuthenticator.ServeHTTP(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected logout to succeed, got %d", w.Code)
+	}
+	_, code = post("/auth/refresh", "{\"refreshToken\":\""+login["refreshToken"]+"\"}")
+	if code != http.StatusUnauthorized {
+		t.Errorf("Expected refreshing after logout to fail, got %d", code)
+	}
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/v1/db", http.NoBody)
+	r.Header.Set("Authorization", "Bearer "+login["token"])
+	if valid, _ := testAuthenticator.ValidateToken(w, r); valid {
+		t.Errorf("Expected the token to be invalid after logout")
+	}
+
+	// Other logins keep their refresh tokens
+	_, code = post("/auth/refresh", "{\"refreshToken\":\""+other["refreshToken"]+"\"}")
+	if code != http.StatusOK {
+		t.Errorf("Expected refreshing another login to succeed, got %d", code)
+	}
+}
+
+// Tests listing and revoking sessions as an admin.
+func TestSessions(t *testing.T) {
+	testAuthenticator := New()
+	roles := authorization.New()
+	roles.Assign("root", authorization.ALL_DATABASES, authorization.ROLE_ADMIN)
+	testAuthenticator.EnforceRoles(&roles)
+	testAuthenticator.InstallUsers(map[string]string{"root": "roottoken", "alice": "alicetoken"})
+	testAuthenticator.users.register("bob", "bobsecret")
+
+	// Sends a request with a token, returning the response.
+	serve := func(token string, method string, path string, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		testAuthenticator.ServeHTTP(w, r)
+		return w
+	}
+
+	// Lists the sessions of a user as root.
+	list := func(user string) []structs.SessionOutput {
+		w := serve("roottoken", http.MethodGet, "/auth/sessions?user="+user, "")
+		var sessions []structs.SessionOutput
+		err := json.Unmarshal(w.Body.Bytes(), &sessions)
+		if w.Code != 200 || err != nil {
+			t.Fatalf("Expected sessions, got %s with code %d", w.Body.String(), w.Code)
+		}
+		return sessions
+	}
+
+	var tokens []string
+	for i := 0; i < 2; i++ {
+		w := serve("", http.MethodPost, "/auth", "{\"username\":\"bob\",\"password\":\"bobsecret\"}")
+		var tokenMap map[string]string
+		json.Unmarshal(w.Body.Bytes(), &tokenMap)
+		tokens = append(tokens, tokenMap["token"])
+	}
+
+	// Only admins see sessions, which do not show tokens
+	if code := serve("alicetoken", http.MethodGet, "/auth/sessions", "").Code; code != 403 {
+		t.Errorf("Expected non-admins to be refused, got %d", code)
+	}
+	if n := len(list("")); n != 4 {
+		t.Errorf("Expected 4 sessions, got %d", n)
+	}
+	serve(tokens[0], http.MethodGet, "/auth/sessions", "")
+	sessions := list("bob")
+	if len(sessions) != 2 {
+		t.Fatalf("Expected bob's sessions, got %v", sessions)
+	}
+	if sessions[0].Id != sessionID(tokens[0]) {
+		sessions[0], sessions[1] = sessions[1], sessions[0]
+	}
+	if sessions[0].Id != sessionID(tokens[0]) || sessions[0].Id == tokens[0] {
+		t.Fatalf("Expected bob's sessions by id, got %v", sessions)
+	}
+	if sessions[0].User != "bob" || sessions[0].LastUsedAt == 0 || sessions[1].LastUsedAt != 0 || sessions[0].ExpiresAt <= sessions[0].CreatedAt {
+		t.Errorf("Expected session details, got %v", sessions)
+	}
+
+	// Revoke one session, then the rest of the user's
+	if code := serve("roottoken", http.MethodDelete, "/auth/sessions/"+sessions[0].Id, "").Code; code != 204 {
+		t.Errorf("Expected revoking a session to succeed, got %d", code)
+	}
+	if code := serve("roottoken", http.MethodDelete, "/auth/sessions/"+sessions[0].Id, "").Code; code != 404 {
+		t.Errorf("Expected revoking a revoked session to fail, got %d", code)
+	}
+	if code := serve(tokens[0], http.MethodGet, "/auth/sessions", "").Code; code != 401 {
+		t.Errorf("Expected a revoked token to be invalid, got %d", code)
+	}
+	if code := serve("roottoken", http.MethodDelete, "/auth/sessions", "").Code; code != 400 {
+		t.Errorf("Expected revoking without a user to fail, got %d", code)
+	}
+	w := serve("roottoken", http.MethodDelete, "/auth/sessions?user=bob", "")
+	if w.Code != 200 || w.Body.String() != "{\"sessions\":1,\"refreshTokens\":1}" {
+		t.Errorf("Expected one session and refresh token revoked, got %s with code %d", w.Body.String(), w.Code)
+	}
+	if n := len(list("bob")); n != 0 {
+		t.Errorf("Expected no sessions of bob, got %d", n)
+	}
+}
+
+// Tests listing and revoking the sessions of signed tokens.
+func TestSignedSessions(t *testing.T) {
+	testAuthenticator := New()
+	err := testAuthenticator.LoadSigningKeys(filepath.Join(t.TempDir(), "keys.json"))
+	if err != nil {
+		t.Fatalf("expected no errors, got %s", err.Error())
+	}
+	roles := authorization.New()
+	roles.Assign("root", authorization.ALL_DATABASES, authorization.ROLE_ADMIN)
+	testAuthenticator.EnforceRoles(&roles)
+	testAuthenticator.InstallUsers(map[string]string{"root": "roottoken"})
+	testAuthenticator.users.register("bob", "bobsecret")
+
+	// Sends a request with a token, returning the response.
+	serve := func(token string, method string, path string, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		testAuthenticator.ServeHTTP(w, r)
+		return w
+	}
+
+	// Lists the sessions of bob as root.
+	list := func() []structs.SessionOutput {
+		w := serve("roottoken", http.MethodGet, "/auth/sessions?user=bob", "")
+		var sessions []structs.SessionOutput
+		err := json.Unmarshal(w.Body.Bytes(), &sessions)
+		if w.Code != 200 || err != nil {
+			t.Fatalf("Expected sessions, got %s with code %d", w.Body.String(), w.Code)
+		}
+		return sessions
+	}
+
+	logins := make([]map[string]string, 0)
+	for i := 0; i < 3; i++ {
+		w := serve("", http.MethodPost, "/auth", "{\"username\":\"bob\",\"password\":\"bobsecret\"}")
+		var tokenMap map[string]string
+		json.Unmarshal(w.Body.Bytes(), &tokenMap)
+		logins = append(logins, tokenMap)
+	}
+	serve(logins[0]["token"], http.MethodGet, "/auth/sessions", "")
+
+	sessions := list()
+	if len(sessions) != 3 {
+		t.Fatalf("Expected 3 sessions of bob, got %v", sessions)
+	}
+	for i := range sessions {
+		if sessions[i].Id == sessionID(logins[0]["refreshToken"]) {
+			sessions[0], sessions[i] = sessions[i], sessions[0]
+		}
+	}
+	if sessions[0].Id != sessionID(logins[0]["refreshToken"]) || sessions[0].LastUsedAt == 0 || sessions[1].LastUsedAt != 0 {
+		t.Fatalf("Expected bob's sessions by refresh id, got %v", sessions)
+	}
+
+	// A revoked signed token and its refresh token stop being valid
+	if code := serve("roottoken", http.MethodDelete, "/auth/sessions/"+sessions[0].Id, "").Code; code != 204 {
+		t.Errorf("Expected revoking a session to succeed, got %d", code)
+	}
+	if code := serve(logins[0]["token"], http.MethodGet, "/auth/sessions", "").Code; code != 401 {
+		t.Errorf("Expected a revoked token to be invalid, got %d", code)
+	}
+	if code := serve("", http.MethodPost, "/auth/refresh", "{\"refreshToken\":\""+logins[0]["refreshToken"]+"\"}").Code; code != 401 {
+		t.Errorf("Expected the refresh token of a revoked token to be invalid, got %d", code)
+	}
+
+	// Refreshing replaces a session
+	w := serve("", http.MethodPost, "/auth/refresh", "{\"refreshToken\":\""+logins[1]["refreshToken"]+"\"}")
+	if w.Code != 200 {
+		t.Fatalf("Expected refreshing to succeed, got %d", w.Code)
+	}
+	if code := serve(logins[1]["token"], http.MethodGet, "/auth/sessions", "").Code; code != 401 {
+		t.Errorf("Expected a refreshed token to be invalid, got %d", code)
+	}
+	if n := len(list()); n != 2 {
+		t.Errorf("Expected 2 sessions of bob, got %d", n)
+	}
+
+	// Revoking the user revokes the rest
+	w = serve("roottoken", http.MethodDelete, "/auth/sessions?user=bob", "")
+	if w.Code != 200 || w.Body.String() != "{\"sessions\":2,\"refreshTokens\":2}" {
+		t.Errorf("Expected two sessions and refresh tokens revoked, got %s with code %d", w.Body.String(), w.Code)
+	}
+	if code := serve(logins[2]["token"], http.MethodGet, "/auth/sessions", "").Code; code != 401 {
+		t.Errorf("Expected a revoked token to be invalid, got %d", code)
+	}
+	if n := len(list()); n != 0 {
+		t.Errorf("Expected no sessions of bob, got %d", n)
+	}
+}
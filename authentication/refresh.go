@@ -0,0 +1,224 @@
+package authentication
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/errorMessage"
+)
+
+// The path of the refresh endpoint, where refresh tokens are
+// exchanged for new tokens.
+const REFRESH_PATH = "/auth/refresh"
+
+// How often the reaper removes expired tokens.
+const REAP_INTERVAL = time.Minute
+
+// A lifetimes holds how long each kind of token lasts.
+type Lifetimes struct {
+	Session   time.Duration // How long a token from logging in or refreshing lasts.
+	Refresh   time.Duration // How long a refresh token lasts.
+	Installed time.Duration // How long a token installed from the token file lasts.
+}
+
+// The lifetimes of tokens unless others are set.
+var DEFAULT_LIFETIMES = Lifetimes{1 * time.Hour, 24 * time.Hour, 24 * time.Hour}
+
+// A refresh info carries the user a refresh token was issued
+// to, when it expires, and the token issued with it.
+type refreshInfo struct {
+	username  string
+	expiresAt time.Time
+	token     string
+}
+
+// Sets how long tokens last. Applies to tokens issued afterwards.
+func (a *Authenticator) SetLifetimes(lifetimes Lifetimes) {
+	a.lifetimes = lifetimes
+}
+
+// Starts removing expired tokens in the background once every interval.
+func (a *Authenticator) StartReaper(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-a.done:
+				return
+			case <-ticker.C:
+				a.reap()
+			}
+		}
+	}()
+}
+
+// Stops removing expired tokens in the background.
+func (a *Authenticator) StopReaper() {
+	close(a.done)
+}
+
+// Removes the expired tokens and refresh tokens.
+func (a *Authenticator) reap() {
+	now := time.Now()
+	reaped := 0
+	a.sessions.Range(func(token, info any) bool {
+		if !info.(sessionInfo).expiresAt.After(now) {
+			a.sessions.Delete(token)
+			reaped++
+		}
+		return true
+	})
+	a.signed.Range(func(rid, info any) bool {
+		if !info.(sessionInfo).expiresAt.After(now) {
+			a.signed.Delete(rid)
+			reaped++
+		}
+		return true
+	})
+	a.revoked.Range(func(rid, expiresAt any) bool {
+		if !expiresAt.(time.Time).After(now) {
+			a.revoked.Delete(rid)
+		}
+		return true
+	})
+	a.refreshes.Range(func(refresh, info any) bool {
+		if !info.(refreshInfo).expiresAt.After(now) {
+			a.refreshes.Delete(refresh)
+			reaped++
+		}
+		return true
+	})
+	slog.Debug("Reaped expired tokens", "count", reaped)
+}
+
+// Revokes the signed token issued by this server with the refresh
+// token whose id is rid, and ends that refresh token. Returns whether
+// there was such a token which had not been revoked.
+func (a *Authenticator) revokeSigned(rid string) bool {
+	info, found := a.signed.LoadAndDelete(rid)
+	if !found {
+		return false
+	}
+
+	a.revoked.Store(rid, info.(sessionInfo).expiresAt)
+	if info.(sessionInfo).refresh != "" {
+		a.refreshes.Delete(info.(sessionInfo).refresh)
+	}
+	return true
+}
+
+// Tells if the signed token issued with the refresh token whose id
+// is rid was revoked.
+func (a *Authenticator) isRevoked(rid string) bool {
+	if rid == "" {
+		return false
+	}
+	_, revoked := a.revoked.Load(rid)
+	return revoked
+}
+
+// Issues a token and a refresh token to username, writing them
+// to the client as {"token": ..., "refreshToken": ...}.
+func (a *Authenticator) issue(w http.ResponseWriter, r *http.Request, username string) {
+	refresh, err := generateToken()
+	if err != nil {
+		// This should never happen
+		slog.Error("Issue: refresh token not successfully generated", "error", err)
+		errorMessage.Respond(w, r, "token not successfully generated", http.StatusInternalServerError)
+		return
+	}
+
+	// Generate a signed token, or a cryptographically secure, random token
+	var token string
+	session := newSession(username, a.lifetimes.Session, refresh)
+	if a.keys != nil {
+		token, err = a.keys.sign(a.claimsOf(username, session.expiresAt, sessionID(refresh)))
+	} else {
+		token, err = generateToken()
+	}
+	if err != nil {
+		// This should never happen
+		slog.Error("Issue: token not successfully generated", "error", err)
+		errorMessage.Respond(w, r, "token not successfully generated", http.StatusInternalServerError)
+		return
+	}
+
+	// Add the user to the sessions map, or that of signed tokens
+	if a.keys == nil {
+		a.sessions.Store(token, session)
+	} else {
+		a.signed.Store(sessionID(refresh), session)
+	}
+	a.refreshes.Store(refresh, refreshInfo{username, time.Now().Add(a.lifetimes.Refresh), token})
+
+	// Return the tokens to the user
+	jsonToken, err := json.Marshal(map[string]string{"token": token, "refreshToken": refresh})
+	if err != nil {
+		// This should never happen
+		slog.Error("Issue: error marshaling", "error", err)
+		errorMessage.Respond(w, r, "error marshaling token", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonToken)
+}
+
+// Exchanges the refresh token in the body of a post to /auth/refresh,
+// {"refreshToken": ...}, for a new token and refresh token. The old
+// refresh token stops being valid, and so does the token issued with it.
+func (a *Authenticator) refresh(w http.ResponseWriter, r *http.Request) {
+	// Set headers of response
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if r.Method != http.MethodPost {
+		slog.Info("User used unsupported method on refresh", "method", r.Method)
+		msg := fmt.Sprintf("unsupported method on refresh: %s", r.Method)
+		errorMessage.Respond(w, r, msg, http.StatusBadRequest)
+		return
+	}
+
+	// Read body of request
+	desc, err := io.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		slog.Error("Refresh: error reading the request body", "error", err)
+		errorMessage.Respond(w, r, "error reading the refresh request body", http.StatusBadRequest)
+		return
+	}
+	var body map[string]string
+	err = json.Unmarshal(desc, &body)
+	if err != nil || body["refreshToken"] == "" {
+		slog.Info("Refresh: bad request body", "error", err)
+		errorMessage.Respond(w, r, "invalid refresh format, expected {\"refreshToken\": ...}", http.StatusBadRequest)
+		return
+	}
+
+	// Each refresh token may be used only once
+	info, loaded := a.refreshes.LoadAndDelete(body["refreshToken"])
+	if !loaded {
+		slog.Info("Refresh: refresh token does not exist")
+		errorMessage.RespondCode(w, r, errorMessage.CODE_INVALID_TOKEN, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+	if !info.(refreshInfo).expiresAt.After(time.Now()) {
+		slog.Info("Refresh: refresh token has expired")
+		errorMessage.RespondCode(w, r, errorMessage.CODE_EXPIRED_TOKEN, "Expired refresh token", http.StatusUnauthorized)
+		return
+	}
+	if a.keys == nil {
+		a.sessions.Delete(info.(refreshInfo).token)
+	} else {
+		a.revokeSigned(sessionID(body["refreshToken"]))
+	}
+
+	username := info.(refreshInfo).username
+	a.issue(w, r, username)
+	slog.Info("Refresh: success", "user", username)
+}
@@ -0,0 +1,167 @@
+package authentication
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/errorMessage"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/structs"
+)
+
+// The path of the sessions endpoint, under which admins manage sessions.
+const SESSIONS_PATH = "/auth/sessions"
+
+// Serves requests under /auth/sessions, which only admins may make.
+// A GET to /auth/sessions lists the sessions, of one user if the
+// query has a user. A DELETE to /auth/sessions?user=<username> revokes
+// every session and refresh token of a user, and a DELETE to
+// /auth/sessions/<id> revokes a single session. The sessions of signed
+// tokens are those issued by this server, identified by the id of
+// their refresh token.
+func (a *Authenticator) serveSessions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if !a.requireAdmin(w, r) {
+		// handled in method
+		return
+	}
+
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, SESSIONS_PATH), "/")
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		a.listSessions(w, r, r.URL.Query().Get("user"))
+	case id == "" && r.Method == http.MethodDelete:
+		a.revokeUser(w, r, r.URL.Query().Get("user"))
+	case id != "" && r.Method == http.MethodDelete:
+		a.revokeSession(w, r, id)
+	default:
+		slog.Info("User used unsupported method on sessions", "method", r.Method)
+		msg := fmt.Sprintf("unsupported method on sessions: %s", r.Method)
+		errorMessage.Respond(w, r, msg, http.StatusBadRequest)
+	}
+}
+
+// Gets the id of the session of a token, which identifies it
+// without giving the token itself away.
+func sessionID(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// Lists the sessions which have not expired, of username if it is
+// not "", from oldest to newest.
+func (a *Authenticator) listSessions(w http.ResponseWriter, r *http.Request, username string) {
+	now := time.Now()
+	sessions := make([]structs.SessionOutput, 0)
+	add := func(id string, session sessionInfo) {
+		if session.expiresAt.After(now) && (username == "" || session.username == username) {
+			sessions = append(sessions, structs.SessionOutput{
+				Id:         id,
+				User:       session.username,
+				CreatedAt:  session.createdAt.UnixMilli(),
+				ExpiresAt:  session.expiresAt.UnixMilli(),
+				LastUsedAt: session.lastUsed.Load(),
+			})
+		}
+	}
+	a.sessions.Range(func(token, info any) bool {
+		add(sessionID(token.(string)), info.(sessionInfo))
+		return true
+	})
+	a.signed.Range(func(rid, info any) bool {
+		add(rid.(string), info.(sessionInfo))
+		return true
+	})
+	sort.Slice(sessions, func(i, j int) bool {
+		if sessions[i].CreatedAt != sessions[j].CreatedAt {
+			return sessions[i].CreatedAt < sessions[j].CreatedAt
+		}
+		return sessions[i].Id < sessions[j].Id
+	})
+
+	jsonResponse, err := json.Marshal(sessions)
+	if err != nil {
+		// This should never happen
+		slog.Error("List sessions: error marshaling", "error", err)
+		errorMessage.Respond(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonResponse)
+}
+
+// Revokes every session and refresh token of username.
+func (a *Authenticator) revokeUser(w http.ResponseWriter, r *http.Request, username string) {
+	if username == "" {
+		slog.Info("Revoke: no user in query")
+		errorMessage.Respond(w, r, "Missing user in query", http.StatusBadRequest)
+		return
+	}
+
+	var revoked structs.RevokeOutput
+	a.sessions.Range(func(token, info any) bool {
+		if info.(sessionInfo).username == username {
+			a.sessions.Delete(token)
+			revoked.Sessions++
+		}
+		return true
+	})
+	a.refreshes.Range(func(refresh, info any) bool {
+		if info.(refreshInfo).username == username {
+			a.refreshes.Delete(refresh)
+			revoked.RefreshTokens++
+		}
+		return true
+	})
+	a.signed.Range(func(rid, info any) bool {
+		if info.(sessionInfo).username == username && a.revokeSigned(rid.(string)) {
+			revoked.Sessions++
+		}
+		return true
+	})
+
+	jsonResponse, err := json.Marshal(revoked)
+	if err != nil {
+		// This should never happen
+		slog.Error("Revoke: error marshaling", "error", err)
+		errorMessage.Respond(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("Revoke: sessions of user revoked", "user", username, "sessions", revoked.Sessions)
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonResponse)
+}
+
+// Revokes the session with id, and the refresh token issued with it.
+func (a *Authenticator) revokeSession(w http.ResponseWriter, r *http.Request, id string) {
+	found := false
+	a.sessions.Range(func(token, info any) bool {
+		if sessionID(token.(string)) != id {
+			return true
+		}
+		_, found = a.sessions.LoadAndDelete(token)
+		if found && info.(sessionInfo).refresh != "" {
+			a.refreshes.Delete(info.(sessionInfo).refresh)
+		}
+		return false
+	})
+	if !found {
+		found = a.revokeSigned(id)
+	}
+
+	if !found {
+		slog.Info("Revoke: session does not exist", "id", id)
+		errorMessage.Respond(w, r, "Session does not exist", http.StatusNotFound)
+		return
+	}
+	slog.Info("Revoke: session revoked", "id", id)
+	w.WriteHeader(http.StatusNoContent)
+}
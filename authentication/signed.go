@@ -0,0 +1,273 @@
+package authentication
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/errorMessage"
+)
+
+// The length of a new signing key, in bytes.
+const KEY_BYTES = 32
+
+// The path of the keys endpoint, where signing keys are rotated.
+const KEYS_PATH = "/auth/keys"
+
+// Errors from verifying signed tokens.
+var (
+	errNotSigned    = errors.New("token is not a signed token")
+	errBadSignature = errors.New("token signature is invalid")
+	errExpired      = errors.New("token has expired")
+)
+
+// The header of a signed token.
+type tokenHeader struct {
+	Alg string `json:"alg"` // The signing algorithm, always HS256.
+	Typ string `json:"typ"` // The type of the token, always JWT.
+	Kid string `json:"kid"` // The id of the key the token is signed with.
+}
+
+// The claims a signed token carries.
+type tokenClaims struct {
+	Subject   string            `json:"sub"`             // The username of the user.
+	Roles     map[string]string `json:"roles,omitempty"` // The roles of the user when issued, by database name; advisory only.
+	IssuedAt  int64             `json:"iat"`             // When the token was issued, in Unix seconds.
+	ExpiresAt int64             `json:"exp"`             // When the token expires, in Unix seconds.
+	RefreshID string            `json:"rid,omitempty"`   // The id of the refresh token issued with the token, which logging out ends.
+}
+
+// A key ring holds the keys tokens are signed with, and the file
+// they are kept in. New tokens are signed with the current key,
+// and tokens signed with any key of the ring are accepted, so
+// tokens issued before a rotation stay valid until they expire.
+type keyRing struct {
+	mu      *sync.RWMutex     // Guards current and keys.
+	current string            // The id of the key new tokens are signed with.
+	keys    map[string][]byte // The keys, by id.
+	file    string            // The file the keys are saved to on rotation.
+}
+
+// The form of a key ring in its file, with hex-encoded keys.
+type keyFile struct {
+	Current string            `json:"current"`
+	Keys    map[string]string `json:"keys"`
+}
+
+// Serves requests to /auth/keys, which only admins may make. A POST
+// rotates the signing key, returning the id of the new key.
+func (a *Authenticator) serveKeys(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if !a.requireAdmin(w, r) {
+		// handled in method
+		return
+	}
+	if r.Method != http.MethodPost {
+		slog.Info("User used unsupported method on keys", "method", r.Method)
+		msg := fmt.Sprintf("unsupported method on keys: %s", r.Method)
+		errorMessage.Respond(w, r, msg, http.StatusBadRequest)
+		return
+	}
+	if a.keys == nil {
+		slog.Info("Rotate: tokens are not signed")
+		errorMessage.Respond(w, r, "Tokens are not signed", http.StatusBadRequest)
+		return
+	}
+
+	kid, err := a.keys.rotate()
+	if err != nil {
+		slog.Error("Rotate: could not save keys", "error", err)
+		errorMessage.Respond(w, r, "could not save keys", http.StatusInternalServerError)
+		return
+	}
+	jsonResponse, err := json.Marshal(map[string]string{"kid": kid})
+	if err != nil {
+		// This should never happen
+		slog.Error("Rotate: error marshaling", "error", err)
+		errorMessage.Respond(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("Rotate: success", "kid", kid)
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonResponse)
+}
+
+// Loads a key ring from a file, which holds a JSON object with the id
+// of the current key and a map of key ids to hex-encoded keys. If the
+// file does not exist, it is created with a new random key.
+func loadKeyRing(file string) (*keyRing, error) {
+	ring := &keyRing{&sync.RWMutex{}, "", make(map[string][]byte), file}
+
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		_, err = ring.rotate()
+		if err != nil {
+			return nil, err
+		}
+		return ring, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var stored keyFile
+	err = json.Unmarshal(data, &stored)
+	if err != nil {
+		return nil, err
+	}
+	for kid, encoded := range stored.Keys {
+		key, err := hex.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("key %s is not hex encoded: %w", kid, err)
+		}
+		if len(key) < KEY_BYTES {
+			return nil, fmt.Errorf("key %s is shorter than %d bytes", kid, KEY_BYTES)
+		}
+		ring.keys[kid] = key
+	}
+	_, found := ring.keys[stored.Current]
+	if !found {
+		return nil, fmt.Errorf("current key %q is not in the key file", stored.Current)
+	}
+	ring.current = stored.Current
+	return ring, nil
+}
+
+// Adds a new random key to the ring and makes it the current key,
+// keeping the old keys to verify tokens signed before. Returns the
+// id of the new key.
+func (k *keyRing) rotate() (string, error) {
+	key := make([]byte, KEY_BYTES)
+	_, err := rand.Read(key)
+	if err != nil {
+		return "", err
+	}
+	kid, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.keys[kid] = key
+	previous := k.current
+	k.current = kid
+	err = k.save()
+	if err != nil {
+		delete(k.keys, kid)
+		k.current = previous
+		return "", err
+	}
+	return kid, nil
+}
+
+// Creates a token for claims, signed with the current key.
+func (k *keyRing) sign(claims tokenClaims) (string, error) {
+	k.mu.RLock()
+	kid, key := k.current, k.keys[k.current]
+	k.mu.RUnlock()
+
+	header, err := json.Marshal(tokenHeader{"HS256", "JWT", kid})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature(key, signed)), nil
+}
+
+// Verifies a signed token, returning its claims if its signature
+// is valid and it has not expired.
+func (k *keyRing) verify(token string) (tokenClaims, error) {
+	var claims tokenClaims
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, errNotSigned
+	}
+
+	// Find the key from the header, accepting only HS256
+	var header tokenHeader
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(data, &header) != nil || header.Alg != "HS256" {
+		return claims, errBadSignature
+	}
+	k.mu.RLock()
+	key, found := k.keys[header.Kid]
+	k.mu.RUnlock()
+	if !found {
+		return claims, errBadSignature
+	}
+
+	// Check the signature before trusting the claims
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(sig, signature(key, parts[0]+"."+parts[1])) {
+		return claims, errBadSignature
+	}
+	data, err = base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(data, &claims) != nil || claims.Subject == "" {
+		return claims, errBadSignature
+	}
+
+	if !time.Unix(claims.ExpiresAt, 0).After(time.Now()) {
+		return claims, errExpired
+	}
+	return claims, nil
+}
+
+// Writes the key ring to its file, replacing it all at once.
+// Must be called with the lock held.
+func (k *keyRing) save() error {
+	stored := keyFile{k.current, make(map[string]string)}
+	for kid, key := range k.keys {
+		stored.Keys[kid] = hex.EncodeToString(key)
+	}
+
+	data, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(k.file), filepath.Base(k.file)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(0600)
+	}
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), k.file)
+}
+
+// Computes the HMAC-SHA256 signature of the signed part of a token.
+func signature(key []byte, signed string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(signed))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,195 @@
+package authentication
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// The number of PBKDF2 iterations new passwords are hashed with.
+const HASH_ITERATIONS = 100000
+
+// The length of the random salt of each password, in bytes.
+const SALT_BYTES = 16
+
+// The shortest password accepted.
+const MIN_PASSWORD_LENGTH = 8
+
+// Errors from changing the user store.
+var (
+	errUserExists = errors.New("user already exists")
+	errNoUser     = errors.New("user does not exist")
+	errShortPass  = errors.New("password is too short")
+)
+
+// A credential is the salted hash of a user's password.
+type credential struct {
+	Salt       string `json:"salt"`       // The random salt, hex encoded.
+	Hash       string `json:"hash"`       // The PBKDF2-HMAC-SHA256 hash of the password, hex encoded.
+	Iterations int    `json:"iterations"` // The number of PBKDF2 iterations.
+}
+
+// A user store holds the credentials of every user,
+// and the file they are kept in.
+type userStore struct {
+	mu    *sync.RWMutex         // Guards users.
+	users map[string]credential // The credentials of each user, by username.
+	file  string                // The file the credentials are saved to on change, or "" to not save them.
+}
+
+// Creates a new user store with no users.
+func newUserStore() *userStore {
+	return &userStore{&sync.RWMutex{}, make(map[string]credential), ""}
+}
+
+// Loads a user store from a file, which holds a JSON object mapping
+// usernames to credentials. The file is created when the first user
+// is registered if it does not exist. Changes are saved back to it.
+func loadUserStore(file string) (*userStore, error) {
+	store := newUserStore()
+	store.file = file
+
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, &store.users)
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Adds a user with a password.
+func (s *userStore) register(username string, password string) error {
+	cred, err := newCredential(password)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, exists := s.users[username]
+	if exists {
+		return errUserExists
+	}
+	s.users[username] = cred
+	return s.save()
+}
+
+// Replaces the password of an existing user.
+func (s *userStore) setPassword(username string, password string) error {
+	cred, err := newCredential(password)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, exists := s.users[username]
+	if !exists {
+		return errNoUser
+	}
+	s.users[username] = cred
+	return s.save()
+}
+
+// Tells if password is the password of username.
+func (s *userStore) verify(username string, password string) bool {
+	s.mu.RLock()
+	cred, exists := s.users[username]
+	s.mu.RUnlock()
+
+	salt, saltErr := hex.DecodeString(cred.Salt)
+	hash, hashErr := hex.DecodeString(cred.Hash)
+	if !exists || saltErr != nil || hashErr != nil {
+		// Hash anyway, so unknown users take as long as known ones
+		hashPassword(password, make([]byte, SALT_BYTES), HASH_ITERATIONS)
+		return false
+	}
+
+	return subtle.ConstantTimeCompare(hashPassword(password, salt, cred.Iterations), hash) == 1
+}
+
+// Writes the credentials to their file, if they have one, replacing
+// it all at once. Must be called with the lock held.
+func (s *userStore) save() error {
+	if s.file == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(s.users, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.file), filepath.Base(s.file)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(0600)
+	}
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.file)
+}
+
+// Creates the credential of a password, with a new random salt.
+func newCredential(password string) (credential, error) {
+	if len(password) < MIN_PASSWORD_LENGTH {
+		return credential{}, errShortPass
+	}
+
+	salt := make([]byte, SALT_BYTES)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return credential{}, err
+	}
+
+	hash := hashPassword(password, salt, HASH_ITERATIONS)
+	return credential{hex.EncodeToString(salt), hex.EncodeToString(hash), HASH_ITERATIONS}, nil
+}
+
+// Hashes a password with PBKDF2-HMAC-SHA256 (RFC 8018), giving
+// a single block of output.
+func hashPassword(password string, salt []byte, iterations int) []byte {
+	prf := hmac.New(sha256.New, []byte(password))
+
+	// U1 = PRF(password, salt || INT(1))
+	prf.Write(salt)
+	prf.Write(binary.BigEndian.AppendUint32(nil, 1))
+	u := prf.Sum(nil)
+
+	// T = U1 ^ U2 ^ ... ^ Uc, where Ui = PRF(password, Ui-1)
+	block := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		prf.Reset()
+		prf.Write(u)
+		u = prf.Sum(u[:0])
+		for j := range block {
+			block[j] ^= u[j]
+		}
+	}
+	return block
+}
@@ -0,0 +1,182 @@
+// Package authorization has a struct and methods for
+// assigning roles to users per database, and for checking
+// whether a user's role allows an action on a database.
+package authorization
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// The roles a user may have on a database, from least to most
+// powerful. Readers may read documents and subscribe to them,
+// writers may also change documents and collections, and admins
+// may also create and delete the database, manage its indexes and
+// assign roles on it.
+const (
+	ROLE_NONE   = ""
+	ROLE_READER = "reader"
+	ROLE_WRITER = "writer"
+	ROLE_ADMIN  = "admin"
+)
+
+// The database name under which a role applies to every database,
+// and to the server itself.
+const ALL_DATABASES = "*"
+
+// The rank of each role; a role allows everything a lower one does.
+var ranks = map[string]int{ROLE_NONE: 0, ROLE_READER: 1, ROLE_WRITER: 2, ROLE_ADMIN: 3}
+
+// A roles holds the role of each user on each database,
+// and the file it is kept in.
+type Roles struct {
+	mu    *sync.RWMutex                // Guards users.
+	users map[string]map[string]string // The roles of each user, by user and then database name.
+	file  string                       // The file the roles are saved to on change, or "" to not save them.
+}
+
+// Creates a new set of roles, with no user having any role.
+func New() Roles {
+	return Roles{&sync.RWMutex{}, make(map[string]map[string]string), ""}
+}
+
+// Loads a set of roles from a file, which holds a JSON object mapping
+// user names to objects mapping database names (or "*") to roles.
+// Changes to the roles are saved back to the file.
+func Load(file string) (Roles, error) {
+	roles := New()
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return roles, err
+	}
+
+	var users map[string]map[string]string
+	err = json.Unmarshal(data, &users)
+	if err != nil {
+		return roles, err
+	}
+	for user, dbRoles := range users {
+		for db, role := range dbRoles {
+			if !IsRole(role) || role == ROLE_NONE {
+				return roles, fmt.Errorf("invalid role %q of %s on %s", role, user, db)
+			}
+		}
+		roles.users[user] = dbRoles
+	}
+
+	roles.file = file
+	return roles, nil
+}
+
+// Tells if role is the name of a role.
+func IsRole(role string) bool {
+	_, found := ranks[role]
+	return found
+}
+
+// Gets the role of user on the database db: the higher of its role
+// on db and its role on every database.
+func (r *Roles) RoleOf(user string, db string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	role := r.users[user][db]
+	if ranks[r.users[user][ALL_DATABASES]] > ranks[role] {
+		role = r.users[user][ALL_DATABASES]
+	}
+	return role
+}
+
+// Tells if the role of user on the database db is at least role.
+func (r *Roles) Allows(user string, db string, role string) bool {
+	return ranks[r.RoleOf(user, db)] >= ranks[role]
+}
+
+// Gets the role each user has been given on the database db itself,
+// by user name.
+func (r *Roles) Users(db string) map[string]string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	users := make(map[string]string)
+	for user, dbRoles := range r.users {
+		role, found := dbRoles[db]
+		if found {
+			users[user] = role
+		}
+	}
+	return users
+}
+
+// Gets the role user has been given on each database, by database name.
+func (r *Roles) Of(user string) map[string]string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	dbRoles := make(map[string]string)
+	for db, role := range r.users[user] {
+		dbRoles[db] = role
+	}
+	return dbRoles
+}
+
+// Gives user role on the database db, or takes its role on db away
+// if role is ROLE_NONE. Returns whether user had a role on db before.
+func (r *Roles) Assign(user string, db string, role string) (bool, error) {
+	if !IsRole(role) {
+		return false, errors.New("unknown role " + role)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, existed := r.users[user][db]
+	if role == ROLE_NONE {
+		delete(r.users[user], db)
+		if len(r.users[user]) == 0 {
+			delete(r.users, user)
+		}
+	} else {
+		if r.users[user] == nil {
+			r.users[user] = make(map[string]string)
+		}
+		r.users[user][db] = role
+	}
+
+	return existed, r.save()
+}
+
+// Writes the roles to their file, if they have one, replacing
+// it all at once. Must be called with the lock held.
+func (r *Roles) save() error {
+	if r.file == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(r.users, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(r.file), filepath.Base(r.file)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(0600)
+	}
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), r.file)
+}
@@ -0,0 +1,71 @@
+package authorization
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRoles(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "roles.json")
+	os.WriteFile(file, []byte("{\"alice\":{\"db1\":\"writer\",\"*\":\"reader\"},\"bob\":{\"*\":\"admin\"}}"), 0644)
+	roles, err := Load(file)
+	if err != nil {
+		t.Fatalf("expected no errors, got %s", err.Error())
+	}
+
+	data := []struct {
+		user    string
+		db      string
+		role    string
+		allowed bool
+	}{
+		{"alice", "db1", ROLE_WRITER, true},
+		{"alice", "db1", ROLE_ADMIN, false},
+		{"alice", "db2", ROLE_READER, true},
+		{"alice", "db2", ROLE_WRITER, false},
+		{"bob", "db2", ROLE_ADMIN, true},
+		{"carol", "db1", ROLE_READER, false},
+		{"carol", "db1", ROLE_NONE, true},
+	}
+	for i, d := range data {
+		if roles.Allows(d.user, d.db, d.role) != d.allowed {
+			t.Errorf("Test %d: expected %s %s on %s to be %t", i, d.user, d.role, d.db, d.allowed)
+		}
+	}
+
+	// Changes are saved to the file
+	existed, err := roles.Assign("carol", "db1", ROLE_ADMIN)
+	if existed || err != nil {
+		t.Errorf("expected a new role, got %t %v", existed, err)
+	}
+	existed, err = roles.Assign("alice", "db1", ROLE_NONE)
+	if !existed || err != nil {
+		t.Errorf("expected a removed role, got %t %v", existed, err)
+	}
+	_, err = roles.Assign("alice", "db1", "owner")
+	if err == nil {
+		t.Errorf("expected an error for an unknown role")
+	}
+
+	reloaded, err := Load(file)
+	if err != nil {
+		t.Fatalf("expected no errors, got %s", err.Error())
+	}
+	if reloaded.RoleOf("carol", "db1") != ROLE_ADMIN || reloaded.RoleOf("alice", "db1") != ROLE_READER {
+		t.Errorf("expected saved roles, got %v", reloaded.users)
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		t.Fatalf("expected no errors, got %s", err.Error())
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected the roles file to be private, got %v", info.Mode())
+	}
+
+	os.WriteFile(file, []byte("{\"alice\":{\"db1\":\"owner\"}}"), 0644)
+	_, err = Load(file)
+	if err == nil {
+		t.Errorf("expected an error for an unknown role")
+	}
+}
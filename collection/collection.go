@@ -3,6 +3,7 @@
 package collection
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
@@ -10,91 +11,255 @@ import (
 	"fmt"
 	"io"
 	"log/slog"
+	"mime"
 	"net/http"
+	"net/url"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/RICE-COMP318-FALL23/owldb-p1group20/errorMessage"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/index"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group20/interfaces"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group20/patcher"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/query"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/quota"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group20/skiplist"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group20/structs"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group20/subscribe"
 	"github.com/santhosh-tekuri/jsonschema/v5"
 )
 
+// An order entry is a document output with its position in a query order.
+type orderEntry struct {
+	key    query.Key   // The position of the document in the order.
+	output interface{} // The output of the document.
+}
+
 /*
 A collection is a concurrent skip list of documents,
-which is sorted by document name, and a set of subscribers
-to a subset of this collection.
+which is sorted by document name, and a stream of events
+for subscribers to subsets of this collection.
 */
 type Collection struct {
-	documents   *skiplist.SkipList[string, interfaces.IDocument] // The set of documents held by this collection.
-	subscribers []structs.CollSub                                // The set of subscribers to this collection.
+	documents *skiplist.SkipList[string, interfaces.IDocument] // The set of documents held by this collection.
+	stream    *subscribe.Stream                                // The events of this collection, for subscribers.
+	indexes   map[string]*index.Index                          // The secondary indexes on the documents, by name.
+	indexLock *sync.RWMutex                                    // Guards the set of indexes.
+	schema    *atomic.Pointer[ownSchema]                       // The schema of this collection, or nil to inherit one.
+	owners    *atomic.Pointer[structs.OwnerRules]              // The ownership rules of the documents of this collection.
+	limits    *atomic.Pointer[structs.Quota]                   // The storage quota of this collection, if it is a database.
+	usage     *atomic.Pointer[quota.Usage]                     // The usage of the database the documents of this collection are counted in.
+}
+
+// An own schema is a compiled schema and the JSON it was compiled from.
+type ownSchema struct {
+	compiled *jsonschema.Schema // The compiled schema.
+	source   json.RawMessage    // The JSON source of the schema.
 }
 
 // Creates a new collection.
 func New() Collection {
 	newSL := skiplist.New[string, interfaces.IDocument](skiplist.STRING_MIN, skiplist.STRING_MAX, skiplist.DEFAULT_LEVEL)
-	return Collection{&newSL, make([]structs.CollSub, 0)}
+	newS := subscribe.NewStream()
+	newO := &atomic.Pointer[structs.OwnerRules]{}
+	newO.Store(&structs.OwnerRules{})
+	newL := &atomic.Pointer[structs.Quota]{}
+	newL.Store(&structs.Quota{})
+	newU := &atomic.Pointer[quota.Usage]{}
+	newU.Store(quota.New(structs.Quota{}))
+	return Collection{&newSL, &newS, make(map[string]*index.Index), &sync.RWMutex{}, &atomic.Pointer[ownSchema]{}, newO, newL, newU}
 }
 
 // Handles a GET request which pointed to this collection.
+//
+// Documents can be selected with the interval and filter query
+// parameters. Outside of subscribe mode, they can also be sorted
+// with orderBy (name, or a JSON pointer into the output such as
+// /doc/age or /meta/lastModifiedAt) and order (asc or desc),
+// and paged with limit; when more documents remain, the response
+// carries a cursor in the X-Next-Cursor header, which is passed back
+// in the cursor query parameter to resume after the last document.
+//
+// In subscribe mode, a client reconnecting with a Last-Event-ID
+// header receives only the events it missed, when they are still kept.
+// Of the documents sent first, only the last has an id, so a client
+// cut off before receiving them all is sent them all again.
 func (c *Collection) GetDocuments(w http.ResponseWriter, r *http.Request) {
 	// Get queries
 	queries := r.URL.Query()
+	mode := queries.Get("mode")
 	interval := getInterval(queries.Get("interval"))
+	filter, err := getFilter(queries.Get("filter"))
+	if err != nil {
+		slog.Info("Collection GET: bad filter", "filter", queries.Get("filter"), "error", err)
+		errorMessage.Respond(w, r, "Bad filter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	order, err := query.NewOrder(queries.Get("orderBy"), queries.Get("order"))
+	if err != nil {
+		slog.Info("Collection GET: bad order", "orderBy", queries.Get("orderBy"), "error", err)
+		errorMessage.Respond(w, r, "Bad orderBy: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit, err := getLimit(queries.Get("limit"))
+	if err != nil {
+		slog.Info("Collection GET: bad limit", "limit", queries.Get("limit"), "error", err)
+		errorMessage.Respond(w, r, "Bad limit: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	var after *query.Key
+	if queries.Get("cursor") != "" && mode != "subscribe" {
+		key, err := order.ParseCursor(queries.Get("cursor"))
+		if err != nil {
+			slog.Info("Collection GET: bad cursor", "error", err)
+			errorMessage.Respond(w, r, "Bad cursor: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		after = &key
+	}
 
-	// Build a list of document outputs
-	returnDocs := make([]interface{}, 0)
-
-	// Make query on collection
-	pairs, err := c.documents.Query(r.Context(), interval[0], interval[1])
+	// Subscribe mode
+	if mode == "subscribe" {
+		subscription, initial, err := c.subscribeEvents(r.Context(), interval, filter, order, r.Header.Get("Last-Event-ID"))
+		if err != nil {
+			// TODO: type of error?
+			slog.Info("Collection could not retrieve query in time")
+			errorMessage.Respond(w, r, "Timeout while querying collection", http.StatusRequestTimeout)
+			return
+		}
+		defer subscription.Cancel()
+		subscription.ServeSubscriber(w, r, initial)
+		return
+	}
 
+	entries, err := c.selectDocuments(r.Context(), interval, filter, order, after)
 	if err != nil {
 		// TODO: type of error?
 		slog.Info("Collection could not retrieve query in time")
-		errorMessage.ErrorResponse(w, "Timeout while querying collection", http.StatusRequestTimeout)
+		errorMessage.Respond(w, r, "Timeout while querying collection", http.StatusRequestTimeout)
+		return
+	}
+
+	// Cut to a page, and tell the client where the next page starts
+	if limit > 0 && len(entries) > limit {
+		entries = entries[:limit]
+		w.Header().Set("X-Next-Cursor", order.Cursor(entries[limit-1].key))
+		w.Header().Add("Access-Control-Expose-Headers", "X-Next-Cursor")
+	}
+
+	// Build a list of document outputs
+	returnDocs := make([]interface{}, 0, len(entries))
+	for _, entry := range entries {
+		returnDocs = append(returnDocs, entry.output)
+	}
+
+	// Convert to JSON and send
+	jsonDocs, err := json.Marshal(returnDocs)
+	if err != nil {
+		// This should never happen
+		slog.Error("Get: error marshaling", "error", err)
+		errorMessage.Respond(w, r, "internal server error", http.StatusInternalServerError)
 		return
 	}
 
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonDocs)
+	slog.Info("Col/DB GET: success")
+}
+
+// Finds the documents in interval which match filter (nil for all),
+// sorted by order, and after the key after if it is not nil.
+func (c *Collection) selectDocuments(ctx context.Context, interval [2]string, filter *query.Filter, order *query.Order, after *query.Key) ([]orderEntry, error) {
+	// Make query on collection, through an index if the filter allows
+	pairs, indexed, err := c.lookupIndex(ctx, filter, interval)
+	if !indexed && err == nil {
+		pairs, err = c.documents.Query(ctx, interval[0], interval[1])
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Select documents and find their positions in the order
+	entries := make([]orderEntry, 0, len(pairs))
 	for _, pair := range pairs {
 		// Just collect the value and get the docoutput from that
-		returnDocs = append(returnDocs, pair.Value.GetRawBody())
-	}
+		output := pair.Value.GetRawBody()
 
-	// Subscribe mode
-	mode := r.URL.Query().Get("mode")
-	if mode == "subscribe" {
-		subscriber := subscribe.New()
-		c.subscribers = append(c.subscribers, structs.CollSub{Subscriber: subscriber, IntervalStart: interval[0], IntervalEnd: interval[1]})
-		go func() {
-			for _, output := range returnDocs {
-				jsonBody, err := json.Marshal(output)
-				if err != nil {
-					// This should never happen
-					slog.Error("Get: error marshaling", "error", err)
-					errorMessage.ErrorResponse(w, "internal server error", http.StatusInternalServerError)
-					return
-				}
-				subscriber.UpdateCh <- jsonBody
+		var resource interface{}
+		if filter != nil || order.ByField() {
+			resource, err = query.ToJSON(output)
+			if err != nil {
+				// This should never happen
+				slog.Error("Get: error converting document", "error", err)
+				continue
 			}
-		}()
-		subscriber.ServeSubscriber(w, r)
-	} else {
-		// Convert to JSON and send
-		jsonDocs, err := json.Marshal(returnDocs)
+		}
+		if filter != nil && !filter.Match(resource) {
+			continue
+		}
+
+		key := order.KeyOf(pair.Key, resource)
+		if after != nil && !order.Less(*after, key) {
+			continue
+		}
+		entries = append(entries, orderEntry{key, output})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return order.Less(entries[i].key, entries[j].key)
+	})
+
+	return entries, nil
+}
+
+// Subscribes to the documents in interval which match filter (nil for
+// all). Subscribes before querying, so no change is missed. Returns the
+// subscription and the events to send first: those missed since
+// lastEventID if the subscription resumes, or else the current
+// documents, sorted by order.
+func (c *Collection) subscribeEvents(ctx context.Context, interval [2]string, filter *query.Filter, order *query.Order, lastEventID string) (*subscribe.Subscription, []subscribe.Event, error) {
+	subscription := c.stream.Subscribe(matchSubscriber(interval, filter), lastEventID)
+	if subscription.Resumed {
+		return subscription, subscription.Backlog, nil
+	}
+
+	entries, err := c.selectDocuments(ctx, interval, filter, order, nil)
+	if err != nil {
+		subscription.Cancel()
+		return nil, nil, err
+	}
+
+	outputs := make([][]byte, 0, len(entries))
+	for _, entry := range entries {
+		jsonBody, err := json.Marshal(entry.output)
 		if err != nil {
 			// This should never happen
 			slog.Error("Get: error marshaling", "error", err)
-			errorMessage.ErrorResponse(w, "internal server error", http.StatusInternalServerError)
-			return
+			continue
 		}
+		outputs = append(outputs, jsonBody)
+	}
+	return subscription, subscription.Updates(outputs), nil
+}
 
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(jsonDocs)
-		slog.Info("Col/DB GET: success")
+// Subscribes to the documents of this collection selected by the
+// interval and filter query parameters, in the order of the orderBy
+// and order query parameters. Returns the subscription and the events
+// to send first.
+func (c *Collection) SubscribeEvents(ctx context.Context, queries url.Values, lastEventID string) (*subscribe.Subscription, []subscribe.Event, error) {
+	interval := getInterval(queries.Get("interval"))
+	filter, err := getFilter(queries.Get("filter"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("bad filter: %w", err)
 	}
+	order, err := query.NewOrder(queries.Get("orderBy"), queries.Get("order"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("bad orderBy: %w", err)
+	}
+
+	return c.subscribeEvents(ctx, interval, filter, order, lastEventID)
 }
 
 // Handles a put request which points to this collection.
@@ -104,7 +269,7 @@ func (c *Collection) PutDocument(w http.ResponseWriter, r *http.Request, path st
 	if err != nil {
 		// This should never happen
 		slog.Error("Put: error marshaling", "error", err)
-		errorMessage.ErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		errorMessage.Respond(w, r, "internal server error", http.StatusInternalServerError)
 	}
 
 	// Conditional Put on timestamp
@@ -114,12 +279,15 @@ func (c *Collection) PutDocument(w http.ResponseWriter, r *http.Request, path st
 		val, err := strconv.Atoi(timeStampStr)
 		if err != nil {
 			slog.Error("Put: Bad timestamp", "error", err)
-			errorMessage.ErrorResponse(w, "Bad timestamp", http.StatusBadRequest)
+			errorMessage.Respond(w, r, "Bad timestamp", http.StatusBadRequest)
 		}
 		timeStamp = int64(val)
 	}
 
-	// Upsert for document; update if found, otherwise create new
+	// Upsert for document; update if found, otherwise create new.
+	// Subscribers are notified once the upsert succeeds.
+	var updateMSG []byte
+	var overwritten interfaces.IDocument
 	docUpsert := func(key string, currValue interfaces.IDocument, exists bool) (interfaces.IDocument, error) {
 		if exists {
 			docmeta, hasMeta := interface{}(newDoc).(interfaces.HasMetadata)
@@ -135,59 +303,69 @@ func (c *Collection) PutDocument(w http.ResponseWriter, r *http.Request, path st
 				return nil, errors.New("badtimestamp")
 			}
 
+			// Overwriting wipes the collections of the document, so they are released with it
+			oldDocuments, oldBytes := MeasureDocument(currValue)
+			size := quota.SizeOf(newDoc.GetJSONDoc())
+			err := c.usage.Load().Reserve(1-oldDocuments, size-oldBytes, size)
+			if err != nil {
+				return nil, err
+			}
+
 			// Modify metadata
 			docoverwrite.OverwriteBody(newDoc.GetJSONDoc(), docmeta.GetOriginalAuthor())
 
-			updateMSG, err := json.Marshal(currValue.GetRawBody())
+			updateMSG, err = json.Marshal(currValue.GetRawBody())
 			if err != nil {
-				errorMessage.ErrorResponse(w, "internal server error", http.StatusInternalServerError)
+				errorMessage.Respond(w, r, "internal server error", http.StatusInternalServerError)
 				return nil, err
 			}
-
-			go func() {
-				// Notify doc subscribers
-				docsub, ok := interface{}(currValue).(interfaces.Subscribable)
-				if ok {
-					docsub.NotifySubscribersUpdate(updateMSG, "")
-				}
-
-				// Notify collection subscribers
-				c.NotifySubscribersUpdate(updateMSG, key)
-			}()
+			overwritten = currValue
 
 			return currValue, nil
 		} else {
 			// Create new document
-			updateMSG, err := json.Marshal(newDoc.GetRawBody())
+			var err error
+			updateMSG, err = json.Marshal(newDoc.GetRawBody())
 			if err != nil {
-				errorMessage.ErrorResponse(w, "PutDocument: error marshalling", http.StatusInternalServerError)
+				errorMessage.Respond(w, r, "PutDocument: error marshalling", http.StatusInternalServerError)
 				return nil, errors.New("marshalling error")
 			}
-
-			go func() {
-				// Notify collection subscribers
-				c.NotifySubscribersUpdate(updateMSG, key)
-			}()
+			size := quota.SizeOf(newDoc.GetJSONDoc())
+			err = c.usage.Load().Reserve(1, size, size)
+			if err != nil {
+				return nil, err
+			}
 
 			return newDoc, nil
 		}
 	}
 
 	updated, err := c.documents.Upsert(path, docUpsert)
+	if respondQuota(w, r, err) {
+		return
+	}
 	if err != nil {
 		switch err.Error() {
 		case "badtimestamp":
 			slog.Error(err.Error())
-			errorMessage.ErrorResponse(w, "PUT: bad timestamp", http.StatusBadRequest)
+			errorMessage.Respond(w, r, "PUT: bad timestamp", http.StatusBadRequest)
 		case "badoverwrite":
 			slog.Error(err.Error())
-			errorMessage.ErrorResponse(w, "PUT: overwrite not supported", http.StatusBadRequest)
+			errorMessage.Respond(w, r, "PUT: overwrite not supported", http.StatusBadRequest)
 		default:
 			slog.Error(err.Error())
-			errorMessage.ErrorResponse(w, "PUT() error "+err.Error(), http.StatusInternalServerError)
+			errorMessage.Respond(w, r, "PUT() error "+err.Error(), http.StatusInternalServerError)
 		}
 		return
 	}
+	c.reindex(path)
+
+	// Notify doc subscribers of an overwrite, then collection subscribers
+	docsub, ok := interface{}(overwritten).(interfaces.Subscribable)
+	if ok {
+		docsub.NotifySubscribersUpdate(updateMSG, "")
+	}
+	c.NotifySubscribersUpdate(updateMSG, path)
 
 	// Success: Construct response
 	w.Header().Set("Location", r.URL.Path)
@@ -203,6 +381,9 @@ func (c *Collection) PutDocument(w http.ResponseWriter, r *http.Request, path st
 }
 
 // Handles a DELETE request which points to a doc in this collection.
+// The collections below the document are deleted with it; the response
+// counts the documents and collections removed in the
+// X-Deleted-Documents and X-Deleted-Collections headers.
 func (c *Collection) DeleteDocument(w http.ResponseWriter, r *http.Request, docpath string) {
 	// Just request a delete on the specified element
 	doc, deleted := c.documents.Remove(docpath)
@@ -213,20 +394,23 @@ func (c *Collection) DeleteDocument(w http.ResponseWriter, r *http.Request, docp
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
+	c.reindex(docpath)
+	c.usage.Load().Release(MeasureDocument(doc))
+
+	// Notify the subscribers of the document and everything below it,
+	// then those of this collection
+	documents, collections := 1, 0
+	deletable, ok := interface{}(doc).(interfaces.Deletable)
+	if ok {
+		documents, collections = deletable.NotifySubtreeDeleted(r.URL.Path)
+	}
+	c.NotifySubscribersDelete(r.URL.Path, docpath)
 
-	go func() {
-		// Notify doc subscribers
-		docsub, ok := interface{}(doc).(interfaces.Subscribable)
-		if ok {
-			docsub.NotifySubscribersDelete(r.URL.Path, "")
-		}
-
-		// Notify collection subscribers
-		c.NotifySubscribersDelete(r.URL.Path, docpath)
-	}()
-
-	slog.Info("Deleted Document", "path", r.URL.Path)
+	slog.Info("Deleted Document", "path", r.URL.Path, "documents", documents, "collections", collections)
 	w.Header().Set("Location", r.URL.Path)
+	w.Header().Set("X-Deleted-Documents", strconv.Itoa(documents))
+	w.Header().Set("X-Deleted-Collections", strconv.Itoa(collections))
+	w.Header().Add("Access-Control-Expose-Headers", "X-Deleted-Documents, X-Deleted-Collections")
 	w.WriteHeader(http.StatusNoContent)
 }
 
@@ -240,89 +424,118 @@ func (c *Collection) PatchDocument(w http.ResponseWriter, r *http.Request, docpa
 	if !ok {
 		slog.Info("User attempted to patch non-extant document", "doc", docpath)
 		msg := fmt.Sprintf("Document, %s, does not exist", docpath)
-		errorMessage.ErrorResponse(w, msg, http.StatusNotFound)
+		errorMessage.Respond(w, r, msg, http.StatusNotFound)
 		return
 	}
 
-	var patches []patcher.Patch
-
 	// Read body of requests
 	body, err := io.ReadAll(r.Body)
 	defer r.Body.Close()
 	if err != nil {
 		slog.Error("Patch document: error reading the patch request body", "error", err)
-		errorMessage.ErrorResponse(w, "invalid request body", http.StatusBadRequest)
-		return
-	}
-
-	// Unmarshal the body into an array of patches.
-	err = json.Unmarshal(body, &patches)
-	if err != nil {
-		slog.Error("Patch document: error unmarshaling patch document request", "error", err)
-		errorMessage.ErrorResponse(w, "invalid patch document format", http.StatusBadRequest)
+		errorMessage.Respond(w, r, "invalid request body", http.StatusBadRequest)
 		return
 	}
 
 	// Check if patchable
-	patcher, canPatch := interface{}(doc).(interfaces.Patchable)
+	patchable, canPatch := interface{}(doc).(interfaces.Patchable)
 	if !canPatch {
-		slog.Error("Patch document: document can't patch", "error", err)
-		errorMessage.ErrorResponse(w, "invalid patch document format", http.StatusBadRequest)
+		slog.Error("Patch document: document can't patch")
+		errorMessage.Respond(w, r, "invalid patch document format", http.StatusBadRequest)
 		return
 	}
 
-	// Apply the patches to the document
-	patchreply, newdoc := patcher.ApplyPatches(patches, schema)
+	// Apply the patches to the document, as a merge patch or a list of patches
+	var patchreply structs.PatchResponse
+	var newdoc interface{}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == patcher.MERGE_PATCH_TYPE {
+		var mergePatch interface{}
+		err = json.Unmarshal(body, &mergePatch)
+		if err != nil {
+			slog.Error("Patch document: error unmarshaling merge patch request", "error", err)
+			errorMessage.Respond(w, r, "invalid merge patch format", http.StatusBadRequest)
+			return
+		}
+		patchreply, newdoc = patchable.ApplyMergePatch(mergePatch, schema)
+	} else {
+		// Unmarshal the body into an array of patches.
+		var patches []patcher.Patch
+		err = json.Unmarshal(body, &patches)
+		if err != nil {
+			slog.Error("Patch document: error unmarshaling patch document request", "error", err)
+			errorMessage.Respond(w, r, "invalid patch document format", http.StatusBadRequest)
+			return
+		}
+		patchreply, newdoc = patchable.ApplyPatches(patches, schema)
+	}
 	patchreply.Uri = r.URL.Path
 
+	// Clients which accept structured errors get the causes of a schema violation
+	if patchreply.Invalid != nil && errorMessage.AcceptsStructured(r) {
+		slog.Info("Patched document did not conform to schema", "path", r.URL.Path)
+		errorMessage.RespondInvalid(w, r, patchreply.Message, patchreply.Invalid, http.StatusBadRequest)
+		return
+	}
+
 	// Marshal it into a json reply
 	jsonResponse, err := json.Marshal(patchreply)
 	if err != nil {
 		// This should never happen
 		slog.Error("Patch: error marshaling", "error", err)
-		errorMessage.ErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		errorMessage.Respond(w, r, "internal server error", http.StatusInternalServerError)
 		return
 	}
 
 	if !patchreply.PatchFailed {
-		// Need to modify metadata
-		patcher.OverwriteBody(newdoc, name)
-
-		updateMSG, err := json.Marshal(doc.GetRawBody())
-		if err != nil {
-			errorMessage.ErrorResponse(w, "internal server error", http.StatusInternalServerError)
-			return
-		}
-
-		go func() {
-			// Notify doc subscribers
-			docsub, ok := interface{}(doc).(interfaces.Subscribable)
-			if ok {
-				docsub.NotifySubscribersUpdate(updateMSG, "")
-			}
-
-			// Notify collection subscribers
-			c.NotifySubscribersUpdate(updateMSG, docpath)
-		}()
-
-		// Upsert to reinsert
+		// Upsert to reinsert, counting the patched document in the quota only if it still exists
 		patchUpsert := func(key string, currValue interfaces.IDocument, exists bool) (interfaces.IDocument, error) {
-			if exists {
-				// Delete Children of this document
-				return doc, nil
-			} else {
+			if !exists {
 				// We expect the document to already exist
 				return nil, errors.New("not found")
 			}
+
+			// Patching wipes the collections of the document, so they are released with it
+			oldDocuments, oldBytes := MeasureDocument(currValue)
+			size := quota.SizeOf(newdoc)
+			err := c.usage.Load().Reserve(1-oldDocuments, size-oldBytes, size)
+			if err != nil {
+				return nil, err
+			}
+
+			// Need to modify metadata
+			patchable.OverwriteBody(newdoc, name)
+			return doc, nil
 		}
 
 		updated, err := c.documents.Upsert(docpath, patchUpsert)
+		if respondQuota(w, r, err) {
+			return
+		}
 		if !updated {
-			// This shouldn't happen
-			slog.Error("Patch: ", "error", err.Error())
-			errorMessage.ErrorResponse(w, "internal server error", http.StatusInternalServerError)
+			// Deleted since it was read
+			slog.Info("Patch: document deleted while patching", "path", r.URL.Path, "error", err)
+			msg := fmt.Sprintf("Document, %s, does not exist", docpath)
+			errorMessage.Respond(w, r, msg, http.StatusNotFound)
 			return
 		}
+
+		updateMSG, err := json.Marshal(doc.GetRawBody())
+		if err != nil {
+			errorMessage.Respond(w, r, "internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		// Notify doc subscribers
+		docsub, ok := interface{}(doc).(interfaces.Subscribable)
+		if ok {
+			docsub.NotifySubscribersUpdate(updateMSG, "")
+		}
+
+		// Notify collection subscribers
+		c.NotifySubscribersUpdate(updateMSG, docpath)
+
+		c.reindex(docpath)
 		slog.Info("Patched a document", "path", r.URL.Path)
 		w.Header().Set("Location", r.URL.Path)
 		w.WriteHeader(http.StatusOK)
@@ -338,26 +551,28 @@ func (c *Collection) PatchDocument(w http.ResponseWriter, r *http.Request, docpa
 func (c *Collection) PostDocument(w http.ResponseWriter, r *http.Request, newDoc interfaces.IDocument) {
 	postdoc, canPost := interface{}(newDoc).(interfaces.Postable)
 	if !canPost {
-		errorMessage.ErrorResponse(w, "Document does not support posting", http.StatusInternalServerError)
+		errorMessage.Respond(w, r, "Document does not support posting", http.StatusInternalServerError)
 		return
 	}
 
-	// Upsert for post
+	// Upsert for post. Subscribers are notified once the upsert succeeds.
+	var updateMSG []byte
 	docUpsert := func(key string, currValue interfaces.IDocument, exists bool) (interfaces.IDocument, error) {
 		if exists {
 			// Return error
 			return nil, errors.New("exists")
 		} else {
-			updateMSG, err := json.Marshal(newDoc.GetRawBody())
+			var err error
+			updateMSG, err = json.Marshal(newDoc.GetRawBody())
 			if err != nil {
-				errorMessage.ErrorResponse(w, "internal server error", http.StatusInternalServerError)
+				errorMessage.Respond(w, r, "internal server error", http.StatusInternalServerError)
 				return nil, errors.New("marshalling error")
 			}
-
-			go func() {
-				// Notify collection subscribers
-				c.NotifySubscribersUpdate(updateMSG, key)
-			}()
+			size := quota.SizeOf(newDoc.GetJSONDoc())
+			err = c.usage.Load().Reserve(1, size, size)
+			if err != nil {
+				return nil, err
+			}
 
 			postdoc.AddNameToPath(key)
 			return newDoc, nil
@@ -373,19 +588,22 @@ func (c *Collection) PostDocument(w http.ResponseWriter, r *http.Request, newDoc
 		_, err := rand.Read(token)
 		if err != nil {
 			slog.Error("Post document: could not generate random name", "error", err)
-			errorMessage.ErrorResponse(w, "Could not generate random name", http.StatusInternalServerError)
+			errorMessage.Respond(w, r, "Could not generate random name", http.StatusInternalServerError)
 			return
 		}
 
 		// Convert the random bytes to a hexadecimal string
 		randomName := hex.EncodeToString(token)
 		_, upErr := c.documents.Upsert(randomName, docUpsert)
+		if respondQuota(w, r, upErr) {
+			return
+		}
 		if upErr != nil {
 			switch upErr.Error() {
 			case "exists": // do nothing
 			default:
 				slog.Error(upErr.Error())
-				errorMessage.ErrorResponse(w, "POST() error "+upErr.Error(), http.StatusInternalServerError)
+				errorMessage.Respond(w, r, "POST() error "+upErr.Error(), http.StatusInternalServerError)
 				return
 			}
 
@@ -397,13 +615,17 @@ func (c *Collection) PostDocument(w http.ResponseWriter, r *http.Request, newDoc
 		path = randomName
 		break
 	}
+	c.reindex(path)
+
+	// Notify collection subscribers
+	c.NotifySubscribersUpdate(updateMSG, path)
 
 	// Marshal
 	jsonResponse, err := json.Marshal(structs.PutOutput{Uri: r.URL.Path + path})
 	if err != nil {
 		// This should never happen
 		slog.Error("Post: error marshaling", "error", err)
-		errorMessage.ErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		errorMessage.Respond(w, r, "internal server error", http.StatusInternalServerError)
 	}
 
 	// Success: Construct response
@@ -413,6 +635,155 @@ func (c *Collection) PostDocument(w http.ResponseWriter, r *http.Request, newDoc
 	w.Write(jsonResponse)
 }
 
+// Inserts a document into this collection, replacing any
+// document with the same name along with its collections.
+// The history of a replaced document is carried over.
+func (c *Collection) RestoreDocument(name string, doc interfaces.IDocument) {
+	restoreUpsert := func(key string, currValue interfaces.IDocument, exists bool) (interfaces.IDocument, error) {
+		versioned, hasHistory := interface{}(doc).(interfaces.Versioned)
+		if exists && hasHistory {
+			versioned.InheritHistory(currValue)
+		}
+		return doc, nil
+	}
+
+	c.documents.Upsert(name, restoreUpsert)
+	c.reindex(name)
+}
+
+// Removes a document from this collection. Returns whether
+// there was a document to remove.
+func (c *Collection) RemoveDocument(name string) bool {
+	_, deleted := c.documents.Remove(name)
+	c.reindex(name)
+	return deleted
+}
+
+// Gets a consistent view of the documents in this collection
+// with names in the interval [start, end].
+func (c *Collection) QueryDocuments(ctx context.Context, start string, end string) ([]skiplist.Pair[string, interfaces.IDocument], error) {
+	return c.documents.Query(ctx, start, end)
+}
+
+// Creates or replaces the index called name on the pointer field,
+// built from the documents currently in this collection. Returns
+// whether an index was replaced. No document may be written while
+// the index is built, or its entry may be left stale.
+func (c *Collection) PutIndex(ctx context.Context, name string, field string) (bool, error) {
+	idx, err := index.New(field)
+	if err != nil {
+		return false, err
+	}
+
+	c.indexLock.Lock()
+	_, replaced := c.indexes[name]
+	c.indexes[name] = &idx
+	c.indexLock.Unlock()
+
+	pairs, err := c.documents.Query(ctx, skiplist.STRING_MIN, skiplist.STRING_MAX)
+	if err != nil {
+		c.DeleteIndex(name)
+		return false, err
+	}
+	for _, pair := range pairs {
+		resource, err := query.ToJSON(pair.Value.GetRawBody())
+		if err == nil {
+			idx.Update(pair.Key, resource)
+		}
+	}
+
+	return replaced, nil
+}
+
+// Deletes the index called name. Returns whether there was such an index.
+func (c *Collection) DeleteIndex(name string) bool {
+	c.indexLock.Lock()
+	defer c.indexLock.Unlock()
+
+	_, found := c.indexes[name]
+	delete(c.indexes, name)
+	return found
+}
+
+// Returns the pointer of each index on this collection, by index name.
+func (c *Collection) Indexes() map[string]string {
+	c.indexLock.RLock()
+	defer c.indexLock.RUnlock()
+
+	fields := make(map[string]string, len(c.indexes))
+	for name, idx := range c.indexes {
+		fields[name] = idx.Field()
+	}
+	return fields
+}
+
+// Brings the entries of a document in every index up to date
+// after it was written or removed.
+func (c *Collection) reindex(name string) {
+	c.indexLock.RLock()
+	defer c.indexLock.RUnlock()
+	if len(c.indexes) == 0 {
+		return
+	}
+
+	doc, found := c.documents.Find(name)
+	if !found {
+		for _, idx := range c.indexes {
+			idx.Remove(name)
+		}
+		return
+	}
+
+	resource, err := query.ToJSON(doc.GetRawBody())
+	if err != nil {
+		// This should never happen
+		slog.Error("Index: error converting document", "error", err)
+		return
+	}
+	for _, idx := range c.indexes {
+		idx.Update(name, resource)
+	}
+}
+
+// Finds the documents in the interval which may match filter using
+// an index on one of its conditions. Returns false if no index applies.
+//
+// The documents found still have to be checked against the filter.
+func (c *Collection) lookupIndex(ctx context.Context, filter *query.Filter, interval [2]string) ([]skiplist.Pair[string, interfaces.IDocument], bool, error) {
+	if filter == nil {
+		return nil, false, nil
+	}
+
+	c.indexLock.RLock()
+	defer c.indexLock.RUnlock()
+
+	for _, cond := range filter.Conditions() {
+		for _, idx := range c.indexes {
+			names, ok, err := idx.Lookup(ctx, cond)
+			if err != nil {
+				return nil, true, err
+			}
+			if !ok {
+				continue
+			}
+
+			pairs := make([]skiplist.Pair[string, interfaces.IDocument], 0, len(names))
+			for _, name := range names {
+				if name < interval[0] || name > interval[1] {
+					continue
+				}
+				doc, found := c.documents.Find(name)
+				if found {
+					pairs = append(pairs, skiplist.Pair[string, interfaces.IDocument]{Key: name, Value: doc})
+				}
+			}
+			return pairs, true, nil
+		}
+	}
+
+	return nil, false, nil
+}
+
 // Finds a document in this collection for other methods.
 func (c *Collection) FindDocument(resource string) (interfaces.IDocument, bool) {
 	return c.documents.Find(resource)
@@ -454,22 +825,200 @@ func getInterval(intervalStr string) [2]string {
 	return interval
 }
 
+/*
+Parse the filter query parameter of a collection query.
+
+Returns nil if there is no filter, or an error if the filter is malformed.
+*/
+func getFilter(filterStr string) (*query.Filter, error) {
+	if filterStr == "" {
+		return nil, nil
+	}
+
+	filter, err := query.Parse(filterStr)
+	if err != nil {
+		return nil, err
+	}
+
+	slog.Info("GetFilter: Good filter", "filter", filterStr)
+	return filter, nil
+}
+
+/*
+Parse the limit query parameter of a collection query.
+
+Returns 0 if there is no limit, or an error if the limit is not a positive integer.
+*/
+func getLimit(limitStr string) (int, error) {
+	if limitStr == "" {
+		return 0, nil
+	}
+
+	limit, err := strconv.Atoi(limitStr)
+	if err != nil || limit <= 0 {
+		return 0, errors.New("limit must be a positive integer")
+	}
+
+	return limit, nil
+}
+
+// Gets the schema of this collection and its JSON source,
+// or nils if it inherits one.
+func (c *Collection) GetSchema() (*jsonschema.Schema, json.RawMessage) {
+	own := c.schema.Load()
+	if own == nil {
+		return nil, nil
+	}
+	return own.compiled, own.source
+}
+
+// Compiles and sets the schema of this collection from its JSON source.
+func (c *Collection) SetSchema(source json.RawMessage) error {
+	compiled, err := jsonschema.CompileString("schema.json", string(source))
+	if err != nil {
+		return err
+	}
+
+	c.schema.Store(&ownSchema{compiled, append(json.RawMessage(nil), source...)})
+	return nil
+}
+
+// Gets the ownership rules of the documents of this collection.
+func (c *Collection) GetOwnerRules() structs.OwnerRules {
+	return *c.owners.Load()
+}
+
+// Sets the ownership rules of the documents of this collection.
+func (c *Collection) SetOwnerRules(rules structs.OwnerRules) {
+	c.owners.Store(&rules)
+}
+
+// Gets the storage quota of this collection, zero if it has none.
+func (c *Collection) GetQuota() structs.Quota {
+	return *c.limits.Load()
+}
+
+// Sets the storage quota of this collection, a database, and the
+// limits of its usage.
+func (c *Collection) SetQuota(limits structs.Quota) {
+	c.limits.Store(&limits)
+	c.usage.Load().SetLimits(limits)
+}
+
+// Gets the usage the documents of this collection are counted in.
+func (c *Collection) GetUsage() *quota.Usage {
+	return c.usage.Load()
+}
+
+// Counts the documents of this collection in usage, that of its database.
+func (c *Collection) SetUsage(usage *quota.Usage) {
+	c.usage.Store(usage)
+}
+
+// Counts the documents below coll and the bytes they take up,
+// including those in the collections of its documents.
+func MeasureCollection(coll interfaces.ICollection) (int64, int64) {
+	pairs, err := coll.QueryDocuments(context.Background(), skiplist.STRING_MIN, skiplist.STRING_MAX)
+	if err != nil {
+		// This should never happen without a deadline
+		slog.Error("Measure: error querying collection", "error", err)
+		return 0, 0
+	}
+
+	var documents, bytes int64
+	for _, pair := range pairs {
+		docDocuments, docBytes := MeasureDocument(pair.Value)
+		documents += docDocuments
+		bytes += docBytes
+	}
+	return documents, bytes
+}
+
+// Counts doc and the documents below it, and the bytes they take up.
+func MeasureDocument(doc interfaces.IDocument) (int64, int64) {
+	documents, bytes := int64(1), quota.SizeOf(doc.GetJSONDoc())
+
+	holder, hasCollection := interface{}(doc).(interfaces.ICollectionHolder)
+	if !hasCollection {
+		return documents, bytes
+	}
+	pairs, err := holder.QueryCollections(context.Background())
+	if err != nil {
+		// This should never happen without a deadline
+		slog.Error("Measure: error querying collections", "error", err)
+		return documents, bytes
+	}
+	for _, pair := range pairs {
+		collDocuments, collBytes := MeasureCollection(pair.Value)
+		documents += collDocuments
+		bytes += collBytes
+	}
+	return documents, bytes
+}
+
+// Responds to a write refused for going over the quota of the
+// database, telling if err was such a refusal.
+func respondQuota(w http.ResponseWriter, r *http.Request, err error) bool {
+	var quotaErr *quota.Error
+	if !errors.As(err, &quotaErr) {
+		return false
+	}
+
+	slog.Info("Write exceeds quota", "path", r.URL.Path, "error", err)
+	errorMessage.Respond(w, r, quotaErr.Error(), quotaErr.Code)
+	return true
+}
+
 // Implements Subscribable method. Notifies subscribers of update messages.
-// Uses interval.
+// Uses interval, and only notifies subscribers whose filter the update matches.
 func (c *Collection) NotifySubscribersUpdate(msg []byte, intervalComp string) {
-	for _, sub := range c.subscribers {
-		if intervalComp == "" || (intervalComp >= sub.IntervalStart && intervalComp <= sub.IntervalEnd) {
-			sub.Subscriber.UpdateCh <- msg
-		}
-	}
+	c.stream.Publish(subscribe.EVENT_UPDATE, intervalComp, msg)
 }
 
 // Implements Subscribable method. Notifies subscribers of delete messages.
 // Uses interval.
 func (c *Collection) NotifySubscribersDelete(msg string, intervalComp string) {
-	for _, sub := range c.subscribers {
-		if intervalComp == "" || (intervalComp >= sub.IntervalStart && intervalComp <= sub.IntervalEnd) {
-			sub.Subscriber.DeleteCh <- msg
+	c.stream.Publish(subscribe.EVENT_DELETE, intervalComp, []byte(msg))
+}
+
+// Implements Deletable method. Notifies the subscribers of this
+// collection of the deletion of each of its documents, which respects
+// their intervals, and the subscribers of the documents and collections
+// below it, then ends their subscriptions.
+func (c *Collection) NotifySubtreeDeleted(path string) (int, int) {
+	documents, collections := 0, 1
+
+	pairs, err := c.documents.Query(context.Background(), skiplist.STRING_MIN, skiplist.STRING_MAX)
+	if err != nil {
+		// This should never happen without a deadline
+		slog.Error("Delete: error querying collection", "error", err)
+	}
+	prefix := strings.TrimSuffix(path, "/") + "/"
+	for _, pair := range pairs {
+		docPath := prefix + pair.Key
+		c.NotifySubscribersDelete(docPath, pair.Key)
+
+		deletable, ok := interface{}(pair.Value).(interfaces.Deletable)
+		if !ok {
+			documents++
+			continue
+		}
+		docDocuments, docCollections := deletable.NotifySubtreeDeleted(docPath)
+		documents += docDocuments
+		collections += docCollections
+	}
+
+	c.stream.Close()
+	return documents, collections
+}
+
+// Creates a function telling if an event is wanted by a subscriber
+// to the documents in interval which match filter (nil for all).
+func matchSubscriber(interval [2]string, filter *query.Filter) subscribe.MatchEvent {
+	return func(event subscribe.Event) bool {
+		if event.Name != "" && (event.Name < interval[0] || event.Name > interval[1]) {
+			return false
 		}
+		return event.Kind != subscribe.EVENT_UPDATE || filter == nil || filter.MatchJSON(event.Data)
 	}
 }
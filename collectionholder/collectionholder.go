@@ -4,10 +4,12 @@
 package collectionholder
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"log/slog"
 	"net/http"
+	"strconv"
 
 	"github.com/RICE-COMP318-FALL23/owldb-p1group20/errorMessage"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group20/interfaces"
@@ -47,9 +49,9 @@ func (c *CollectionHolder) PutCollection(w http.ResponseWriter, r *http.Request,
 		slog.Error(err.Error())
 		switch err.Error() {
 		case "db exist":
-			errorMessage.ErrorResponse(w, "Database already exists", http.StatusBadRequest)
+			errorMessage.Respond(w, r, "Database already exists", http.StatusBadRequest)
 		default:
-			errorMessage.ErrorResponse(w, "PUT() error "+err.Error(), http.StatusInternalServerError)
+			errorMessage.Respond(w, r, "PUT() error "+err.Error(), http.StatusInternalServerError)
 		}
 		return
 	}
@@ -59,7 +61,7 @@ func (c *CollectionHolder) PutCollection(w http.ResponseWriter, r *http.Request,
 	if err != nil {
 		// This should never happen
 		slog.Error("PUT: marshal error", "error", err)
-		errorMessage.ErrorResponse(w, "internal server error", http.StatusInternalServerError)
+		errorMessage.Respond(w, r, "internal server error", http.StatusInternalServerError)
 		return
 	}
 	slog.Info("Created Database", "path", dbpath)
@@ -68,7 +70,10 @@ func (c *CollectionHolder) PutCollection(w http.ResponseWriter, r *http.Request,
 	w.Write(jsonResponse)
 }
 
-// Deletes a collection inside this CollectionHolder.
+// Deletes a collection inside this CollectionHolder, with the documents
+// and collections below it. The response counts the documents and
+// collections removed in the X-Deleted-Documents and
+// X-Deleted-Collections headers.
 func (c *CollectionHolder) DeleteCollection(w http.ResponseWriter, r *http.Request, dbpath string) {
 	// Just request a delete on the specified element
 	col, deleted := c.collections.Remove(dbpath)
@@ -76,23 +81,51 @@ func (c *CollectionHolder) DeleteCollection(w http.ResponseWriter, r *http.Reque
 	// Handle response
 	if !deleted {
 		slog.Info("Collection does not exist", "path", r.URL.Path)
-		errorMessage.ErrorResponse(w, "collectio/database does not exist", http.StatusNotFound)
+		errorMessage.Respond(w, r, "collectio/database does not exist", http.StatusNotFound)
 		return
 	}
 
-	// Notify subscribers
-	// Notify collection subscribers
-	// TODO: does not use interval?
-	colsub, ok := interface{}(col).(interfaces.Subscribable)
+	// Notify the subscribers of the collection and everything below it
+	documents, collections := 0, 1
+	deletable, ok := interface{}(col).(interfaces.Deletable)
 	if ok {
-		colsub.NotifySubscribersDelete(r.URL.Path, "")
+		documents, collections = deletable.NotifySubtreeDeleted(r.URL.Path)
 	}
 
-	slog.Info("Deleted Collection", "path", r.URL.Path)
+	slog.Info("Deleted Collection", "path", r.URL.Path, "documents", documents, "collections", collections)
 	w.Header().Set("Location", r.URL.Path)
+	w.Header().Set("X-Deleted-Documents", strconv.Itoa(documents))
+	w.Header().Set("X-Deleted-Collections", strconv.Itoa(collections))
+	w.Header().Add("Access-Control-Expose-Headers", "X-Deleted-Documents, X-Deleted-Collections")
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// Inserts a collection into this collection holder if there
+// is not one with the same name already.
+func (c *CollectionHolder) RestoreCollection(name string, newColl interfaces.ICollection) {
+	restoreUpsert := func(key string, currValue interfaces.ICollection, exists bool) (interfaces.ICollection, error) {
+		if exists {
+			return currValue, nil
+		} else {
+			return newColl, nil
+		}
+	}
+
+	c.collections.Upsert(name, restoreUpsert)
+}
+
+// Removes a collection from this collection holder. Returns
+// whether there was a collection to remove.
+func (c *CollectionHolder) RemoveCollection(name string) bool {
+	_, deleted := c.collections.Remove(name)
+	return deleted
+}
+
+// Gets a consistent view of the collections in this collection holder.
+func (c *CollectionHolder) QueryCollections(ctx context.Context) ([]skiplist.Pair[string, interfaces.ICollection], error) {
+	return c.collections.Query(ctx, skiplist.STRING_MIN, skiplist.STRING_MAX)
+}
+
 // Find a collection in this collection holder.
 func (c *CollectionHolder) GetCollection(resource string) (coll interfaces.ICollection, found bool) {
 	return c.collections.Find(resource)
@@ -0,0 +1,104 @@
+package dbhandler
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/authorization"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/errorMessage"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/interfaces"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/paths"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/skiplist"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/structs"
+)
+
+// Top-level collections handler
+//
+// Handles GET /v1/_collections, which lists the databases the user may
+// read, and GET <document path>/_collections, which lists the
+// collections of the document at docPath. With ?counts=true, each
+// database or collection also has the number of documents directly in it.
+func (d *Dbhandler) collections(w http.ResponseWriter, r *http.Request, docPath string, username string) {
+	if r.Method != http.MethodGet {
+		slog.Info("User used unsupported method on collections", "method", r.Method)
+		msg := fmt.Sprintf("unsupported method on collections: %s", r.Method)
+		errorMessage.Respond(w, r, msg, http.StatusBadRequest)
+		return
+	}
+
+	holder, prefix, found := d.listedHolder(w, r, docPath, username)
+	if !found {
+		// handled in method
+		return
+	}
+
+	pairs, err := holder.QueryCollections(r.Context())
+	if err != nil {
+		slog.Info("Collections: could not query collections in time", "error", err)
+		errorMessage.Respond(w, r, "Timeout while listing collections", http.StatusRequestTimeout)
+		return
+	}
+
+	counts := r.URL.Query().Get("counts") == "true"
+	output := structs.CollectionsOutput{Uri: r.URL.Path, Collections: make([]structs.CollectionEntry, 0, len(pairs))}
+	for _, pair := range pairs {
+		if docPath == "" && d.roles != nil && !d.roles.Allows(username, pair.Key, authorization.ROLE_READER) {
+			continue
+		}
+
+		entry := structs.CollectionEntry{Name: pair.Key, Uri: prefix + pair.Key + "/"}
+		if counts {
+			docs, err := pair.Value.QueryDocuments(r.Context(), skiplist.STRING_MIN, skiplist.STRING_MAX)
+			if err != nil {
+				slog.Info("Collections: could not count documents in time", "error", err)
+				errorMessage.Respond(w, r, "Timeout while counting documents", http.StatusRequestTimeout)
+				return
+			}
+			documents := len(docs)
+			entry.Documents = &documents
+		}
+		output.Collections = append(output.Collections, entry)
+	}
+
+	jsonResponse, err := json.Marshal(output)
+	if err != nil {
+		// This should never happen
+		slog.Error("Collections: marshal error", "error", err)
+		errorMessage.Respond(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonResponse)
+}
+
+// Gets the collection holder whose collections are listed, the
+// databases if docPath is "", or else the document at docPath, and
+// the prefix of the paths of its collections. If the document does not
+// exist or the user may not read it, writes an error to the client.
+func (d *Dbhandler) listedHolder(w http.ResponseWriter, r *http.Request, docPath string, username string) (interfaces.ICollectionHolder, string, bool) {
+	if docPath == "" {
+		return d.databases, "/v1/", true
+	}
+
+	_, doc, resc := paths.GetResourceFromPath(docPath, d.databases)
+	if resc != paths.RESOURCE_DOC {
+		paths.HandlePathError(w, r, resc)
+		return nil, "", false
+	}
+	if !d.mayRead(docPath, doc, username) {
+		slog.Info("User does not own document", "user", username, "path", docPath)
+		errorMessage.Respond(w, r, "Forbidden: only the creator of the document may read it", http.StatusForbidden)
+		return nil, "", false
+	}
+
+	holder, ok := interface{}(doc).(interfaces.ICollectionHolder)
+	if !ok {
+		// This should never happen
+		slog.Error("Collections: document does not hold collections", "path", docPath)
+		errorMessage.Respond(w, r, "internal server error", http.StatusInternalServerError)
+		return nil, "", false
+	}
+	return holder, docPath + "/", true
+}
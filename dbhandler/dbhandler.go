@@ -5,18 +5,24 @@
 package dbhandler
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
+	"strconv"
+	"sync"
 
-	"github.com/RICE-COMP318-FALL23/owldb-p1group20/collection"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/authorization"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group20/document"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group20/errorMessage"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group20/interfaces"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group20/options"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group20/paths"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/ratelimit"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/wal"
 	"github.com/santhosh-tekuri/jsonschema/v5"
 )
 
@@ -27,11 +33,15 @@ type Dbhandler struct {
 	databases     interfaces.ICollectionHolder // The set of databases held by this handler.
 	schema        *jsonschema.Schema           // The schema documents in this database must conform to.
 	authenticator interfaces.Authenticator     // An authenticator for user validation.
+	log           *wal.Log                     // The write-ahead log of mutations, or nil if persistence is disabled.
+	writeLock     *sync.RWMutex                // Serializes logged writes so the log order matches the order they were applied, and isolates transactions.
+	roles         *authorization.Roles         // The roles of users on databases, or nil if roles are not enforced.
+	limiter       *ratelimit.Limiter           // The rate limits of users, or nil if rates are not limited.
 }
 
 // Creates a new DBHandler
 func New(holder interfaces.ICollectionHolder, schema *jsonschema.Schema, authenticator interfaces.Authenticator) Dbhandler {
-	return Dbhandler{holder, schema, authenticator}
+	return Dbhandler{holder, schema, authenticator, nil, &sync.RWMutex{}, nil, nil}
 }
 
 // The server implements the "handler" interface, it will recieve
@@ -49,44 +59,107 @@ func (d *Dbhandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodOptions {
 		options.Options(w, r)
 	} else {
+		// Browsers cannot set headers on WebSocket handshakes
+		token := r.URL.Query().Get("access_token")
+		if paths.IsWebSocketRequest(r.URL.Path) && r.Header.Get("Authorization") == "" && token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+
 		valid, username := d.authenticator.ValidateToken(w, r)
-		if valid {
-			switch r.Method {
-			case http.MethodGet:
-				d.get(w, r)
-			case http.MethodPut:
-				d.put(w, r, username)
-			case http.MethodPost:
-				d.post(w, r, username)
-			case http.MethodPatch:
-				d.patch(w, r, username)
-			case http.MethodDelete:
-				d.delete(w, r)
-			default:
-				// If user used method we do not support.
-				slog.Info("User used unsupported method", "method", r.Method)
-				msg := fmt.Sprintf("unsupported method: %s", r.Method)
-				errorMessage.ErrorResponse(w, msg, http.StatusBadRequest)
+		if valid && d.throttle(w, r, username) && d.authorize(w, r, username) {
+			if r.Method == http.MethodGet {
+				d.serve(w, r, username)
+			} else if d.log != nil {
+				d.serveLogged(w, r, username)
+			} else {
+				d.serveLocked(w, r, username)
 			}
 		}
 	}
 }
 
+// Delegates a validated request to the handler for its method.
+func (d *Dbhandler) serve(w http.ResponseWriter, r *http.Request, username string) {
+	if paths.IsWebSocketRequest(r.URL.Path) {
+		d.webSocket(w, r, username)
+		return
+	}
+	docPath, isCollections := paths.CutCollectionsRequest(r.URL.Path)
+	if isCollections {
+		d.collections(w, r, docPath, username)
+		return
+	}
+	rolesDB, rolesUser, isRoles := paths.CutRolesRequest(r.URL.Path)
+	if isRoles {
+		d.rolesHandler(w, r, rolesDB, rolesUser)
+		return
+	}
+
+	// Indexes take the place of a document, so must be caught before paths are resolved
+	collPath, indexName, isIndex := paths.CutIndexRequest(r.URL.Path)
+	if isIndex {
+		d.indexes(w, r, collPath, indexName)
+		return
+	}
+	dbName, isTransaction := paths.CutTransactionRequest(r.URL.Path)
+	if isTransaction {
+		d.transaction(w, r, dbName, username)
+		return
+	}
+	dbName, isUsage := paths.CutUsageRequest(r.URL.Path)
+	if isUsage {
+		d.usage(w, r, dbName)
+		return
+	}
+	if paths.IsServerSchemaRequest(r.URL.Path) {
+		d.serverSchema(w, r)
+		return
+	}
+	schemaPath, isSchema := paths.CutSchemaRequest(r.URL.Path)
+	if isSchema {
+		d.getSchema(w, r, schemaPath)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		d.get(w, r, username)
+	case http.MethodPut:
+		d.put(w, r, username)
+	case http.MethodPost:
+		d.post(w, r, username)
+	case http.MethodPatch:
+		d.patch(w, r, username)
+	case http.MethodDelete:
+		d.delete(w, r, username)
+	default:
+		// If user used method we do not support.
+		slog.Info("User used unsupported method", "method", r.Method)
+		msg := fmt.Sprintf("unsupported method: %s", r.Method)
+		errorMessage.Respond(w, r, msg, http.StatusBadRequest)
+	}
+}
+
 // Top-level GET handler
 //
 // Handles GET document, GET database, or GET collection.
 // On success, sends a response body of all document or a set of all documents.
-func (d *Dbhandler) get(w http.ResponseWriter, r *http.Request) {
+// Documents only their creators may read are left out of sets.
+func (d *Dbhandler) get(w http.ResponseWriter, r *http.Request, username string) {
 
 	// Action fork for GET Database and GET Document
 	coll, doc, resc := paths.GetResourceFromPath(r.URL.Path, d.databases)
 	switch resc {
 	case paths.RESOURCE_DB:
-		d.getCollection(w, r, coll)
+		d.getCollection(w, r, coll, username)
 	case paths.RESOURCE_COLL:
-		coll.GetDocuments(w, r)
+		if d.restrictRequestToOwner(w, r, coll, username) {
+			coll.GetDocuments(w, r)
+		}
 	case paths.RESOURCE_DOC:
-		doc.GetDocument(w, r)
+		if d.checkOwnerRead(w, r, doc, username) {
+			doc.GetDocument(w, r)
+		}
 	default:
 		paths.HandlePathError(w, r, resc)
 	}
@@ -107,7 +180,7 @@ func (d *Dbhandler) put(w http.ResponseWriter, r *http.Request, username string)
 	} else if resc == paths.RESOURCE_DB {
 		slog.Info("Bad syntax for PUT database", "path", r.URL.Path)
 		msg := fmt.Sprintf("Bad syntax for PUT database")
-		errorMessage.ErrorResponse(w, msg, http.StatusBadRequest)
+		errorMessage.Respond(w, r, msg, http.StatusBadRequest)
 		return
 	} else if resc <= 0 {
 		paths.HandlePathError(w, r, resc)
@@ -119,7 +192,10 @@ func (d *Dbhandler) put(w http.ResponseWriter, r *http.Request, username string)
 	switch resc {
 	case paths.RESOURCE_DB:
 		// PUT document (in database)
-		doc, err := d.createDocument(w, r, username)
+		if !d.checkOwnerWrite(w, r, coll, newName, username) {
+			return
+		}
+		doc, err := d.createDocument(w, r, username, d.schemaFor(newRequest))
 		if err != nil {
 			// handled in method
 			return
@@ -127,7 +203,10 @@ func (d *Dbhandler) put(w http.ResponseWriter, r *http.Request, username string)
 		coll.PutDocument(w, r, newName, &doc)
 	case paths.RESOURCE_COLL:
 		// PUT document (in collection)
-		doc, err := d.createDocument(w, r, username)
+		if !d.checkOwnerWrite(w, r, coll, newName, username) {
+			return
+		}
+		doc, err := d.createDocument(w, r, username, d.schemaFor(newRequest))
 		if err != nil {
 			// handled in method
 			return
@@ -135,12 +214,14 @@ func (d *Dbhandler) put(w http.ResponseWriter, r *http.Request, username string)
 		coll.PutDocument(w, r, newName, &doc)
 	case paths.RESOURCE_DOC:
 		// PUT collection (in document)
-		coll := collection.New()
 		colhold, hasCollection := interface{}(doc).(interfaces.ICollectionHolder)
-		if hasCollection {
-			colhold.PutCollection(w, r, newName, &coll)
-		} else {
+		if !hasCollection {
 			paths.HandlePathError(w, r, resc)
+			return
+		}
+		coll, ok := d.newCollection(w, r)
+		if ok && d.meterCollection(w, r, &coll, paths.DatabaseOf(r.URL.Path)) {
+			colhold.PutCollection(w, r, newName, &coll)
 		}
 	default:
 		paths.HandlePathError(w, r, resc)
@@ -151,7 +232,7 @@ func (d *Dbhandler) put(w http.ResponseWriter, r *http.Request, username string)
 //
 // Handles DELETE database, DELETE document, DELETE collection.
 // On success, deletes the desired resource based on the specified path.
-func (d *Dbhandler) delete(w http.ResponseWriter, r *http.Request) {
+func (d *Dbhandler) delete(w http.ResponseWriter, r *http.Request, username string) {
 	// Obtain parent resource to delete the element from
 	newRequest, newName, resc := paths.CutRequest(r.URL.Path)
 
@@ -167,17 +248,18 @@ func (d *Dbhandler) delete(w http.ResponseWriter, r *http.Request) {
 	// Action fork for DELETE Document and DELETE Collection
 	coll, doc, resc := paths.GetResourceFromPath(newRequest, d.databases)
 	switch resc {
-	case paths.RESOURCE_DB:
-		// DELETE document (from database)
-		coll.DeleteDocument(w, r, newName)
-	case paths.RESOURCE_COLL:
-		// delete a document from a collection
-		coll.DeleteDocument(w, r, newName)
+	case paths.RESOURCE_DB, paths.RESOURCE_COLL:
+		// DELETE document (from database or collection)
+		if d.checkOwnerWrite(w, r, coll, newName, username) {
+			coll.DeleteDocument(w, r, newName)
+		}
 	case paths.RESOURCE_DOC:
 		// delete a collection from a document
 		colhold, hasCollection := interface{}(doc).(interfaces.ICollectionHolder)
 		if hasCollection {
+			coll, found := colhold.GetCollection(newName)
 			colhold.DeleteCollection(w, r, newName)
+			d.releaseCollection(colhold, newName, coll, found, paths.DatabaseOf(r.URL.Path))
 		} else {
 			paths.HandlePathError(w, r, resc)
 		}
@@ -192,13 +274,19 @@ func (d *Dbhandler) delete(w http.ResponseWriter, r *http.Request) {
 // On success, adds the requested document with a randomly generated name
 // to a database or collection.
 func (d *Dbhandler) post(w http.ResponseWriter, r *http.Request, username string) {
-	// Action fork for POST Database and POST Collection
-	coll, _, resc := paths.GetResourceFromPath(r.URL.Path, d.databases)
+	// Action fork for POST Database, POST Collection and POST Document (revert)
+	coll, doc, resc := paths.GetResourceFromPath(r.URL.Path, d.databases)
 	switch resc {
 	case paths.RESOURCE_DB:
 		d.postDocument(w, r, coll, username)
+	case paths.RESOURCE_DOC:
+		if r.URL.Query().Get("revert") == "" {
+			paths.HandlePathError(w, r, resc)
+			return
+		}
+		d.revertDocument(w, r, doc, username)
 	case paths.RESOURCE_COLL:
-		doc, err := d.createDocument(w, r, username)
+		doc, err := d.createDocument(w, r, username, d.schemaFor(r.URL.Path))
 		if err != nil {
 			// handled in method
 			return
@@ -225,32 +313,36 @@ func (d *Dbhandler) patch(w http.ResponseWriter, r *http.Request, name string) {
 	// Should go to parent first
 	coll, _, resc := paths.GetResourceFromPath(newRequest, d.databases)
 	switch resc {
-	case paths.RESOURCE_DB:
-		coll.PatchDocument(w, r, newName, d.schema, name)
-	case paths.RESOURCE_COLL:
-		coll.PatchDocument(w, r, newName, d.schema, name)
+	case paths.RESOURCE_DB, paths.RESOURCE_COLL:
+		if d.checkOwnerWrite(w, r, coll, newName, name) {
+			coll.PatchDocument(w, r, newName, d.schemaFor(newRequest), name)
+		}
 	default:
 		paths.HandlePathError(w, r, resc)
 	}
 }
 
 // Specific handler for GET database (get a collection of documents from a database)
-func (d *Dbhandler) getCollection(w http.ResponseWriter, r *http.Request, coll interfaces.ICollection) {
+func (d *Dbhandler) getCollection(w http.ResponseWriter, r *http.Request, coll interfaces.ICollection, username string) {
 	// Same behavior as collection for now
-	coll.GetDocuments(w, r)
+	if d.restrictRequestToOwner(w, r, coll, username) {
+		coll.GetDocuments(w, r)
+	}
 }
 
 // Specific handler for PUT database (create a new database)
 func (d *Dbhandler) putDatabase(w http.ResponseWriter, r *http.Request, dbpath string) {
 	// Same behavior as collection for now
-	coll := collection.New()
-	d.databases.PutCollection(w, r, dbpath, &coll)
+	coll, ok := d.newCollection(w, r)
+	if ok {
+		d.databases.PutCollection(w, r, dbpath, &coll)
+	}
 }
 
 // Specific handler for POST database (post a document to a database)
 func (d *Dbhandler) postDocument(w http.ResponseWriter, r *http.Request, coll interfaces.ICollection, name string) {
 	// Same behavior as collection for now
-	doc, err := d.createDocument(w, r, name)
+	doc, err := d.createDocument(w, r, name, d.schemaFor(r.URL.Path))
 	if err != nil {
 		// handled in method
 		return
@@ -258,21 +350,68 @@ func (d *Dbhandler) postDocument(w http.ResponseWriter, r *http.Request, coll in
 	coll.PostDocument(w, r, &doc)
 }
 
+// Specific handler for POST document with ?revert=N (revert a document)
+//
+// Writes the body of revision N of the document as a new revision,
+// as a PUT of that body would.
+func (d *Dbhandler) revertDocument(w http.ResponseWriter, r *http.Request, doc interfaces.IDocument, username string) {
+	version, err := strconv.Atoi(r.URL.Query().Get("revert"))
+	if err != nil {
+		slog.Info("Revert: bad version", "version", r.URL.Query().Get("revert"))
+		errorMessage.Respond(w, r, "Bad revert version", http.StatusBadRequest)
+		return
+	}
+
+	versioned, hasHistory := interface{}(doc).(interfaces.Versioned)
+	if !hasHistory {
+		errorMessage.Respond(w, r, "Document does not support history", http.StatusBadRequest)
+		return
+	}
+	docBody, found := versioned.GetRevision(version)
+	if !found {
+		slog.Info("Revert: version not kept", "path", r.URL.Path, "version", version)
+		errorMessage.Respond(w, r, "Version does not exist", http.StatusNotFound)
+		return
+	}
+
+	// The schema may have changed since the revision was written
+	newRequest, newName, _ := paths.CutRequest(r.URL.Path)
+	err = d.schemaFor(newRequest).Validate(docBody)
+	if err != nil {
+		slog.Info("Revert: revision does not conform to schema", "error", err)
+		errorMessage.RespondInvalid(w, r, "revision did not conform to schema", err, http.StatusBadRequest)
+		return
+	}
+
+	coll, found := d.collectionAt(newRequest)
+	if !found {
+		// This should never happen, the document was just found
+		errorMessage.Respond(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !d.checkOwnerWrite(w, r, coll, newName, username) {
+		return
+	}
+	newDoc := document.New(paths.GetRelativePathNonDB(r.URL.Path), username, docBody)
+	coll.PutDocument(w, r, newName, &newDoc)
+}
+
 // Specific handler for DELETE database (delete a top level database)
 func (d *Dbhandler) deleteDatabase(w http.ResponseWriter, r *http.Request, name string) {
 	// Same behavior as collection for now
 	d.databases.DeleteCollection(w, r, name)
 }
 
-// Creates a document object to insert into a collection.
-func (d *Dbhandler) createDocument(w http.ResponseWriter, r *http.Request, name string) (document.Document, error) {
+// Creates a document object to insert into a collection,
+// checking it against the schema of that collection.
+func (d *Dbhandler) createDocument(w http.ResponseWriter, r *http.Request, name string, schema *jsonschema.Schema) (document.Document, error) {
 	var zero document.Document
 	// Read body of requests
 	desc, err := io.ReadAll(r.Body)
 	defer r.Body.Close()
 	if err != nil {
 		slog.Error("Post document: error reading the document request body", "error", err)
-		errorMessage.ErrorResponse(w, "invalid document format", http.StatusBadRequest)
+		errorMessage.Respond(w, r, "invalid document format", http.StatusBadRequest)
 		return zero, err
 	}
 
@@ -281,17 +420,36 @@ func (d *Dbhandler) createDocument(w http.ResponseWriter, r *http.Request, name
 	err = json.Unmarshal(desc, &docBody)
 	if err != nil {
 		slog.Error("createReplaceDocument: error unmarshaling Post document request", "error", err)
-		errorMessage.ErrorResponse(w, "invalid Post document format", http.StatusBadRequest)
+		errorMessage.Respond(w, r, "invalid Post document format", http.StatusBadRequest)
 		return zero, err
 	}
 
 	// Validate against schema
-	err = d.schema.Validate(docBody)
+	err = schema.Validate(docBody)
 	if err != nil {
 		slog.Error("Post document: document did not conform to schema", "error", err)
-		errorMessage.ErrorResponse(w, "document did not conform to schema", http.StatusBadRequest)
+		errorMessage.RespondInvalid(w, r, "document did not conform to schema", err, http.StatusBadRequest)
 		return zero, err
 	}
 
 	return document.New(paths.GetRelativePathNonDB(r.URL.Path), name, docBody), nil
 }
+
+// Gets the SHA-256 hash of the body of the document at path, hex
+// encoded, so changes to it can be audited. Returns false if there
+// is no document at path.
+func (d *Dbhandler) DocumentHash(path string) (string, bool) {
+	_, doc, resc := paths.GetResourceFromPath(path, d.databases)
+	if resc != paths.RESOURCE_DOC {
+		return "", false
+	}
+
+	jsonDoc, err := json.Marshal(doc.GetJSONDoc())
+	if err != nil {
+		// This should never happen
+		slog.Error("Document hash: error marshaling", "error", err)
+		return "", false
+	}
+	hash := sha256.Sum256(jsonDoc)
+	return hex.EncodeToString(hash[:]), true
+}
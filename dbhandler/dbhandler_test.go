@@ -1,13 +1,24 @@
 package dbhandler
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strings"
 	"testing"
 
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/authorization"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group20/collectionholder"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/errorMessage"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/interfaces"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/ratelimit"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/structs"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/wal"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/websocket"
 	"github.com/santhosh-tekuri/jsonschema/v5"
 )
 
@@ -127,6 +138,12 @@ func TestServeHTTPSequential(t *testing.T) {
 		{httptest.NewRequest(http.MethodPatch, "/v1/db1/doc1", strings.NewReader("[{\"op\":\"ArrayAdd\",\"path\":\"/b\",\"value\":100},{\"op\":\"ObjectAdd\",\"path\":\"/c\",\"value\":100}]")),
 			httptest.NewRecorder(),
 			"", 400},
+		{httptest.NewRequest(http.MethodPatch, "/v1/db1/doc1", strings.NewReader("[{\"op\":\"add\",\"path\":\"/list\",\"value\":[1]},{\"op\":\"move\",\"from\":\"/list\",\"path\":\"/moved\"}]")),
+			httptest.NewRecorder(),
+			"{\"uri\":\"/v1/db1/doc1\",\"patchFailed\":false,\"message\":\"patches applied\"}", 200},
+		{httptest.NewRequest(http.MethodPatch, "/v1/db1/doc1", strings.NewReader("[{\"op\":\"test\",\"path\":\"/moved/0\",\"value\":1},{\"op\":\"test\",\"path\":\"/list\",\"value\":[1]}]")),
+			httptest.NewRecorder(),
+			"{\"uri\":\"/v1/db1/doc1\",\"patchFailed\":true,\"message\":\"Error applying patch 1: missing key \\\"list\\\" in path\",\"failedOp\":1}", 400},
 	}
 
 	for _, d := range data {
@@ -210,3 +227,1413 @@ func TestServeHTTPSequential(t *testing.T) {
 	}
 
 }
+
+// Tests that the databases are rebuilt from the write-ahead log.
+func TestRecover(t *testing.T) {
+	testschema, _ := jsonschema.Compile("testschema.json")
+	dir := t.TempDir()
+
+	log, err := wal.Open(dir, wal.SYNC_ALWAYS)
+	if err != nil {
+		t.Fatalf("expected no errors, got %s", err.Error())
+	}
+	databases := collectionholder.New()
+	testhandler := New(&databases, testschema, skeletonAuthenticator{})
+	testhandler.Recover(log, 0)
+
+	requests := []*http.Request{
+		httptest.NewRequest(http.MethodPut, "/v1/db1", nil),
+		httptest.NewRequest(http.MethodPut, "/v1/db1/doc1", strings.NewReader("{\"prop\":100}")),
+		httptest.NewRequest(http.MethodPut, "/v1/db1/doc2", strings.NewReader("{\"prop\":100}")),
+		httptest.NewRequest(http.MethodPatch, "/v1/db1/doc1", strings.NewReader("[{\"op\":\"ObjectAdd\",\"path\":\"/a\",\"value\":1}]")),
+		httptest.NewRequest(http.MethodPut, "/v1/db1/doc1/col/", nil),
+		httptest.NewRequest(http.MethodPost, "/v1/db1/doc1/col/", strings.NewReader("{\"prop\":1}")),
+		httptest.NewRequest(http.MethodDelete, "/v1/db1/doc2", nil),
+		httptest.NewRequest(http.MethodPut, "/v1/db1/_indexes/byProp", strings.NewReader("{\"field\":\"/doc/prop\"}")),
+		httptest.NewRequest(http.MethodPut, "/v1/db1/_indexes/tmp", strings.NewReader("{\"field\":\"/doc/a\"}")),
+		httptest.NewRequest(http.MethodDelete, "/v1/db1/_indexes/tmp", nil),
+		httptest.NewRequest(http.MethodPost, "/v1/db1/_transaction", strings.NewReader("{\"operations\":[{\"op\":\"put\",\"path\":\"/doc3\",\"doc\":{}},{\"op\":\"put\",\"path\":\"/doc4\",\"doc\":{}},{\"op\":\"delete\",\"path\":\"/doc4\"}]}")),
+	}
+	for i, r := range requests {
+		w := httptest.NewRecorder()
+		testhandler.ServeHTTP(w, r)
+		if w.Code >= 300 {
+			t.Fatalf("Request %d: expected success, got %d", i, w.Code)
+		}
+	}
+	log.Close()
+
+	// Rebuild into a fresh handler
+	log, err = wal.Open(dir, wal.SYNC_ALWAYS)
+	if err != nil {
+		t.Fatalf("expected no errors, got %s", err.Error())
+	}
+	defer log.Close()
+	recovered := collectionholder.New()
+	recoveredhandler := New(&recovered, testschema, skeletonAuthenticator{})
+	err = recoveredhandler.Recover(log, 0)
+	if err != nil {
+		t.Fatalf("expected no errors, got %s", err.Error())
+	}
+
+	data := []test{
+		{httptest.NewRequest(http.MethodGet, "/v1/db1/doc1", nil), httptest.NewRecorder(), "", 200},
+		{httptest.NewRequest(http.MethodGet, "/v1/db1/doc2", nil), httptest.NewRecorder(), "", 404},
+		{httptest.NewRequest(http.MethodGet, "/v1/db1/doc1/col/", nil), httptest.NewRecorder(), "", 200},
+		{httptest.NewRequest(http.MethodGet, "/v1/db1/_indexes/byProp", nil), httptest.NewRecorder(), "{\"name\":\"byProp\",\"field\":\"/doc/prop\"}", 200},
+		{httptest.NewRequest(http.MethodGet, "/v1/db1/_indexes/tmp", nil), httptest.NewRecorder(), "", 404},
+		{httptest.NewRequest(http.MethodGet, "/v1/db1/doc3", nil), httptest.NewRecorder(), "", 200},
+		{httptest.NewRequest(http.MethodGet, "/v1/db1/doc4", nil), httptest.NewRecorder(), "", 404},
+	}
+	for i, d := range data {
+		recoveredhandler.ServeHTTP(d.w, d.r)
+		if d.expected != "" && d.w.Body.String() != d.expected {
+			t.Errorf("Test %d: Expected body %s got %s", i, d.expected, d.w.Body.String())
+		}
+		if d.w.Code != d.code {
+			t.Errorf("Test %d: Expected response code %d got %d", i, d.code, d.w.Code)
+		}
+	}
+
+	// The patch and the posted document survived
+	var doc map[string]interface{}
+	json.Unmarshal(data[0].w.Body.Bytes(), &doc)
+	if doc["doc"].(map[string]interface{})["a"] != 1.0 || doc["meta"].(map[string]interface{})["createdBy"] != "charlie" {
+		t.Errorf("Expected patched document with metadata, got %s", data[0].w.Body.String())
+	}
+	var docs []interface{}
+	json.Unmarshal(data[2].w.Body.Bytes(), &docs)
+	if len(docs) != 1 {
+		t.Errorf("Expected 1 posted document, got %s", data[2].w.Body.String())
+	}
+}
+
+// Tests that a change which cannot be recorded in the write-ahead log
+// is undone, and that subscribers are not told of it.
+func TestUnloggedChange(t *testing.T) {
+	testschema, _ := jsonschema.Compile("testschema.json")
+	log, err := wal.Open(t.TempDir(), wal.SYNC_ALWAYS)
+	if err != nil {
+		t.Fatalf("expected no errors, got %s", err.Error())
+	}
+	databases := collectionholder.New()
+	testhandler := New(&databases, testschema, skeletonAuthenticator{})
+	testhandler.Recover(log, 0)
+
+	setup := []*http.Request{
+		httptest.NewRequest(http.MethodPut, "/v1/db1", nil),
+		httptest.NewRequest(http.MethodPut, "/v1/db1/doc1", strings.NewReader("{\"a\":1}")),
+		httptest.NewRequest(http.MethodPut, "/v1/db1/doc1/col/", nil),
+		httptest.NewRequest(http.MethodPut, "/v1/db1/_indexes/byA", strings.NewReader("{\"field\":\"/doc/a\"}")),
+	}
+	for i, r := range setup {
+		w := httptest.NewRecorder()
+		testhandler.ServeHTTP(w, r)
+		if w.Code >= 300 {
+			t.Fatalf("Setup %d: expected success, got %d", i, w.Code)
+		}
+	}
+	coll, _ := databases.GetCollection("db1")
+	sub, _, err := coll.(interfaces.Streamable).SubscribeEvents(context.Background(), url.Values{}, "")
+	if err != nil {
+		t.Fatalf("expected no errors, got %s", err.Error())
+	}
+	defer sub.Cancel()
+
+	// Every change fails to be recorded once the log is closed
+	log.Close()
+	requests := []*http.Request{
+		httptest.NewRequest(http.MethodPut, "/v1/db1/doc1", strings.NewReader("{\"a\":2}")),
+		httptest.NewRequest(http.MethodPatch, "/v1/db1/doc1", strings.NewReader("[{\"op\":\"ObjectAdd\",\"path\":\"/b\",\"value\":1}]")),
+		httptest.NewRequest(http.MethodDelete, "/v1/db1/doc1", nil),
+		httptest.NewRequest(http.MethodPut, "/v1/db1/doc2", strings.NewReader("{\"a\":1}")),
+		httptest.NewRequest(http.MethodPost, "/v1/db1/", strings.NewReader("{\"a\":1}")),
+		httptest.NewRequest(http.MethodPut, "/v1/db2", nil),
+		httptest.NewRequest(http.MethodDelete, "/v1/db1/doc1/col/", nil),
+		httptest.NewRequest(http.MethodPut, "/v1/db1/_indexes/byB", strings.NewReader("{\"field\":\"/doc/b\"}")),
+		httptest.NewRequest(http.MethodDelete, "/v1/db1/_indexes/byA", nil),
+		httptest.NewRequest(http.MethodPost, "/v1/db1/_transaction", strings.NewReader("{\"operations\":[{\"op\":\"put\",\"path\":\"/doc1\",\"doc\":{\"a\":3}},{\"op\":\"put\",\"path\":\"/doc3\",\"doc\":{}}]}")),
+		httptest.NewRequest(http.MethodDelete, "/v1/db1", nil),
+	}
+	for i, r := range requests {
+		w := httptest.NewRecorder()
+		testhandler.ServeHTTP(w, r)
+		if w.Code != http.StatusInternalServerError {
+			t.Errorf("Request %d: expected response code 500, got %d", i, w.Code)
+		}
+	}
+
+	data := []test{
+		{httptest.NewRequest(http.MethodGet, "/v1/db1/doc2", nil), httptest.NewRecorder(), "", 404},
+		{httptest.NewRequest(http.MethodGet, "/v1/db1/doc3", nil), httptest.NewRecorder(), "", 404},
+		{httptest.NewRequest(http.MethodGet, "/v1/db2/", nil), httptest.NewRecorder(), "", 404},
+		{httptest.NewRequest(http.MethodGet, "/v1/db1/doc1/col/", nil), httptest.NewRecorder(), "[]", 200},
+		{httptest.NewRequest(http.MethodGet, "/v1/db1/_indexes/", nil), httptest.NewRecorder(), "[{\"name\":\"byA\",\"field\":\"/doc/a\"}]", 200},
+		{httptest.NewRequest(http.MethodGet, "/v1/db1/_usage", nil), httptest.NewRecorder(), "{\"uri\":\"/v1/db1/_usage\",\"documents\":1,\"bytes\":7,\"quota\":{}}", 200},
+	}
+	for i, d := range data {
+		testhandler.ServeHTTP(d.w, d.r)
+		if d.expected != "" && d.w.Body.String() != d.expected {
+			t.Errorf("Test %d: Expected body %s got %s", i, d.expected, d.w.Body.String())
+		}
+		if d.w.Code != d.code {
+			t.Errorf("Test %d: Expected response code %d got %d", i, d.code, d.w.Code)
+		}
+	}
+
+	// The document is as it was, and still found through the index
+	w := httptest.NewRecorder()
+	testhandler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/db1/?filter="+url.QueryEscape("/doc/a == 1"), nil))
+	var docs []map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &docs)
+	if len(docs) != 1 || docs[0]["meta"].(map[string]interface{})["version"] != 1.0 || len(docs[0]["doc"].(map[string]interface{})) != 1 {
+		t.Errorf("Expected the document as it was, got %s", w.Body.String())
+	}
+	if events := sub.Pending(); len(events) != 0 {
+		t.Errorf("Expected no events, got %d", len(events))
+	}
+}
+
+// Tests that collection queries only return documents matching a filter.
+func TestFilter(t *testing.T) {
+	testschema, _ := jsonschema.Compile("testschema.json")
+	databases := collectionholder.New()
+	testhandler := New(&databases, testschema, skeletonAuthenticator{})
+
+	setup := []*http.Request{
+		httptest.NewRequest(http.MethodPut, "/v1/db1", nil),
+		httptest.NewRequest(http.MethodPut, "/v1/db1/a", strings.NewReader("{\"age\":10}")),
+		httptest.NewRequest(http.MethodPut, "/v1/db1/b", strings.NewReader("{\"age\":20}")),
+		httptest.NewRequest(http.MethodPut, "/v1/db1/c", strings.NewReader("{\"age\":30}")),
+	}
+	for _, r := range setup {
+		testhandler.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	data := []struct {
+		filter string
+		count  int
+		code   int
+	}{
+		{"/doc/age >= 20", 2, 200},
+		{"/doc/age in [10, 30] and /meta/createdBy == \"charlie\"", 2, 200},
+		{"/doc/age > 20 or not exists /doc/age", 1, 200},
+		{"/doc/age >=", 0, 400},
+	}
+
+	for i, d := range data {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/v1/db1/?filter="+url.QueryEscape(d.filter), nil)
+		testhandler.ServeHTTP(w, r)
+		if w.Code != d.code {
+			t.Errorf("Test %d: Expected response code %d got %d", i, d.code, w.Code)
+			continue
+		}
+
+		var docs []interface{}
+		json.Unmarshal(w.Body.Bytes(), &docs)
+		if d.code == 200 && len(docs) != d.count {
+			t.Errorf("Test %d: Expected %d documents got %s", i, d.count, w.Body.String())
+		}
+	}
+}
+
+// Tests that collection listings are sorted and paged with cursors.
+func TestPagination(t *testing.T) {
+	testschema, _ := jsonschema.Compile("testschema.json")
+	databases := collectionholder.New()
+	testhandler := New(&databases, testschema, skeletonAuthenticator{})
+
+	setup := []*http.Request{
+		httptest.NewRequest(http.MethodPut, "/v1/db1", nil),
+		httptest.NewRequest(http.MethodPut, "/v1/db1/a", strings.NewReader("{\"age\":30}")),
+		httptest.NewRequest(http.MethodPut, "/v1/db1/b", strings.NewReader("{\"age\":10}")),
+		httptest.NewRequest(http.MethodPut, "/v1/db1/c", strings.NewReader("{\"age\":20}")),
+		httptest.NewRequest(http.MethodPut, "/v1/db1/d", strings.NewReader("{}")),
+	}
+	for _, r := range setup {
+		testhandler.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	data := []struct {
+		query    string
+		expected []string
+	}{
+		{"orderBy=name&limit=3", []string{"/a", "/b", "/c", "/d"}},
+		{"orderBy=%2Fdoc%2Fage&limit=2", []string{"/d", "/b", "/c", "/a"}},
+		{"orderBy=%2Fdoc%2Fage&order=desc&limit=3", []string{"/a", "/c", "/b", "/d"}},
+		{"order=desc&limit=1&filter=" + url.QueryEscape("exists /doc/age"), []string{"/c", "/b", "/a"}},
+		{"orderBy=%2Fmeta%2FcreatedAt&order=desc&limit=2", []string{"/d", "/c", "/b", "/a"}},
+	}
+
+	for i, d := range data {
+		names := make([]string, 0)
+		cursor := ""
+		for pages := 0; pages < 10; pages++ {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/v1/db1/?"+d.query+"&cursor="+cursor, nil)
+			testhandler.ServeHTTP(w, r)
+			if w.Code != 200 {
+				t.Fatalf("Test %d: Expected response code 200 got %d: %s", i, w.Code, w.Body.String())
+			}
+
+			var docs []map[string]interface{}
+			json.Unmarshal(w.Body.Bytes(), &docs)
+			for _, doc := range docs {
+				names = append(names, doc["path"].(string))
+			}
+
+			cursor = w.Header().Get("X-Next-Cursor")
+			if cursor == "" {
+				break
+			}
+		}
+
+		if strings.Join(names, ",") != strings.Join(d.expected, ",") {
+			t.Errorf("Test %d: Expected %v got %v", i, d.expected, names)
+		}
+	}
+
+	// Bad parameters, and cursors from a different order, are rejected
+	w := httptest.NewRecorder()
+	testhandler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/db1/?orderBy=name&limit=1", nil))
+	cursor := w.Header().Get("X-Next-Cursor")
+	bad := []string{"limit=0", "limit=x", "order=up", "orderBy=age", "cursor=not-a-cursor!", "order=desc&cursor=" + cursor}
+	for i, query := range bad {
+		w := httptest.NewRecorder()
+		testhandler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/db1/?"+query, nil))
+		if w.Code != 400 {
+			t.Errorf("Bad test %d: Expected response code 400 got %d", i, w.Code)
+		}
+	}
+}
+
+// Tests that indexes are managed through _indexes, kept up to
+// date on writes and used by filter queries.
+func TestIndexes(t *testing.T) {
+	testschema, _ := jsonschema.Compile("testschema.json")
+	databases := collectionholder.New()
+	testhandler := New(&databases, testschema, skeletonAuthenticator{})
+
+	setup := []struct {
+		method string
+		path   string
+		body   string
+		code   int
+	}{
+		{http.MethodPut, "/v1/db1", "", 201},
+		{http.MethodPut, "/v1/db1/a", "{\"age\":10}", 201},
+		{http.MethodPut, "/v1/db1/b", "{\"age\":20}", 201},
+		{http.MethodPut, "/v1/db1/d", "{}", 201},
+		{http.MethodPut, "/v1/db1/_indexes/byAge", "{\"field\":\"/doc/age\"}", 201},
+		{http.MethodPut, "/v1/db1/_indexes/byAge", "{\"field\":\"/doc/age\"}", 200},
+		{http.MethodPut, "/v1/db1/c", "{\"age\":30}", 201},
+		{http.MethodPut, "/v1/db1/b", "{\"age\":40}", 200},
+		{http.MethodPatch, "/v1/db1/d", "[{\"op\":\"ObjectAdd\",\"path\":\"/age\",\"value\":50}]", 200},
+		{http.MethodPost, "/v1/db1/", "{\"age\":30}", 201},
+		{http.MethodDelete, "/v1/db1/c", "", 204},
+		{http.MethodPut, "/v1/db1/a/col/", "", 201},
+		{http.MethodPut, "/v1/db1/a/col/_indexes/byName", "{\"field\":\"/doc/name\"}", 201},
+		{http.MethodPut, "/v1/db1/_indexes/bad", "{\"field\":\"age\"}", 400},
+		{http.MethodPut, "/v1/db1/_indexes/", "{\"field\":\"/doc/age\"}", 400},
+		{http.MethodPut, "/v1/db2/_indexes/byAge", "{\"field\":\"/doc/age\"}", 404},
+		{http.MethodDelete, "/v1/db1/_indexes/missing", "", 404},
+	}
+	for i, s := range setup {
+		w := httptest.NewRecorder()
+		testhandler.ServeHTTP(w, httptest.NewRequest(s.method, s.path, strings.NewReader(s.body)))
+		if w.Code != s.code {
+			t.Fatalf("Setup %d: Expected response code %d got %d: %s", i, s.code, w.Code, w.Body.String())
+		}
+	}
+
+	data := []struct {
+		filter string
+		count  int
+	}{
+		{"/doc/age == 10", 1},
+		{"/doc/age == 20", 0},
+		{"/doc/age == 30", 1},
+		{"/doc/age >= 30", 3},
+		{"/doc/age == 50", 1},
+		{"/doc/age < 40 and /meta/createdBy == \"charlie\"", 2},
+		{"/doc/age == 30 or /doc/age == 10", 2},
+	}
+	for i, d := range data {
+		w := httptest.NewRecorder()
+		testhandler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/db1/?filter="+url.QueryEscape(d.filter), nil))
+
+		var docs []interface{}
+		json.Unmarshal(w.Body.Bytes(), &docs)
+		if w.Code != 200 || len(docs) != d.count {
+			t.Errorf("Test %d: Expected %d documents got %d %s", i, d.count, w.Code, w.Body.String())
+		}
+	}
+
+	// Listing, then deleting
+	w := httptest.NewRecorder()
+	testhandler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/db1/_indexes/", nil))
+	if w.Body.String() != "[{\"name\":\"byAge\",\"field\":\"/doc/age\"}]" {
+		t.Errorf("Expected one index, got %s", w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	testhandler.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/v1/db1/_indexes/byAge", nil))
+	if w.Code != 204 {
+		t.Errorf("Expected response code 204 got %d", w.Code)
+	}
+}
+
+// Tests that documents written while an index is built are found
+// through it with their latest value.
+func TestIndexBuildWhileWriting(t *testing.T) {
+	testschema, _ := jsonschema.Compile("testschema.json")
+	databases := collectionholder.New()
+	testhandler := New(&databases, testschema, skeletonAuthenticator{})
+
+	const documents = 200
+	testhandler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPut, "/v1/db1", nil))
+	for i := 0; i < documents; i++ {
+		path := fmt.Sprintf("/v1/db1/d%d", i)
+		testhandler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPut, path, strings.NewReader("{\"age\":0}")))
+	}
+
+	// Rebuild the index while every document is rewritten
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			testhandler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPut, "/v1/db1/_indexes/byAge", strings.NewReader("{\"field\":\"/doc/age\"}")))
+		}
+	}()
+	for i := 0; i < documents; i++ {
+		path := fmt.Sprintf("/v1/db1/d%d", i)
+		testhandler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPut, path, strings.NewReader("{\"age\":1}")))
+	}
+	<-done
+
+	w := httptest.NewRecorder()
+	testhandler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/db1/?filter="+url.QueryEscape("/doc/age == 1"), nil))
+	var docs []interface{}
+	json.Unmarshal(w.Body.Bytes(), &docs)
+	if w.Code != 200 || len(docs) != documents {
+		t.Errorf("Expected %d documents got %d with code %d", documents, len(docs), w.Code)
+	}
+}
+
+// Tests that merge patches are applied when sent with their content
+// type, and that the result is validated against the schema.
+func TestMergePatch(t *testing.T) {
+	testschema, _ := jsonschema.CompileString("schema.json", "{\"type\":\"object\",\"properties\":{\"age\":{\"type\":\"number\"}}}")
+	databases := collectionholder.New()
+	testhandler := New(&databases, testschema, skeletonAuthenticator{})
+
+	testhandler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPut, "/v1/db1", nil))
+	testhandler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPut, "/v1/db1/doc", strings.NewReader("{\"age\":1,\"name\":{\"first\":\"a\",\"last\":\"b\"}}")))
+
+	data := []struct {
+		contentType string
+		body        string
+		code        int
+		expected    string
+	}{
+		{"application/merge-patch+json", "{\"age\":2,\"name\":{\"last\":null,\"nick\":\"c\"}}", 200, "{\"age\":2,\"name\":{\"first\":\"a\",\"nick\":\"c\"}}"},
+		{"application/merge-patch+json; charset=utf-8", "{\"name\":null}", 200, "{\"age\":2}"},
+		{"application/merge-patch+json", "{\"age\":\"old\"}", 400, "{\"age\":2}"},
+		{"application/merge-patch+json", "null", 400, "{\"age\":2}"},
+		{"application/merge-patch+json", "{", 400, "{\"age\":2}"},
+		{"application/json", "{\"age\":3}", 400, "{\"age\":2}"},
+	}
+
+	for i, d := range data {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPatch, "/v1/db1/doc", strings.NewReader(d.body))
+		r.Header.Set("Content-Type", d.contentType)
+		testhandler.ServeHTTP(w, r)
+		if w.Code != d.code {
+			t.Errorf("Test %d: Expected response code %d got %d: %s", i, d.code, w.Code, w.Body.String())
+		}
+
+		w = httptest.NewRecorder()
+		testhandler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/db1/doc", nil))
+		var doc map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &doc)
+		output, _ := json.Marshal(doc["doc"])
+		if string(output) != d.expected {
+			t.Errorf("Test %d: Expected document %s got %s", i, d.expected, output)
+		}
+	}
+}
+
+// Tests that transactions apply all of their operations or none.
+func TestHistory(t *testing.T) {
+	testschema, _ := jsonschema.CompileString("schema.json", "{\"type\":\"object\",\"properties\":{\"age\":{\"type\":\"number\"}}}")
+	databases := collectionholder.New()
+	testhandler := New(&databases, testschema, skeletonAuthenticator{})
+
+	testhandler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPut, "/v1/db1", nil))
+	for _, body := range []string{"{\"age\":1}", "{\"age\":2}", "{\"age\":3}"} {
+		testhandler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPut, "/v1/db1/doc", strings.NewReader(body)))
+	}
+
+	w := httptest.NewRecorder()
+	testhandler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/db1/doc?history=true", nil))
+	var revisions []map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &revisions)
+	if len(revisions) != 3 {
+		t.Fatalf("Expected 3 revisions got %d: %s", len(revisions), w.Body.String())
+	}
+	for i, revision := range revisions {
+		version := revision["meta"].(map[string]interface{})["version"]
+		if version != float64(i+1) {
+			t.Errorf("Revision %d: Expected version %d got %v", i, i+1, version)
+		}
+	}
+
+	data := []struct {
+		method   string
+		path     string
+		code     int
+		expected string
+	}{
+		{http.MethodGet, "/v1/db1/doc?version=1", 200, "{\"age\":1}"},
+		{http.MethodGet, "/v1/db1/doc?version=3", 200, "{\"age\":3}"},
+		{http.MethodGet, "/v1/db1/doc?version=one", 400, ""},
+		{http.MethodGet, "/v1/db1/doc?version=9", 404, ""},
+		{http.MethodGet, "/v1/db1/doc?asOf=0", 404, ""},
+		{http.MethodGet, "/v1/db1/doc?asOf=now", 400, ""},
+		{http.MethodGet, "/v1/db1/doc?asOf=99999999999999", 200, "{\"age\":3}"},
+		{http.MethodPost, "/v1/db1/doc?revert=one", 400, ""},
+		{http.MethodPost, "/v1/db1/doc?revert=9", 404, ""},
+		{http.MethodPost, "/v1/db1/doc", 400, ""},
+		{http.MethodPost, "/v1/db1/doc?revert=1", 200, ""},
+		{http.MethodGet, "/v1/db1/doc?version=4", 200, "{\"age\":1}"},
+		{http.MethodGet, "/v1/db1/doc?version=3", 200, "{\"age\":3}"},
+	}
+
+	for i, d := range data {
+		w := httptest.NewRecorder()
+		testhandler.ServeHTTP(w, httptest.NewRequest(d.method, d.path, nil))
+		if w.Code != d.code {
+			t.Errorf("Test %d: Expected response code %d got %d: %s", i, d.code, w.Code, w.Body.String())
+			continue
+		}
+		if d.expected == "" {
+			continue
+		}
+		var doc map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &doc)
+		output, _ := json.Marshal(doc["doc"])
+		if string(output) != d.expected {
+			t.Errorf("Test %d: Expected document %s got %s", i, d.expected, output)
+		}
+	}
+}
+
+func TestSchemas(t *testing.T) {
+	testschema, _ := jsonschema.CompileString("schema.json", "{\"type\":\"object\"}")
+	dir := t.TempDir()
+	log, err := wal.Open(dir, wal.SYNC_ALWAYS)
+	if err != nil {
+		t.Fatalf("expected no errors, got %s", err.Error())
+	}
+	databases := collectionholder.New()
+	testhandler := New(&databases, testschema, skeletonAuthenticator{})
+	testhandler.Recover(log, 0)
+
+	ageSchema := "{\"schema\":{\"type\":\"object\",\"required\":[\"age\"],\"properties\":{\"age\":{\"type\":\"number\"}}}}"
+	nameSchema := "{\"schema\":{\"type\":\"object\",\"required\":[\"name\"]}}"
+	data := []struct {
+		method string
+		path   string
+		body   string
+		code   int
+	}{
+		{http.MethodPut, "/v1/typed", ageSchema, 201},
+		{http.MethodPut, "/v1/untyped", "", 201},
+		{http.MethodPut, "/v1/bad", "{\"schema\":{\"type\":12}}", 400},
+		{http.MethodPut, "/v1/bad", "not json", 400},
+		{http.MethodPut, "/v1/typed/a", "{\"age\":\"old\"}", 400},
+		{http.MethodPut, "/v1/typed/a", "{\"age\":1}", 201},
+		{http.MethodPut, "/v1/untyped/a", "{\"age\":\"old\"}", 201},
+		{http.MethodPost, "/v1/typed/", "{}", 400},
+		{http.MethodPatch, "/v1/typed/a", "[{\"op\":\"remove\",\"path\":\"/age\"}]", 400},
+		{http.MethodPatch, "/v1/untyped/a", "[{\"op\":\"remove\",\"path\":\"/age\"}]", 200},
+		// Collections inherit the schema of their parent, unless they have their own
+		{http.MethodPut, "/v1/typed/a/inherits/", "", 201},
+		{http.MethodPut, "/v1/typed/a/inherits/b", "{}", 400},
+		{http.MethodPut, "/v1/typed/a/inherits/b", "{\"age\":2}", 201},
+		{http.MethodPut, "/v1/typed/a/own/", nameSchema, 201},
+		{http.MethodPut, "/v1/typed/a/own/b", "{\"age\":2}", 400},
+		{http.MethodPut, "/v1/typed/a/own/b", "{\"name\":\"b\"}", 201},
+		{http.MethodPost, "/v1/typed/_transaction", "{\"operations\":[{\"op\":\"put\",\"path\":\"/c\",\"doc\":{}}]}", 400},
+		{http.MethodPost, "/v1/typed/_transaction", "{\"operations\":[{\"op\":\"put\",\"path\":\"/a/own/c\",\"doc\":{\"name\":\"c\"}}]}", 200},
+		{http.MethodPut, "/v1/typed/_schema", "", 400},
+		{http.MethodGet, "/v1/nodb/_schema", "", 404},
+	}
+
+	for i, d := range data {
+		w := httptest.NewRecorder()
+		testhandler.ServeHTTP(w, httptest.NewRequest(d.method, d.path, strings.NewReader(d.body)))
+		if w.Code != d.code {
+			t.Errorf("Test %d: Expected response code %d got %d: %s", i, d.code, w.Code, w.Body.String())
+		}
+	}
+	log.Close()
+
+	// Schemas are read back, and survive recovery
+	log, err = wal.Open(dir, wal.SYNC_ALWAYS)
+	if err != nil {
+		t.Fatalf("expected no errors, got %s", err.Error())
+	}
+	defer log.Close()
+	recovered := collectionholder.New()
+	recoveredhandler := New(&recovered, testschema, skeletonAuthenticator{})
+	err = recoveredhandler.Recover(log, 0)
+	if err != nil {
+		t.Fatalf("expected no errors, got %s", err.Error())
+	}
+
+	for _, handler := range []*Dbhandler{&testhandler, &recoveredhandler} {
+		schemas := []struct {
+			path      string
+			required  string
+			inherited bool
+		}{
+			{"/v1/typed/_schema", "age", false},
+			{"/v1/typed/a/inherits/_schema", "", true},
+			{"/v1/typed/a/own/_schema", "name", false},
+			{"/v1/untyped/_schema", "", true},
+		}
+		for _, schema := range schemas {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, schema.path, nil))
+			var output structs.SchemaOutput
+			json.Unmarshal(w.Body.Bytes(), &output)
+			if w.Code != 200 || output.Inherited != schema.inherited || !strings.Contains(string(output.Schema), schema.required) {
+				t.Errorf("%s: expected schema requiring %q, got %d %s", schema.path, schema.required, w.Code, w.Body.String())
+			}
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/typed/a/own/", strings.NewReader("{\"age\":3}")))
+		if w.Code != 400 {
+			t.Errorf("expected own schema to be enforced, got %d", w.Code)
+		}
+	}
+}
+
+func TestServerSchema(t *testing.T) {
+	testschema, _ := jsonschema.CompileString("schema.json", "{\"type\":\"object\"}")
+	databases := collectionholder.New()
+	testhandler := New(&databases, testschema, skeletonAuthenticator{})
+
+	setup := []struct {
+		path string
+		body string
+	}{
+		{"/v1/db1", ""},
+		{"/v1/db1/a", "{\"age\":1}"},
+		{"/v1/db1/b", "{\"age\":\"old\"}"},
+		{"/v1/db1/a/col/", ""},
+		{"/v1/db1/a/col/c", "{\"age\":2}"},
+		{"/v1/db2", "{\"schema\":{}}"},
+		{"/v1/db2/d", "{}"},
+	}
+	for _, d := range setup {
+		w := httptest.NewRecorder()
+		testhandler.ServeHTTP(w, httptest.NewRequest(http.MethodPut, d.path, strings.NewReader(d.body)))
+		if w.Code != 201 {
+			t.Fatalf("%s: expected 201 got %d", d.path, w.Code)
+		}
+	}
+
+	newSchema := "{\"type\":\"object\",\"required\":[\"age\"],\"properties\":{\"age\":{\"type\":\"number\"}}}"
+	data := []struct {
+		method        string
+		path          string
+		body          string
+		code          int
+		applied       bool
+		checked       int
+		nonConforming int
+	}{
+		{http.MethodPut, "/v1/_schema", newSchema, 409, false, 3, 1},
+		{http.MethodDelete, "/v1/db1/b", "", 204, false, 0, 0},
+		{http.MethodPut, "/v1/_schema?dryRun=true", newSchema, 200, false, 2, 0},
+		{http.MethodPut, "/v1/db1/e", "{}", 201, false, 0, 0},
+		{http.MethodDelete, "/v1/db1/e", "", 204, false, 0, 0},
+		{http.MethodPut, "/v1/_schema", newSchema, 200, true, 2, 0},
+		{http.MethodPut, "/v1/db1/e", "{}", 400, false, 0, 0},
+		{http.MethodPut, "/v1/db2/e", "{}", 201, false, 0, 0},
+		{http.MethodPut, "/v1/_schema", "{\"type\":12}", 400, false, 0, 0},
+		{http.MethodGet, "/v1/_schema", "", 400, false, 0, 0},
+	}
+
+	for i, d := range data {
+		w := httptest.NewRecorder()
+		testhandler.ServeHTTP(w, httptest.NewRequest(d.method, d.path, strings.NewReader(d.body)))
+		if w.Code != d.code {
+			t.Errorf("Test %d: Expected response code %d got %d: %s", i, d.code, w.Code, w.Body.String())
+			continue
+		}
+		if d.checked == 0 {
+			continue
+		}
+
+		var report structs.MigrationReport
+		json.Unmarshal(w.Body.Bytes(), &report)
+		if report.Applied != d.applied || report.NonConforming != d.nonConforming {
+			t.Errorf("Test %d: Expected applied %t with %d non-conforming, got %s", i, d.applied, d.nonConforming, w.Body.String())
+		}
+		// db2 has its own schema, so only db1's documents are checked
+		if report.Checked != d.checked {
+			t.Errorf("Test %d: Expected %d documents to be checked, got %d", i, d.checked, report.Checked)
+		}
+		if d.nonConforming > 0 && (report.Violations[0].Path != "/v1/db1/b" || len(report.Violations[0].Errors) == 0) {
+			t.Errorf("Test %d: Expected a violation by /v1/db1/b, got %v", i, report.Violations)
+		}
+	}
+}
+
+func TestTransaction(t *testing.T) {
+	testschema, _ := jsonschema.CompileString("schema.json", "{\"type\":\"object\",\"properties\":{\"age\":{\"type\":\"number\"}}}")
+	databases := collectionholder.New()
+	testhandler := New(&databases, testschema, skeletonAuthenticator{})
+
+	setup := []*http.Request{
+		httptest.NewRequest(http.MethodPut, "/v1/db1", nil),
+		httptest.NewRequest(http.MethodPut, "/v1/db1/a", strings.NewReader("{\"age\":1}")),
+		httptest.NewRequest(http.MethodPut, "/v1/db1/b", strings.NewReader("{\"age\":2}")),
+		httptest.NewRequest(http.MethodPut, "/v1/db1/b/col/", nil),
+		httptest.NewRequest(http.MethodPut, "/v1/db1/b/col/c", strings.NewReader("{\"age\":3}")),
+	}
+	for _, r := range setup {
+		testhandler.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	// Gets the body of a document, or nil if it does not exist, and its lastModifiedAt.
+	get := func(path string) (interface{}, int64) {
+		w := httptest.NewRecorder()
+		testhandler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != 200 {
+			return nil, 0
+		}
+		var doc map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &doc)
+		return doc["doc"], int64(doc["meta"].(map[string]interface{})["lastModifiedAt"].(float64))
+	}
+	_, modified := get("/v1/db1/a")
+
+	data := []struct {
+		body string
+		code int
+	}{
+		// Failures, none of which may change anything
+		{fmt.Sprintf("{\"operations\":[{\"op\":\"put\",\"path\":\"/x\",\"doc\":{}},{\"op\":\"delete\",\"path\":\"/a\",\"lastModifiedAt\":%d}]}", modified+1), 412},
+		{"{\"operations\":[{\"op\":\"put\",\"path\":\"/x\",\"doc\":{}},{\"op\":\"patch\",\"path\":\"/y\",\"patches\":[]}]}", 404},
+		{"{\"operations\":[{\"op\":\"put\",\"path\":\"/x\",\"doc\":{}},{\"op\":\"put\",\"path\":\"/a\",\"doc\":{\"age\":\"old\"}}]}", 400},
+		{"{\"operations\":[{\"op\":\"put\",\"path\":\"/x\",\"doc\":{}},{\"op\":\"patch\",\"path\":\"/a\",\"patches\":[{\"op\":\"replace\",\"path\":\"/age\",\"value\":\"old\"}]}]}", 400},
+		{"{\"operations\":[{\"op\":\"put\",\"path\":\"/x\",\"doc\":{}},{\"op\":\"delete\",\"path\":\"/x\"},{\"op\":\"delete\",\"path\":\"/x\"}]}", 404},
+		{"{\"operations\":[{\"op\":\"put\",\"path\":\"/x\",\"doc\":{}},{\"op\":\"delete\",\"path\":\"/b\"},{\"op\":\"delete\",\"path\":\"/b/col/c\"}]}", 400},
+		{"{\"operations\":[{\"op\":\"put\",\"path\":\"/x\",\"doc\":{}},{\"op\":\"put\",\"path\":\"/nocol/d/e\",\"doc\":{}}]}", 404},
+		{"{\"operations\":[{\"op\":\"put\",\"path\":\"/x\",\"doc\":{}},{\"op\":\"upsert\",\"path\":\"/a\"}]}", 400},
+		{"{\"operations\":[]}", 400},
+
+		// Success
+		{fmt.Sprintf("{\"operations\":[{\"op\":\"put\",\"path\":\"/x\",\"doc\":{\"age\":5}},{\"op\":\"patch\",\"path\":\"/x\",\"patches\":[{\"op\":\"add\",\"path\":\"/age\",\"value\":6}]},{\"op\":\"delete\",\"path\":\"/a\",\"lastModifiedAt\":%d},{\"op\":\"put\",\"path\":\"/b/col/c\",\"doc\":{\"age\":7}}]}", modified), 200},
+	}
+
+	for i, d := range data {
+		w := httptest.NewRecorder()
+		testhandler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/db1/_transaction", strings.NewReader(d.body)))
+		if w.Code != d.code {
+			t.Errorf("Test %d: Expected response code %d got %d: %s", i, d.code, w.Code, w.Body.String())
+		}
+
+		// Check that either nothing or everything was applied
+		x, _ := get("/v1/db1/x")
+		a, _ := get("/v1/db1/a")
+		c, _ := get("/v1/db1/b/col/c")
+		if d.code != 200 && (x != nil || a == nil || c.(map[string]interface{})["age"] != 3.0) {
+			t.Errorf("Test %d: Expected no changes, got x=%v a=%v c=%v", i, x, a, c)
+		}
+		if d.code == 200 && (x.(map[string]interface{})["age"] != 6.0 || a != nil || c.(map[string]interface{})["age"] != 7.0) {
+			t.Errorf("Test %d: Expected all changes, got x=%v a=%v c=%v", i, x, a, c)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	testhandler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/db1/_transaction", nil))
+	if w.Code != 400 {
+		t.Errorf("Expected response code 400 for GET, got %d", w.Code)
+	}
+}
+
+// Reads n messages from a WebSocket, keyed by subscription id and type,
+// as messages of different subscriptions may come in any order.
+func readWSMessages(t *testing.T, conn *websocket.Conn, n int) map[string]structs.WSMessage {
+	msgs := make(map[string]structs.WSMessage)
+	for i := 0; i < n; i++ {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("expected a message, got %s", err.Error())
+		}
+		var msg structs.WSMessage
+		json.Unmarshal(data, &msg)
+		msgs[msg.Id+" "+msg.Type] = msg
+	}
+	return msgs
+}
+
+// Tests subscribing to several resources over one WebSocket.
+func TestWebSocket(t *testing.T) {
+	testschema, _ := jsonschema.CompileString("schema.json", "{\"type\":\"object\"}")
+	databases := collectionholder.New()
+	testhandler := New(&databases, testschema, skeletonAuthenticator{})
+	server := httptest.NewServer(&testhandler)
+	defer server.Close()
+
+	testhandler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPut, "/v1/db1", nil))
+	testhandler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPut, "/v1/db1/a", strings.NewReader("{\"age\":1}")))
+	testhandler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPut, "/v1/db1/c", strings.NewReader("{}")))
+
+	conn, err := websocket.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/v1/_ws", nil)
+	if err != nil {
+		t.Fatalf("expected no errors, got %s", err.Error())
+	}
+	defer conn.Close()
+	send := func(msg string) {
+		conn.WriteMessage(websocket.OP_TEXT, []byte(msg))
+	}
+
+	send("{\"type\":\"subscribe\",\"id\":\"coll\",\"path\":\"/v1/db1/\",\"interval\":\"[a,b]\"}")
+	msgs := readWSMessages(t, conn, 2)
+	if _, found := msgs["coll subscribed"]; !found || !strings.Contains(string(msgs["coll update"].Data), "\"age\":1") {
+		t.Fatalf("expected subscription with document a, got %v", msgs)
+	}
+	send("{\"type\":\"subscribe\",\"id\":\"doc\",\"path\":\"/v1/db1/a\"}")
+	msgs = readWSMessages(t, conn, 2)
+	if _, found := msgs["doc update"]; !found {
+		t.Fatalf("expected subscription with document a, got %v", msgs)
+	}
+
+	// A change to b reaches the collection subscription only
+	testhandler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPut, "/v1/db1/b", strings.NewReader("{\"age\":2}")))
+	msgs = readWSMessages(t, conn, 1)
+	updateB := msgs["coll update"]
+	if !strings.Contains(string(updateB.Data), "\"age\":2") || updateB.EventId == 0 {
+		t.Fatalf("expected update of b, got %v", msgs)
+	}
+
+	// Deleting a ends the subscription to it
+	testhandler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodDelete, "/v1/db1/a", nil))
+	msgs = readWSMessages(t, conn, 3)
+	if _, found := msgs["doc unsubscribed"]; msgs["coll delete"].Path != "/v1/db1/a" || msgs["doc delete"].Path != "/v1/db1/a" || !found {
+		t.Fatalf("expected deletes of a and end of its subscription, got %v", msgs)
+	}
+
+	send(fmt.Sprintf("{\"type\":\"ack\",\"id\":\"coll\",\"eventId\":\"%d\"}", updateB.EventId))
+	send("{\"type\":\"unsubscribe\",\"id\":\"coll\"}")
+	msgs = readWSMessages(t, conn, 1)
+	if _, found := msgs["coll unsubscribed"]; !found {
+		t.Fatalf("expected unsubscribed, got %v", msgs)
+	}
+
+	// Resuming after the update of b only sends the delete of a
+	send(fmt.Sprintf("{\"type\":\"subscribe\",\"id\":\"again\",\"path\":\"/v1/db1/\",\"lastEventId\":\"%d\"}", updateB.EventId))
+	msgs = readWSMessages(t, conn, 2)
+	if !msgs["again subscribed"].Resumed || msgs["again delete"].Path != "/v1/db1/a" {
+		t.Fatalf("expected resumed subscription with delete of a, got %v", msgs)
+	}
+
+	// Errors are reported without closing the connection
+	for _, msg := range []string{
+		"{\"type\":\"subscribe\",\"id\":\"again\",\"path\":\"/v1/db1/\"}",
+		"{\"type\":\"subscribe\",\"id\":\"x\",\"path\":\"/v1/nodb/\"}",
+		"{\"type\":\"subscribe\",\"path\":\"/v1/db1/\"}",
+		"{\"type\":\"unsubscribe\",\"id\":\"coll\"}",
+		"{\"type\":\"jump\"}",
+		"not json",
+	} {
+		send(msg)
+		_, data, err := conn.ReadMessage()
+		var reply structs.WSMessage
+		json.Unmarshal(data, &reply)
+		if err != nil || reply.Type != WS_ERROR {
+			t.Errorf("%s: expected an error, got %s", msg, data)
+		}
+	}
+
+	// Plain requests are not upgraded
+	w := httptest.NewRecorder()
+	testhandler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/_ws", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a plain request, got %d", w.Code)
+	}
+}
+
+// Tests that errors are structured only for clients which ask for them.
+func TestStructuredErrors(t *testing.T) {
+	testschema, _ := jsonschema.CompileString("schema.json", "{\"type\":\"object\",\"properties\":{\"age\":{\"type\":\"number\"}}}")
+	databases := collectionholder.New()
+	testhandler := New(&databases, testschema, skeletonAuthenticator{})
+	testhandler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPut, "/v1/db1", nil))
+	testhandler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPut, "/v1/db1/p", strings.NewReader("{}")))
+
+	data := []struct {
+		method string
+		path   string
+		body   string
+		code   int
+		errc   string
+		causes bool
+	}{
+		{http.MethodPut, "/v1/db1/a", "{\"age\":\"old\"}", 400, errorMessage.CODE_SCHEMA_VIOLATION, true},
+		{http.MethodPost, "/v1/db1/_transaction", "{\"operations\":[{\"op\":\"put\",\"path\":\"/a\",\"doc\":{\"age\":\"old\"}}]}", 400, errorMessage.CODE_SCHEMA_VIOLATION, true},
+		{http.MethodPost, "/v1/db1/_transaction", "{\"operations\":[{\"op\":\"patch\",\"path\":\"/p\",\"patches\":[{\"op\":\"ObjectAdd\",\"path\":\"/age\",\"value\":\"old\"}]}]}", 400, errorMessage.CODE_SCHEMA_VIOLATION, true},
+		{http.MethodGet, "/v1/db1/nodoc", "", 404, "not_found", false},
+		{http.MethodGet, "/v1/db1/a/", "", 400, errorMessage.CODE_BAD_PATH, false},
+		{http.MethodGet, "/v1/db1/?limit=0", "", 400, "bad_request", false},
+	}
+
+	for i, d := range data {
+		// Old clients get a string
+		w := httptest.NewRecorder()
+		testhandler.ServeHTTP(w, httptest.NewRequest(d.method, d.path, strings.NewReader(d.body)))
+		var msg string
+		if w.Code != d.code || json.Unmarshal(w.Body.Bytes(), &msg) != nil {
+			t.Errorf("Test %d: Expected a string with code %d, got %d %s", i, d.code, w.Code, w.Body.String())
+		}
+
+		r := httptest.NewRequest(d.method, d.path, strings.NewReader(d.body))
+		r.Header.Set("Accept", "application/json, "+errorMessage.ERROR_TYPE)
+		w = httptest.NewRecorder()
+		testhandler.ServeHTTP(w, r)
+		var body errorMessage.ErrorBody
+		err := json.Unmarshal(w.Body.Bytes(), &body)
+		if err != nil || w.Code != d.code || w.Header().Get("Content-Type") != errorMessage.ERROR_TYPE {
+			t.Errorf("Test %d: Expected a structured error with code %d, got %d %s", i, d.code, w.Code, w.Body.String())
+			continue
+		}
+		if body.Status != d.code || body.Code != d.errc || body.Message != msg || body.Path != r.URL.Path {
+			t.Errorf("Test %d: Expected %s error matching %q, got %s", i, d.errc, msg, w.Body.String())
+		}
+		if d.causes && (len(body.Causes) == 0 || body.Causes[len(body.Causes)-1].InstanceLocation != "/age") {
+			t.Errorf("Test %d: Expected causes at /age, got %v", i, body.Causes)
+		}
+	}
+
+	// Old clients get a patch response for a patch which breaks the schema
+	patch := "[{\"op\":\"ObjectAdd\",\"path\":\"/age\",\"value\":\"old\"}]"
+	w := httptest.NewRecorder()
+	testhandler.ServeHTTP(w, httptest.NewRequest(http.MethodPatch, "/v1/db1/p", strings.NewReader(patch)))
+	var reply structs.PatchResponse
+	if w.Code != 400 || json.Unmarshal(w.Body.Bytes(), &reply) != nil || !reply.PatchFailed {
+		t.Errorf("Expected a failed patch response, got %d %s", w.Code, w.Body.String())
+	}
+	r := httptest.NewRequest(http.MethodPatch, "/v1/db1/p", strings.NewReader(patch))
+	r.Header.Set("Accept", errorMessage.ERROR_TYPE)
+	w = httptest.NewRecorder()
+	testhandler.ServeHTTP(w, r)
+	var body errorMessage.ErrorBody
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if w.Code != 400 || body.Code != errorMessage.CODE_SCHEMA_VIOLATION || body.Message != reply.Message || len(body.Causes) == 0 || body.Causes[len(body.Causes)-1].InstanceLocation != "/age" {
+		t.Errorf("Expected a schema violation at /age, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+// An authenticator which takes the bearer token as the username.
+type tokenAuthenticator struct{}
+
+// A simple implementation of validate token for testing.
+func (tokenAuthenticator) ValidateToken(w http.ResponseWriter, r *http.Request) (bool, string) {
+	return true, strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+// Tests that requests are refused unless the user's role allows them.
+func TestRoles(t *testing.T) {
+	testschema, _ := jsonschema.CompileString("schema.json", "{\"type\":\"object\"}")
+	databases := collectionholder.New()
+	testhandler := New(&databases, testschema, tokenAuthenticator{})
+	roles := authorization.New()
+	roles.Assign("root", authorization.ALL_DATABASES, authorization.ROLE_ADMIN)
+	testhandler.EnforceRoles(&roles)
+
+	data := []struct {
+		user   string
+		method string
+		path   string
+		body   string
+		code   int
+	}{
+		{"alice", http.MethodPut, "/v1/db1", "", 403},
+		{"root", http.MethodPut, "/v1/db1", "", 201},
+		{"root", http.MethodPut, "/v1/db1/_roles/alice", "{\"role\":\"writer\"}", 201},
+		{"root", http.MethodPut, "/v1/db1/_roles/bob", "{\"role\":\"reader\"}", 201},
+		{"root", http.MethodPut, "/v1/db1/_roles/bob", "{\"role\":\"owner\"}", 400},
+		{"alice", http.MethodGet, "/v1/db1/_roles/", "", 403},
+		{"alice", http.MethodPut, "/v1/db1/a", "{}", 201},
+		{"alice", http.MethodPatch, "/v1/db1/a", "[]", 200},
+		{"alice", http.MethodPut, "/v1/db1/_indexes/age", "{\"field\":\"/doc/age\"}", 403},
+		{"alice", http.MethodDelete, "/v1/db1", "", 403},
+		{"bob", http.MethodGet, "/v1/db1/a", "", 200},
+		{"bob", http.MethodGet, "/v1/db1/", "", 200},
+		{"bob", http.MethodPut, "/v1/db1/b", "{}", 403},
+		{"bob", http.MethodPost, "/v1/db1/_transaction", "{\"operations\":[{\"op\":\"delete\",\"path\":\"/a\"}]}", 403},
+		{"carol", http.MethodGet, "/v1/db1/a", "", 403},
+		{"alice", http.MethodPut, "/v1/_schema", "{}", 403},
+		{"root", http.MethodDelete, "/v1/db1/_roles/bob", "", 204},
+		{"root", http.MethodDelete, "/v1/db1/_roles/bob", "", 404},
+		{"bob", http.MethodGet, "/v1/db1/a", "", 403},
+		// Path errors are reported as before
+		{"carol", http.MethodGet, "/invalidPath", "", 400},
+	}
+
+	for i, d := range data {
+		r := httptest.NewRequest(d.method, d.path, strings.NewReader(d.body))
+		r.Header.Set("Authorization", "Bearer "+d.user)
+		w := httptest.NewRecorder()
+		testhandler.ServeHTTP(w, r)
+		if w.Code != d.code {
+			t.Errorf("Test %d: Expected response code %d got %d: %s", i, d.code, w.Code, w.Body.String())
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/v1/db1/_roles/", nil)
+	r.Header.Set("Authorization", "Bearer root")
+	w := httptest.NewRecorder()
+	testhandler.ServeHTTP(w, r)
+	if w.Body.String() != "[{\"user\":\"alice\",\"role\":\"writer\"}]" {
+		t.Errorf("Expected the roles on db1, got %s", w.Body.String())
+	}
+}
+
+// Tests that ownership rules restrict documents to their creators and admins.
+func TestOwners(t *testing.T) {
+	testschema, _ := jsonschema.CompileString("schema.json", "{\"type\":\"object\"}")
+	dir := t.TempDir()
+	log, err := wal.Open(dir, wal.SYNC_ALWAYS)
+	if err != nil {
+		t.Fatalf("expected no errors, got %s", err.Error())
+	}
+	databases := collectionholder.New()
+	testhandler := New(&databases, testschema, tokenAuthenticator{})
+	roles := authorization.New()
+	roles.Assign("root", authorization.ALL_DATABASES, authorization.ROLE_ADMIN)
+	testhandler.EnforceRoles(&roles)
+	testhandler.Recover(log, 0)
+
+	// Sends a request as user.
+	serve := func(handler *Dbhandler, user string, method string, path string, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+user)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	roles.Assign("alice", "db1", authorization.ROLE_WRITER)
+	roles.Assign("bob", "db1", authorization.ROLE_WRITER)
+	data := []struct {
+		user   string
+		method string
+		path   string
+		body   string
+		code   int
+	}{
+		{"root", http.MethodPut, "/v1/db1", "{\"owners\":{\"ownerWrite\":true,\"ownerRead\":true}}", 201},
+		{"alice", http.MethodPut, "/v1/db1/a", "{}", 201},
+		{"bob", http.MethodPut, "/v1/db1/b", "{}", 201},
+		{"bob", http.MethodPut, "/v1/db1/a", "{\"x\":1}", 403},
+		{"bob", http.MethodPatch, "/v1/db1/a", "[]", 403},
+		{"bob", http.MethodDelete, "/v1/db1/a", "", 403},
+		{"bob", http.MethodGet, "/v1/db1/a", "", 403},
+		{"bob", http.MethodPost, "/v1/db1/_transaction", "{\"operations\":[{\"op\":\"delete\",\"path\":\"/a\"}]}", 403},
+		{"alice", http.MethodPatch, "/v1/db1/a", "[]", 200},
+		{"alice", http.MethodGet, "/v1/db1/a", "", 200},
+		{"root", http.MethodGet, "/v1/db1/a", "", 200},
+		{"root", http.MethodPut, "/v1/db1/b", "{\"x\":1}", 200},
+	}
+
+	for i, d := range data {
+		w := serve(&testhandler, d.user, d.method, d.path, d.body)
+		if w.Code != d.code {
+			t.Errorf("Test %d: Expected response code %d got %d: %s", i, d.code, w.Code, w.Body.String())
+		}
+	}
+	log.Close()
+
+	// Rules survive recovery
+	log, err = wal.Open(dir, wal.SYNC_ALWAYS)
+	if err != nil {
+		t.Fatalf("expected no errors, got %s", err.Error())
+	}
+	defer log.Close()
+	recovered := collectionholder.New()
+	recoveredhandler := New(&recovered, testschema, tokenAuthenticator{})
+	recoveredhandler.EnforceRoles(&roles)
+	err = recoveredhandler.Recover(log, 0)
+	if err != nil {
+		t.Fatalf("expected no errors, got %s", err.Error())
+	}
+
+	for _, handler := range []*Dbhandler{&testhandler, &recoveredhandler} {
+		listings := []struct {
+			user  string
+			query string
+			docs  []string
+		}{
+			{"alice", "", []string{"/a"}},
+			{"bob", "", []string{"/b"}},
+			{"bob", "?filter=" + url.QueryEscape("/doc/x == 1"), []string{"/b"}},
+			{"bob", "?filter=" + url.QueryEscape("/doc/x == 2"), []string{}},
+			{"root", "", []string{"/a", "/b"}},
+		}
+		for i, listing := range listings {
+			w := serve(handler, listing.user, http.MethodGet, "/v1/db1/"+listing.query, "")
+			var docs []map[string]interface{}
+			json.Unmarshal(w.Body.Bytes(), &docs)
+			paths := make([]string, 0)
+			for _, doc := range docs {
+				paths = append(paths, doc["path"].(string))
+			}
+			if fmt.Sprint(paths) != fmt.Sprint(listing.docs) {
+				t.Errorf("Listing %d: Expected %v got %s", i, listing.docs, w.Body.String())
+			}
+		}
+		if w := serve(handler, "bob", http.MethodDelete, "/v1/db1/a", ""); w.Code != 403 {
+			t.Errorf("Expected ownership to be enforced, got %d", w.Code)
+		}
+	}
+}
+
+// Tests that a filter cannot escape the restriction of a listing or
+// subscription to the documents a user created.
+func TestOwnerFilterInjection(t *testing.T) {
+	testschema, _ := jsonschema.CompileString("schema.json", "{\"type\":\"object\"}")
+	databases := collectionholder.New()
+	testhandler := New(&databases, testschema, tokenAuthenticator{})
+	roles := authorization.New()
+	roles.Assign("root", authorization.ALL_DATABASES, authorization.ROLE_ADMIN)
+	roles.Assign("alice", "db1", authorization.ROLE_WRITER)
+	roles.Assign("bob", "db1", authorization.ROLE_WRITER)
+	testhandler.EnforceRoles(&roles)
+	server := httptest.NewServer(&testhandler)
+	defer server.Close()
+
+	// Sends a request as user.
+	serve := func(user string, method string, path string, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+user)
+		w := httptest.NewRecorder()
+		testhandler.ServeHTTP(w, r)
+		return w
+	}
+	serve("root", http.MethodPut, "/v1/db1", "{\"owners\":{\"ownerRead\":true}}")
+	serve("alice", http.MethodPut, "/v1/db1/a", "{\"a\":1}")
+	serve("bob", http.MethodPut, "/v1/db1/b", "{}")
+
+	// A filter closing the restriction's parenthesis is refused
+	injection := "/doc/a == 1) or (exists /meta"
+	w := serve("bob", http.MethodGet, "/v1/db1/?filter="+url.QueryEscape(injection), "")
+	if w.Code != http.StatusBadRequest || strings.Contains(w.Body.String(), "/a") {
+		t.Errorf("Expected 400 for the injected filter, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// A whole filter only selects from the user's own documents
+	w = serve("bob", http.MethodGet, "/v1/db1/?filter="+url.QueryEscape("/doc/a == 1 or exists /meta"), "")
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "\"/a\"") || !strings.Contains(w.Body.String(), "\"/b\"") {
+		t.Errorf("Expected only b, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Subscriptions over a WebSocket are refused too
+	header := http.Header{}
+	header.Set("Authorization", "Bearer bob")
+	conn, err := websocket.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/v1/_ws", header)
+	if err != nil {
+		t.Fatalf("expected no errors, got %s", err.Error())
+	}
+	defer conn.Close()
+	msg, _ := json.Marshal(structs.WSRequest{Type: "subscribe", Id: "s", Path: "/v1/db1/", Filter: injection})
+	conn.WriteMessage(websocket.OP_TEXT, msg)
+	msgs := readWSMessages(t, conn, 1)
+	if _, found := msgs["s error"]; !found {
+		t.Errorf("Expected the injected filter to be refused, got %v", msgs)
+	}
+}
+
+// Tests that requests over a user's rate limits are refused.
+func TestRateLimits(t *testing.T) {
+	testschema, _ := jsonschema.CompileString("schema.json", "{\"type\":\"object\"}")
+	databases := collectionholder.New()
+	testhandler := New(&databases, testschema, tokenAuthenticator{})
+	limiter, err := ratelimit.New(ratelimit.Config{
+		Defaults: map[string]ratelimit.Rate{
+			ratelimit.KIND_READ:      {PerSecond: 0.001, Burst: 2},
+			ratelimit.KIND_WRITE:     {PerSecond: 0.001, Burst: 2},
+			ratelimit.KIND_SUBSCRIBE: {PerSecond: 0.001, Burst: 1},
+		},
+		Users: map[string]map[string]ratelimit.Rate{"root": {ratelimit.KIND_READ: {PerSecond: 0.001, Burst: 5}}},
+	})
+	if err != nil {
+		t.Fatalf("expected no errors, got %s", err.Error())
+	}
+	testhandler.LimitRates(limiter)
+
+	// Subscriptions end at once, as their context is done
+	done, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	data := []struct {
+		user      string
+		method    string
+		path      string
+		code      int
+		remaining string
+	}{
+		{"alice", http.MethodPut, "/v1/db1", 201, "1"},
+		{"alice", http.MethodPut, "/v1/db1/a", 201, "0"},
+		{"alice", http.MethodPut, "/v1/db1/b", 429, "0"},
+		{"alice", http.MethodGet, "/v1/db1/a", 200, "1"},
+		{"alice", http.MethodGet, "/v1/db1/?mode=subscribe", 200, "0"},
+		{"alice", http.MethodGet, "/v1/db1/?mode=subscribe", 429, "0"},
+		{"alice", http.MethodGet, "/v1/db1/a", 200, "0"},
+		{"alice", http.MethodGet, "/v1/db1/a", 429, "0"},
+		{"bob", http.MethodGet, "/v1/db1/a", 200, "1"},
+		{"root", http.MethodGet, "/v1/db1/a", 200, "4"},
+	}
+	for i, d := range data {
+		r := httptest.NewRequest(d.method, d.path, strings.NewReader("{}")).WithContext(done)
+		r.Header.Set("Authorization", "Bearer "+d.user)
+		w := httptest.NewRecorder()
+		testhandler.ServeHTTP(w, r)
+		if w.Code != d.code || w.Header().Get("X-RateLimit-Remaining") != d.remaining {
+			t.Errorf("Test %d: Expected code %d with %s remaining, got %d with %s", i, d.code, d.remaining, w.Code, w.Header().Get("X-RateLimit-Remaining"))
+		}
+		if d.code == 429 && w.Header().Get("Retry-After") != "1000" {
+			t.Errorf("Test %d: Expected to retry after 1000 seconds, got %s", i, w.Header().Get("Retry-After"))
+		}
+		if exposed := strings.Join(w.Header().Values("Access-Control-Expose-Headers"), ", "); !strings.Contains(exposed, "X-RateLimit-Remaining") || !strings.Contains(exposed, "Retry-After") {
+			t.Errorf("Test %d: Expected the rate limit headers to be exposed, got %q", i, exposed)
+		}
+	}
+
+	// Headers exposed by the collection are exposed alongside them
+	r := httptest.NewRequest(http.MethodPut, "/v1/db1/c", strings.NewReader("{}"))
+	r.Header.Set("Authorization", "Bearer root")
+	testhandler.ServeHTTP(httptest.NewRecorder(), r)
+	r = httptest.NewRequest(http.MethodGet, "/v1/db1/?limit=1", nil)
+	r.Header.Set("Authorization", "Bearer root")
+	w := httptest.NewRecorder()
+	testhandler.ServeHTTP(w, r)
+	exposed := strings.Join(w.Header().Values("Access-Control-Expose-Headers"), ", ")
+	if w.Header().Get("X-Next-Cursor") == "" || !strings.Contains(exposed, "X-Next-Cursor") || !strings.Contains(exposed, "X-RateLimit-Limit") {
+		t.Errorf("Expected the cursor and rate limit headers to be exposed, got %q", exposed)
+	}
+}
+
+// Tests that writes over the quota of a database are refused, that
+// patches and deletes free up the whole subtree they wipe, and that
+// usage is recovered.
+func TestQuotas(t *testing.T) {
+	testschema, _ := jsonschema.CompileString("schema.json", "{\"type\":\"object\"}")
+	dir := t.TempDir()
+	log, err := wal.Open(dir, wal.SYNC_ALWAYS)
+	if err != nil {
+		t.Fatalf("expected no errors, got %s", err.Error())
+	}
+	databases := collectionholder.New()
+	testhandler := New(&databases, testschema, skeletonAuthenticator{})
+	testhandler.Recover(log, 0)
+
+	data := []struct {
+		method string
+		path   string
+		body   string
+		code   int
+	}{
+		{http.MethodPut, "/v1/db1", "{\"quota\":{\"maxDocuments\":3,\"maxBytes\":20,\"maxDepth\":2}}", 201},
+		{http.MethodPut, "/v1/db1/a", "{\"a\":1}", 201},
+		{http.MethodPut, "/v1/db1/a/col/", "", 201},
+		{http.MethodPut, "/v1/db1/a/col/b", "{}", 201},
+		{http.MethodPut, "/v1/db1/a/col/b/col/", "", 507},
+		{http.MethodPut, "/v1/db1/c", "{\"c\":\"0123456789012345678901\"}", 413},
+		{http.MethodPut, "/v1/db1/c", "{\"c\":\"0123456789\"}", 507},
+		{http.MethodPost, "/v1/db1/", "{}", 201},
+		{http.MethodPost, "/v1/db1/", "{}", 507},
+		{http.MethodPost, "/v1/db1/_transaction", "{\"operations\":[{\"op\":\"put\",\"path\":\"/d\",\"doc\":{}}]}", 507},
+		{http.MethodPatch, "/v1/db1/a", "[{\"op\":\"ObjectAdd\",\"path\":\"/b\",\"value\":\"01234\"}]", 507},
+		{http.MethodPatch, "/v1/db1/a", "[{\"op\":\"ObjectAdd\",\"path\":\"/b\",\"value\":2}]", 200},
+		{http.MethodPut, "/v1/db1/a/col/", "", 201},
+		{http.MethodPut, "/v1/db1/a/col/b", "{}", 201},
+		{http.MethodDelete, "/v1/db1/a", "", 204},
+		{http.MethodPut, "/v1/db1/e", "{}", 201},
+		{http.MethodPut, "/v1/db1/e/col/", "{\"quota\":{\"maxDocuments\":1}}", 400},
+		{http.MethodPut, "/v1/db2", "{\"quota\":{\"maxBytes\":-1}}", 400},
+	}
+	for i, d := range data {
+		w := httptest.NewRecorder()
+		testhandler.ServeHTTP(w, httptest.NewRequest(d.method, d.path, strings.NewReader(d.body)))
+		if w.Code != d.code {
+			t.Errorf("Test %d: Expected response code %d got %d: %s", i, d.code, w.Code, w.Body.String())
+		}
+	}
+
+	expected := "{\"uri\":\"/v1/db1/_usage\",\"documents\":2,\"bytes\":4,\"quota\":{\"maxDocuments\":3,\"maxBytes\":20,\"maxDepth\":2}}"
+	w := httptest.NewRecorder()
+	testhandler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/db1/_usage", nil))
+	if w.Code != 200 || w.Body.String() != expected {
+		t.Errorf("Expected usage %s, got %s with code %d", expected, w.Body.String(), w.Code)
+	}
+	log.Close()
+
+	// The quota and usage are rebuilt from the log
+	log, err = wal.Open(dir, wal.SYNC_ALWAYS)
+	if err != nil {
+		t.Fatalf("expected no errors, got %s", err.Error())
+	}
+	defer log.Close()
+	recovered := collectionholder.New()
+	recoveredhandler := New(&recovered, testschema, skeletonAuthenticator{})
+	err = recoveredhandler.Recover(log, 0)
+	if err != nil {
+		t.Fatalf("expected no errors, got %s", err.Error())
+	}
+	w = httptest.NewRecorder()
+	recoveredhandler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/db1/_usage", nil))
+	if w.Code != 200 || w.Body.String() != expected {
+		t.Errorf("Expected recovered usage %s, got %s with code %d", expected, w.Body.String(), w.Code)
+	}
+	w = httptest.NewRecorder()
+	recoveredhandler.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/v1/db1/e/col/", nil))
+	w = httptest.NewRecorder()
+	recoveredhandler.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/v1/db1/e/col/f", strings.NewReader("{\"c\":\"0123456789\"}")))
+	if w.Code != 507 {
+		t.Errorf("Expected nested collections to count against the recovered quota, got %d", w.Code)
+	}
+}
+
+// Tests that deleting a document or database tells the subscribers of
+// everything below it, and counts what was removed.
+func TestCascadingDelete(t *testing.T) {
+	testschema, _ := jsonschema.CompileString("schema.json", "{\"type\":\"object\"}")
+	databases := collectionholder.New()
+	testhandler := New(&databases, testschema, skeletonAuthenticator{})
+	server := httptest.NewServer(&testhandler)
+	defer server.Close()
+
+	for _, path := range []string{"/v1/db1", "/v1/db1/a", "/v1/db1/a/c1/", "/v1/db1/a/c1/x", "/v1/db1/a/c1/y",
+		"/v1/db1/a/c1/x/c2/", "/v1/db1/a/c1/x/c2/z", "/v1/db2", "/v1/db2/d"} {
+		w := httptest.NewRecorder()
+		testhandler.ServeHTTP(w, httptest.NewRequest(http.MethodPut, path, strings.NewReader("{}")))
+		if w.Code != http.StatusCreated {
+			t.Fatalf("%s: expected 201, got %d", path, w.Code)
+		}
+	}
+
+	conn, err := websocket.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/v1/_ws", nil)
+	if err != nil {
+		t.Fatalf("expected no errors, got %s", err.Error())
+	}
+	defer conn.Close()
+	for _, msg := range []string{
+		"{\"type\":\"subscribe\",\"id\":\"c1\",\"path\":\"/v1/db1/a/c1/\",\"interval\":\"[x,x]\"}",
+		"{\"type\":\"subscribe\",\"id\":\"x\",\"path\":\"/v1/db1/a/c1/x\"}",
+		"{\"type\":\"subscribe\",\"id\":\"c2\",\"path\":\"/v1/db1/a/c1/x/c2/\"}",
+		"{\"type\":\"subscribe\",\"id\":\"db2\",\"path\":\"/v1/db2/\"}",
+	} {
+		conn.WriteMessage(websocket.OP_TEXT, []byte(msg))
+		readWSMessages(t, conn, 2)
+	}
+
+	// Deleting a removes both collections and the documents in them
+	w := httptest.NewRecorder()
+	testhandler.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/v1/db1/a", nil))
+	if w.Code != http.StatusNoContent || w.Header().Get("X-Deleted-Documents") != "4" || w.Header().Get("X-Deleted-Collections") != "2" {
+		t.Fatalf("expected 4 documents and 2 collections deleted, got %d %v", w.Code, w.Header())
+	}
+	msgs := readWSMessages(t, conn, 6)
+	if msgs["c1 delete"].Path != "/v1/db1/a/c1/x" || msgs["x delete"].Path != "/v1/db1/a/c1/x" || msgs["c2 delete"].Path != "/v1/db1/a/c1/x/c2/z" {
+		t.Fatalf("expected deletes of x and z only, got %v", msgs)
+	}
+	for _, id := range []string{"c1", "x", "c2"} {
+		if _, found := msgs[id+" unsubscribed"]; !found {
+			t.Errorf("expected subscription %s to end, got %v", id, msgs)
+		}
+	}
+
+	// Deleting a database tells its subscribers of each document
+	w = httptest.NewRecorder()
+	testhandler.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/v1/db2", nil))
+	if w.Code != http.StatusNoContent || w.Header().Get("X-Deleted-Documents") != "1" || w.Header().Get("X-Deleted-Collections") != "1" {
+		t.Fatalf("expected 1 document and 1 collection deleted, got %d %v", w.Code, w.Header())
+	}
+	msgs = readWSMessages(t, conn, 2)
+	if _, found := msgs["db2 unsubscribed"]; msgs["db2 delete"].Path != "/v1/db2/d" || !found {
+		t.Fatalf("expected delete of d and end of subscription, got %v", msgs)
+	}
+
+	// Subscribing to a deleted collection is refused
+	conn.WriteMessage(websocket.OP_TEXT, []byte("{\"type\":\"subscribe\",\"id\":\"gone\",\"path\":\"/v1/db1/a/c1/\"}"))
+	msgs = readWSMessages(t, conn, 1)
+	if _, found := msgs["gone error"]; !found {
+		t.Errorf("expected an error subscribing to a deleted collection, got %v", msgs)
+	}
+}
+
+// Tests listing the databases and the collections of documents.
+func TestCollections(t *testing.T) {
+	testschema, _ := jsonschema.CompileString("schema.json", "{\"type\":\"object\"}")
+	databases := collectionholder.New()
+	testhandler := New(&databases, testschema, tokenAuthenticator{})
+	roles := authorization.New()
+	roles.Assign("root", authorization.ALL_DATABASES, authorization.ROLE_ADMIN)
+	roles.Assign("bob", "db2", authorization.ROLE_READER)
+	testhandler.EnforceRoles(&roles)
+
+	request := func(user string, method string, path string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader("{}"))
+		r.Header.Set("Authorization", "Bearer "+user)
+		w := httptest.NewRecorder()
+		testhandler.ServeHTTP(w, r)
+		return w
+	}
+	for _, path := range []string{"/v1/db2", "/v1/db1", "/v1/db1/a", "/v1/db1/a/c2/", "/v1/db1/a/c1/",
+		"/v1/db1/a/c1/x", "/v1/db1/a/c1/y", "/v1/db2/b"} {
+		if w := request("root", http.MethodPut, path); w.Code != http.StatusCreated {
+			t.Fatalf("%s: expected 201, got %d", path, w.Code)
+		}
+	}
+
+	data := []struct {
+		user     string
+		method   string
+		path     string
+		code     int
+		expected string
+	}{
+		{"root", http.MethodGet, "/v1/_collections", 200,
+			"{\"uri\":\"/v1/_collections\",\"collections\":[{\"name\":\"db1\",\"uri\":\"/v1/db1/\"},{\"name\":\"db2\",\"uri\":\"/v1/db2/\"}]}"},
+		{"root", http.MethodGet, "/v1/_collections?counts=true", 200,
+			"{\"uri\":\"/v1/_collections\",\"collections\":[{\"name\":\"db1\",\"uri\":\"/v1/db1/\",\"documents\":1},{\"name\":\"db2\",\"uri\":\"/v1/db2/\",\"documents\":1}]}"},
+		// Databases the user may not read are left out
+		{"bob", http.MethodGet, "/v1/_collections", 200,
+			"{\"uri\":\"/v1/_collections\",\"collections\":[{\"name\":\"db2\",\"uri\":\"/v1/db2/\"}]}"},
+		{"root", http.MethodGet, "/v1/db1/a/_collections?counts=true", 200,
+			"{\"uri\":\"/v1/db1/a/_collections\",\"collections\":[{\"name\":\"c1\",\"uri\":\"/v1/db1/a/c1/\",\"documents\":2},{\"name\":\"c2\",\"uri\":\"/v1/db1/a/c2/\",\"documents\":0}]}"},
+		{"root", http.MethodGet, "/v1/db1/a/c1/x/_collections", 200,
+			"{\"uri\":\"/v1/db1/a/c1/x/_collections\",\"collections\":[]}"},
+		{"root", http.MethodGet, "/v1/db1/z/_collections", 404, ""},
+		{"bob", http.MethodGet, "/v1/db1/a/_collections", 403, ""},
+		{"root", http.MethodPut, "/v1/_collections", 400, ""},
+	}
+
+	for i, d := range data {
+		w := request(d.user, d.method, d.path)
+		if w.Code != d.code {
+			t.Errorf("Test %d: Expected response code %d got %d: %s", i, d.code, w.Code, w.Body.String())
+		} else if d.expected != "" && w.Body.String() != d.expected {
+			t.Errorf("Test %d: Expected %s got %s", i, d.expected, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package dbhandler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/errorMessage"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/interfaces"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/paths"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/structs"
+)
+
+// Top-level indexes handler
+//
+// Handles GET, PUT and DELETE on <collection path>/_indexes/<name>,
+// where a PUT body of the form {"field": "/doc/age"} creates an index
+// on a pointer into the outputs of the documents of the database or
+// collection. A GET on <collection path>/_indexes/ lists its indexes.
+func (d *Dbhandler) indexes(w http.ResponseWriter, r *http.Request, collPath string, name string) {
+	indexable, found := d.indexableAt(w, r, collPath)
+	if !found {
+		// handled in method
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		d.getIndexes(w, r, indexable, name)
+	case http.MethodPut:
+		d.putIndex(w, r, indexable, name)
+	case http.MethodDelete:
+		d.deleteIndex(w, r, indexable, name)
+	default:
+		slog.Info("User used unsupported method on indexes", "method", r.Method)
+		msg := fmt.Sprintf("unsupported method on indexes: %s", r.Method)
+		errorMessage.Respond(w, r, msg, http.StatusBadRequest)
+	}
+}
+
+// Specific handler for GET indexes (list indexes, or get a single index)
+func (d *Dbhandler) getIndexes(w http.ResponseWriter, r *http.Request, indexable interfaces.Indexable, name string) {
+	fields := indexable.Indexes()
+
+	var output interface{}
+	if name == "" {
+		specs := make([]structs.IndexSpec, 0, len(fields))
+		for indexName, field := range fields {
+			specs = append(specs, structs.IndexSpec{Name: indexName, Field: field})
+		}
+		sort.Slice(specs, func(i, j int) bool {
+			return specs[i].Name < specs[j].Name
+		})
+		output = specs
+	} else {
+		field, found := fields[name]
+		if !found {
+			slog.Info("Index does not exist", "path", r.URL.Path)
+			errorMessage.Respond(w, r, "Index does not exist", http.StatusNotFound)
+			return
+		}
+		output = structs.IndexSpec{Name: name, Field: field}
+	}
+
+	jsonResponse, err := json.Marshal(output)
+	if err != nil {
+		// This should never happen
+		slog.Error("GET indexes: marshal error", "error", err)
+		errorMessage.Respond(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonResponse)
+}
+
+// Specific handler for PUT index (create or replace an index)
+//
+// Must be called with the write lock held exclusively.
+func (d *Dbhandler) putIndex(w http.ResponseWriter, r *http.Request, indexable interfaces.Indexable, name string) {
+	if name == "" {
+		slog.Info("PUT index without a name", "path", r.URL.Path)
+		errorMessage.Respond(w, r, "Missing index name", http.StatusBadRequest)
+		return
+	}
+
+	// Read body of requests
+	body, err := io.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		slog.Error("PUT index: error reading the request body", "error", err)
+		errorMessage.Respond(w, r, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var spec structs.IndexSpec
+	err = json.Unmarshal(body, &spec)
+	if err != nil || spec.Field == "" {
+		slog.Info("PUT index: bad index format", "error", err)
+		errorMessage.Respond(w, r, "invalid index format, expected {\"field\": <pointer>}", http.StatusBadRequest)
+		return
+	}
+
+	replaced, err := indexable.PutIndex(r.Context(), name, spec.Field)
+	if err != nil {
+		slog.Info("PUT index: could not create index", "error", err)
+		errorMessage.Respond(w, r, "Bad field: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	jsonResponse, err := json.Marshal(structs.PutOutput{Uri: r.URL.Path})
+	if err != nil {
+		// This should never happen
+		slog.Error("PUT index: marshal error", "error", err)
+		errorMessage.Respond(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Location", r.URL.Path)
+	if replaced {
+		slog.Info("Replaced index", "path", r.URL.Path, "field", spec.Field)
+		w.WriteHeader(http.StatusOK)
+	} else {
+		slog.Info("Created index", "path", r.URL.Path, "field", spec.Field)
+		w.WriteHeader(http.StatusCreated)
+	}
+	w.Write(jsonResponse)
+}
+
+// Specific handler for DELETE index
+func (d *Dbhandler) deleteIndex(w http.ResponseWriter, r *http.Request, indexable interfaces.Indexable, name string) {
+	if !indexable.DeleteIndex(name) {
+		slog.Info("Index does not exist", "path", r.URL.Path)
+		errorMessage.Respond(w, r, "Index does not exist", http.StatusNotFound)
+		return
+	}
+
+	slog.Info("Deleted index", "path", r.URL.Path)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Finds the database or collection at collPath, if it supports indexes.
+// On failure, writes an error to the client.
+func (d *Dbhandler) indexableAt(w http.ResponseWriter, r *http.Request, collPath string) (interfaces.Indexable, bool) {
+	coll, _, resc := paths.GetResourceFromPath(collPath, d.databases)
+	if resc != paths.RESOURCE_DB && resc != paths.RESOURCE_COLL {
+		paths.HandlePathError(w, r, resc)
+		return nil, false
+	}
+
+	indexable, ok := interface{}(coll).(interfaces.Indexable)
+	if !ok {
+		errorMessage.Respond(w, r, "Collection does not support indexes", http.StatusBadRequest)
+		return nil, false
+	}
+	return indexable, true
+}
@@ -0,0 +1,140 @@
+package dbhandler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/errorMessage"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/interfaces"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/skiplist"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/structs"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// The most non-conforming documents listed in a migration report.
+const MIGRATION_REPORT_LIMIT = 1000
+
+// Top-level server schema handler
+//
+// Handles PUT /v1/_schema, whose body is a new schema for the server
+// (the one given with -s). Every document the schema applies to, those
+// not below a database or collection with a schema of its own, is
+// checked against it, and the response reports those which do not
+// conform. The new schema replaces the old one only if every document
+// conforms (else the response is 409) and the dryRun query parameter
+// is not true. The replacement lasts until the server restarts; update
+// the -s file to keep it.
+//
+// Must be called with the write lock held exclusively, so no document
+// changes between the check and the replacement.
+func (d *Dbhandler) serverSchema(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		slog.Info("User used unsupported method on server schema", "method", r.Method)
+		msg := fmt.Sprintf("unsupported method on schema: %s", r.Method)
+		errorMessage.Respond(w, r, msg, http.StatusBadRequest)
+		return
+	}
+
+	// Read body of requests
+	body, err := io.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		slog.Error("Server schema: error reading the request body", "error", err)
+		errorMessage.Respond(w, r, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	schema, err := jsonschema.CompileString("schema.json", string(body))
+	if err != nil {
+		slog.Info("Server schema: invalid schema", "error", err)
+		errorMessage.Respond(w, r, "invalid schema: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	report := structs.MigrationReport{Uri: r.URL.Path, Violations: make([]structs.SchemaViolation, 0)}
+	err = checkHolder(r.Context(), schema, d.databases, "/v1/", &report)
+	if err != nil {
+		slog.Info("Server schema: could not check documents in time", "error", err)
+		errorMessage.Respond(w, r, "Timeout while checking documents", http.StatusRequestTimeout)
+		return
+	}
+
+	code := http.StatusOK
+	if report.NonConforming > 0 {
+		code = http.StatusConflict
+	} else if r.URL.Query().Get("dryRun") != "true" {
+		d.schema = schema
+		report.Applied = true
+		slog.Info("Server schema replaced", "checked", report.Checked)
+	}
+
+	jsonResponse, err := json.Marshal(report)
+	if err != nil {
+		// This should never happen
+		slog.Error("Server schema: marshal error", "error", err)
+		errorMessage.Respond(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(code)
+	w.Write(jsonResponse)
+}
+
+// Checks the documents of the collections of holder, whose path is
+// prefix, against schema, adding them to report. Skips collections
+// with a schema of their own, and everything below them.
+func checkHolder(ctx context.Context, schema *jsonschema.Schema, holder interfaces.ICollectionHolder, prefix string, report *structs.MigrationReport) error {
+	colls, err := holder.QueryCollections(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, coll := range colls {
+		schematized, ok := interface{}(coll.Value).(interfaces.Schematized)
+		if ok {
+			own, _ := schematized.GetSchema()
+			if own != nil {
+				continue
+			}
+		}
+
+		docs, err := coll.Value.QueryDocuments(ctx, skiplist.STRING_MIN, skiplist.STRING_MAX)
+		if err != nil {
+			return err
+		}
+		for _, doc := range docs {
+			path := prefix + coll.Key + "/" + doc.Key
+			report.Checked++
+			checkDocument(schema, path, doc.Value, report)
+
+			child, hasCollection := interface{}(doc.Value).(interfaces.ICollectionHolder)
+			if hasCollection {
+				err = checkHolder(ctx, schema, child, path+"/", report)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// Checks the document at path against schema, adding it to report
+// if it does not conform.
+func checkDocument(schema *jsonschema.Schema, path string, doc interfaces.IDocument, report *structs.MigrationReport) {
+	err := schema.Validate(doc.GetJSONDoc())
+	if err == nil {
+		return
+	}
+
+	report.NonConforming++
+	if len(report.Violations) >= MIGRATION_REPORT_LIMIT {
+		return
+	}
+
+	violation := structs.SchemaViolation{Path: path, Errors: errorMessage.ValidationCauses(err)}
+	report.Violations = append(report.Violations, violation)
+}
@@ -0,0 +1,127 @@
+package dbhandler
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/url"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/authorization"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/errorMessage"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/interfaces"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/paths"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/query"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/structs"
+)
+
+// Gets the ownership rules of the documents of a database or
+// collection, which are none if it does not support them.
+func ownerRules(coll interfaces.ICollection) structs.OwnerRules {
+	owned, ok := interface{}(coll).(interfaces.Owned)
+	if !ok {
+		return structs.OwnerRules{}
+	}
+	return owned.GetOwnerRules()
+}
+
+// Tells if username is an admin of the database db, who is not
+// bound by ownership rules. Without roles, there are no admins.
+func (d *Dbhandler) isAdmin(username string, db string) bool {
+	return d.roles != nil && d.roles.Allows(username, db, authorization.ROLE_ADMIN)
+}
+
+// Tells if username created doc, or is an admin of the database db.
+func (d *Dbhandler) isOwner(doc interfaces.IDocument, username string, db string) bool {
+	meta, hasMeta := interface{}(doc).(interfaces.HasMetadata)
+	if hasMeta && meta.GetOriginalAuthor() == username {
+		return true
+	}
+	return d.isAdmin(username, db)
+}
+
+// Tells if username may overwrite, patch or delete the document name
+// of coll, if there is one. If not, writes a 403 error to the client.
+func (d *Dbhandler) checkOwnerWrite(w http.ResponseWriter, r *http.Request, coll interfaces.ICollection, name string, username string) bool {
+	if !ownerRules(coll).OwnerWrite {
+		return true
+	}
+	doc, found := coll.FindDocument(name)
+	if !found || d.isOwner(doc, username, paths.DatabaseOf(r.URL.Path)) {
+		return true
+	}
+
+	slog.Info("User does not own document", "user", username, "path", r.URL.Path)
+	errorMessage.Respond(w, r, "Forbidden: only the creator of the document may change it", http.StatusForbidden)
+	return false
+}
+
+// Tells if username may read the document at the path of the request.
+// If not, writes a 403 error to the client.
+func (d *Dbhandler) checkOwnerRead(w http.ResponseWriter, r *http.Request, doc interfaces.IDocument, username string) bool {
+	if d.mayRead(r.URL.Path, doc, username) {
+		return true
+	}
+
+	slog.Info("User does not own document", "user", username, "path", r.URL.Path)
+	errorMessage.Respond(w, r, "Forbidden: only the creator of the document may read it", http.StatusForbidden)
+	return false
+}
+
+// Tells if username may read the document doc at path.
+func (d *Dbhandler) mayRead(path string, doc interfaces.IDocument, username string) bool {
+	parentPath, _, _ := paths.CutRequest(path)
+	coll, found := d.collectionAt(parentPath)
+	if !found || !ownerRules(coll).OwnerRead {
+		return true
+	}
+	return d.isOwner(doc, username, paths.DatabaseOf(path))
+}
+
+// Restricts the filter of a listing of, or subscription to, the
+// documents of coll at path to those username created, if only
+// their creators may read them. The filter of the client is parsed
+// on its own first, so it cannot escape the restriction; returns an
+// error if it does not parse.
+func (d *Dbhandler) restrictToOwner(queries url.Values, path string, coll interfaces.ICollection, username string) error {
+	if !ownerRules(coll).OwnerRead || d.isAdmin(username, paths.DatabaseOf(path)) {
+		return nil
+	}
+
+	// A JSON string is a literal of the filter language
+	literal, err := json.Marshal(username)
+	if err != nil {
+		// This should never happen
+		slog.Error("Owner filter: error marshaling", "error", err)
+		return err
+	}
+	filter, err := query.Parse("/meta/createdBy == " + string(literal))
+	if err != nil {
+		// This should never happen
+		slog.Error("Owner filter: error parsing", "error", err)
+		return err
+	}
+	if queries.Get("filter") != "" {
+		userFilter, err := query.Parse(queries.Get("filter"))
+		if err != nil {
+			return err
+		}
+		filter = query.And(filter, userFilter)
+	}
+	queries.Set("filter", filter.String())
+	return nil
+}
+
+// Restricts the filter of a request for the documents of coll,
+// as restrictToOwner does. If the filter of the request does not
+// parse, writes a 400 error to the client.
+func (d *Dbhandler) restrictRequestToOwner(w http.ResponseWriter, r *http.Request, coll interfaces.ICollection, username string) bool {
+	queries := r.URL.Query()
+	err := d.restrictToOwner(queries, r.URL.Path, coll, username)
+	if err != nil {
+		slog.Info("Owner filter: bad filter", "filter", queries.Get("filter"), "error", err)
+		errorMessage.Respond(w, r, "Bad filter: "+err.Error(), http.StatusBadRequest)
+		return false
+	}
+	r.URL.RawQuery = queries.Encode()
+	return true
+}
@@ -0,0 +1,191 @@
+package dbhandler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/collection"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/errorMessage"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/interfaces"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/quota"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/skiplist"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/structs"
+)
+
+// Gets the usage the documents of the database dbName are counted in.
+func (d *Dbhandler) usageOf(dbName string) (*quota.Usage, bool) {
+	db, found := d.databases.GetCollection(dbName)
+	if !found {
+		return nil, false
+	}
+	metered, ok := interface{}(db).(interfaces.Metered)
+	if !ok {
+		return nil, false
+	}
+	return metered.GetUsage(), true
+}
+
+// Gets how many collections deep the collection at path is,
+// counting its database as 1.
+func depthOf(path string) int {
+	resources := strings.Split(strings.Trim(strings.TrimPrefix(path, "/v1/"), "/"), "/")
+	return (len(resources) + 1) / 2
+}
+
+// Counts the documents of coll, a new collection to be put at the
+// path of the request, in the usage of its database, if the quota
+// of the database allows a collection so deep. If not, writes a 507
+// error to the client.
+func (d *Dbhandler) meterCollection(w http.ResponseWriter, r *http.Request, coll interfaces.ICollection, dbName string) bool {
+	metered, ok := interface{}(coll).(interfaces.Metered)
+	usage, found := d.usageOf(dbName)
+	if !ok || !found {
+		return true
+	}
+
+	err := usage.CheckDepth(depthOf(r.URL.Path))
+	if err != nil {
+		slog.Info("Collection exceeds quota", "path", r.URL.Path, "error", err)
+		errorMessage.Respond(w, r, err.Error(), err.(*quota.Error).Code)
+		return false
+	}
+	metered.SetUsage(usage)
+	return true
+}
+
+// Stops counting the documents of the collection name of holder in
+// the usage of the database dbName, if the collection was removed.
+// found and coll are the collection before it was removed.
+func (d *Dbhandler) releaseCollection(holder interfaces.ICollectionHolder, name string, coll interfaces.ICollection, found bool, dbName string) {
+	_, stillFound := holder.GetCollection(name)
+	usage, hasUsage := d.usageOf(dbName)
+	if found && !stillFound && hasUsage {
+		usage.Release(collection.MeasureCollection(coll))
+	}
+}
+
+// Counts the changes of the staged documents of a transaction on
+// the database dbName in its usage, if they stay within its quota.
+// Documents written or deleted are released with the collections
+// below them, which writing wipes.
+func (d *Dbhandler) reserveTransaction(dbName string, staged []*stagedDoc) *transactionError {
+	usage, found := d.usageOf(dbName)
+	if !found {
+		return nil
+	}
+
+	var documents, bytes, largest int64
+	for _, doc := range staged {
+		if doc.existing != nil {
+			existingDocuments, existingBytes := collection.MeasureDocument(doc.existing)
+			documents -= existingDocuments
+			bytes -= existingBytes
+		}
+		if !doc.absent {
+			size := quota.SizeOf(doc.body)
+			documents++
+			bytes += size
+			largest = max(largest, size)
+		}
+	}
+
+	err := usage.Reserve(documents, bytes, largest)
+	var quotaErr *quota.Error
+	if errors.As(err, &quotaErr) {
+		return &transactionError{quotaErr.Code, quotaErr.Error(), nil}
+	}
+	return nil
+}
+
+// Recounts the usage of every database from the documents stored,
+// so that every collection below a database is counted in its usage.
+// Used once the databases are recovered, which also clears any drift
+// from writes below a document at the same time as it was removed.
+func (d *Dbhandler) measureUsage() error {
+	pairs, err := d.databases.QueryCollections(context.Background())
+	if err != nil {
+		return err
+	}
+
+	for _, pair := range pairs {
+		metered, ok := interface{}(pair.Value).(interfaces.Metered)
+		if !ok {
+			continue
+		}
+		usage := quota.New(metered.GetQuota())
+		err = shareUsage(pair.Value, usage)
+		if err != nil {
+			return err
+		}
+		usage.Reset(collection.MeasureCollection(pair.Value))
+	}
+	return nil
+}
+
+// Counts the documents of coll and every collection below it in usage.
+func shareUsage(coll interfaces.ICollection, usage *quota.Usage) error {
+	metered, ok := interface{}(coll).(interfaces.Metered)
+	if ok {
+		metered.SetUsage(usage)
+	}
+
+	docs, err := coll.QueryDocuments(context.Background(), skiplist.STRING_MIN, skiplist.STRING_MAX)
+	if err != nil {
+		return err
+	}
+	for _, doc := range docs {
+		holder, hasCollection := interface{}(doc.Value).(interfaces.ICollectionHolder)
+		if !hasCollection {
+			continue
+		}
+		colls, err := holder.QueryCollections(context.Background())
+		if err != nil {
+			return err
+		}
+		for _, child := range colls {
+			err = shareUsage(child.Value, usage)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Top-level usage handler
+//
+// Handles GET /v1/<db>/_usage, which responds with the number of
+// documents in the database, the bytes of JSON they take up, and
+// the quota of the database.
+func (d *Dbhandler) usage(w http.ResponseWriter, r *http.Request, dbName string) {
+	if r.Method != http.MethodGet {
+		slog.Info("User used unsupported method on usage", "method", r.Method)
+		msg := fmt.Sprintf("unsupported method on usage: %s", r.Method)
+		errorMessage.Respond(w, r, msg, http.StatusBadRequest)
+		return
+	}
+
+	usage, found := d.usageOf(dbName)
+	if !found {
+		slog.Info("Usage: database does not exist", "db", dbName)
+		errorMessage.Respond(w, r, "Database does not exist", http.StatusNotFound)
+		return
+	}
+
+	output := structs.UsageOutput{Uri: r.URL.Path, Quota: usage.Limits()}
+	output.Documents, output.Bytes = usage.Totals()
+	jsonResponse, err := json.Marshal(output)
+	if err != nil {
+		// This should never happen
+		slog.Error("Usage: marshal error", "error", err)
+		errorMessage.Respond(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonResponse)
+}
@@ -0,0 +1,68 @@
+package dbhandler
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/errorMessage"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/paths"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/ratelimit"
+)
+
+// Limits how often each user may read, write and subscribe on all
+// future requests handled by d. Without a limiter, there are no limits.
+func (d *Dbhandler) LimitRates(limiter *ratelimit.Limiter) {
+	d.limiter = limiter
+}
+
+// Tells if the rate limits of username allow the request, setting the
+// X-RateLimit-Limit and X-RateLimit-Remaining headers to the budget left
+// for its kind. If not, writes a 429 error with Retry-After to the client.
+// The headers are exposed to browser clients.
+func (d *Dbhandler) throttle(w http.ResponseWriter, r *http.Request, username string) bool {
+	if d.limiter == nil {
+		return true
+	}
+
+	kind := kindOf(r)
+	decision := d.limiter.Take(username, kind)
+	if decision.Limited {
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(decision.Limit))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(decision.Remaining))
+		w.Header().Add("Access-Control-Expose-Headers", "X-RateLimit-Limit, X-RateLimit-Remaining, Retry-After")
+	}
+	if decision.Allowed {
+		return true
+	}
+
+	retryAfter := retrySeconds(decision.RetryAfter)
+	slog.Info("User exceeded rate limit", "user", username, "kind", kind, "retryAfter", retryAfter)
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	msg := fmt.Sprintf("Too many %s requests, retry after %d seconds", kind, retryAfter)
+	errorMessage.Respond(w, r, msg, http.StatusTooManyRequests)
+	return false
+}
+
+// Finds the kind of a request for rate limits: subscriptions,
+// other reads, or writes. Subscriptions over a WebSocket are
+// limited as they are made, so opening one is a read.
+func kindOf(r *http.Request) string {
+	switch {
+	case r.Method != http.MethodGet:
+		return ratelimit.KIND_WRITE
+	case !paths.IsWebSocketRequest(r.URL.Path) && r.URL.Query().Get("mode") == "subscribe":
+		return ratelimit.KIND_SUBSCRIBE
+	default:
+		return ratelimit.KIND_READ
+	}
+}
+
+// Rounds how long until a request is allowed up to whole seconds,
+// as Retry-After gives it.
+func retrySeconds(retryAfter time.Duration) int {
+	return int(math.Ceil(retryAfter.Seconds()))
+}
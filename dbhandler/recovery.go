@@ -0,0 +1,553 @@
+package dbhandler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/collection"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/document"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/errorMessage"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/interfaces"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/paths"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/structs"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/subscribe"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/wal"
+)
+
+// A response buffer holds a response back from the client
+// until its request has been recorded in the write-ahead log.
+type responseBuffer struct {
+	w      http.ResponseWriter // The response writer the response is eventually sent to.
+	status int                 // The status code of the response, 0 if not yet written.
+	body   bytes.Buffer        // The body of the response.
+}
+
+// Returns the header of the underlying response writer.
+func (b *responseBuffer) Header() http.Header {
+	return b.w.Header()
+}
+
+// Records the status code of the response.
+func (b *responseBuffer) WriteHeader(statusCode int) {
+	if b.status == 0 {
+		b.status = statusCode
+	}
+}
+
+// Buffers part of the body of the response.
+func (b *responseBuffer) Write(data []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	return b.body.Write(data)
+}
+
+// Sends the buffered response to the client.
+func (b *responseBuffer) flush() {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	b.w.WriteHeader(b.status)
+	b.w.Write(b.body.Bytes())
+}
+
+// Rebuilds the databases from the records in the write-ahead log
+// with sequence numbers greater than after (those not covered by
+// a snapshot) and counts their usage, then records all future
+// mutations handled by d in it.
+func (d *Dbhandler) Recover(log *wal.Log, after uint64) error {
+	err := log.Replay(after, d.apply)
+	if err != nil {
+		return err
+	}
+	err = d.measureUsage()
+	if err != nil {
+		return err
+	}
+
+	d.log = log
+	return nil
+}
+
+// Handles a mutating request and records it in the write-ahead log
+// before its response is sent. Subscribers are only told of the change
+// once it is recorded; if it cannot be, the change is undone, so that
+// an error response means nothing changed.
+func (d *Dbhandler) serveLogged(w http.ResponseWriter, r *http.Request, username string) {
+	// Read the body before locking, so a slow client does not hold up other writers
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		slog.Error("Logged request: error reading the request body", "error", err)
+		errorMessage.Respond(w, r, "error reading request body", http.StatusBadRequest)
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	buffer := &responseBuffer{w: w}
+	d.writeLock.Lock()
+	undo := d.savepoint(r, body)
+	hold := subscribe.NewHold()
+	d.serve(buffer, r, username)
+	if buffer.status >= 200 && buffer.status < 300 {
+		err = d.logRequest(r, buffer.body.Bytes())
+	}
+	if err != nil {
+		hold.Discard()
+		undo(buffer.body.Bytes())
+	} else {
+		hold.Release()
+	}
+	d.writeLock.Unlock()
+
+	if err != nil {
+		slog.Error("Logged request: could not record request", "path", r.URL.Path, "error", err)
+		errorMessage.Respond(w, r, "could not persist change", http.StatusInternalServerError)
+		return
+	}
+	buffer.flush()
+}
+
+// Saves the state of what a mutating request may change, returning a
+// function which puts it back given the response to the request. Used
+// to undo a change which could not be logged.
+func (d *Dbhandler) savepoint(r *http.Request, body []byte) func(response []byte) {
+	collPath, indexName, isIndex := paths.CutIndexRequest(r.URL.Path)
+	if isIndex {
+		restore := d.saveIndex(collPath, indexName)
+		return func(response []byte) {
+			restore()
+		}
+	}
+	dbName, isTransaction := paths.CutTransactionRequest(r.URL.Path)
+	if isTransaction {
+		// A transaction which cannot be read changes nothing
+		var input structs.TransactionInput
+		json.Unmarshal(body, &input)
+		restores := make([]func(), 0, len(input.Operations))
+		for _, op := range input.Operations {
+			restores = append(restores, d.saveResource("/v1/"+dbName+op.Path))
+		}
+		return func(response []byte) {
+			for i := len(restores) - 1; i >= 0; i-- {
+				restores[i]()
+			}
+			d.restoreUsage()
+		}
+	}
+	_, _, isRoles := paths.CutRolesRequest(r.URL.Path)
+	if isRoles || paths.IsServerSchemaRequest(r.URL.Path) {
+		// Not logged, so never undone
+		return func(response []byte) {}
+	}
+
+	if r.Method == http.MethodPost {
+		// The name of the new document is only known from the response
+		return func(response []byte) {
+			var output structs.PutOutput
+			err := json.Unmarshal(response, &output)
+			if err != nil {
+				return
+			}
+			newRequest, newName, resc := paths.CutRequest(output.Uri)
+			coll, found := d.collectionAt(newRequest)
+			if found && resc == paths.RESOURCE_DOC {
+				coll.RemoveDocument(newName)
+				d.restoreUsage()
+			}
+		}
+	}
+	restore := d.saveResource(r.URL.Path)
+	return func(response []byte) {
+		restore()
+		d.restoreUsage()
+	}
+}
+
+// Saves the state of the document, database or collection at path,
+// returning a function which puts it back, or removes it if there
+// was none.
+func (d *Dbhandler) saveResource(path string) func() {
+	newRequest, newName, resc := paths.CutRequest(path)
+	if resc <= 0 {
+		return func() {}
+	}
+
+	if resc == paths.RESOURCE_DOC {
+		coll, found := d.collectionAt(newRequest)
+		if !found {
+			return func() {}
+		}
+		doc, existed := coll.FindDocument(newName)
+		if !existed {
+			return func() {
+				coll.RemoveDocument(newName)
+			}
+		}
+
+		// Documents are overwritten in place, so their state is saved too
+		restore := func() {}
+		revertible, ok := interface{}(doc).(interfaces.Revertible)
+		if ok {
+			restore = revertible.Save()
+		}
+		return func() {
+			restore()
+			coll.RestoreDocument(newName, doc)
+		}
+	}
+
+	holder, found := d.holderAt(newRequest, resc)
+	if !found {
+		return func() {}
+	}
+	coll, existed := holder.GetCollection(newName)
+	return func() {
+		holder.RemoveCollection(newName)
+		if existed {
+			holder.RestoreCollection(newName, coll)
+		}
+	}
+}
+
+// Saves the index called name of the database or collection at
+// collPath, returning a function which puts it back, or deletes it if
+// there was none.
+func (d *Dbhandler) saveIndex(collPath string, name string) func() {
+	coll, found := d.collectionAt(collPath)
+	indexable, ok := interface{}(coll).(interfaces.Indexable)
+	if !found || !ok || name == "" {
+		return func() {}
+	}
+
+	field, existed := indexable.Indexes()[name]
+	return func() {
+		if !existed {
+			indexable.DeleteIndex(name)
+			return
+		}
+		_, err := indexable.PutIndex(context.Background(), name, field)
+		if err != nil {
+			// This should never happen, as the index was built before
+			slog.Error("Undo: could not rebuild index", "path", collPath, "index", name, "error", err)
+		}
+	}
+}
+
+// Counts the usage of every database again, after a change to
+// them was undone.
+func (d *Dbhandler) restoreUsage() {
+	err := d.measureUsage()
+	if err != nil {
+		slog.Error("Undo: could not measure usage", "error", err)
+	}
+}
+
+// Appends the record of a successful mutating request to the log.
+func (d *Dbhandler) logRequest(r *http.Request, response []byte) error {
+	collPath, indexName, isIndex := paths.CutIndexRequest(r.URL.Path)
+	if isIndex {
+		return d.logIndex(r, collPath, indexName)
+	}
+	_, isTransaction := paths.CutTransactionRequest(r.URL.Path)
+	if isTransaction {
+		return d.logTransaction(r, response)
+	}
+	if paths.IsServerSchemaRequest(r.URL.Path) {
+		// The schema of the server comes from -s, and is not recovered
+		return nil
+	}
+	_, _, isRoles := paths.CutRolesRequest(r.URL.Path)
+	if isRoles {
+		// Roles are saved to their own file
+		return nil
+	}
+
+	var rec wal.Record
+	switch r.Method {
+	case http.MethodPut:
+		_, _, resc := paths.CutRequest(r.URL.Path)
+		if resc == paths.RESOURCE_DOC {
+			return d.logDocument(r.URL.Path)
+		}
+		return d.logCollection(r.URL.Path)
+	case http.MethodPost:
+		// The name of the new document is only known from the response
+		var output structs.PutOutput
+		err := json.Unmarshal(response, &output)
+		if err != nil {
+			return err
+		}
+		return d.logDocument(output.Uri)
+	case http.MethodPatch:
+		return d.logDocument(r.URL.Path)
+	case http.MethodDelete:
+		rec = wal.Record{Op: wal.OP_DELETE, Path: r.URL.Path}
+	default:
+		return nil
+	}
+
+	_, err := d.log.Append(rec)
+	return err
+}
+
+// Appends the creation of the database or collection at path,
+// with its schema, ownership rules and quota, to the log.
+func (d *Dbhandler) logCollection(path string) error {
+	rec := wal.Record{Op: wal.OP_PUT_COLLECTION, Path: path}
+
+	var spec structs.CollectionSpec
+	coll, found := d.collectionAt(strings.TrimSuffix(path, "/") + "/")
+	schematized, ok := interface{}(coll).(interfaces.Schematized)
+	if found && ok {
+		_, spec.Schema = schematized.GetSchema()
+	}
+	owned, ok := interface{}(coll).(interfaces.Owned)
+	if found && ok && owned.GetOwnerRules() != (structs.OwnerRules{}) {
+		rules := owned.GetOwnerRules()
+		spec.Owners = &rules
+	}
+	metered, ok := interface{}(coll).(interfaces.Metered)
+	if found && ok && metered.GetQuota() != (structs.Quota{}) {
+		limits := metered.GetQuota()
+		spec.Quota = &limits
+	}
+	if spec.Schema != nil || spec.Owners != nil || spec.Quota != nil {
+		jsonSpec, err := json.Marshal(spec)
+		if err != nil {
+			return err
+		}
+		rec.Doc = jsonSpec
+	}
+
+	_, err := d.log.Append(rec)
+	return err
+}
+
+// Appends the current state of the document at path to the log.
+func (d *Dbhandler) logDocument(path string) error {
+	rec, err := d.documentRecord(path)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.log.Append(rec)
+	return err
+}
+
+// Builds a record of the current state of the document at path.
+func (d *Dbhandler) documentRecord(path string) (wal.Record, error) {
+	_, doc, resc := paths.GetResourceFromPath(path, d.databases)
+	if resc != paths.RESOURCE_DOC {
+		return wal.Record{}, fmt.Errorf("could not find document %s", path)
+	}
+
+	jsonDoc, err := json.Marshal(doc.GetRawBody())
+	if err != nil {
+		return wal.Record{}, err
+	}
+
+	return wal.Record{Op: wal.OP_PUT_DOCUMENT, Path: path, Doc: jsonDoc}, nil
+}
+
+// Appends the documents changed by a committed transaction to the
+// log as a single record, so that they are recovered all or nothing.
+func (d *Dbhandler) logTransaction(r *http.Request, response []byte) error {
+	var output structs.TransactionOutput
+	err := json.Unmarshal(response, &output)
+	if err != nil {
+		return err
+	}
+
+	recs := make([]wal.Record, 0, len(output.Results))
+	for _, result := range output.Results {
+		if result.Deleted {
+			recs = append(recs, wal.Record{Op: wal.OP_DELETE, Path: result.Uri})
+			continue
+		}
+		rec, err := d.documentRecord(result.Uri)
+		if err != nil {
+			return err
+		}
+		recs = append(recs, rec)
+	}
+
+	batch, err := json.Marshal(recs)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.log.Append(wal.Record{Op: wal.OP_TRANSACTION, Path: r.URL.Path, Doc: batch})
+	return err
+}
+
+// Appends the record of a successful request to the indexes of
+// the database or collection at collPath to the log.
+func (d *Dbhandler) logIndex(r *http.Request, collPath string, name string) error {
+	var rec wal.Record
+	switch r.Method {
+	case http.MethodPut:
+		coll, found := d.collectionAt(collPath)
+		indexable, ok := interface{}(coll).(interfaces.Indexable)
+		if !found || !ok {
+			return fmt.Errorf("could not find collection %s", collPath)
+		}
+
+		spec, err := json.Marshal(structs.IndexSpec{Field: indexable.Indexes()[name]})
+		if err != nil {
+			return err
+		}
+		rec = wal.Record{Op: wal.OP_PUT_INDEX, Path: r.URL.Path, Doc: spec}
+	case http.MethodDelete:
+		rec = wal.Record{Op: wal.OP_DELETE, Path: r.URL.Path}
+	default:
+		return nil
+	}
+
+	_, err := d.log.Append(rec)
+	return err
+}
+
+// Applies a record of the write-ahead log to the databases.
+// Records whose parent resource no longer exists are skipped.
+func (d *Dbhandler) apply(rec wal.Record) error {
+	if rec.Op == wal.OP_TRANSACTION {
+		var recs []wal.Record
+		err := json.Unmarshal(rec.Doc, &recs)
+		if err != nil {
+			return fmt.Errorf("invalid transaction in record %d: %w", rec.Seq, err)
+		}
+		for _, sub := range recs {
+			sub.Seq = rec.Seq
+			err = d.apply(sub)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	collPath, indexName, isIndex := paths.CutIndexRequest(rec.Path)
+	if isIndex {
+		return d.applyIndex(rec, collPath, indexName)
+	}
+
+	newRequest, newName, resc := paths.CutRequest(rec.Path)
+	if resc <= 0 {
+		return fmt.Errorf("invalid path in record %d: %s", rec.Seq, rec.Path)
+	}
+
+	switch rec.Op {
+	case wal.OP_PUT_COLLECTION:
+		holder, found := d.holderAt(newRequest, resc)
+		if !found {
+			slog.Warn("Recovery: missing parent of collection", "seq", rec.Seq, "path", rec.Path)
+			return nil
+		}
+		coll := collection.New()
+		if len(rec.Doc) > 0 {
+			var spec structs.CollectionSpec
+			err := json.Unmarshal(rec.Doc, &spec)
+			if err == nil && spec.Schema != nil {
+				err = coll.SetSchema(spec.Schema)
+			}
+			if err != nil {
+				return fmt.Errorf("invalid schema in record %d: %w", rec.Seq, err)
+			}
+			if spec.Owners != nil {
+				coll.SetOwnerRules(*spec.Owners)
+			}
+			if spec.Quota != nil {
+				coll.SetQuota(*spec.Quota)
+			}
+		}
+		holder.RestoreCollection(newName, &coll)
+	case wal.OP_PUT_DOCUMENT:
+		coll, found := d.collectionAt(newRequest)
+		if !found {
+			slog.Warn("Recovery: missing parent of document", "seq", rec.Seq, "path", rec.Path)
+			return nil
+		}
+		doc, err := document.Restore(rec.Doc)
+		if err != nil {
+			return fmt.Errorf("invalid document in record %d: %w", rec.Seq, err)
+		}
+		coll.RestoreDocument(newName, &doc)
+	case wal.OP_DELETE:
+		if resc == paths.RESOURCE_DOC {
+			coll, found := d.collectionAt(newRequest)
+			if found {
+				coll.RemoveDocument(newName)
+			}
+		} else {
+			holder, found := d.holderAt(newRequest, resc)
+			if found {
+				holder.RemoveCollection(newName)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown operation in record %d: %s", rec.Seq, rec.Op)
+	}
+
+	return nil
+}
+
+// Applies a record of the write-ahead log to the indexes of the
+// database or collection at collPath.
+func (d *Dbhandler) applyIndex(rec wal.Record, collPath string, name string) error {
+	coll, found := d.collectionAt(collPath)
+	indexable, ok := interface{}(coll).(interfaces.Indexable)
+	if !found || !ok {
+		slog.Warn("Recovery: missing collection of index", "seq", rec.Seq, "path", rec.Path)
+		return nil
+	}
+
+	switch rec.Op {
+	case wal.OP_PUT_INDEX:
+		var spec structs.IndexSpec
+		err := json.Unmarshal(rec.Doc, &spec)
+		if err != nil {
+			return fmt.Errorf("invalid index in record %d: %w", rec.Seq, err)
+		}
+		_, err = indexable.PutIndex(context.Background(), name, spec.Field)
+		if err != nil {
+			return fmt.Errorf("invalid index in record %d: %w", rec.Seq, err)
+		}
+	case wal.OP_DELETE:
+		indexable.DeleteIndex(name)
+	default:
+		return fmt.Errorf("unknown operation in record %d: %s", rec.Seq, rec.Op)
+	}
+
+	return nil
+}
+
+// Finds the collection holder a database or collection is put into,
+// given the truncated request path and resource type from paths.CutRequest.
+func (d *Dbhandler) holderAt(request string, resc int) (interfaces.ICollectionHolder, bool) {
+	if resc == paths.RESOURCE_DB_PD {
+		return d.databases, true
+	}
+
+	_, doc, docResc := paths.GetResourceFromPath(request, d.databases)
+	if docResc != paths.RESOURCE_DOC {
+		return nil, false
+	}
+	holder, ok := interface{}(doc).(interfaces.ICollectionHolder)
+	return holder, ok
+}
+
+// Finds the database or collection at the truncated request path.
+func (d *Dbhandler) collectionAt(request string) (interfaces.ICollection, bool) {
+	coll, _, resc := paths.GetResourceFromPath(request, d.databases)
+	if resc != paths.RESOURCE_DB && resc != paths.RESOURCE_COLL {
+		return nil, false
+	}
+	return coll, true
+}
@@ -0,0 +1,204 @@
+package dbhandler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/authorization"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/errorMessage"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/paths"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/structs"
+)
+
+// Enforces roles on all future requests handled by d, so that
+// users may only do what their role on a database allows.
+// Without roles, every user may do anything.
+func (d *Dbhandler) EnforceRoles(roles *authorization.Roles) {
+	d.roles = roles
+}
+
+// Tells if the role of username allows the request. If not,
+// writes a 403 error to the client.
+func (d *Dbhandler) authorize(w http.ResponseWriter, r *http.Request, username string) bool {
+	if d.roles == nil {
+		return true
+	}
+
+	db, role := requiredRole(r)
+	if db == "" || d.roles.Allows(username, db, role) {
+		return true
+	}
+
+	slog.Info("User lacks role for request", "user", username, "db", db, "role", role, "path", r.URL.Path)
+	msg := fmt.Sprintf("Forbidden: %s role on %s required", role, db)
+	errorMessage.Respond(w, r, msg, http.StatusForbidden)
+	return false
+}
+
+// Finds the database a request is to and the least role on it
+// which allows the request. The database is "" for requests which
+// are not to a database, or are checked elsewhere.
+func requiredRole(r *http.Request) (string, string) {
+	if paths.IsServerSchemaRequest(r.URL.Path) {
+		return authorization.ALL_DATABASES, authorization.ROLE_ADMIN
+	}
+	if paths.IsWebSocketRequest(r.URL.Path) {
+		// Checked for each subscription
+		return "", authorization.ROLE_NONE
+	}
+	if docPath, isCollections := paths.CutCollectionsRequest(r.URL.Path); isCollections && docPath == "" {
+		// Databases the user may not read are left out of the listing
+		return "", authorization.ROLE_NONE
+	}
+
+	db := paths.DatabaseOf(r.URL.Path)
+	_, _, isRoles := paths.CutRolesRequest(r.URL.Path)
+	_, _, isIndex := paths.CutIndexRequest(r.URL.Path)
+	_, _, resc := paths.CutRequest(r.URL.Path)
+	switch {
+	case isRoles:
+		return db, authorization.ROLE_ADMIN
+	case r.Method == http.MethodGet:
+		return db, authorization.ROLE_READER
+	case isIndex || resc == paths.RESOURCE_DB_PD:
+		return db, authorization.ROLE_ADMIN
+	default:
+		return db, authorization.ROLE_WRITER
+	}
+}
+
+// Top-level roles handler
+//
+// Handles GET, PUT and DELETE on /v1/<db>/_roles/<user>, where a PUT
+// body of the form {"role": "writer"} gives the user a role on the
+// database, and a DELETE takes it away. A GET on /v1/<db>/_roles/
+// lists the roles given on the database. The database "*" stands for
+// every database. Only admins of the database may use it.
+func (d *Dbhandler) rolesHandler(w http.ResponseWriter, r *http.Request, db string, user string) {
+	if d.roles == nil {
+		slog.Info("Roles request without roles enforced", "path", r.URL.Path)
+		errorMessage.Respond(w, r, "Roles are not enforced on this server", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		d.getRoles(w, r, db, user)
+	case http.MethodPut:
+		d.putRole(w, r, db, user)
+	case http.MethodDelete:
+		d.deleteRole(w, r, db, user)
+	default:
+		slog.Info("User used unsupported method on roles", "method", r.Method)
+		msg := fmt.Sprintf("unsupported method on roles: %s", r.Method)
+		errorMessage.Respond(w, r, msg, http.StatusBadRequest)
+	}
+}
+
+// Specific handler for GET roles (list roles, or get the role of a single user)
+func (d *Dbhandler) getRoles(w http.ResponseWriter, r *http.Request, db string, user string) {
+	users := d.roles.Users(db)
+
+	var output interface{}
+	if user == "" {
+		specs := make([]structs.RoleSpec, 0, len(users))
+		for name, role := range users {
+			specs = append(specs, structs.RoleSpec{User: name, Role: role})
+		}
+		sort.Slice(specs, func(i, j int) bool {
+			return specs[i].User < specs[j].User
+		})
+		output = specs
+	} else {
+		role, found := users[user]
+		if !found {
+			slog.Info("Role does not exist", "path", r.URL.Path)
+			errorMessage.Respond(w, r, "User has no role on database", http.StatusNotFound)
+			return
+		}
+		output = structs.RoleSpec{User: user, Role: role}
+	}
+
+	jsonResponse, err := json.Marshal(output)
+	if err != nil {
+		// This should never happen
+		slog.Error("GET roles: marshal error", "error", err)
+		errorMessage.Respond(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonResponse)
+}
+
+// Specific handler for PUT role (give a user a role)
+func (d *Dbhandler) putRole(w http.ResponseWriter, r *http.Request, db string, user string) {
+	if user == "" {
+		slog.Info("PUT role without a user", "path", r.URL.Path)
+		errorMessage.Respond(w, r, "Missing user name", http.StatusBadRequest)
+		return
+	}
+
+	// Read body of requests
+	body, err := io.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		slog.Error("PUT role: error reading the request body", "error", err)
+		errorMessage.Respond(w, r, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var spec structs.RoleSpec
+	err = json.Unmarshal(body, &spec)
+	if err != nil || spec.Role == authorization.ROLE_NONE || !authorization.IsRole(spec.Role) {
+		slog.Info("PUT role: bad role format", "error", err)
+		errorMessage.Respond(w, r, "invalid role format, expected {\"role\": \"reader\", \"writer\" or \"admin\"}", http.StatusBadRequest)
+		return
+	}
+
+	replaced, err := d.roles.Assign(user, db, spec.Role)
+	if err != nil {
+		slog.Error("PUT role: could not save roles", "error", err)
+		errorMessage.Respond(w, r, "could not save roles", http.StatusInternalServerError)
+		return
+	}
+
+	jsonResponse, err := json.Marshal(structs.PutOutput{Uri: r.URL.Path})
+	if err != nil {
+		// This should never happen
+		slog.Error("PUT role: marshal error", "error", err)
+		errorMessage.Respond(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Location", r.URL.Path)
+	if replaced {
+		slog.Info("Replaced role", "path", r.URL.Path, "role", spec.Role)
+		w.WriteHeader(http.StatusOK)
+	} else {
+		slog.Info("Created role", "path", r.URL.Path, "role", spec.Role)
+		w.WriteHeader(http.StatusCreated)
+	}
+	w.Write(jsonResponse)
+}
+
+// Specific handler for DELETE role (take a user's role away)
+func (d *Dbhandler) deleteRole(w http.ResponseWriter, r *http.Request, db string, user string) {
+	existed, err := d.roles.Assign(user, db, authorization.ROLE_NONE)
+	if err != nil {
+		slog.Error("DELETE role: could not save roles", "error", err)
+		errorMessage.Respond(w, r, "could not save roles", http.StatusInternalServerError)
+		return
+	}
+	if !existed {
+		slog.Info("Role does not exist", "path", r.URL.Path)
+		errorMessage.Respond(w, r, "User has no role on database", http.StatusNotFound)
+		return
+	}
+
+	slog.Info("Deleted role", "path", r.URL.Path)
+	w.WriteHeader(http.StatusNoContent)
+}
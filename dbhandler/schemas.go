@@ -0,0 +1,156 @@
+package dbhandler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/collection"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/errorMessage"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/interfaces"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/paths"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/structs"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// Creates a database or collection from the body of a PUT request,
+// which is empty or a structs.CollectionSpec, giving it a schema of
+// its own, ownership rules and, for a database, a quota if the body
+// has them. On error, writes a response and returns false.
+func (d *Dbhandler) newCollection(w http.ResponseWriter, r *http.Request) (collection.Collection, bool) {
+	coll := collection.New()
+
+	// Read body of requests
+	body, err := io.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		slog.Error("Put collection: error reading the request body", "error", err)
+		errorMessage.Respond(w, r, "invalid request body", http.StatusBadRequest)
+		return coll, false
+	}
+	if len(strings.TrimSpace(string(body))) == 0 {
+		return coll, true
+	}
+
+	var spec structs.CollectionSpec
+	err = json.Unmarshal(body, &spec)
+	if err != nil {
+		slog.Info("Put collection: bad collection format", "error", err)
+		errorMessage.Respond(w, r, "invalid collection format, expected {\"schema\": {...}, \"owners\": {...}, \"quota\": {...}}", http.StatusBadRequest)
+		return coll, false
+	}
+	if spec.Schema != nil {
+		err = coll.SetSchema(spec.Schema)
+		if err != nil {
+			slog.Info("Put collection: invalid schema", "error", err)
+			errorMessage.Respond(w, r, "invalid schema: "+err.Error(), http.StatusBadRequest)
+			return coll, false
+		}
+	}
+	if spec.Owners != nil {
+		coll.SetOwnerRules(*spec.Owners)
+	}
+	if spec.Quota != nil {
+		_, _, resc := paths.CutRequest(r.URL.Path)
+		if resc != paths.RESOURCE_DB_PD {
+			slog.Info("Put collection: quota on a collection", "path", r.URL.Path)
+			errorMessage.Respond(w, r, "only databases may have a quota", http.StatusBadRequest)
+			return coll, false
+		}
+		if spec.Quota.MaxDocuments < 0 || spec.Quota.MaxBytes < 0 || spec.Quota.MaxDepth < 0 {
+			slog.Info("Put collection: negative quota", "path", r.URL.Path)
+			errorMessage.Respond(w, r, "quota limits must not be negative", http.StatusBadRequest)
+			return coll, false
+		}
+		coll.SetQuota(*spec.Quota)
+	}
+
+	return coll, true
+}
+
+// Finds the schema documents in the database or collection at collPath
+// must conform to: that of the innermost enclosing collection with a
+// schema of its own, or else the schema of the server.
+func (d *Dbhandler) schemaFor(collPath string) *jsonschema.Schema {
+	schema := d.schema
+
+	path, found := strings.CutPrefix(collPath, "/v1/")
+	if !found {
+		return schema
+	}
+	resources := strings.Split(strings.TrimSuffix(path, "/"), "/")
+
+	// Collections are at even positions, documents at odd ones
+	var holder interfaces.ICollectionHolder = d.databases
+	for i := 0; i < len(resources); i += 2 {
+		coll, found := holder.GetCollection(resources[i])
+		if !found {
+			return schema
+		}
+		schematized, ok := interface{}(coll).(interfaces.Schematized)
+		if ok {
+			own, _ := schematized.GetSchema()
+			if own != nil {
+				schema = own
+			}
+		}
+
+		if i+1 >= len(resources) {
+			break
+		}
+		doc, found := coll.FindDocument(resources[i+1])
+		if !found {
+			return schema
+		}
+		holder, ok = interface{}(doc).(interfaces.ICollectionHolder)
+		if !ok {
+			return schema
+		}
+	}
+
+	return schema
+}
+
+// Top-level schema handler
+//
+// Handles GET <collection path>/_schema, which responds with the
+// schema of the database or collection, or null with inherited set
+// if it has none of its own.
+func (d *Dbhandler) getSchema(w http.ResponseWriter, r *http.Request, collPath string) {
+	if r.Method != http.MethodGet {
+		slog.Info("User used unsupported method on schema", "method", r.Method)
+		msg := fmt.Sprintf("unsupported method on schema: %s", r.Method)
+		errorMessage.Respond(w, r, msg, http.StatusBadRequest)
+		return
+	}
+
+	coll, found := d.collectionAt(collPath)
+	if !found {
+		slog.Info("Schema: collection does not exist", "path", collPath)
+		errorMessage.Respond(w, r, "Collection does not exist", http.StatusNotFound)
+		return
+	}
+
+	output := structs.SchemaOutput{Uri: r.URL.Path, Schema: json.RawMessage("null"), Inherited: true}
+	schematized, ok := interface{}(coll).(interfaces.Schematized)
+	if ok {
+		_, source := schematized.GetSchema()
+		if source != nil {
+			output.Schema = source
+			output.Inherited = false
+		}
+	}
+
+	jsonResponse, err := json.Marshal(output)
+	if err != nil {
+		// This should never happen
+		slog.Error("Schema: marshal error", "error", err)
+		errorMessage.Respond(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonResponse)
+}
@@ -0,0 +1,318 @@
+package dbhandler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/document"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/errorMessage"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/interfaces"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/patcher"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/paths"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/structs"
+)
+
+// The operations of a transaction.
+const (
+	TX_PUT    = "put"
+	TX_PATCH  = "patch"
+	TX_DELETE = "delete"
+)
+
+// A staged document holds the state of one document
+// as the operations of a transaction are checked.
+type stagedDoc struct {
+	uri      string                 // The full path of the document.
+	coll     interfaces.ICollection // The database or collection holding the document.
+	name     string                 // The name of the document in its collection.
+	existing interfaces.IDocument   // The document before the transaction, or nil if there was none.
+	body     interface{}            // The body of the document after the operations so far.
+	absent   bool                   // Whether the document does not exist after the operations so far.
+}
+
+// A transaction error is an error staging a transaction, with
+// the status code to respond with.
+type transactionError struct {
+	code    int    // The HTTP status code of the error.
+	msg     string // The message of the error.
+	invalid error  // The error from validating a document against its schema, if that failed.
+}
+
+// Returns the message of this error.
+func (e *transactionError) Error() string {
+	return e.msg
+}
+
+// Creates a transaction error for the operation with index i.
+func txErrorf(code int, i int, format string, args ...any) *transactionError {
+	return &transactionError{code, fmt.Sprintf("operation %d: %s", i, fmt.Sprintf(format, args...)), nil}
+}
+
+// Creates a transaction error for the operation with index i, whose
+// document did not conform to its schema.
+func txInvalid(i int, format string, err error) *transactionError {
+	txErr := txErrorf(http.StatusBadRequest, i, format, err.Error())
+	txErr.invalid = err
+	return txErr
+}
+
+// Handles a mutating request without a write-ahead log. Transactions,
+// schema replacements and index changes hold the write lock alone, so
+// that no other write can interleave with them, while other writes may
+// run concurrently with each other.
+func (d *Dbhandler) serveLocked(w http.ResponseWriter, r *http.Request, username string) {
+	_, isTransaction := paths.CutTransactionRequest(r.URL.Path)
+	_, _, isIndex := paths.CutIndexRequest(r.URL.Path)
+	if isTransaction || isIndex || paths.IsServerSchemaRequest(r.URL.Path) {
+		d.writeLock.Lock()
+		defer d.writeLock.Unlock()
+	} else {
+		d.writeLock.RLock()
+		defer d.writeLock.RUnlock()
+	}
+
+	d.serve(w, r, username)
+}
+
+// Top-level transaction handler
+//
+// Handles POST /v1/<db>/_transaction, whose body lists put, patch and
+// delete operations on documents of the database. Either every
+// operation is applied, or none are: all of them are checked against
+// the documents, their lastModifiedAt preconditions and the schema
+// before any change is made. Subscribers are notified once per
+// changed document after the transaction is committed.
+//
+// Must be called with the write lock held exclusively.
+func (d *Dbhandler) transaction(w http.ResponseWriter, r *http.Request, dbName string, username string) {
+	if r.Method != http.MethodPost {
+		slog.Info("User used unsupported method on transaction", "method", r.Method)
+		msg := fmt.Sprintf("unsupported method on transaction: %s", r.Method)
+		errorMessage.Respond(w, r, msg, http.StatusBadRequest)
+		return
+	}
+
+	// Read body of requests
+	body, err := io.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		slog.Error("Transaction: error reading the request body", "error", err)
+		errorMessage.Respond(w, r, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var input structs.TransactionInput
+	err = json.Unmarshal(body, &input)
+	if err != nil || len(input.Operations) == 0 {
+		slog.Info("Transaction: bad transaction format", "error", err)
+		errorMessage.Respond(w, r, "invalid transaction format, expected {\"operations\": [...]}", http.StatusBadRequest)
+		return
+	}
+
+	staged, txErr := d.stageTransaction(dbName, input.Operations, username)
+	if txErr == nil {
+		txErr = d.reserveTransaction(dbName, staged)
+	}
+	if txErr != nil {
+		slog.Info("Transaction aborted", "db", dbName, "error", txErr.msg)
+		if txErr.invalid != nil {
+			errorMessage.RespondInvalid(w, r, "Transaction aborted: "+txErr.msg, txErr.invalid, txErr.code)
+		} else {
+			errorMessage.Respond(w, r, "Transaction aborted: "+txErr.msg, txErr.code)
+		}
+		return
+	}
+
+	output := structs.TransactionOutput{Uri: r.URL.Path, Results: d.commitTransaction(staged, username)}
+	jsonResponse, err := json.Marshal(output)
+	if err != nil {
+		// This should never happen
+		slog.Error("Transaction: marshal error", "error", err)
+		errorMessage.Respond(w, r, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	slog.Info("Committed transaction", "db", dbName, "operations", len(input.Operations))
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonResponse)
+}
+
+// Checks the operations of a transaction on the database dbName and
+// works out the resulting state of every document they touch, without
+// changing anything, as username. Returns the staged documents in order
+// of first use.
+func (d *Dbhandler) stageTransaction(dbName string, ops []structs.TransactionOp, username string) ([]*stagedDoc, *transactionError) {
+	byURI := make(map[string]*stagedDoc)
+	order := make([]*stagedDoc, 0)
+
+	for i, op := range ops {
+		uri := "/v1/" + dbName + op.Path
+		parentPath, name, resc := paths.CutRequest(uri)
+		if !strings.HasPrefix(op.Path, "/") || resc != paths.RESOURCE_DOC {
+			return nil, txErrorf(http.StatusBadRequest, i, "%q is not a document path", op.Path)
+		}
+
+		doc, found := byURI[uri]
+		if !found {
+			// Writing a document wipes its collections, so operations
+			// on a document and its descendants cannot be combined
+			for _, other := range order {
+				if strings.HasPrefix(uri, other.uri+"/") || strings.HasPrefix(other.uri, uri+"/") {
+					return nil, txErrorf(http.StatusBadRequest, i, "%s overlaps %s", uri, other.uri)
+				}
+			}
+
+			coll, found := d.collectionAt(parentPath)
+			if !found {
+				return nil, txErrorf(http.StatusNotFound, i, "collection of %s does not exist", uri)
+			}
+
+			doc = &stagedDoc{uri: uri, coll: coll, name: name, absent: true}
+			existing, exists := coll.FindDocument(name)
+			if exists && ownerRules(coll).OwnerWrite && !d.isOwner(existing, username, dbName) {
+				return nil, txErrorf(http.StatusForbidden, i, "only the creator of %s may change it", uri)
+			}
+			if exists {
+				doc.existing = existing
+				doc.body = existing.GetJSONDoc()
+				doc.absent = false
+			}
+			byURI[uri] = doc
+			order = append(order, doc)
+		}
+
+		// Preconditions are on the documents as they were before the transaction
+		if op.LastModifiedAt != nil {
+			meta, hasMeta := interface{}(doc.existing).(interfaces.HasMetadata)
+			if doc.existing == nil || !hasMeta || meta.GetLastModified() != *op.LastModifiedAt {
+				return nil, txErrorf(http.StatusPreconditionFailed, i, "%s was modified", uri)
+			}
+		}
+
+		if doc.existing != nil && op.Op != TX_DELETE {
+			_, canOverwrite := interface{}(doc.existing).(interfaces.Overwriteable)
+			if !canOverwrite {
+				return nil, txErrorf(http.StatusBadRequest, i, "%s cannot be overwritten", uri)
+			}
+		}
+
+		switch op.Op {
+		case TX_PUT:
+			_, isObject := op.Doc.(map[string]interface{})
+			if !isObject {
+				return nil, txErrorf(http.StatusBadRequest, i, "document must be an object")
+			}
+			err := d.schemaFor(parentPath).Validate(op.Doc)
+			if err != nil {
+				return nil, txInvalid(i, "document did not conform to schema: %s", err)
+			}
+			doc.body = op.Doc
+			doc.absent = false
+		case TX_PATCH:
+			if doc.absent {
+				return nil, txErrorf(http.StatusNotFound, i, "%s does not exist", uri)
+			}
+			newBody := doc.body
+			for j, patch := range op.Patches {
+				var err error
+				newBody, err = patcher.ApplyPatch(newBody, patch)
+				if err != nil {
+					return nil, txErrorf(http.StatusBadRequest, i, "patch %d: %s", j, err.Error())
+				}
+			}
+			err := d.schemaFor(parentPath).Validate(newBody)
+			if err != nil {
+				return nil, txInvalid(i, "patched document did not conform to schema: %s", err)
+			}
+			doc.body = newBody
+		case TX_DELETE:
+			if doc.absent {
+				return nil, txErrorf(http.StatusNotFound, i, "%s does not exist", uri)
+			}
+			doc.body = nil
+			doc.absent = true
+		default:
+			return nil, txErrorf(http.StatusBadRequest, i, "unknown operation %q", op.Op)
+		}
+	}
+
+	return order, nil
+}
+
+// Applies the staged documents of a checked transaction, then notifies
+// subscribers of the changes. Returns the changed documents.
+func (d *Dbhandler) commitTransaction(staged []*stagedDoc, username string) []structs.TransactionResult {
+	results := make([]structs.TransactionResult, 0, len(staged))
+	changed := make([]*stagedDoc, 0, len(staged))
+
+	for _, doc := range staged {
+		if doc.absent {
+			if doc.existing == nil {
+				// Created and deleted within the transaction
+				continue
+			}
+			doc.coll.RemoveDocument(doc.name)
+		} else if doc.existing != nil {
+			// Checked when staged
+			overwrite := interface{}(doc.existing).(interfaces.Overwriteable)
+			overwrite.OverwriteBody(doc.body, username)
+			doc.coll.RestoreDocument(doc.name, doc.existing)
+		} else {
+			newDoc := document.New(paths.GetRelativePathNonDB(doc.uri), username, doc.body)
+			doc.coll.RestoreDocument(doc.name, &newDoc)
+		}
+
+		results = append(results, structs.TransactionResult{Uri: doc.uri, Deleted: doc.absent})
+		changed = append(changed, doc)
+	}
+
+	notifyTransaction(changed)
+
+	return results
+}
+
+// Notifies the subscribers of the documents changed by a transaction,
+// and of their collections. Those below deleted documents are told of
+// their deletion too.
+func notifyTransaction(changed []*stagedDoc) {
+	for _, doc := range changed {
+		collsub, collOK := interface{}(doc.coll).(interfaces.Subscribable)
+
+		if doc.absent {
+			deletable, ok := interface{}(doc.existing).(interfaces.Deletable)
+			if ok {
+				deletable.NotifySubtreeDeleted(doc.uri)
+			}
+			if collOK {
+				collsub.NotifySubscribersDelete(doc.uri, doc.name)
+			}
+			continue
+		}
+
+		current, found := doc.coll.FindDocument(doc.name)
+		if !found {
+			// Deleted since the transaction committed
+			continue
+		}
+		updateMSG, err := json.Marshal(current.GetRawBody())
+		if err != nil {
+			// This should never happen
+			slog.Error("Transaction: error marshaling notification", "error", err)
+			continue
+		}
+
+		if doc.existing != nil {
+			docsub, ok := interface{}(doc.existing).(interfaces.Subscribable)
+			if ok {
+				docsub.NotifySubscribersUpdate(updateMSG, "")
+			}
+		}
+		if collOK {
+			collsub.NotifySubscribersUpdate(updateMSG, doc.name)
+		}
+	}
+}
@@ -0,0 +1,331 @@
+package dbhandler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/authorization"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/errorMessage"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/interfaces"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/paths"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/ratelimit"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/structs"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/subscribe"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/websocket"
+)
+
+// The types of messages on a WebSocket connection.
+const (
+	WS_SUBSCRIBE    = "subscribe"
+	WS_UNSUBSCRIBE  = "unsubscribe"
+	WS_ACK          = "ack"
+	WS_SUBSCRIBED   = "subscribed"
+	WS_UNSUBSCRIBED = "unsubscribed"
+	WS_RESYNC       = "resync"
+	WS_ERROR        = "error"
+)
+
+// How often pings are sent to keep a WebSocket connection open.
+const WS_PING_INTERVAL = 15 * time.Second
+
+// A WebSocket session serves the subscriptions of one connection.
+type wsSession struct {
+	conn     *websocket.Conn            // The connection to the client.
+	username string                     // The user who opened the connection.
+	ctx      context.Context            // Cancelled when the connection closes.
+	mu       *sync.Mutex                // Guards subs.
+	subs     map[string]*wsSubscription // The subscriptions, by the client's id.
+}
+
+// A WebSocket subscription is one subscription of a session.
+type wsSubscription struct {
+	id         string                // The client's id for the subscription.
+	queries    url.Values            // The interval and filter of the subscription.
+	streamable interfaces.Streamable // The document or collection subscribed to.
+	acked      *atomic.Uint64        // The last event the client acknowledged.
+	stop       chan struct{}         // Closed when the client unsubscribes.
+}
+
+// Top-level WebSocket handler
+//
+// Handles GET /v1/_ws, upgrading the connection to a WebSocket on which
+// the client subscribes to any number of documents and collections.
+// Messages are JSON objects with a type and the client's id for a
+// subscription:
+//
+//	{"type":"subscribe","id":"s1","path":"/v1/db/col/","interval":"[a,z]","filter":"...","lastEventId":"..."}
+//	{"type":"unsubscribe","id":"s1"}
+//	{"type":"ack","id":"s1","eventId":"..."}
+//
+// The server answers with subscribed and unsubscribed messages, and
+// sends update and delete events as SSE subscriptions would, each with
+// an eventId but for the documents sent first, of which only the last
+// has one. If a subscription falls too far behind, it is resent
+// from the last acknowledged event (or in full) after a resync message.
+// Once the resource subscribed to is deleted, the server sends its last
+// events and an unsubscribed message.
+// Browsers, which cannot set headers on the handshake, may pass their
+// token in the access_token query parameter. When roles are enforced,
+// subscribing needs the reader role on the database subscribed to.
+// When rates are limited, each subscribe message is a subscription.
+func (d *Dbhandler) webSocket(w http.ResponseWriter, r *http.Request, username string) {
+	conn, err := websocket.Upgrade(w, r)
+	if err != nil {
+		slog.Info("WebSocket: bad handshake", "error", err)
+		errorMessage.Respond(w, r, "Bad WebSocket handshake: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	session := &wsSession{conn, username, ctx, &sync.Mutex{}, make(map[string]*wsSubscription)}
+	defer func() {
+		cancel()
+		conn.Close()
+	}()
+
+	go session.ping()
+
+	slog.Info("WebSocket: connection opened")
+	for {
+		opcode, data, err := conn.ReadMessage()
+		if err != nil {
+			slog.Info("WebSocket: connection closed", "error", err)
+			return
+		}
+
+		var request structs.WSRequest
+		if opcode != websocket.OP_TEXT || json.Unmarshal(data, &request) != nil {
+			session.send(structs.WSMessage{Type: WS_ERROR, Message: "messages must be JSON objects"})
+			continue
+		}
+
+		switch request.Type {
+		case WS_SUBSCRIBE:
+			d.wsSubscribe(session, request)
+		case WS_UNSUBSCRIBE:
+			session.unsubscribe(request)
+		case WS_ACK:
+			session.ack(request)
+		default:
+			session.send(structs.WSMessage{Type: WS_ERROR, Id: request.Id, Message: "unknown message type: " + request.Type})
+		}
+	}
+}
+
+// Handles a subscribe message, subscribing to the document or
+// collection at the path of request.
+func (d *Dbhandler) wsSubscribe(session *wsSession, request structs.WSRequest) {
+	if request.Id == "" {
+		session.send(structs.WSMessage{Type: WS_ERROR, Message: "subscriptions need an id"})
+		return
+	}
+	if d.limiter != nil {
+		decision := d.limiter.Take(session.username, ratelimit.KIND_SUBSCRIBE)
+		if !decision.Allowed {
+			msg := fmt.Sprintf("too many subscribe requests, retry after %d seconds", retrySeconds(decision.RetryAfter))
+			session.send(structs.WSMessage{Type: WS_ERROR, Id: request.Id, Message: msg})
+			return
+		}
+	}
+	db := paths.DatabaseOf(request.Path)
+	if d.roles != nil && !d.roles.Allows(session.username, db, authorization.ROLE_READER) {
+		session.send(structs.WSMessage{Type: WS_ERROR, Id: request.Id, Message: "forbidden: reader role on " + db + " required"})
+		return
+	}
+
+	queries := url.Values{}
+	if request.Interval != "" {
+		queries.Set("interval", request.Interval)
+	}
+	if request.Filter != "" {
+		queries.Set("filter", request.Filter)
+	}
+
+	var resource interface{}
+	coll, doc, resc := paths.GetResourceFromPath(request.Path, d.databases)
+	switch resc {
+	case paths.RESOURCE_DB, paths.RESOURCE_COLL:
+		err := d.restrictToOwner(queries, request.Path, coll, session.username)
+		if err != nil {
+			session.send(structs.WSMessage{Type: WS_ERROR, Id: request.Id, Message: "bad filter: " + err.Error()})
+			return
+		}
+		resource = coll
+	case paths.RESOURCE_DOC:
+		if !d.mayRead(request.Path, doc, session.username) {
+			session.send(structs.WSMessage{Type: WS_ERROR, Id: request.Id, Message: "forbidden: only the creator of " + request.Path + " may read it"})
+			return
+		}
+		resource = doc
+	default:
+		session.send(structs.WSMessage{Type: WS_ERROR, Id: request.Id, Message: "no document or collection at " + request.Path})
+		return
+	}
+	streamable, ok := resource.(interfaces.Streamable)
+	if !ok {
+		session.send(structs.WSMessage{Type: WS_ERROR, Id: request.Id, Message: "cannot subscribe to " + request.Path})
+		return
+	}
+
+	sub := &wsSubscription{request.Id, queries, streamable, &atomic.Uint64{}, make(chan struct{})}
+
+	session.mu.Lock()
+	_, exists := session.subs[request.Id]
+	if !exists {
+		session.subs[request.Id] = sub
+	}
+	session.mu.Unlock()
+	if exists {
+		session.send(structs.WSMessage{Type: WS_ERROR, Id: request.Id, Message: "subscription id already in use"})
+		return
+	}
+
+	subscription, initial, err := streamable.SubscribeEvents(session.ctx, queries, request.LastEventId)
+	if err != nil {
+		session.remove(request.Id)
+		session.send(structs.WSMessage{Type: WS_ERROR, Id: request.Id, Message: err.Error()})
+		return
+	}
+
+	slog.Info("WebSocket: subscribed", "id", request.Id, "path", request.Path, "resumed", subscription.Resumed)
+	session.send(structs.WSMessage{Type: WS_SUBSCRIBED, Id: request.Id, Resumed: subscription.Resumed})
+	go session.forward(sub, subscription, initial)
+}
+
+// Sends the initial events, then the events of a subscription, until
+// the client unsubscribes, the connection closes, or the resource is
+// deleted. Resubscribes from the last acknowledged event if the
+// subscription falls behind.
+func (s *wsSession) forward(sub *wsSubscription, subscription *subscribe.Subscription, initial []subscribe.Event) {
+	for {
+		for _, event := range initial {
+			s.sendEvent(sub.id, event)
+		}
+
+		select {
+		case <-sub.stop:
+			subscription.Cancel()
+			return
+		case <-s.ctx.Done():
+			subscription.Cancel()
+			return
+		case <-subscription.Lagged():
+			subscription.Cancel()
+
+			lastEventID := ""
+			if acked := sub.acked.Load(); acked != 0 {
+				lastEventID = strconv.FormatUint(acked, 10)
+			}
+			var err error
+			subscription, initial, err = sub.streamable.SubscribeEvents(s.ctx, sub.queries, lastEventID)
+			if err != nil {
+				s.remove(sub.id)
+				s.send(structs.WSMessage{Type: WS_ERROR, Id: sub.id, Message: err.Error()})
+				return
+			}
+			s.send(structs.WSMessage{Type: WS_RESYNC, Id: sub.id, Resumed: subscription.Resumed})
+		case <-subscription.Ended():
+			// Send the last events, such as the deletion, before unsubscribing
+			subscription.Cancel()
+			for _, event := range subscription.Pending() {
+				s.sendEvent(sub.id, event)
+			}
+			_, found := s.remove(sub.id)
+			if found {
+				s.send(structs.WSMessage{Type: WS_UNSUBSCRIBED, Id: sub.id})
+			}
+			return
+		case event := <-subscription.EventCh:
+			initial = []subscribe.Event{event}
+		}
+	}
+}
+
+// Handles an unsubscribe message.
+func (s *wsSession) unsubscribe(request structs.WSRequest) {
+	sub, found := s.remove(request.Id)
+	if !found {
+		s.send(structs.WSMessage{Type: WS_ERROR, Id: request.Id, Message: "no such subscription"})
+		return
+	}
+
+	close(sub.stop)
+	s.send(structs.WSMessage{Type: WS_UNSUBSCRIBED, Id: request.Id})
+}
+
+// Handles an ack message, recording the last event the client handled.
+func (s *wsSession) ack(request structs.WSRequest) {
+	s.mu.Lock()
+	sub, found := s.subs[request.Id]
+	s.mu.Unlock()
+	if !found {
+		s.send(structs.WSMessage{Type: WS_ERROR, Id: request.Id, Message: "no such subscription"})
+		return
+	}
+
+	for {
+		acked := sub.acked.Load()
+		if request.EventId <= acked || sub.acked.CompareAndSwap(acked, request.EventId) {
+			return
+		}
+	}
+}
+
+// Removes the subscription with the given id from this session.
+func (s *wsSession) remove(id string) (*wsSubscription, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sub, found := s.subs[id]
+	delete(s.subs, id)
+	return sub, found
+}
+
+// Sends an event of the subscription with the given id.
+func (s *wsSession) sendEvent(id string, event subscribe.Event) {
+	msg := structs.WSMessage{Type: event.Kind, Id: id, EventId: event.Id}
+	if event.Kind == subscribe.EVENT_DELETE {
+		msg.Path = string(event.Data)
+	} else {
+		msg.Data = event.Data
+	}
+	s.send(msg)
+}
+
+// Sends a message to the client.
+func (s *wsSession) send(msg structs.WSMessage) {
+	jsonMsg, err := json.Marshal(msg)
+	if err != nil {
+		// This should never happen
+		slog.Error("WebSocket: error marshaling message", "error", err)
+		return
+	}
+
+	err = s.conn.WriteMessage(websocket.OP_TEXT, jsonMsg)
+	if err != nil {
+		slog.Info("WebSocket: error sending message", "error", err)
+	}
+}
+
+// Pings the client until the connection closes.
+func (s *wsSession) ping() {
+	ticker := time.NewTicker(WS_PING_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			s.conn.WriteMessage(websocket.OP_PING, nil)
+		}
+	}
+}
@@ -4,16 +4,19 @@
 package document
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"net/url"
 	"time"
 
 	"github.com/RICE-COMP318-FALL23/owldb-p1group20/collectionholder"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group20/errorMessage"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group20/interfaces"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group20/patcher"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/skiplist"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group20/structs"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group20/subscribe"
 	"github.com/santhosh-tekuri/jsonschema/v5"
@@ -25,6 +28,7 @@ type meta struct {
 	CreatedAt      int64  `json:"createdAt"`      // The time this JSON document was created.
 	LastModifiedBy string `json:"lastModifiedBy"` // The last user who modified this JSON document.
 	LastModifiedAt int64  `json:"lastModifiedAt"` // The last time that this JSON document was modified.
+	Version        int    `json:"version"`        // The revision of this JSON document, counting from 1.
 }
 
 /*
@@ -38,17 +42,33 @@ type docoutput struct {
 }
 
 // A document is a document plus a concurrent
-// skip list of collections, and a slice of subscribers.
+// skip list of collections, and a stream of events for subscribers.
 type Document struct {
-	output      docoutput                          // The document held in this object with extra meta data.
-	children    *collectionholder.CollectionHolder // The set of collections this document holds.
-	subscribers []subscribe.Subscriber             // A slice of subscribers to this document.
+	output   docoutput                          // The document held in this object with extra meta data.
+	children *collectionholder.CollectionHolder // The set of collections this document holds.
+	stream   *subscribe.Stream                  // The events of this document, for subscribers.
+	history  *history                           // The earlier revisions of this document.
 }
 
 // Creates a new document.
 func New(path, user string, docBody interface{}) Document {
 	newH := collectionholder.New()
-	return Document{newOutput(path, user, docBody), &newH, make([]subscribe.Subscriber, 0)}
+	newS := subscribe.NewStream()
+	return Document{newOutput(path, user, docBody), &newH, &newS, &history{}}
+}
+
+// Recreates a document from its JSON output (the document
+// and its metadata), as recorded in the write-ahead log.
+func Restore(jsonBody []byte) (Document, error) {
+	var output docoutput
+	err := json.Unmarshal(jsonBody, &output)
+	if err != nil {
+		return Document{}, err
+	}
+
+	newH := collectionholder.New()
+	newS := subscribe.NewStream()
+	return Document{output, &newH, &newS, &history{}}, nil
 }
 
 // Create a new docoutput
@@ -58,32 +78,60 @@ func newOutput(path, user string, docBody interface{}) docoutput {
 
 // Create a new metadata
 func newMeta(user string) meta {
-	return meta{user, time.Now().UnixMilli(), user, time.Now().UnixMilli()}
+	return meta{user, time.Now().UnixMilli(), user, time.Now().UnixMilli(), 1}
 }
 
 // Handles a GET request that has a path pointing to this document.
+//
+// Earlier revisions are read with the history=true, version=N
+// and asOf=<ms since epoch> query parameters. In subscribe mode, a client
+// reconnecting with a Last-Event-ID header receives only the events it
+// missed, when they are still kept.
 func (d *Document) GetDocument(w http.ResponseWriter, r *http.Request) {
-	// Convert to JSON and send
-	jsonDoc, err := d.GetJSONBody()
-	if err != nil {
-		errorMessage.ErrorResponse(w, "internal server error", http.StatusInternalServerError)
+	if d.getHistory(w, r) {
 		return
 	}
 
 	// Subscribe mode
 	mode := r.URL.Query().Get("mode")
 	if mode == "subscribe" {
-		subscriber := subscribe.New()
-		d.subscribers = append(d.subscribers, subscriber)
-		go func() {
-			d.NotifySubscribersUpdate(jsonDoc, "")
-		}()
-		subscriber.ServeSubscriber(w, r)
-	} else {
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(jsonDoc)
-		slog.Info("GET: success")
+		subscription, initial, err := d.SubscribeEvents(r.Context(), r.URL.Query(), r.Header.Get("Last-Event-ID"))
+		if err != nil {
+			errorMessage.Respond(w, r, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer subscription.Cancel()
+		subscription.ServeSubscriber(w, r, initial)
+		return
+	}
+
+	// Convert to JSON and send
+	jsonDoc, err := d.GetJSONBody()
+	if err != nil {
+		errorMessage.Respond(w, r, "internal server error", http.StatusInternalServerError)
+		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonDoc)
+	slog.Info("GET: success")
+}
+
+// Subscribes to this document. Subscribes before reading the document,
+// so no change is missed. Returns the subscription and the events to
+// send first: those missed since lastEventID if the subscription
+// resumes, or else the current document. Does not use queries.
+func (d *Document) SubscribeEvents(ctx context.Context, queries url.Values, lastEventID string) (*subscribe.Subscription, []subscribe.Event, error) {
+	subscription := d.stream.Subscribe(nil, lastEventID)
+	if subscription.Resumed {
+		return subscription, subscription.Backlog, nil
+	}
+
+	jsonDoc, err := d.GetJSONBody()
+	if err != nil {
+		subscription.Cancel()
+		return nil, nil, err
+	}
+	return subscription, subscription.Updates([][]byte{jsonDoc}), nil
 }
 
 // Handles a PUT request that has a path pointing to this document.
@@ -101,9 +149,28 @@ func (d *Document) GetCollection(resource string) (interfaces.ICollection, bool)
 	return d.children.GetCollection(resource)
 }
 
-// Overwrite the body of a document upon recieving a put or patch.
+// Inserts a collection into this document if absent.
+func (d *Document) RestoreCollection(name string, newColl interfaces.ICollection) {
+	d.children.RestoreCollection(name, newColl)
+}
+
+// Removes a collection from this document.
+func (d *Document) RemoveCollection(name string) bool {
+	return d.children.RemoveCollection(name)
+}
+
+// Gets a consistent view of the collections in this document.
+func (d *Document) QueryCollections(ctx context.Context) ([]skiplist.Pair[string, interfaces.ICollection], error) {
+	return d.children.QueryCollections(ctx)
+}
+
+// Overwrite the body of a document upon recieving a put or patch,
+// keeping the previous body and metadata as a revision.
 func (d *Document) OverwriteBody(docBody interface{}, name string) {
+	d.history.push(d.output)
+
 	existingDocOutput := d.output
+	existingDocOutput.Meta.Version++
 	existingDocOutput.Meta.LastModifiedAt = time.Now().UnixMilli()
 	existingDocOutput.Meta.LastModifiedBy = name
 
@@ -118,6 +185,18 @@ func (d *Document) OverwriteBody(docBody interface{}, name string) {
 	d.children = &newChildren
 }
 
+// Saves the body, metadata, collections and history of this document,
+// returning a function which puts them back, used to undo a change
+// which could not be logged.
+func (d *Document) Save() func() {
+	output, children, revisions := d.output, d.children, d.history.list()
+	return func() {
+		d.output = output
+		d.children = children
+		d.history.set(revisions)
+	}
+}
+
 // Required for POST case.
 func (d *Document) AddNameToPath(name string) {
 	d.output.Path = d.output.Path + name
@@ -140,20 +219,49 @@ func (d *Document) ApplyPatches(patches []patcher.Patch, schema *jsonschema.Sche
 
 		if err != nil {
 			slog.Info("Patch failed", "num", i)
-			str := fmt.Sprintf("Error applying patches: %s", err.Error())
+			str := fmt.Sprintf("Error applying patch %d: %s", i, err.Error())
+			failed := i
 			ret.Message = str
 			ret.PatchFailed = true
+			ret.FailedOp = &failed
 			return ret, nil
 		}
 	}
 
+	return validatePatched(newdoc, schema)
+}
+
+// Applys a JSON merge patch to this document.
+// Returns a PatchResponse without the Uri field
+// set, expecting it to be set by caller.
+func (d *Document) ApplyMergePatch(patch interface{}, schema *jsonschema.Schema) (structs.PatchResponse, interface{}) {
+	slog.Info("Applying merge patch to document", "path", d.output.Path)
+	var ret structs.PatchResponse
+
+	newdoc, err := patcher.ApplyMergePatch(d.output.Doc, patch)
+	if err != nil {
+		slog.Info("Merge patch failed", "error", err)
+		ret.Message = fmt.Sprintf("Error applying merge patch: %s", err.Error())
+		ret.PatchFailed = true
+		return ret, nil
+	}
+
+	return validatePatched(newdoc, schema)
+}
+
+// Validates a patched document against the schema, and builds the
+// response to the patch.
+func validatePatched(newdoc interface{}, schema *jsonschema.Schema) (structs.PatchResponse, interface{}) {
+	var ret structs.PatchResponse
+
 	// Validates document against schema after patches have been applied.
-	err = schema.Validate(newdoc)
+	err := schema.Validate(newdoc)
 	if err != nil {
 		slog.Error("Patch document: patched document did not conform to schema", "error", err)
 		str := fmt.Sprintf("Patched document did not conform to schema: %s", err.Error())
 		ret.Message = str
 		ret.PatchFailed = true
+		ret.Invalid = err
 		return ret, nil
 	}
 
@@ -199,15 +307,38 @@ func (d *Document) GetJSONDoc() interface{} {
 // Implements Subscribable method. Notifies subscribers of update messages.
 // Does not use interval.
 func (d *Document) NotifySubscribersUpdate(msg []byte, intervalComp string) {
-	for _, sub := range d.subscribers {
-		sub.UpdateCh <- msg
-	}
+	d.stream.Publish(subscribe.EVENT_UPDATE, "", msg)
 }
 
-// Implements Subscribable method. Notifies subscribers of update messages.
+// Implements Subscribable method. Notifies subscribers of delete messages.
 // Does not use interval.
 func (d *Document) NotifySubscribersDelete(msg string, intervalComp string) {
-	for _, sub := range d.subscribers {
-		sub.DeleteCh <- msg
+	d.stream.Publish(subscribe.EVENT_DELETE, "", []byte(msg))
+}
+
+// Implements Deletable method. Notifies the subscribers of this document
+// and of the collections below it that they were deleted, then ends
+// their subscriptions.
+func (d *Document) NotifySubtreeDeleted(path string) (int, int) {
+	d.NotifySubscribersDelete(path, "")
+	documents, collections := 1, 0
+
+	pairs, err := d.children.QueryCollections(context.Background())
+	if err != nil {
+		// This should never happen without a deadline
+		slog.Error("Delete: error querying collections", "error", err)
 	}
+	for _, pair := range pairs {
+		deletable, ok := interface{}(pair.Value).(interfaces.Deletable)
+		if !ok {
+			collections++
+			continue
+		}
+		collDocuments, collCollections := deletable.NotifySubtreeDeleted(path + "/" + pair.Key + "/")
+		documents += collDocuments
+		collections += collCollections
+	}
+
+	d.stream.Close()
+	return documents, collections
 }
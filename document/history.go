@@ -0,0 +1,177 @@
+package document
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/errorMessage"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/interfaces"
+)
+
+// The number of earlier revisions kept for each document.
+const HISTORY_LIMIT = 50
+
+// A history holds the earlier revisions of a document, oldest first.
+type history struct {
+	mu        sync.Mutex  // Guards revisions.
+	revisions []docoutput // The earlier revisions of the document, oldest first.
+}
+
+// Records a revision which is being replaced, dropping the oldest
+// revisions beyond HISTORY_LIMIT.
+func (h *history) push(revision docoutput) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.revisions = append(h.revisions, revision)
+	if len(h.revisions) > HISTORY_LIMIT {
+		h.revisions = append([]docoutput(nil), h.revisions[len(h.revisions)-HISTORY_LIMIT:]...)
+	}
+}
+
+// Gets a copy of the earlier revisions, oldest first.
+func (h *history) list() []docoutput {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return append([]docoutput(nil), h.revisions...)
+}
+
+// Replaces the earlier revisions.
+func (h *history) set(revisions []docoutput) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.revisions = revisions
+}
+
+// Gets every kept revision of this document, oldest first,
+// ending with the current one.
+func (d *Document) revisions() []docoutput {
+	return append(d.history.list(), d.output)
+}
+
+// Handles a GET request for the history of this document, which
+// selects revisions with the history, version and asOf query parameters.
+// Returns false if the request is not for history.
+func (d *Document) getHistory(w http.ResponseWriter, r *http.Request) bool {
+	queries := r.URL.Query()
+
+	var output interface{}
+	if queries.Get("history") == "true" {
+		output = d.revisions()
+	} else if versionStr := queries.Get("version"); versionStr != "" {
+		version, err := strconv.Atoi(versionStr)
+		if err != nil {
+			slog.Info("Document GET: bad version", "version", versionStr)
+			errorMessage.Respond(w, r, "Bad version", http.StatusBadRequest)
+			return true
+		}
+
+		revision, found := d.findRevision(version)
+		if !found {
+			slog.Info("Document GET: version not kept", "version", version)
+			errorMessage.Respond(w, r, "Version does not exist", http.StatusNotFound)
+			return true
+		}
+		output = revision
+	} else if asOfStr := queries.Get("asOf"); asOfStr != "" {
+		asOf, err := strconv.ParseInt(asOfStr, 10, 64)
+		if err != nil {
+			slog.Info("Document GET: bad asOf", "asOf", asOfStr)
+			errorMessage.Respond(w, r, "Bad asOf", http.StatusBadRequest)
+			return true
+		}
+
+		// The revision as of a time is the last one written by then
+		revisions := d.revisions()
+		found := false
+		for i := len(revisions) - 1; i >= 0; i-- {
+			if revisions[i].Meta.LastModifiedAt <= asOf {
+				output = revisions[i]
+				found = true
+				break
+			}
+		}
+		if !found {
+			slog.Info("Document GET: no version as of time", "asOf", asOf)
+			errorMessage.Respond(w, r, "No version as of that time", http.StatusNotFound)
+			return true
+		}
+	} else {
+		return false
+	}
+
+	jsonResponse, err := json.Marshal(output)
+	if err != nil {
+		// This should never happen
+		slog.Error("Document GET: error marshaling history", "error", err)
+		errorMessage.Respond(w, r, "internal server error", http.StatusInternalServerError)
+		return true
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonResponse)
+	slog.Info("GET history: success")
+	return true
+}
+
+// Finds the revision of this document with the given version.
+func (d *Document) findRevision(version int) (docoutput, bool) {
+	for _, revision := range d.revisions() {
+		if revision.Meta.Version == version {
+			return revision, true
+		}
+	}
+	return docoutput{}, false
+}
+
+// Gets the body of the revision of this document with
+// the given version, if it is still kept.
+func (d *Document) GetRevision(version int) (interface{}, bool) {
+	revision, found := d.findRevision(version)
+	return revision.Doc, found
+}
+
+// Takes on the history of the document this one replaces, keeping
+// the revisions older than this one. Used when documents are restored
+// from the write-ahead log, so replaying a record twice is harmless.
+func (d *Document) InheritHistory(previous interfaces.IDocument) {
+	prev, ok := interface{}(previous).(*Document)
+	if !ok || prev == d {
+		return
+	}
+
+	revisions := make([]docoutput, 0)
+	for _, revision := range prev.revisions() {
+		if revision.Meta.Version < d.output.Meta.Version {
+			revisions = append(revisions, revision)
+		}
+	}
+	if len(revisions) > HISTORY_LIMIT {
+		revisions = revisions[len(revisions)-HISTORY_LIMIT:]
+	}
+	d.history.set(revisions)
+}
+
+// Encodes the earlier revisions of this document, for snapshots.
+func (d *Document) GetHistoryJSON() ([]byte, error) {
+	return json.Marshal(d.history.list())
+}
+
+// Decodes the earlier revisions of this document, for snapshots.
+func (d *Document) RestoreHistory(data []byte) error {
+	var revisions []docoutput
+	err := json.Unmarshal(data, &revisions)
+	if err != nil {
+		return err
+	}
+	if len(revisions) > HISTORY_LIMIT {
+		revisions = revisions[len(revisions)-HISTORY_LIMIT:]
+	}
+
+	d.history.set(revisions)
+	return nil
+}
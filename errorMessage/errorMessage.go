@@ -1,13 +1,41 @@
-// Package errorMessage has a helper function that writes error response
-// of JSON strings with the given input string and http code.
+// Package errorMessage has helper functions that write error responses,
+// either as JSON strings with the given input string and http code, or
+// as structured error bodies to clients which ask for them.
 package errorMessage
 
 import (
 	"encoding/json"
+	"errors"
 	"log/slog"
+	"mime"
 	"net/http"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
 )
 
+// The media type of structured error bodies. Clients which list it in
+// their Accept header get an ErrorBody instead of a bare JSON string.
+const ERROR_TYPE = "application/problem+json"
+
+// Error codes which are not derived from the status code of a response.
+const (
+	CODE_BAD_PATH         = "bad_path"
+	CODE_SCHEMA_VIOLATION = "schema_violation"
+	CODE_MISSING_TOKEN    = "missing_token"
+	CODE_EXPIRED_TOKEN    = "expired_token"
+	CODE_INVALID_TOKEN    = "invalid_token"
+)
+
+// An error body is the structured body of an error response.
+type ErrorBody struct {
+	Status  int                     `json:"status"`           // The HTTP status code of the response.
+	Code    string                  `json:"code"`             // A stable, machine-readable name for the error.
+	Message string                  `json:"message"`          // The message an old client gets as a string.
+	Path    string                  `json:"path"`             // The path of the request.
+	Causes  []jsonschema.BasicError `json:"causes,omitempty"` // Where and why a document does not conform to its schema.
+}
+
 // Writes error response of JSON strings with the given input string and http statusCode.
 func ErrorResponse(w http.ResponseWriter, str string, statusCode int) {
 	// Converts input string to JSON string
@@ -22,3 +50,74 @@ func ErrorResponse(w http.ResponseWriter, str string, statusCode int) {
 	w.WriteHeader(statusCode)
 	w.Write(jsonData)
 }
+
+// Writes an error response to request r with the given message and
+// http statusCode, with a code named after the status.
+func Respond(w http.ResponseWriter, r *http.Request, str string, statusCode int) {
+	RespondBody(w, r, ErrorBody{Status: statusCode, Code: codeOf(statusCode), Message: str})
+}
+
+// Writes an error response to request r with the given error code,
+// message and http statusCode.
+func RespondCode(w http.ResponseWriter, r *http.Request, code string, str string, statusCode int) {
+	RespondBody(w, r, ErrorBody{Status: statusCode, Code: code, Message: str})
+}
+
+// Writes an error response to request r for a document which did not
+// conform to its schema, listing the causes of err.
+func RespondInvalid(w http.ResponseWriter, r *http.Request, str string, err error, statusCode int) {
+	RespondBody(w, r, ErrorBody{Status: statusCode, Code: CODE_SCHEMA_VIOLATION, Message: str, Causes: ValidationCauses(err)})
+}
+
+// Writes body as the response to request r if the client accepts
+// structured errors, or else only its message as a JSON string.
+// The path of body is set to that of the request.
+func RespondBody(w http.ResponseWriter, r *http.Request, body ErrorBody) {
+	if !AcceptsStructured(r) {
+		ErrorResponse(w, body.Message, body.Status)
+		return
+	}
+
+	body.Path = r.URL.Path
+	jsonData, err := json.Marshal(body)
+	if err != nil {
+		// This should never happen.
+		slog.Error("error marshaling error response", "error", err)
+		http.Error(w, `"error marshaling error response"`, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", ERROR_TYPE)
+	w.WriteHeader(body.Status)
+	w.Write(jsonData)
+}
+
+// Tells if the client which made request r lists the structured
+// error media type in its Accept header.
+func AcceptsStructured(r *http.Request) bool {
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err == nil && mediaType == ERROR_TYPE {
+			return true
+		}
+	}
+	return false
+}
+
+// Lists where and why a document did not conform to its schema,
+// given the error from validating it.
+func ValidationCauses(err error) []jsonschema.BasicError {
+	var validationErr *jsonschema.ValidationError
+	if errors.As(err, &validationErr) {
+		return validationErr.BasicOutput().Errors
+	}
+	return []jsonschema.BasicError{{Error: err.Error()}}
+}
+
+// Names the error code of a status code, such as "not_found" for 404.
+func codeOf(statusCode int) string {
+	text := http.StatusText(statusCode)
+	if text == "" {
+		return "error"
+	}
+	return strings.ReplaceAll(strings.ToLower(text), " ", "_")
+}
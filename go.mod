@@ -2,8 +2,9 @@ module github.com/RICE-COMP318-FALL23/owldb-p1group20
 
 go 1.21.0
 
+require github.com/santhosh-tekuri/jsonschema/v5 v5.3.1
+
 require (
-	github.com/santhosh-tekuri/jsonschema/v5 v5.3.1 // indirect
 	github.com/yuin/goldmark v1.4.13 // indirect
 	golang.org/x/mod v0.13.0 // indirect
 	golang.org/x/sys v0.13.0 // indirect
@@ -0,0 +1,191 @@
+// Package index implements secondary indexes on the documents of a
+// collection. An index is a skip list keyed by the value at a JSON
+// pointer into each document's output, so that filter queries on
+// that pointer only visit the documents they can match.
+//
+// Keys are strings encoded so that their order matches the order of
+// the values they encode, and so that they fit in the key range of
+// a skiplist.SkipList. Only null, boolean, number and string values
+// are indexed; documents without a value at the pointer, or with an
+// array or object there, are left out of the index.
+package index
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"slices"
+	"sync"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/query"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/skiplist"
+)
+
+// The type tags leading every key, in the order values of each type sort.
+const (
+	TAG_NULL   = "1"
+	TAG_BOOL   = "2"
+	TAG_NUMBER = "3"
+	TAG_STRING = "4"
+)
+
+// Separates the encoded value of a key from the encoded document
+// name. It sorts before every hex digit, so shorter values come first.
+const SEPARATOR = " "
+
+// Sorts after every hex digit and the separator, bounding key ranges.
+const HIGH = "~"
+
+// An index maps the values at a pointer to the names of the
+// documents holding them.
+type Index struct {
+	field   string                             // The pointer this index is on.
+	tokens  []string                           // The reference tokens of the pointer.
+	mu      *sync.Mutex                        // Guards keys, so each document has at most one entry.
+	keys    map[string]string                  // The key of each indexed document, by document name.
+	entries *skiplist.SkipList[string, string] // The document names, by key.
+}
+
+// Creates a new, empty index on the pointer field.
+func New(field string) (Index, error) {
+	tokens, err := query.ParsePointer(field)
+	if err != nil {
+		return Index{}, err
+	}
+
+	entries := skiplist.New[string, string](skiplist.STRING_MIN, skiplist.STRING_MAX, skiplist.DEFAULT_LEVEL)
+	return Index{field, tokens, &sync.Mutex{}, make(map[string]string), &entries}, nil
+}
+
+// Returns the pointer this index is on.
+func (idx *Index) Field() string {
+	return idx.field
+}
+
+// Updates the entry of the document name, whose output is resource
+// (a JSON value, see query.ToJSON).
+func (idx *Index) Update(name string, resource any) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if old, found := idx.keys[name]; found {
+		idx.entries.Remove(old)
+		delete(idx.keys, name)
+	}
+
+	value, found := query.Lookup(resource, idx.tokens)
+	if !found {
+		return
+	}
+	prefix, ok := encodeValue(value)
+	if !ok {
+		return
+	}
+
+	key := prefix + SEPARATOR + hex.EncodeToString([]byte(name))
+	insert := func(key string, currValue string, exists bool) (string, error) {
+		return name, nil
+	}
+	idx.entries.Upsert(key, insert)
+	idx.keys[name] = key
+}
+
+// Removes the entry of the document name, if any.
+func (idx *Index) Remove(name string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if old, found := idx.keys[name]; found {
+		idx.entries.Remove(old)
+		delete(idx.keys, name)
+	}
+}
+
+// Finds the names of the documents which may satisfy cond. Returns
+// false if cond is not on the pointer of this index, or cannot be
+// answered from it.
+func (idx *Index) Lookup(ctx context.Context, cond query.Condition) ([]string, bool, error) {
+	if !slices.Equal(cond.Tokens, idx.tokens) {
+		return nil, false, nil
+	}
+
+	start, end, ok := bounds(cond)
+	if !ok {
+		return nil, false, nil
+	}
+
+	pairs, err := idx.entries.Query(ctx, start, end)
+	if err != nil {
+		return nil, true, err
+	}
+
+	names := make([]string, 0, len(pairs))
+	for _, pair := range pairs {
+		names = append(names, pair.Value)
+	}
+	return names, true, nil
+}
+
+// Finds the range of keys holding the values which satisfy cond.
+func bounds(cond query.Condition) (string, string, bool) {
+	prefix, ok := encodeValue(cond.Value)
+	if !ok {
+		return "", "", false
+	}
+	tag := prefix[:1]
+
+	switch cond.Op {
+	case "==":
+		return prefix + SEPARATOR, prefix + SEPARATOR + HIGH, true
+	}
+
+	// Ordering comparisons are only defined on numbers, strings and booleans
+	if tag == TAG_NULL {
+		return "", "", false
+	}
+
+	switch cond.Op {
+	case ">=":
+		return prefix + SEPARATOR, tag + HIGH, true
+	case ">":
+		return prefix + SEPARATOR + HIGH, tag + HIGH, true
+	case "<=":
+		return tag, prefix + SEPARATOR + HIGH, true
+	case "<":
+		return tag, prefix + SEPARATOR, true
+	default:
+		return "", "", false
+	}
+}
+
+// Encodes a JSON value as the start of a key. Returns false
+// if values of its type are not indexed.
+func encodeValue(value any) (string, bool) {
+	switch v := value.(type) {
+	case nil:
+		return TAG_NULL, true
+	case bool:
+		if v {
+			return TAG_BOOL + "1", true
+		}
+		return TAG_BOOL + "0", true
+	case float64:
+		// Flip the sign bit of positive numbers and every bit of negative
+		// ones, so the bits order like the numbers
+		bits := math.Float64bits(v)
+		if v == 0 {
+			bits = 0 // -0 equals 0
+		}
+		if bits&(1<<63) != 0 {
+			bits = ^bits
+		} else {
+			bits |= 1 << 63
+		}
+		return fmt.Sprintf("%s%016x", TAG_NUMBER, bits), true
+	case string:
+		return TAG_STRING + hex.EncodeToString([]byte(v)), true
+	default:
+		return "", false
+	}
+}
@@ -0,0 +1,101 @@
+package index
+
+import (
+	"context"
+	"slices"
+	"sort"
+	"testing"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/query"
+)
+
+// Tests that encoded values sort like the values they encode.
+func TestEncodeOrder(t *testing.T) {
+	values := []any{nil, false, true, -1e10, -2.5, -0.0, 0.5, 3.0, 1e10, "", "a", "ab", "b"}
+
+	for i := 1; i < len(values); i++ {
+		prev, _ := encodeValue(values[i-1])
+		next, _ := encodeValue(values[i])
+		if prev >= next {
+			t.Errorf("Test %d: expected %v to sort before %v", i, values[i-1], values[i])
+		}
+	}
+
+	_, ok := encodeValue([]any{1.0})
+	if ok {
+		t.Error("expected arrays not to be indexed")
+	}
+}
+
+// Tests that lookups find the documents satisfying a condition,
+// and that entries follow updates and removals.
+func TestLookup(t *testing.T) {
+	idx, err := New("/doc/v")
+	if err != nil {
+		t.Fatalf("expected no errors, got %s", err.Error())
+	}
+
+	docs := map[string]any{
+		"a": 1.0,
+		"b": 2.0,
+		"c": 2.0,
+		"d": 3.0,
+		"e": "2",
+		"f": []any{2.0},
+	}
+	for name, v := range docs {
+		idx.Update(name, map[string]any{"doc": map[string]any{"v": v}})
+	}
+	idx.Update("g", map[string]any{"doc": map[string]any{}})
+
+	data := []struct {
+		filter   string
+		expected []string
+	}{
+		{"/doc/v == 2", []string{"b", "c"}},
+		{"/doc/v > 1", []string{"b", "c", "d"}},
+		{"/doc/v >= 2", []string{"b", "c", "d"}},
+		{"/doc/v < 3", []string{"a", "b", "c"}},
+		{"/doc/v <= 1", []string{"a"}},
+		{"/doc/v == \"2\"", []string{"e"}},
+		{"/doc/v < \"3\"", []string{"e"}},
+	}
+
+	for i, d := range data {
+		names := lookup(t, &idx, d.filter)
+		if !slices.Equal(names, d.expected) {
+			t.Errorf("Test %d: expected %v, got %v", i, d.expected, names)
+		}
+	}
+
+	// Updates move entries, removals drop them
+	idx.Update("a", map[string]any{"doc": map[string]any{"v": 2.0}})
+	idx.Remove("c")
+	names := lookup(t, &idx, "/doc/v == 2")
+	if !slices.Equal(names, []string{"a", "b"}) {
+		t.Errorf("expected [a b] after update, got %v", names)
+	}
+
+	// Conditions on other pointers, or not on a range, are not answered
+	for _, filter := range []string{"/doc/w == 2", "/doc/v != 2", "/doc/v < null"} {
+		parsed, _ := query.Parse(filter)
+		_, ok, _ := idx.Lookup(context.Background(), parsed.Conditions()[0])
+		if ok {
+			t.Errorf("expected %s not to use the index", filter)
+		}
+	}
+}
+
+// Looks up the names of the documents satisfying a single condition filter, sorted.
+func lookup(t *testing.T, idx *Index, filter string) []string {
+	parsed, err := query.Parse(filter)
+	if err != nil {
+		t.Fatalf("expected no errors, got %s", err.Error())
+	}
+	names, ok, err := idx.Lookup(context.Background(), parsed.Conditions()[0])
+	if !ok || err != nil {
+		t.Fatalf("expected %s to use the index, got %v", filter, err)
+	}
+	sort.Strings(names)
+	return names
+}
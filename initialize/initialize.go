@@ -7,28 +7,61 @@ import (
 	"flag"
 	"log/slog"
 	"os"
+	"time"
 
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/authentication"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/authorization"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/ratelimit"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/wal"
 	"github.com/santhosh-tekuri/jsonschema/v5"
 )
 
+// A config holds the settings of the server read from the commandline.
+type Config struct {
+	Port        int                      // The port to listen on.
+	Schema      *jsonschema.Schema       // The schema documents must conform to.
+	Tokens      map[string]string        // The map of usernames to pre-installed tokens.
+	Roles       *authorization.Roles     // The roles of users on databases, or nil if roles are not enforced.
+	UsersFile   string                   // The file of the accounts users log in with, or "" to keep them in memory.
+	KeysFile    string                   // The file of the keys tokens are signed with, or "" to keep tokens in memory.
+	DataDir     string                   // The directory for the write-ahead log, or "" to disable persistence.
+	FsyncPolicy string                   // The fsync policy of the write-ahead log.
+	Snapshots   time.Duration            // How often to snapshot the databases, or 0 to never snapshot.
+	Lifetimes   authentication.Lifetimes // How long tokens last.
+	AuditFile   string                   // The file of the audit trail, or "" to not audit requests.
+	AuditBytes  int64                    // The size past which the audit file is rotated.
+	Limiter     *ratelimit.Limiter       // The rate limits of users, or nil if rates are not limited.
+}
+
 // Initialize sets up flags for inputs and compiles
 // the input schema file into a jsonschema.Schema object.
-// Returns the port number, schema object, and the token
-// file's path.
-func Initialize() (int, *jsonschema.Schema, map[string]string, error) {
+// Returns the configuration of the server.
+func Initialize() (Config, error) {
 	// Initialize flags
 	portFlag := flag.Int("p", 3318, "Port number")
 	schemaFlag := flag.String("s", "", "Schema file name")
 	tokenFlag := flag.String("t", "", "Token file name")
+	rolesFlag := flag.String("r", "", "Roles file name, roles are not enforced if omitted")
+	usersFlag := flag.String("u", "", "Users file name, accounts are kept in memory if omitted")
+	keysFlag := flag.String("k", "", "Signing key file name, tokens are kept in memory if omitted")
 	loggerFlag := flag.Int("l", 0, "Logger output level, -1 for debug, 1 for only errors")
+	dataFlag := flag.String("d", "", "Data directory for the write-ahead log, persistence is disabled if omitted")
+	fsyncFlag := flag.String("f", wal.SYNC_ALWAYS, "Fsync policy of the write-ahead log: always, interval or never")
+	snapshotFlag := flag.Duration("snapshot", 5*time.Minute, "Interval between snapshots of the databases, 0 to disable")
+	auditFlag := flag.String("a", "", "Audit trail file name, requests are not audited if omitted")
+	auditSizeFlag := flag.Int64("auditsize", 10, "Size in megabytes past which the audit trail file is rotated")
+	limitsFlag := flag.String("limits", "", "Rate limits file name, rates are not limited if omitted")
+	sessionFlag := flag.Duration("session", authentication.DEFAULT_LIFETIMES.Session, "Lifetime of tokens from logging in or refreshing")
+	refreshFlag := flag.Duration("refresh", authentication.DEFAULT_LIFETIMES.Refresh, "Lifetime of refresh tokens")
+	installedFlag := flag.Duration("installed", authentication.DEFAULT_LIFETIMES.Installed, "Lifetime of tokens from the token file")
 	flag.Parse()
 
-	var tokenmap map[string]string
+	var config Config
 
 	// Ensure we got a schema file
 	if *schemaFlag == "" {
 		slog.Error("Missing schema", "error", errors.New("missing schema"))
-		return 0, nil, tokenmap, errors.New("missing schema")
+		return config, errors.New("missing schema")
 	}
 
 	// Compile the schema
@@ -37,8 +70,9 @@ func Initialize() (int, *jsonschema.Schema, map[string]string, error) {
 	// Check for errors.
 	if err != nil {
 		slog.Error("Invalid schema", "error", err)
-		return 0, nil, tokenmap, errors.New("invalid schema")
+		return config, errors.New("invalid schema")
 	}
+	config.Schema = schema
 
 	// If the user inputs a token file.
 	if *tokenFlag != "" {
@@ -46,17 +80,63 @@ func Initialize() (int, *jsonschema.Schema, map[string]string, error) {
 		tokens, err := os.ReadFile(*tokenFlag)
 		if err != nil {
 			slog.Error("Error reading token file", "error", err)
-			return 0, nil, tokenmap, errors.New("token file error")
+			return config, errors.New("token file error")
 		}
 
 		// Unmarshal it.
-		err = json.Unmarshal(tokens, &tokenmap)
+		err = json.Unmarshal(tokens, &config.Tokens)
 		if err != nil {
 			slog.Error("Error marshalling token file", "error", err)
-			return 0, nil, tokenmap, errors.New("marshalling tokens error")
+			return config, errors.New("marshalling tokens error")
+		}
+	}
+
+	// If the user inputs a roles file.
+	if *rolesFlag != "" {
+		roles, err := authorization.Load(*rolesFlag)
+		if err != nil {
+			slog.Error("Error reading roles file", "error", err)
+			return config, errors.New("roles file error")
+		}
+		config.Roles = &roles
+	}
+
+	// If the user inputs a rate limits file.
+	if *limitsFlag != "" {
+		config.Limiter, err = ratelimit.Load(*limitsFlag)
+		if err != nil {
+			slog.Error("Error reading rate limits file", "error", err)
+			return config, errors.New("rate limits file error")
 		}
 	}
 
+	// Check the fsync policy
+	switch *fsyncFlag {
+	case wal.SYNC_ALWAYS, wal.SYNC_INTERVAL, wal.SYNC_NEVER:
+	default:
+		slog.Error("Invalid fsync policy", "policy", *fsyncFlag)
+		return config, errors.New("invalid fsync policy")
+	}
+
+	// Check the snapshot interval
+	if *snapshotFlag < 0 {
+		slog.Error("Invalid snapshot interval", "interval", *snapshotFlag)
+		return config, errors.New("invalid snapshot interval")
+	}
+
+	// Check the token lifetimes
+	config.Lifetimes = authentication.Lifetimes{Session: *sessionFlag, Refresh: *refreshFlag, Installed: *installedFlag}
+	if *sessionFlag <= 0 || *refreshFlag <= 0 || *installedFlag <= 0 {
+		slog.Error("Invalid token lifetime", "session", *sessionFlag, "refresh", *refreshFlag, "installed", *installedFlag)
+		return config, errors.New("invalid token lifetime")
+	}
+
+	// Check the audit trail size
+	if *auditSizeFlag <= 0 {
+		slog.Error("Invalid audit trail size", "size", *auditSizeFlag)
+		return config, errors.New("invalid audit trail size")
+	}
+
 	// Set to debug and above
 	if *loggerFlag == -1 {
 		h := slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug})
@@ -69,5 +149,13 @@ func Initialize() (int, *jsonschema.Schema, map[string]string, error) {
 		slog.SetDefault(slog.New(h))
 	}
 
-	return *portFlag, schema, tokenmap, nil
+	config.Port = *portFlag
+	config.UsersFile = *usersFlag
+	config.KeysFile = *keysFlag
+	config.AuditFile = *auditFlag
+	config.AuditBytes = *auditSizeFlag * 1024 * 1024
+	config.DataDir = *dataFlag
+	config.FsyncPolicy = *fsyncFlag
+	config.Snapshots = *snapshotFlag
+	return config, nil
 }
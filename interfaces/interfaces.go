@@ -3,10 +3,16 @@
 package interfaces
 
 import (
+	"context"
+	"encoding/json"
 	"net/http"
+	"net/url"
 
 	"github.com/RICE-COMP318-FALL23/owldb-p1group20/patcher"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/quota"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/skiplist"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group20/structs"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/subscribe"
 	"github.com/santhosh-tekuri/jsonschema/v5"
 )
 
@@ -45,6 +51,15 @@ type ICollection interface {
 
 	// HTTP handler for POST on document paths
 	PostDocument(w http.ResponseWriter, r *http.Request, newDoc IDocument)
+
+	// Insert or replace a document without a request, used for recovery
+	RestoreDocument(name string, doc IDocument)
+
+	// Remove a document without a request, used for recovery
+	RemoveDocument(name string) bool
+
+	// Get a consistent view of the documents with names in [start, end]
+	QueryDocuments(ctx context.Context, start string, end string) ([]skiplist.Pair[string, IDocument], error)
 }
 
 // The interface of a collection holder.
@@ -59,6 +74,15 @@ type ICollectionHolder interface {
 
 	// HTTP handler for DELETEs on collections (manage collections)
 	DeleteCollection(w http.ResponseWriter, r *http.Request, dbpath string)
+
+	// Insert a collection if absent without a request, used for recovery
+	RestoreCollection(name string, newColl ICollection)
+
+	// Remove a collection without a request, used for recovery
+	RemoveCollection(name string) bool
+
+	// Get a consistent view of all the collections held
+	QueryCollections(ctx context.Context) ([]skiplist.Pair[string, ICollection], error)
 }
 
 // An authenticator is something which can validate a login token
@@ -69,6 +93,16 @@ type Authenticator interface {
 	ValidateToken(w http.ResponseWriter, r *http.Request) (bool, string)
 }
 
+// An auditable handler can hash the documents it holds, so
+// that changes to them can be audited.
+type Auditable interface {
+	http.Handler
+
+	// Gets the SHA-256 hash of the body of the document at path, hex
+	// encoded. Returns false if there is no document at path.
+	DocumentHash(path string) (string, bool)
+}
+
 // A subscribable object allows the sending of messages to subscribers.
 type Subscribable interface {
 	// Notifies subscribers of update messages.
@@ -78,6 +112,60 @@ type Subscribable interface {
 	NotifySubscribersDelete(msg string, intervalComp string)
 }
 
+// A deletable object tells its subscribers, and those of everything
+// below it, once it is deleted.
+type Deletable interface {
+	// Notifies the subscribers of this object, deleted from path, and
+	// of every document and collection below it, then ends their
+	// subscriptions. Returns how many documents and collections were
+	// removed, this object included.
+	NotifySubtreeDeleted(path string) (documents int, collections int)
+}
+
+// A schematized object may have a schema of its own, which the
+// documents below it must conform to instead of an inherited one.
+type Schematized interface {
+	// Gets the schema of this object and its JSON source, or nils if it has none.
+	GetSchema() (*jsonschema.Schema, json.RawMessage)
+
+	// Compiles and sets the schema of this object from its JSON source.
+	SetSchema(source json.RawMessage) error
+}
+
+// An owned object may restrict its documents to the users who
+// created them.
+type Owned interface {
+	// Gets the ownership rules of the documents of this object.
+	GetOwnerRules() structs.OwnerRules
+
+	// Sets the ownership rules of the documents of this object.
+	SetOwnerRules(rules structs.OwnerRules)
+}
+
+// A metered object counts the documents below it against the
+// storage quota of its database.
+type Metered interface {
+	// Gets the storage quota of this object, zero if it has none.
+	GetQuota() structs.Quota
+
+	// Sets the storage quota of this object and the limits of its usage.
+	SetQuota(limits structs.Quota)
+
+	// Gets the usage the documents of this object are counted in.
+	GetUsage() *quota.Usage
+
+	// Counts the documents of this object in usage, that of its database.
+	SetUsage(usage *quota.Usage)
+}
+
+// A streamable object has a stream of events for subscribers.
+type Streamable interface {
+	// Subscribes to the events selected by queries. Returns the
+	// subscription and the events to send first: those missed since
+	// lastEventID if the subscription resumes, or else the current state.
+	SubscribeEvents(ctx context.Context, queries url.Values, lastEventID string) (*subscribe.Subscription, []subscribe.Event, error)
+}
+
 // A HasMetadata object allows storage and public retrieval of metadata
 type HasMetadata interface {
 	// Gets the original author of this document
@@ -93,6 +181,9 @@ type Patchable interface {
 	// Applys a slice of patches to this document.
 	ApplyPatches(patches []patcher.Patch, schema *jsonschema.Schema) (structs.PatchResponse, interface{})
 
+	// Applys a JSON merge patch to this document.
+	ApplyMergePatch(patch interface{}, schema *jsonschema.Schema) (structs.PatchResponse, interface{})
+
 	// Overwrite the body of a document upon recieving a put or patch.
 	OverwriteBody(docBody interface{}, name string)
 }
@@ -103,6 +194,41 @@ type Overwriteable interface {
 	OverwriteBody(docBody interface{}, name string)
 }
 
+// An indexable object maintains secondary indexes on its documents.
+type Indexable interface {
+	// Creates or replaces an index on a pointer into document outputs.
+	// Returns whether an index was replaced.
+	PutIndex(ctx context.Context, name string, field string) (bool, error)
+
+	// Deletes an index. Returns whether there was such an index.
+	DeleteIndex(name string) bool
+
+	// Gets the pointer of each index, by index name.
+	Indexes() map[string]string
+}
+
+// A versioned object keeps the earlier revisions of a document.
+type Versioned interface {
+	// Gets the body of the revision with the given version, if it is still kept.
+	GetRevision(version int) (interface{}, bool)
+
+	// Takes on the history of the document this one replaces, used for recovery.
+	InheritHistory(previous IDocument)
+
+	// Encodes the earlier revisions, used for snapshots.
+	GetHistoryJSON() ([]byte, error)
+
+	// Decodes the earlier revisions, used for snapshots.
+	RestoreHistory(data []byte) error
+}
+
+// A revertible object can be put back as it was, undoing a change
+// which could not be recorded.
+type Revertible interface {
+	// Saves the state of this object, returning a function which puts it back.
+	Save() (restore func())
+}
+
 // A postable object supports posting
 type Postable interface {
 	// Insert name to the end of the path string
@@ -26,15 +26,45 @@ The flags are:
 	-t
 		A token file name, the file contains a JSON mapping user names
 		to string tokens. These tokens will be installed on the system
-		for 24 hours.
+		for the installed lifetime.
+	-u
+		A users file name, the file in which accounts are kept. If
+		omitted, accounts only live in memory.
+	-k
+		A signing key file name. When given, tokens are signed JSON Web
+		Tokens which survive restarts. If omitted, tokens only live in
+		memory.
+	-r
+		A roles file name, the file contains a JSON mapping user names
+		to their roles on each database. If omitted, every user may do
+		anything.
+	-limits
+		A rate limits file name. If omitted, requests are not limited.
+	-a
+		An audit trail file name. If omitted, requests are not audited.
+	-auditsize
+		An integer, the megabytes an audit trail file grows to before
+		a new one is started.
+	-session, -refresh, -installed
+		Durations, how long tokens from logging in, refresh tokens, and
+		tokens from the token file last.
 	-l
 		An integer, logger output level, 1 for errors only, -1 for debug
 		as well as all other info.
+	-d
+		A data directory name, the directory in which the write-ahead
+		log is stored. If omitted, the databases only live in memory.
+	-f
+		The fsync policy of the write-ahead log: "always", "interval"
+		or "never".
+	-snapshot
+		A duration, how often a snapshot of the databases is written to
+		the data directory.
 
 When a client logs into the OwlDB server, they will be given a unique
 token which they will use on all future logins. They will have the power
-to then access all of the databases, documents, and collections on the
-server, as well as adding new ones, and subscribing to changes.
+to then access the databases, documents, and collections on the server
+their roles allow, as well as adding new ones, and subscribing to changes.
 */
 package main
 
@@ -46,48 +76,117 @@ import (
 	"os/signal"
 	"syscall"
 
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/audit"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group20/authentication"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group20/collectionholder"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group20/dbhandler"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group20/errorMessage"
 	"github.com/RICE-COMP318-FALL23/owldb-p1group20/initialize"
-	"github.com/santhosh-tekuri/jsonschema/v5"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/snapshot"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/wal"
 )
 
 // Implements the main functionality for the OwlDB program.
 func main() {
 	// Declare variables for main method.
-	var port int
-	var schema *jsonschema.Schema
-	var tokenmap map[string]string
+	var config initialize.Config
 	var err error
 	var server http.Server
 	var owlDB dbhandler.Dbhandler
 	var authenticator authentication.Authenticator
+	var log *wal.Log
+	var snapshotter *snapshot.Snapshotter
+	var auditLog *audit.Log
 
 	// Initialize the user input variables.
-	port, schema, tokenmap, err = initialize.Initialize()
+	config, err = initialize.Initialize()
 
 	// Printing was handled in initialize.
 	if err != nil {
 		return
 	}
+	port := config.Port
 
 	// Create handlers
 	authenticator = authentication.New()
+	authenticator.SetLifetimes(config.Lifetimes)
 	databases := collectionholder.New()
-	owlDB = dbhandler.New(&databases, schema, &authenticator)
+	owlDB = dbhandler.New(&databases, config.Schema, &authenticator)
+	if config.Roles != nil {
+		owlDB.EnforceRoles(config.Roles)
+		authenticator.EnforceRoles(config.Roles)
+	}
+	if config.Limiter != nil {
+		owlDB.LimitRates(config.Limiter)
+	}
+	if config.UsersFile != "" {
+		err = authenticator.LoadUsers(config.UsersFile)
+		if err != nil {
+			slog.Error("Could not load users", "error", err)
+			return
+		}
+	}
+
+	if config.KeysFile != "" {
+		err = authenticator.LoadSigningKeys(config.KeysFile)
+		if err != nil {
+			slog.Error("Could not load signing keys", "error", err)
+			return
+		}
+	}
+
+	// Rebuild the databases from the latest snapshot and the write-ahead log
+	if config.DataDir != "" {
+		seq, err := snapshot.Load(config.DataDir, &databases)
+		if err != nil {
+			slog.Error("Could not load snapshot", "error", err)
+			return
+		}
+		log, err = wal.Open(config.DataDir, config.FsyncPolicy)
+		if err != nil {
+			slog.Error("Could not open write-ahead log", "error", err)
+			return
+		}
+		err = owlDB.Recover(log, seq)
+		if err != nil {
+			slog.Error("Could not recover databases", "error", err)
+			log.Close()
+			return
+		}
+
+		if config.Snapshots > 0 {
+			snapshotter = snapshot.New(config.DataDir, log, &databases, seq)
+			snapshotter.Start(config.Snapshots)
+		}
+	}
+
+	// Record the mutating requests to the databases in the audit trail
+	var dbHandler http.Handler = &owlDB
+	if config.AuditFile != "" {
+		auditLog, err = audit.Open(config.AuditFile, config.AuditBytes)
+		if err != nil {
+			slog.Error("Could not open audit trail", "error", err)
+			return
+		}
+		auditor := audit.Wrap(&owlDB, &authenticator, auditLog)
+		if config.Roles != nil {
+			auditor.EnforceRoles(config.Roles)
+		}
+		dbHandler = auditor
+	}
 
 	// Install handlers into mux
 	mux := http.NewServeMux()
-	mux.Handle("/v1/", &owlDB)
+	mux.Handle("/v1/", dbHandler)
 	mux.Handle("/auth", &authenticator)
+	mux.Handle("/auth/", &authenticator)
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		errorMessage.ErrorResponse(w, "Missing /v1/ or /auth in request", 400)
+		errorMessage.Respond(w, r, "Missing /v1/ or /auth in request", 400)
 	})
 
-	// Install users into authenticator
-	authenticator.InstallUsers(tokenmap)
+	// Install users into authenticator, and remove tokens as they expire
+	authenticator.InstallUsers(config.Tokens)
+	authenticator.StartReaper(authentication.REAP_INTERVAL)
 
 	server.Addr = fmt.Sprintf("localhost:%d", port)
 	server.Handler = mux
@@ -113,4 +212,22 @@ func main() {
 	} else {
 		slog.Info("Server closed", "error", err)
 	}
+
+	// Flush the write-ahead log
+	authenticator.StopReaper()
+	if snapshotter != nil {
+		snapshotter.Stop()
+	}
+	if log != nil {
+		err = log.Close()
+		if err != nil {
+			slog.Error("Could not close write-ahead log", "error", err)
+		}
+	}
+	if auditLog != nil {
+		err = auditLog.Close()
+		if err != nil {
+			slog.Error("Could not close audit trail", "error", err)
+		}
+	}
 }
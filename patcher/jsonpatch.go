@@ -0,0 +1,305 @@
+package patcher
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/jsonvisit"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/query"
+)
+
+// The operations of a JSON Patch (RFC 6902).
+const (
+	OP_ADD     = "add"
+	OP_REMOVE  = "remove"
+	OP_REPLACE = "replace"
+	OP_MOVE    = "move"
+	OP_COPY    = "copy"
+	OP_TEST    = "test"
+)
+
+// The array index which refers to the position after the last element.
+const APPEND_INDEX = "-"
+
+// Applies a JSON Patch operation to doc. The document is copied
+// first, so the input is never modified.
+func applyJSONPatch(doc interface{}, patch Patch) (interface{}, error) {
+	path, err := query.ParsePointer(patch.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch patch.Op {
+	case OP_ADD:
+		return addValue(deepCopy(doc), path, deepCopy(patch.Value))
+	case OP_REMOVE:
+		return removeValue(deepCopy(doc), path)
+	case OP_REPLACE:
+		return replaceValue(deepCopy(doc), path, deepCopy(patch.Value))
+	case OP_TEST:
+		value, err := getValue(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !jsonvisit.Equal(normalize(value), normalize(patch.Value)) {
+			return nil, fmt.Errorf("test failed, value at %s differs", patch.Path)
+		}
+		return doc, nil
+	}
+
+	// Move and copy take their value from another location
+	from, err := query.ParsePointer(patch.From)
+	if err != nil {
+		return nil, fmt.Errorf("bad from: %w", err)
+	}
+	value, err := getValue(doc, from)
+	if err != nil {
+		return nil, fmt.Errorf("bad from: %w", err)
+	}
+
+	switch patch.Op {
+	case OP_MOVE:
+		if len(path) > len(from) && isPrefix(from, path) {
+			return nil, errors.New("cannot move a value into one of its children")
+		}
+		moved, err := removeValue(deepCopy(doc), from)
+		if err != nil {
+			return nil, err
+		}
+		return addValue(moved, path, deepCopy(value))
+	case OP_COPY:
+		return addValue(deepCopy(doc), path, deepCopy(value))
+	default:
+		return nil, fmt.Errorf("unknown patch operation %q", patch.Op)
+	}
+}
+
+// Tells if op is a JSON Patch operation.
+func isJSONPatchOp(op string) bool {
+	switch op {
+	case OP_ADD, OP_REMOVE, OP_REPLACE, OP_MOVE, OP_COPY, OP_TEST:
+		return true
+	default:
+		return false
+	}
+}
+
+// Gets the value at the reference tokens path inside doc.
+func getValue(doc interface{}, path []string) (interface{}, error) {
+	current := doc
+	for _, token := range path {
+		switch node := current.(type) {
+		case map[string]interface{}:
+			child, found := node[token]
+			if !found {
+				return nil, fmt.Errorf("missing key %q in path", token)
+			}
+			current = child
+		case []interface{}:
+			i, err := arrayIndex(token, len(node)-1)
+			if err != nil {
+				return nil, err
+			}
+			current = node[i]
+		default:
+			return nil, fmt.Errorf("path continues past a scalar at %q", token)
+		}
+	}
+	return current, nil
+}
+
+// Adds value at path inside doc, inserting into arrays and
+// setting object members. Returns the updated document.
+func addValue(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	return updateParent(doc, path, func(parent interface{}, token string) (interface{}, error) {
+		switch node := parent.(type) {
+		case map[string]interface{}:
+			node[token] = value
+			return node, nil
+		case []interface{}:
+			i := len(node)
+			if token != APPEND_INDEX {
+				var err error
+				i, err = arrayIndex(token, len(node))
+				if err != nil {
+					return nil, err
+				}
+			}
+			node = append(node, nil)
+			copy(node[i+1:], node[i:])
+			node[i] = value
+			return node, nil
+		default:
+			return nil, fmt.Errorf("cannot add %q to a scalar", token)
+		}
+	})
+}
+
+// Removes the value at path inside doc. Returns the updated document.
+func removeValue(doc interface{}, path []string) (interface{}, error) {
+	if len(path) == 0 {
+		return nil, errors.New("cannot remove the whole document")
+	}
+
+	return updateParent(doc, path, func(parent interface{}, token string) (interface{}, error) {
+		switch node := parent.(type) {
+		case map[string]interface{}:
+			_, found := node[token]
+			if !found {
+				return nil, fmt.Errorf("missing key %q in path", token)
+			}
+			delete(node, token)
+			return node, nil
+		case []interface{}:
+			i, err := arrayIndex(token, len(node)-1)
+			if err != nil {
+				return nil, err
+			}
+			return append(node[:i], node[i+1:]...), nil
+		default:
+			return nil, fmt.Errorf("cannot remove %q from a scalar", token)
+		}
+	})
+}
+
+// Replaces the existing value at path inside doc. Returns the updated document.
+func replaceValue(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	return updateParent(doc, path, func(parent interface{}, token string) (interface{}, error) {
+		switch node := parent.(type) {
+		case map[string]interface{}:
+			_, found := node[token]
+			if !found {
+				return nil, fmt.Errorf("missing key %q in path", token)
+			}
+			node[token] = value
+			return node, nil
+		case []interface{}:
+			i, err := arrayIndex(token, len(node)-1)
+			if err != nil {
+				return nil, err
+			}
+			node[i] = value
+			return node, nil
+		default:
+			return nil, fmt.Errorf("cannot replace %q in a scalar", token)
+		}
+	})
+}
+
+// Finds the parent of the value at path inside doc and replaces it
+// with the result of update, which is given the parent and the last
+// reference token of path. Returns the updated document.
+func updateParent(doc interface{}, path []string, update func(parent interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		return update(doc, path[0])
+	}
+
+	token := path[0]
+	switch node := doc.(type) {
+	case map[string]interface{}:
+		child, found := node[token]
+		if !found {
+			return nil, fmt.Errorf("missing key %q in path", token)
+		}
+		updated, err := updateParent(child, path[1:], update)
+		if err != nil {
+			return nil, err
+		}
+		node[token] = updated
+		return node, nil
+	case []interface{}:
+		i, err := arrayIndex(token, len(node)-1)
+		if err != nil {
+			return nil, err
+		}
+		updated, err := updateParent(node[i], path[1:], update)
+		if err != nil {
+			return nil, err
+		}
+		node[i] = updated
+		return node, nil
+	default:
+		return nil, fmt.Errorf("path continues past a scalar at %q", token)
+	}
+}
+
+// Parses an array index, which must be a number without leading
+// zeros no greater than limit.
+func arrayIndex(token string, limit int) (int, error) {
+	if token == "" || (len(token) > 1 && token[0] == '0') || strings.Trim(token, "0123456789") != "" {
+		return 0, fmt.Errorf("bad array index %q", token)
+	}
+
+	i, err := strconv.Atoi(token)
+	if err != nil || i > limit {
+		return 0, fmt.Errorf("array index %q out of bounds", token)
+	}
+	return i, nil
+}
+
+// Tells if the reference tokens prefix start the reference tokens path.
+func isPrefix(prefix []string, path []string) bool {
+	if len(prefix) > len(path) {
+		return false
+	}
+	for i := range prefix {
+		if prefix[i] != path[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Copies the objects and arrays of a JSON value, so that it can be
+// modified without modifying the original.
+func deepCopy(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(v))
+		for key, child := range v {
+			copied[key] = deepCopy(child)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+		for i, child := range v {
+			copied[i] = deepCopy(child)
+		}
+		return copied
+	default:
+		return v
+	}
+}
+
+// Converts the numbers inside a value to float64, as they are
+// when decoded from JSON, so that values can be compared.
+func normalize(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		normalized := make(map[string]interface{}, len(v))
+		for key, child := range v {
+			normalized[key] = normalize(child)
+		}
+		return normalized
+	case []interface{}:
+		normalized := make([]interface{}, len(v))
+		for i, child := range v {
+			normalized[i] = normalize(child)
+		}
+		return normalized
+	case int:
+		return float64(v)
+	default:
+		return v
+	}
+}
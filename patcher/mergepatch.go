@@ -0,0 +1,75 @@
+package patcher
+
+import (
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/jsonvisit"
+)
+
+// The content type of JSON Merge Patch (RFC 7396) request bodies.
+const MERGE_PATCH_TYPE = "application/merge-patch+json"
+
+// A struct that visits a merge patch and merges it into a target document.
+type mergeVisitor struct {
+	target interface{} // The value the visited patch is merged into.
+}
+
+// Applies a JSON Merge Patch to the input document, and returns
+// the patched document, or an error, if one occurs. Members of the
+// patch set to null are removed, objects are merged recursively and
+// any other value replaces the target. The input is never modified.
+func ApplyMergePatch(doc interface{}, patch interface{}) (interface{}, error) {
+	return jsonvisit.Accept[any](patch, &mergeVisitor{doc})
+}
+
+// Handles visiting a JSON object of the patch, merging it member by member.
+func (v *mergeVisitor) Map(m map[string]any) (any, error) {
+	retval := make(map[string]any)
+
+	// A patch object replaces any target which is not an object
+	target, isMap := v.target.(map[string]any)
+	if isMap {
+		for key, val := range target {
+			retval[key] = val
+		}
+	}
+
+	for key, val := range m {
+		if val == nil {
+			delete(retval, key)
+			continue
+		}
+
+		merged, err := jsonvisit.Accept[any](val, &mergeVisitor{retval[key]})
+		if err != nil {
+			return nil, err
+		}
+		retval[key] = merged
+	}
+
+	return retval, nil
+}
+
+// Handles visiting an array of the patch, which replaces the target.
+func (v *mergeVisitor) Slice(s []any) (any, error) {
+	return deepCopy(s), nil
+}
+
+// Handles visiting a bool of the patch, which replaces the target.
+func (v *mergeVisitor) Bool(b bool) (any, error) {
+	return b, nil
+}
+
+// Handles visiting a float of the patch, which replaces the target.
+func (v *mergeVisitor) Float64(f float64) (any, error) {
+	return f, nil
+}
+
+// Handles visiting a string of the patch, which replaces the target.
+func (v *mergeVisitor) String(s string) (any, error) {
+	return s, nil
+}
+
+// Handles visiting a null patch, which replaces the whole target.
+// Nulls inside objects remove members instead, see Map.
+func (v *mergeVisitor) Null() (any, error) {
+	return nil, nil
+}
@@ -1,6 +1,10 @@
 // Package patcher provides a struct to marshal
 // patches and a method to apply an input patch
 // to an input document.
+//
+// Both the standard JSON Patch operations of RFC 6902 (add, remove,
+// replace, move, copy and test), with RFC 6901 pointers, and the
+// original ObjectAdd, ArrayAdd and ArrayRemove operations are supported.
 package patcher
 
 import (
@@ -18,6 +22,7 @@ type Patch struct {
 	Op    string      // The desired operation of the patch.
 	Path  string      // A JSON pointer to the target of the patch.
 	Value interface{} // The JSON object to be added or removed by the patch.
+	From  string      // A JSON pointer to the source of a move or copy patch.
 }
 
 // A struct that visits a document and applies a patch to it.
@@ -45,6 +50,16 @@ func new(patch Patch) (patchVisitor, error) {
 // Applies the input patch to the input document, and returns
 // the patched document, or an error, if one occurs.
 func ApplyPatch(doc interface{}, patch Patch) (interface{}, error) {
+	if isJSONPatchOp(patch.Op) {
+		return applyJSONPatch(doc, patch)
+	}
+
+	switch patch.Op {
+	case "ObjectAdd", "ArrayAdd", "ArrayRemove":
+	default:
+		return nil, fmt.Errorf("unknown patch operation %q", patch.Op)
+	}
+
 	patcher, err := new(patch)
 	if err != nil {
 		return nil, err
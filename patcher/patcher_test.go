@@ -1,6 +1,7 @@
 package patcher
 
 import (
+	"encoding/json"
 	"log/slog"
 	"os"
 	"testing"
@@ -45,7 +46,7 @@ func TestApplyPatchBadPath(t *testing.T) {
 	// Create docs for testing
 	_, patchedDoc := createTestDocs()
 
-	patch := Patch{"ObjectAdd", "/c/d", 100}
+	patch := Patch{Op: "ObjectAdd", Path: "/c/d", Value: 100}
 
 	_, err := ApplyPatch(patchedDoc, patch)
 
@@ -59,7 +60,7 @@ func TestApplyPatchPathMissingSlash(t *testing.T) {
 	// Create docs for testing
 	_, patchedDoc := createTestDocs()
 
-	patch := Patch{"ObjectAdd", "c", 100}
+	patch := Patch{Op: "ObjectAdd", Path: "c", Value: 100}
 
 	_, err := ApplyPatch(patchedDoc, patch)
 
@@ -73,7 +74,7 @@ func TestApplyPatchNotModErr(t *testing.T) {
 	// Create docs for testing
 	doc, patchedDoc := createTestDocs()
 
-	patch := Patch{"ObjectAdd", "/c/d", 100}
+	patch := Patch{Op: "ObjectAdd", Path: "/c/d", Value: 100}
 
 	_, err := ApplyPatch(patchedDoc, patch)
 
@@ -87,7 +88,7 @@ func TestApplyPatchNotModSucc(t *testing.T) {
 	// Create docs for testing
 	doc, patchedDoc := createTestDocs()
 
-	patch := Patch{"ObjectAdd", "/c", 100}
+	patch := Patch{Op: "ObjectAdd", Path: "/c", Value: 100}
 
 	_, err := ApplyPatch(patchedDoc, patch)
 
@@ -105,7 +106,7 @@ func TestApplyPatchObjAdd(t *testing.T) {
 	// Create docs for testing
 	doc, patchedDoc := createTestDocs()
 
-	patch := Patch{"ObjectAdd", "/c", 100}
+	patch := Patch{Op: "ObjectAdd", Path: "/c", Value: 100}
 
 	patchedDoc, _ = ApplyPatch(patchedDoc, patch)
 
@@ -121,7 +122,7 @@ func TestApplyPatchOverwrite(t *testing.T) {
 	// Create docs for testing
 	doc, patchedDoc := createTestDocs()
 
-	patch := Patch{"ObjectAdd", "/a", 100}
+	patch := Patch{Op: "ObjectAdd", Path: "/a", Value: 100}
 
 	patchedDoc, _ = ApplyPatch(patchedDoc, patch)
 
@@ -135,7 +136,7 @@ func TestApplyPatchNestedObjAdd(t *testing.T) {
 	// Create docs for testing
 	doc, patchedDoc := createTestDocs()
 
-	patch := Patch{"ObjectAdd", "/b/a", 100}
+	patch := Patch{Op: "ObjectAdd", Path: "/b/a", Value: 100}
 
 	patchedDoc, _ = ApplyPatch(patchedDoc, patch)
 
@@ -151,7 +152,7 @@ func TestApplyPatchSliceNestedObjAdd(t *testing.T) {
 	// Create docs for testing
 	doc, patchedDoc := createTestDocs()
 
-	patch := Patch{"ObjectAdd", "/array/0/b", 100}
+	patch := Patch{Op: "ObjectAdd", Path: "/array/0/b", Value: 100}
 
 	patchedDoc, _ = ApplyPatch(patchedDoc, patch)
 
@@ -171,7 +172,7 @@ func TestApplyPatchArrayAdd(t *testing.T) {
 	// Create docs for testing
 	doc, patchedDoc := createTestDocs()
 
-	patch := Patch{"ArrayAdd", "/array", 100}
+	patch := Patch{Op: "ArrayAdd", Path: "/array", Value: 100}
 
 	patchedDoc, _ = ApplyPatch(patchedDoc, patch)
 
@@ -197,7 +198,7 @@ func TestApplyPatchArrayRemove(t *testing.T) {
 
 	map1 := make(map[string]interface{})
 	map1["a"] = 2
-	patch := Patch{"ArrayRemove", "/array", map1}
+	patch := Patch{Op: "ArrayRemove", Path: "/array", Value: map1}
 
 	patchedDoc, _ = ApplyPatch(patchedDoc, patch)
 
@@ -208,3 +209,118 @@ func TestApplyPatchArrayRemove(t *testing.T) {
 		t.Error("Expected doc = patchedDoc, got", "doc", doc, "patchedDoc", patchedDoc)
 	}
 }
+
+/*
+ * JSON Patch tests.
+ */
+
+// Tests the JSON Patch operations against their expected results.
+func TestApplyJSONPatch(t *testing.T) {
+	data := []struct {
+		patch    Patch
+		expected string // The patched document, or "" if the patch fails.
+	}{
+		{Patch{Op: "add", Path: "/c", Value: 3.0}, `{"a":1,"b":{"a/b":true,"m~n":2},"c":3,"list":[1,2,3]}`},
+		{Patch{Op: "add", Path: "/a", Value: "x"}, `{"a":"x","b":{"a/b":true,"m~n":2},"list":[1,2,3]}`},
+		{Patch{Op: "add", Path: "/list/1", Value: 9.0}, `{"a":1,"b":{"a/b":true,"m~n":2},"list":[1,9,2,3]}`},
+		{Patch{Op: "add", Path: "/list/-", Value: 9.0}, `{"a":1,"b":{"a/b":true,"m~n":2},"list":[1,2,3,9]}`},
+		{Patch{Op: "add", Path: "/list/3", Value: 9.0}, `{"a":1,"b":{"a/b":true,"m~n":2},"list":[1,2,3,9]}`},
+		{Patch{Op: "add", Path: "/list/4", Value: 9.0}, ""},
+		{Patch{Op: "add", Path: "/list/01", Value: 9.0}, ""},
+		{Patch{Op: "add", Path: "/x/y", Value: 9.0}, ""},
+		{Patch{Op: "remove", Path: "/b/a~1b"}, `{"a":1,"b":{"m~n":2},"list":[1,2,3]}`},
+		{Patch{Op: "remove", Path: "/list/0"}, `{"a":1,"b":{"a/b":true,"m~n":2},"list":[2,3]}`},
+		{Patch{Op: "remove", Path: "/list/-"}, ""},
+		{Patch{Op: "remove", Path: "/c"}, ""},
+		{Patch{Op: "replace", Path: "/b/m~0n", Value: false}, `{"a":1,"b":{"a/b":true,"m~n":false},"list":[1,2,3]}`},
+		{Patch{Op: "replace", Path: "/c", Value: false}, ""},
+		{Patch{Op: "replace", Path: "", Value: "whole"}, `"whole"`},
+		{Patch{Op: "move", From: "/a", Path: "/b/a"}, `{"b":{"a":1,"a/b":true,"m~n":2},"list":[1,2,3]}`},
+		{Patch{Op: "move", From: "/list/0", Path: "/list/-"}, `{"a":1,"b":{"a/b":true,"m~n":2},"list":[2,3,1]}`},
+		{Patch{Op: "move", From: "/b", Path: "/b/c"}, ""},
+		{Patch{Op: "copy", From: "/b", Path: "/c"}, `{"a":1,"b":{"a/b":true,"m~n":2},"c":{"a/b":true,"m~n":2},"list":[1,2,3]}`},
+		{Patch{Op: "copy", From: "/missing", Path: "/c"}, ""},
+		{Patch{Op: "test", Path: "/list", Value: []interface{}{1.0, 2.0, 3.0}}, `{"a":1,"b":{"a/b":true,"m~n":2},"list":[1,2,3]}`},
+		{Patch{Op: "test", Path: "/a", Value: 2.0}, ""},
+		{Patch{Op: "frobnicate", Path: "/a"}, ""},
+	}
+
+	for i, d := range data {
+		doc := map[string]interface{}{
+			"a":    1,
+			"b":    map[string]interface{}{"a/b": true, "m~n": 2},
+			"list": []interface{}{1, 2, 3},
+		}
+		original, _ := json.Marshal(doc)
+
+		patched, err := ApplyPatch(doc, d.patch)
+		if d.expected == "" {
+			if err == nil {
+				t.Errorf("Test %d: expected error, did not get", i)
+			}
+		} else if err != nil {
+			t.Errorf("Test %d: expected no errors, got %s", i, err.Error())
+		} else if output, _ := json.Marshal(patched); string(output) != d.expected {
+			t.Errorf("Test %d: expected %s, got %s", i, d.expected, output)
+		}
+
+		// The input document is never modified
+		after, _ := json.Marshal(doc)
+		if string(after) != string(original) {
+			t.Errorf("Test %d: input document was modified to %s", i, after)
+		}
+	}
+}
+
+/*
+ * Merge patch tests.
+ */
+
+// Tests merge patches against the examples of RFC 7396.
+func TestApplyMergePatch(t *testing.T) {
+	data := []struct {
+		doc      string
+		patch    string
+		expected string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"a":1,"e":null}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+
+	for i, d := range data {
+		var doc, patch interface{}
+		json.Unmarshal([]byte(d.doc), &doc)
+		json.Unmarshal([]byte(d.patch), &patch)
+
+		patched, err := ApplyMergePatch(doc, patch)
+		if err != nil {
+			t.Errorf("Test %d: expected no errors, got %s", i, err.Error())
+			continue
+		}
+		output, _ := json.Marshal(patched)
+		if string(output) != d.expected {
+			t.Errorf("Test %d: expected %s, got %s", i, d.expected, output)
+		}
+
+		// The input document is never modified
+		after, _ := json.Marshal(doc)
+		var original interface{}
+		json.Unmarshal([]byte(d.doc), &original)
+		if !jsonvisit.Equal(doc, original) {
+			t.Errorf("Test %d: input document was modified to %s", i, after)
+		}
+	}
+}
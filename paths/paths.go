@@ -32,6 +32,34 @@ const (
 	RESOURCE_DB_PD = 4 // specifically for put and delete db w/o slash
 )
 
+// The reserved document name under which the indexes of a
+// database or collection are managed.
+const INDEXES = "_indexes"
+
+// The reserved document name under which the schema of a
+// database or collection is read.
+const SCHEMA = "_schema"
+
+// The reserved document name of the transaction endpoint of a database.
+const TRANSACTION = "_transaction"
+
+// The reserved database name of the WebSocket endpoint.
+const WEBSOCKET = "_ws"
+
+// The reserved document name under which the roles of users
+// on a database are managed.
+const ROLES = "_roles"
+
+// The reserved database name of the audit trail endpoint.
+const AUDIT = "_audit"
+
+// The reserved document name of the storage usage endpoint of a database.
+const USAGE = "_usage"
+
+// The reserved name under which the collections of a document, or
+// the databases, are listed.
+const COLLECTIONS = "_collections"
+
 /*
 Obtains resource from the specified path "request." Starts looking at the "root" collectioon holder.
 
@@ -213,47 +241,47 @@ func HandlePathError(w http.ResponseWriter, r *http.Request, code int) {
 	case ERROR_BAD_SLASH:
 		slog.Info("Invalid path: malformed slash.", "path", r.URL.Path)
 		msg := fmt.Sprintf("Invalid path: malformed slash in pathname.")
-		errorMessage.ErrorResponse(w, msg, http.StatusBadRequest)
+		errorMessage.RespondCode(w, r, errorMessage.CODE_BAD_PATH, msg, http.StatusBadRequest)
 	case ERROR_NO_VERSION:
 		slog.Info("Invalid path: did not include version", "path", r.URL.Path)
 		msg := fmt.Sprintf("Invalid path: did not include version.")
-		errorMessage.ErrorResponse(w, msg, http.StatusBadRequest)
+		errorMessage.RespondCode(w, r, errorMessage.CODE_BAD_PATH, msg, http.StatusBadRequest)
 	case ERROR_NO_DB:
 		slog.Info("User attempted to access non-extant database", "path", r.URL.Path)
 		msg := fmt.Sprintf("Invalid path: could not find resource.")
-		errorMessage.ErrorResponse(w, msg, http.StatusNotFound)
+		errorMessage.Respond(w, r, msg, http.StatusNotFound)
 	case ERROR_NO_DOC:
 		slog.Info("User attempted to access non-extant document", "path", r.URL.Path)
 		msg := fmt.Sprintf("Invalid path: could not find resource.")
-		errorMessage.ErrorResponse(w, msg, http.StatusNotFound)
+		errorMessage.Respond(w, r, msg, http.StatusNotFound)
 	case ERROR_NO_COLL:
 		slog.Info("User attempted to access non-extant collection", "path", r.URL.Path)
 		msg := fmt.Sprintf("Invalid path: could not find resource.")
-		errorMessage.ErrorResponse(w, msg, http.StatusNotFound)
+		errorMessage.Respond(w, r, msg, http.StatusNotFound)
 	case RESOURCE_DB:
 		slog.Info("Invalid database resource for request", "path", r.URL.Path)
 		msg := fmt.Sprintf("Invalid request: request does not support databases")
-		errorMessage.ErrorResponse(w, msg, http.StatusBadRequest)
+		errorMessage.Respond(w, r, msg, http.StatusBadRequest)
 	case RESOURCE_COLL:
 		slog.Info("Invalid collection request for request", "path", r.URL.Path)
 		msg := fmt.Sprintf("Invalid request: request does not support collections")
-		errorMessage.ErrorResponse(w, msg, http.StatusBadRequest)
+		errorMessage.Respond(w, r, msg, http.StatusBadRequest)
 	case RESOURCE_DOC:
 		slog.Info("Invalid document request for request", "path", r.URL.Path)
 		msg := fmt.Sprintf("Invalid request: request does not support documents")
-		errorMessage.ErrorResponse(w, msg, http.StatusBadRequest)
+		errorMessage.Respond(w, r, msg, http.StatusBadRequest)
 	case RESOURCE_DB_PD:
 		slog.Info("Invalid database (no slash) request for request", "path", r.URL.Path)
 		msg := fmt.Sprintf("Invalid request: invalid syntax for database or does not support database.")
-		errorMessage.ErrorResponse(w, msg, http.StatusBadRequest)
+		errorMessage.RespondCode(w, r, errorMessage.CODE_BAD_PATH, msg, http.StatusBadRequest)
 	case ERROR_BLANK_PATHNAME:
 		slog.Info("Invalid path name (empty name for resource)", "path", r.URL.Path)
 		msg := fmt.Sprintf("Invalid path: empty name for resource")
-		errorMessage.ErrorResponse(w, msg, http.StatusNotFound)
+		errorMessage.RespondCode(w, r, errorMessage.CODE_BAD_PATH, msg, http.StatusNotFound)
 	default:
 		slog.Info("Internal Error: unhandled error code", "path", r.URL.Path, "code", code)
 		msg := fmt.Sprintf("ERROR: handlePath unhandled error code: %d", code)
-		errorMessage.ErrorResponse(w, msg, http.StatusInternalServerError)
+		errorMessage.Respond(w, r, msg, http.StatusInternalServerError)
 	}
 }
 
@@ -270,3 +298,146 @@ func GetRelativePathDB(path string) string {
 	trimmedpath := strings.TrimPrefix(path, "/v1")
 	return trimmedpath
 }
+
+/*
+Splits a request to the indexes of a database or collection, of the form
+<collection path>/_indexes/<name>, into the path of the database or collection
+(with a trailing slash) and the name of the index. The name is empty for
+requests to the whole set of indexes.
+
+Returns false if the request is not to indexes.
+*/
+func CutIndexRequest(request string) (collPath string, name string, found bool) {
+	path, found := strings.CutPrefix(request, "/v1/")
+	if !found {
+		return "", "", false
+	}
+
+	// Indexes take the place of a document, at an odd position
+	resources := strings.Split(path, "/")
+	for i := 1; i < len(resources); i += 2 {
+		if resources[i] != INDEXES {
+			continue
+		}
+		if len(resources) > i+2 {
+			return "", "", false
+		}
+		if len(resources) == i+2 {
+			name = resources[i+1]
+		}
+		return "/v1/" + strings.Join(resources[:i], "/") + "/", name, true
+	}
+
+	return "", "", false
+}
+
+// Tells if a request is to the schema of a database or collection,
+// <collection path>/_schema, and returns the path of the database or
+// collection (with a trailing slash) if so.
+func CutSchemaRequest(request string) (collPath string, found bool) {
+	path, found := strings.CutPrefix(request, "/v1/")
+	if !found {
+		return "", false
+	}
+
+	// The schema takes the place of a document, at an odd position
+	resources := strings.Split(path, "/")
+	if len(resources) < 2 || len(resources)%2 != 0 || resources[len(resources)-1] != SCHEMA {
+		return "", false
+	}
+	return "/v1/" + strings.Join(resources[:len(resources)-1], "/") + "/", true
+}
+
+// Tells if request is for the schema of the server, /v1/_schema.
+func IsServerSchemaRequest(request string) bool {
+	return request == "/v1/"+SCHEMA
+}
+
+// Tells if a request is to the transaction endpoint of a database,
+// /v1/<db>/_transaction, and returns the name of the database if so.
+func CutTransactionRequest(request string) (dbName string, found bool) {
+	path, found := strings.CutPrefix(request, "/v1/")
+	if !found {
+		return "", false
+	}
+
+	dbName, found = strings.CutSuffix(path, "/"+TRANSACTION)
+	if !found || dbName == "" || strings.Contains(dbName, "/") {
+		return "", false
+	}
+	return dbName, true
+}
+
+// Tells if a request is to the storage usage endpoint of a database,
+// /v1/<db>/_usage, and returns the name of the database if so.
+func CutUsageRequest(request string) (dbName string, found bool) {
+	path, found := strings.CutPrefix(request, "/v1/")
+	if !found {
+		return "", false
+	}
+
+	dbName, found = strings.CutSuffix(path, "/"+USAGE)
+	if !found || dbName == "" || strings.Contains(dbName, "/") {
+		return "", false
+	}
+	return dbName, true
+}
+
+// Tells if a request is for a listing of the databases, /v1/_collections,
+// or of the collections of a document, <document path>/_collections.
+// Returns the path of the document, or "" for the databases, if so.
+func CutCollectionsRequest(request string) (docPath string, found bool) {
+	path, found := strings.CutPrefix(request, "/v1/")
+	if !found {
+		return "", false
+	}
+
+	// The listing takes the place of a collection, at an even position
+	resources := strings.Split(path, "/")
+	if len(resources)%2 != 1 || resources[len(resources)-1] != COLLECTIONS {
+		return "", false
+	}
+	if len(resources) == 1 {
+		return "", true
+	}
+	return "/v1/" + strings.Join(resources[:len(resources)-1], "/"), true
+}
+
+// Tells if request is for the WebSocket endpoint, /v1/_ws.
+func IsWebSocketRequest(request string) bool {
+	return request == "/v1/"+WEBSOCKET
+}
+
+// Tells if request is for the audit trail endpoint, /v1/_audit.
+func IsAuditRequest(request string) bool {
+	return request == "/v1/"+AUDIT
+}
+
+// Gets the name of the database a request is to, the first
+// name after /v1/, or "" if there is none.
+func DatabaseOf(request string) string {
+	path, found := strings.CutPrefix(request, "/v1/")
+	if !found {
+		return ""
+	}
+
+	dbName, _, _ := strings.Cut(path, "/")
+	return dbName
+}
+
+// Tells if a request is to the roles of users on a database,
+// /v1/<db>/_roles/<user>, and returns the name of the database
+// and the user if so. The user is empty for requests to the roles
+// of every user, /v1/<db>/_roles/.
+func CutRolesRequest(request string) (dbName string, user string, found bool) {
+	path, found := strings.CutPrefix(request, "/v1/")
+	if !found {
+		return "", "", false
+	}
+
+	resources := strings.Split(path, "/")
+	if len(resources) != 3 || resources[0] == "" || resources[1] != ROLES {
+		return "", "", false
+	}
+	return resources[0], resources[2], true
+}
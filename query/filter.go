@@ -0,0 +1,396 @@
+// Package query implements the filter language used to select
+// documents in collection queries, along with JSON pointer
+// lookups and comparisons of JSON values.
+//
+// A filter is made of predicates on JSON pointers into a document's
+// output, so "/doc/..." selects from the document and "/meta/..."
+// from its metadata. The predicates are
+//
+//	<pointer> == <value>    (also !=, <, <=, >, >=)
+//	<pointer> in [<value>, ...]
+//	exists <pointer>
+//
+// where values are JSON literals. Predicates may be combined with
+// "and", "or", "not" and parentheses, for example
+//
+//	/doc/age >= 21 and (/meta/createdBy == "bob" or not exists /doc/owner)
+package query
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/jsonvisit"
+)
+
+// A filter is a parsed filter expression.
+type Filter struct {
+	root node   // The root of the expression tree.
+	text string // The original text of the filter.
+}
+
+// A node of a filter expression tree.
+type node interface {
+	// Tells if a resource satisfies the expression.
+	eval(resource any) bool
+}
+
+// A node combining two expressions with "and".
+type andNode struct {
+	left, right node
+}
+
+// A node combining two expressions with "or".
+type orNode struct {
+	left, right node
+}
+
+// A node negating an expression.
+type notNode struct {
+	inner node
+}
+
+// A node comparing the value at a pointer with a literal.
+type compareNode struct {
+	pointer string   // The pointer, as written.
+	tokens  []string // The reference tokens of the pointer.
+	op      string   // The comparison operator.
+	value   any      // The literal to compare with.
+}
+
+// A node testing if the value at a pointer is one of several literals.
+type inNode struct {
+	tokens []string // The reference tokens of the pointer.
+	values []any    // The literals to look for.
+}
+
+// A node testing if a pointer leads to a value.
+type existsNode struct {
+	tokens []string // The reference tokens of the pointer.
+}
+
+// A condition is a comparison that every resource matching a filter satisfies.
+type Condition struct {
+	Pointer string   // The pointer, as written.
+	Tokens  []string // The reference tokens of the pointer.
+	Op      string   // The comparison operator.
+	Value   any      // The literal compared with.
+}
+
+// The comparison operators, longest first so that prefixes do not match.
+var operators = []string{"==", "!=", "<=", ">=", "<", ">"}
+
+// A parser holds the state of parsing a filter.
+type parser struct {
+	input string // The filter being parsed.
+	pos   int    // The position of the next unread character.
+}
+
+// Parses a filter expression.
+func Parse(text string) (*Filter, error) {
+	p := parser{input: text}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	p.skipSpace()
+	if p.pos != len(p.input) {
+		return nil, p.errorf("unexpected %q", p.input[p.pos:])
+	}
+
+	return &Filter{root, text}, nil
+}
+
+// Combines two parsed filters with "and", so that a resource must
+// satisfy both. The text of the result parses back to the same
+// expression, as each filter is a whole expression on its own.
+func And(left *Filter, right *Filter) *Filter {
+	return &Filter{&andNode{left.root, right.root}, "(" + left.text + ") and (" + right.text + ")"}
+}
+
+// Tells if a resource (a JSON value of a document's output) satisfies this filter.
+func (f *Filter) Match(resource any) bool {
+	return f.root.eval(resource)
+}
+
+// Tells if a JSON encoded resource satisfies this filter.
+// Resources that cannot be decoded never match.
+func (f *Filter) MatchJSON(data []byte) bool {
+	var resource any
+	err := json.Unmarshal(data, &resource)
+	if err != nil {
+		return false
+	}
+	return f.Match(resource)
+}
+
+// Returns the comparisons joined by "and" at the top of this filter.
+// A resource matching the filter satisfies all of them, so they can
+// be used to narrow down the resources to check, for example with
+// an index.
+func (f *Filter) Conditions() []Condition {
+	conditions := make([]Condition, 0)
+	nodes := []node{f.root}
+	for len(nodes) > 0 {
+		switch n := nodes[0].(type) {
+		case *andNode:
+			nodes = append(nodes, n.left, n.right)
+		case *compareNode:
+			conditions = append(conditions, Condition{n.pointer, n.tokens, n.op, n.value})
+		}
+		nodes = nodes[1:]
+	}
+	return conditions
+}
+
+// Returns the original text of this filter.
+func (f *Filter) String() string {
+	return f.text
+}
+
+// Parses a sequence of expressions joined by "or".
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.keyword("or") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &orNode{left, right}
+	}
+
+	return left, nil
+}
+
+// Parses a sequence of expressions joined by "and".
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.keyword("and") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &andNode{left, right}
+	}
+
+	return left, nil
+}
+
+// Parses a negation, a parenthesized expression or a predicate.
+func (p *parser) parseUnary() (node, error) {
+	if p.keyword("not") {
+		inner, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{inner}, nil
+	}
+
+	if p.symbol("(") {
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.symbol(")") {
+			return nil, p.errorf("missing closing parenthesis")
+		}
+		return inner, nil
+	}
+
+	if p.keyword("exists") {
+		_, tokens, err := p.parsePointer()
+		if err != nil {
+			return nil, err
+		}
+		return &existsNode{tokens}, nil
+	}
+
+	return p.parsePredicate()
+}
+
+// Parses a comparison or "in" predicate.
+func (p *parser) parsePredicate() (node, error) {
+	pointer, tokens, err := p.parsePointer()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.keyword("in") {
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		values, ok := value.([]any)
+		if !ok {
+			return nil, p.errorf("expected an array after in")
+		}
+		return &inNode{tokens, values}, nil
+	}
+
+	p.skipSpace()
+	for _, op := range operators {
+		if strings.HasPrefix(p.input[p.pos:], op) {
+			p.pos += len(op)
+			value, err := p.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			return &compareNode{pointer, tokens, op, value}, nil
+		}
+	}
+
+	return nil, p.errorf("expected an operator after %s", pointer)
+}
+
+// Parses a JSON pointer, which ends at a space, parenthesis or operator.
+func (p *parser) parsePointer() (string, []string, error) {
+	p.skipSpace()
+	if p.pos >= len(p.input) || p.input[p.pos] != '/' {
+		return "", nil, p.errorf("expected a pointer starting with /")
+	}
+
+	start := p.pos
+	for p.pos < len(p.input) && !strings.ContainsRune(" \t\n()=!<>", rune(p.input[p.pos])) {
+		p.pos++
+	}
+
+	pointer := p.input[start:p.pos]
+	tokens, err := ParsePointer(pointer)
+	return pointer, tokens, err
+}
+
+// Parses a JSON literal.
+func (p *parser) parseValue() (any, error) {
+	p.skipSpace()
+	decoder := json.NewDecoder(strings.NewReader(p.input[p.pos:]))
+
+	var value any
+	err := decoder.Decode(&value)
+	if err != nil {
+		return nil, p.errorf("invalid value: %s", err.Error())
+	}
+
+	p.pos += int(decoder.InputOffset())
+	return value, nil
+}
+
+// Consumes a keyword if it is next in the input.
+func (p *parser) keyword(word string) bool {
+	p.skipSpace()
+	rest := p.input[p.pos:]
+	if !strings.HasPrefix(rest, word) {
+		return false
+	}
+
+	// The keyword must not just be the start of a longer word
+	if len(rest) > len(word) && (unicode.IsLetter(rune(rest[len(word)])) || unicode.IsDigit(rune(rest[len(word)]))) {
+		return false
+	}
+
+	p.pos += len(word)
+	return true
+}
+
+// Consumes a symbol if it is next in the input.
+func (p *parser) symbol(sym string) bool {
+	p.skipSpace()
+	if strings.HasPrefix(p.input[p.pos:], sym) {
+		p.pos += len(sym)
+		return true
+	}
+	return false
+}
+
+// Skips any whitespace.
+func (p *parser) skipSpace() {
+	for p.pos < len(p.input) && unicode.IsSpace(rune(p.input[p.pos])) {
+		p.pos++
+	}
+}
+
+// Creates an error at the current position.
+func (p *parser) errorf(format string, args ...any) error {
+	return fmt.Errorf("filter position %d: %s", p.pos, fmt.Sprintf(format, args...))
+}
+
+// Evaluates an and node.
+func (n *andNode) eval(resource any) bool {
+	return n.left.eval(resource) && n.right.eval(resource)
+}
+
+// Evaluates an or node.
+func (n *orNode) eval(resource any) bool {
+	return n.left.eval(resource) || n.right.eval(resource)
+}
+
+// Evaluates a not node.
+func (n *notNode) eval(resource any) bool {
+	return !n.inner.eval(resource)
+}
+
+// Evaluates a comparison node. Comparisons with a pointer that has
+// no value, and ordering comparisons of values that are not
+// comparable, are false.
+func (n *compareNode) eval(resource any) bool {
+	value, found := Lookup(resource, n.tokens)
+	if !found {
+		return false
+	}
+
+	switch n.op {
+	case "==":
+		return jsonvisit.Equal(value, n.value)
+	case "!=":
+		return !jsonvisit.Equal(value, n.value)
+	}
+
+	order, ok := Compare(value, n.value)
+	if !ok {
+		return false
+	}
+
+	switch n.op {
+	case "<":
+		return order < 0
+	case "<=":
+		return order <= 0
+	case ">":
+		return order > 0
+	case ">=":
+		return order >= 0
+	default:
+		return false
+	}
+}
+
+// Evaluates an in node.
+func (n *inNode) eval(resource any) bool {
+	value, found := Lookup(resource, n.tokens)
+	if !found {
+		return false
+	}
+
+	for _, candidate := range n.values {
+		if jsonvisit.Equal(value, candidate) {
+			return true
+		}
+	}
+	return false
+}
+
+// Evaluates an exists node.
+func (n *existsNode) eval(resource any) bool {
+	_, found := Lookup(resource, n.tokens)
+	return found
+}
@@ -0,0 +1,137 @@
+package query
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// Creates a resource shaped like a document's output for testing.
+func createTestResource() any {
+	var resource any
+	json.Unmarshal([]byte(`{
+		"path": "/doc",
+		"doc": {"age": 30, "name": "alice", "tags": ["a", "b"], "a/b": {"~": true}, "none": null},
+		"meta": {"createdBy": "bob", "createdAt": 100}
+	}`), &resource)
+	return resource
+}
+
+// Tests pointer lookups, including escaped tokens and array indices.
+func TestLookup(t *testing.T) {
+	resource := createTestResource()
+
+	data := []struct {
+		pointer string
+		found   bool
+		value   any
+	}{
+		{"/doc/age", true, 30.0},
+		{"/doc/tags/1", true, "b"},
+		{"/doc/a~1b/~0", true, true},
+		{"/doc/none", true, nil},
+		{"/meta/createdBy", true, "bob"},
+		{"/doc/tags/2", false, nil},
+		{"/doc/age/x", false, nil},
+		{"/doc/missing", false, nil},
+	}
+
+	for i, d := range data {
+		tokens, err := ParsePointer(d.pointer)
+		if err != nil {
+			t.Fatalf("Test %d: expected no errors, got %s", i, err.Error())
+		}
+		value, found := Lookup(resource, tokens)
+		if found != d.found || (found && value != d.value) {
+			t.Errorf("Test %d: expected %v %v, got %v %v", i, d.found, d.value, found, value)
+		}
+	}
+}
+
+// Tests that filters select the expected resources.
+func TestMatch(t *testing.T) {
+	resource := createTestResource()
+
+	data := []struct {
+		filter string
+		match  bool
+	}{
+		{`/doc/age == 30`, true},
+		{`/doc/age != 30`, false},
+		{`/doc/age>=30`, true},
+		{`/doc/age < 30`, false},
+		{`/doc/name > "al"`, true},
+		{`/doc/name < 5`, false},
+		{`/doc/tags == ["a","b"]`, true},
+		{`/doc/name in ["bob", "alice"]`, true},
+		{`/doc/name in ["bob"]`, false},
+		{`exists /doc/none`, true},
+		{`exists /doc/missing`, false},
+		{`not exists /doc/missing`, true},
+		{`/doc/age > 20 and /meta/createdBy == "bob"`, true},
+		{`/doc/age > 40 or /meta/createdBy == "bob"`, true},
+		{`/doc/age > 40 or (/meta/createdBy == "bob" and /doc/age < 20)`, false},
+		{`/doc/missing != 1`, false},
+	}
+
+	for i, d := range data {
+		filter, err := Parse(d.filter)
+		if err != nil {
+			t.Fatalf("Test %d: expected no errors, got %s", i, err.Error())
+		}
+		if filter.Match(resource) != d.match {
+			t.Errorf("Test %d: expected %s to be %v", i, d.filter, d.match)
+		}
+	}
+}
+
+// Tests that malformed filters are rejected.
+func TestParseErrors(t *testing.T) {
+	data := []string{
+		``,
+		`doc/age == 1`,
+		`/doc/age`,
+		`/doc/age == `,
+		`/doc/age == 1 and`,
+		`(/doc/age == 1`,
+		`/doc/age in 1`,
+		`/doc/age == 1 /doc/name == 2`,
+	}
+
+	for i, d := range data {
+		_, err := Parse(d)
+		if err == nil {
+			t.Errorf("Test %d: expected error for %q, did not get", i, d)
+		}
+	}
+}
+
+// Tests that filters combined with And keep both expressions whole,
+// including when their text is parsed again.
+func TestAnd(t *testing.T) {
+	resource := createTestResource()
+	owner, _ := Parse(`/meta/createdBy == "alice"`)
+
+	data := []struct {
+		filter string
+		match  bool
+	}{
+		{`/doc/age == 30`, false},
+		{`/doc/age == 30 or exists /meta`, false},
+		{`not exists /doc/missing`, false},
+	}
+
+	for i, d := range data {
+		filter, err := Parse(d.filter)
+		if err != nil {
+			t.Fatalf("Test %d: expected no errors, got %s", i, err.Error())
+		}
+		combined := And(owner, filter)
+		reparsed, err := Parse(combined.String())
+		if err != nil {
+			t.Fatalf("Test %d: expected %q to parse, got %s", i, combined.String(), err.Error())
+		}
+		if combined.Match(resource) != d.match || reparsed.Match(resource) != d.match {
+			t.Errorf("Test %d: expected %s to be %v", i, combined.String(), d.match)
+		}
+	}
+}
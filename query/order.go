@@ -0,0 +1,169 @@
+package query
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// The field that orders documents by their names.
+const ORDER_BY_NAME = "name"
+
+// An order sorts documents by their names, or by the value
+// at a pointer into their output with names breaking ties.
+type Order struct {
+	field  string   // ORDER_BY_NAME or the pointer documents are ordered by.
+	tokens []string // The reference tokens of the pointer, nil when ordering by name.
+	desc   bool     // Whether the order is descending.
+}
+
+// A key is the position of a document in an order.
+type Key struct {
+	Name  string // The name of the document.
+	Found bool   // Whether the pointer of the order leads to a value in the document.
+	Value any    // The value at the pointer of the order.
+}
+
+// The contents of a cursor, before encoding.
+type cursor struct {
+	Field string `json:"o"`           // The field of the order the cursor belongs to.
+	Desc  bool   `json:"d"`           // The direction of the order the cursor belongs to.
+	Name  string `json:"n"`           // The name of the last document returned.
+	Found bool   `json:"f"`           // Whether the last document returned had a value at the pointer.
+	Value any    `json:"v,omitempty"` // The value at the pointer of the last document returned.
+}
+
+// Creates an order on field, ORDER_BY_NAME or a JSON pointer, in the
+// direction "asc" or "desc". Empty arguments select the defaults,
+// ascending by name.
+func NewOrder(field string, direction string) (*Order, error) {
+	order := Order{field: field}
+	if field == "" {
+		order.field = ORDER_BY_NAME
+	}
+
+	if order.field != ORDER_BY_NAME {
+		tokens, err := ParsePointer(order.field)
+		if err != nil {
+			return nil, err
+		}
+		order.tokens = tokens
+	}
+
+	switch direction {
+	case "", "asc":
+	case "desc":
+		order.desc = true
+	default:
+		return nil, fmt.Errorf("unknown direction %q", direction)
+	}
+
+	return &order, nil
+}
+
+// Tells if this order needs the output of documents, not just their names.
+func (o *Order) ByField() bool {
+	return o.tokens != nil
+}
+
+// Returns the key of a document with the given name and output
+// (a JSON value, which is ignored when ordering by name).
+func (o *Order) KeyOf(name string, resource any) Key {
+	key := Key{Name: name}
+	if o.tokens != nil {
+		key.Value, key.Found = Lookup(resource, o.tokens)
+	}
+	return key
+}
+
+// Tells if key a comes before key b in this order.
+func (o *Order) Less(a Key, b Key) bool {
+	cmp := 0
+	if o.tokens != nil {
+		cmp = compareTotal(a, b)
+	}
+	if cmp == 0 {
+		cmp = strings.Compare(a.Name, b.Name)
+	}
+
+	if o.desc {
+		return cmp > 0
+	}
+	return cmp < 0
+}
+
+// Encodes an opaque cursor which resumes this order after key.
+func (o *Order) Cursor(key Key) string {
+	data, err := json.Marshal(cursor{o.field, o.desc, key.Name, key.Found, key.Value})
+	if err != nil {
+		// This should never happen, values come from JSON documents
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// Decodes a cursor made by Cursor on the same order.
+func (o *Order) ParseCursor(encoded string) (Key, error) {
+	var key Key
+
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return key, errors.New("malformed cursor")
+	}
+
+	var c cursor
+	err = json.Unmarshal(data, &c)
+	if err != nil {
+		return key, errors.New("malformed cursor")
+	}
+	if c.Field != o.field || c.Desc != o.desc {
+		return key, errors.New("cursor belongs to a different order")
+	}
+
+	return Key{c.Name, c.Found, c.Value}, nil
+}
+
+// Ranks the types of JSON values, so values of different types can be ordered.
+func typeRank(found bool, value any) int {
+	if !found {
+		return 0
+	}
+
+	switch value.(type) {
+	case nil:
+		return 1
+	case bool:
+		return 2
+	case float64:
+		return 3
+	case string:
+		return 4
+	case []any:
+		return 5
+	default:
+		return 6
+	}
+}
+
+// Compares the values of two keys in a total order. Missing values come
+// first, then null, booleans, numbers, strings, arrays and objects.
+// Arrays and objects are ordered by their JSON encodings.
+func compareTotal(a Key, b Key) int {
+	aRank := typeRank(a.Found, a.Value)
+	bRank := typeRank(b.Found, b.Value)
+	if aRank != bRank {
+		return aRank - bRank
+	}
+
+	cmp, ok := Compare(a.Value, b.Value)
+	if ok {
+		return cmp
+	}
+
+	// Missing values and nulls are equal; compare anything else by encoding
+	aJSON, _ := json.Marshal(a.Value)
+	bJSON, _ := json.Marshal(b.Value)
+	return strings.Compare(string(aJSON), string(bJSON))
+}
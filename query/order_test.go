@@ -0,0 +1,68 @@
+package query
+
+import (
+	"sort"
+	"testing"
+)
+
+// Tests that values of every type are ordered, with names breaking ties.
+func TestOrderLess(t *testing.T) {
+	order, err := NewOrder("/v", "")
+	if err != nil {
+		t.Fatalf("expected no errors, got %s", err.Error())
+	}
+
+	keys := []Key{
+		{"k", true, map[string]any{}},
+		{"j", true, []any{}},
+		{"i", true, "b"},
+		{"h", true, "a"},
+		{"g", true, 2.0},
+		{"f", true, 1.0},
+		{"e", true, true},
+		{"d", true, false},
+		{"c", true, nil},
+		{"b", false, nil},
+		{"a", false, nil},
+	}
+	sort.Slice(keys, func(i, j int) bool { return order.Less(keys[i], keys[j]) })
+
+	expected := "abcdefghijk"
+	for i, key := range keys {
+		if key.Name != expected[i:i+1] {
+			t.Errorf("Position %d: expected %s, got %s", i, expected[i:i+1], key.Name)
+		}
+	}
+
+	desc, _ := NewOrder("/v", "desc")
+	if !desc.Less(keys[1], keys[0]) {
+		t.Error("expected descending order to be reversed")
+	}
+}
+
+// Tests that cursors round trip and only resume the order they belong to.
+func TestCursor(t *testing.T) {
+	order, _ := NewOrder("/doc/age", "desc")
+	key := Key{"doc", true, 30.0}
+
+	parsed, err := order.ParseCursor(order.Cursor(key))
+	if err != nil || parsed != key {
+		t.Fatalf("expected %v, got %v, %v", key, parsed, err)
+	}
+
+	other, _ := NewOrder("/doc/age", "asc")
+	_, err = other.ParseCursor(order.Cursor(key))
+	if err == nil {
+		t.Error("expected error for cursor of a different order")
+	}
+
+	_, err = order.ParseCursor("not a cursor")
+	if err == nil {
+		t.Error("expected error for malformed cursor")
+	}
+
+	_, err = NewOrder("doc", "")
+	if err == nil {
+		t.Error("expected error for pointer without leading slash")
+	}
+}
@@ -0,0 +1,156 @@
+package query
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/jsonvisit"
+)
+
+// The error returned when a pointer does not lead to a value.
+var errNoValue = errors.New("no value at pointer")
+
+// A struct that visits a JSON value to find the value a pointer leads to.
+type pointerVisitor struct {
+	tokens []string // The remaining reference tokens of the pointer.
+}
+
+// Splits a JSON pointer (RFC 6901) into its unescaped reference tokens.
+// The empty pointer refers to the whole document.
+func ParsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return []string{}, nil
+	}
+
+	rest, found := strings.CutPrefix(pointer, "/")
+	if !found {
+		return nil, fmt.Errorf("pointer %q missing leading slash", pointer)
+	}
+
+	tokens := strings.Split(rest, "/")
+	for i, token := range tokens {
+		// ~1 must be unescaped before ~0, so "~01" becomes "~1"
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// Finds the value that the reference tokens of a pointer lead to
+// inside value. Returns false if there is no such value.
+func Lookup(value any, tokens []string) (any, bool) {
+	visitor := pointerVisitor{tokens}
+	found, err := jsonvisit.Accept(value, &visitor)
+	return found, err == nil
+}
+
+// Converts a Go value, such as the output of a document, into
+// a JSON value that can be visited.
+func ToJSON(value any) (any, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	var jsonValue any
+	err = json.Unmarshal(data, &jsonValue)
+	return jsonValue, err
+}
+
+// Handles visiting a JSON object with this pointer.
+func (p *pointerVisitor) Map(m map[string]any) (any, error) {
+	if len(p.tokens) == 0 {
+		return m, nil
+	}
+
+	next, found := m[p.tokens[0]]
+	if !found {
+		return nil, errNoValue
+	}
+
+	p.tokens = p.tokens[1:]
+	return jsonvisit.Accept(next, p)
+}
+
+// Handles visiting a slice with this pointer.
+func (p *pointerVisitor) Slice(s []any) (any, error) {
+	if len(p.tokens) == 0 {
+		return s, nil
+	}
+
+	index, err := strconv.Atoi(p.tokens[0])
+	if err != nil || index < 0 || index >= len(s) {
+		return nil, errNoValue
+	}
+
+	p.tokens = p.tokens[1:]
+	return jsonvisit.Accept(s[index], p)
+}
+
+// Handles visiting a bool with this pointer.
+func (p *pointerVisitor) Bool(b bool) (any, error) {
+	return p.leaf(b)
+}
+
+// Handles visiting a float with this pointer.
+func (p *pointerVisitor) Float64(f float64) (any, error) {
+	return p.leaf(f)
+}
+
+// Handles visiting a string with this pointer.
+func (p *pointerVisitor) String(s string) (any, error) {
+	return p.leaf(s)
+}
+
+// Handles visiting a null object with this pointer.
+func (p *pointerVisitor) Null() (any, error) {
+	return p.leaf(nil)
+}
+
+// Returns a scalar value if the pointer ends at it.
+func (p *pointerVisitor) leaf(value any) (any, error) {
+	if len(p.tokens) != 0 {
+		return nil, errNoValue
+	}
+	return value, nil
+}
+
+// Compares two JSON values of the same type. Numbers and strings
+// compare in their natural order, and false is less than true.
+// Returns false if the values are not comparable.
+func Compare(a any, b any) (int, bool) {
+	switch aVal := a.(type) {
+	case float64:
+		bVal, ok := b.(float64)
+		if !ok {
+			return 0, false
+		}
+		if aVal < bVal {
+			return -1, true
+		} else if aVal > bVal {
+			return 1, true
+		}
+		return 0, true
+	case string:
+		bVal, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(aVal, bVal), true
+	case bool:
+		bVal, ok := b.(bool)
+		if !ok {
+			return 0, false
+		}
+		if aVal == bVal {
+			return 0, true
+		} else if bVal {
+			return -1, true
+		}
+		return 1, true
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,127 @@
+// Package quota has structs and methods for limiting how much
+// a database may store: how many documents it holds, how many
+// bytes of JSON its documents take up, and how deeply its
+// collections nest. The usage of a database is shared by all of
+// its collections, and counted as documents are written and removed.
+package quota
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/structs"
+)
+
+// An error is a write refused for going over a quota, with
+// the status code to respond with.
+type Error struct {
+	Code int    // The HTTP status code of the error.
+	msg  string // The message of the error.
+}
+
+// Returns the message of this error.
+func (e *Error) Error() string {
+	return e.msg
+}
+
+// A usage holds the limits of a database and what it stores.
+type Usage struct {
+	mu        *sync.Mutex   // Guards the fields below.
+	limits    structs.Quota // The limits of the database, zero where there are none.
+	documents int64         // The number of documents stored.
+	bytes     int64         // The number of bytes of JSON the documents take up.
+}
+
+// Creates an empty usage with limits.
+func New(limits structs.Quota) *Usage {
+	return &Usage{&sync.Mutex{}, limits, 0, 0}
+}
+
+// Gets the limits of this usage.
+func (u *Usage) Limits() structs.Quota {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.limits
+}
+
+// Replaces the limits of this usage. What is already stored is
+// kept, even if it is over the new limits.
+func (u *Usage) SetLimits(limits structs.Quota) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.limits = limits
+}
+
+// Gets the number of documents stored and the bytes they take up.
+func (u *Usage) Totals() (int64, int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.documents, u.bytes
+}
+
+// Replaces what this usage counts with documents documents taking
+// up bytes bytes, as measured from the documents stored.
+func (u *Usage) Reset(documents int64, bytes int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.documents = documents
+	u.bytes = bytes
+}
+
+// Counts documents more documents and bytes more bytes, either of
+// which may be negative, if they stay within the limits. Shrinking
+// is always allowed. Writing a document of size bytes larger than
+// the whole byte limit is refused with 413, and going over a limit
+// otherwise with 507.
+func (u *Usage) Reserve(documents int64, bytes int64, size int64) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.limits.MaxBytes > 0 && size > u.limits.MaxBytes {
+		msg := fmt.Sprintf("document of %d bytes is larger than the quota of %d bytes", size, u.limits.MaxBytes)
+		return &Error{http.StatusRequestEntityTooLarge, msg}
+	}
+	if documents > 0 && u.limits.MaxDocuments > 0 && u.documents+documents > u.limits.MaxDocuments {
+		msg := fmt.Sprintf("quota of %d documents exceeded", u.limits.MaxDocuments)
+		return &Error{http.StatusInsufficientStorage, msg}
+	}
+	if bytes > 0 && u.limits.MaxBytes > 0 && u.bytes+bytes > u.limits.MaxBytes {
+		msg := fmt.Sprintf("quota of %d bytes exceeded", u.limits.MaxBytes)
+		return &Error{http.StatusInsufficientStorage, msg}
+	}
+
+	u.documents += documents
+	u.bytes += bytes
+	return nil
+}
+
+// Stops counting documents documents and bytes bytes which were removed.
+func (u *Usage) Release(documents int64, bytes int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.documents -= documents
+	u.bytes -= bytes
+}
+
+// Tells if a collection may be created depth collections deep,
+// counting the database as 1. If not, returns a 507 error.
+func (u *Usage) CheckDepth(depth int) error {
+	limits := u.Limits()
+	if limits.MaxDepth > 0 && depth > limits.MaxDepth {
+		msg := fmt.Sprintf("collections may nest at most %d deep", limits.MaxDepth)
+		return &Error{http.StatusInsufficientStorage, msg}
+	}
+	return nil
+}
+
+// Gets the number of bytes a document body takes up as JSON.
+func SizeOf(body interface{}) int64 {
+	jsonBody, err := json.Marshal(body)
+	if err != nil {
+		// This should never happen, bodies come from JSON
+		return 0
+	}
+	return int64(len(jsonBody))
+}
@@ -0,0 +1,45 @@
+package quota
+
+import (
+	"testing"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/structs"
+)
+
+// Tests that reservations are refused over the limits, with the right codes.
+func TestReserve(t *testing.T) {
+	usage := New(structs.Quota{MaxDocuments: 2, MaxBytes: 10, MaxDepth: 2})
+
+	data := []struct {
+		documents int64
+		bytes     int64
+		size      int64
+		code      int
+	}{
+		{1, 4, 4, 0},
+		{1, 11, 11, 413},
+		{1, 7, 7, 507},
+		{1, 6, 6, 0},
+		{1, 0, 0, 507},
+		{-1, -2, 2, 0},
+		{0, 3, 5, 507},
+	}
+	for i, d := range data {
+		err := usage.Reserve(d.documents, d.bytes, d.size)
+		code := 0
+		if err != nil {
+			code = err.(*Error).Code
+		}
+		if code != d.code {
+			t.Errorf("Test %d: Expected code %d, got %d", i, d.code, code)
+		}
+	}
+
+	documents, bytes := usage.Totals()
+	if documents != 1 || bytes != 8 {
+		t.Errorf("Expected 1 document of 8 bytes, got %d of %d", documents, bytes)
+	}
+	if usage.CheckDepth(2) != nil || usage.CheckDepth(3) == nil {
+		t.Errorf("Expected collections to nest at most 2 deep")
+	}
+}
@@ -0,0 +1,153 @@
+// Package ratelimit has structs and methods for limiting
+// how often each user may make each kind of request, with
+// a token bucket per user and kind of request. Each bucket
+// holds up to a burst of tokens, refills at a steady rate,
+// and gives up a token for every request it allows.
+package ratelimit
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+// The kinds of requests which are limited separately.
+const (
+	KIND_READ      = "read"
+	KIND_WRITE     = "write"
+	KIND_SUBSCRIBE = "subscribe"
+)
+
+// A rate is how often requests of one kind are allowed.
+type Rate struct {
+	PerSecond float64 `json:"rate"`  // The number of requests allowed per second, over time.
+	Burst     float64 `json:"burst"` // The number of requests allowed at once.
+}
+
+// A config holds the rates of each kind of request: the defaults,
+// and the overrides of particular users. A kind of request with no
+// rate is not limited.
+type Config struct {
+	Defaults map[string]Rate            `json:"defaults"` // The rates of every user, by kind.
+	Users    map[string]map[string]Rate `json:"users"`    // The rates of particular users, by user and then kind.
+}
+
+// A decision tells whether a request is allowed, and how
+// much of the user's budget for its kind remains.
+type Decision struct {
+	Allowed    bool          // Whether the request is allowed.
+	Limited    bool          // Whether the kind of request is limited at all.
+	Limit      int           // The number of requests allowed at once.
+	Remaining  int           // The number of requests allowed at once after this one.
+	RetryAfter time.Duration // How long until a request is allowed, if this one is not.
+}
+
+// A bucket holds the tokens of one user for one kind of request.
+type bucket struct {
+	tokens float64   // The number of tokens as of last.
+	last   time.Time // When tokens was last brought up to date.
+}
+
+// A key identifies a bucket.
+type key struct {
+	user string
+	kind string
+}
+
+// A limiter holds the buckets of every user.
+type Limiter struct {
+	mu      *sync.Mutex     // Guards buckets.
+	config  Config          // The rates of each kind of request.
+	buckets map[key]*bucket // The buckets, by user and kind.
+}
+
+// Creates a limiter with the rates of config, with every bucket full.
+func New(config Config) (*Limiter, error) {
+	check := func(rates map[string]Rate) error {
+		for kind, rate := range rates {
+			if kind != KIND_READ && kind != KIND_WRITE && kind != KIND_SUBSCRIBE {
+				return fmt.Errorf("unknown kind of request %q", kind)
+			}
+			if rate.PerSecond <= 0 || rate.Burst < 1 {
+				return fmt.Errorf("rate of %s must be positive with a burst of at least 1", kind)
+			}
+		}
+		return nil
+	}
+
+	err := check(config.Defaults)
+	if err != nil {
+		return nil, err
+	}
+	for user, rates := range config.Users {
+		err = check(rates)
+		if err != nil {
+			return nil, fmt.Errorf("user %s: %w", user, err)
+		}
+	}
+	return &Limiter{&sync.Mutex{}, config, make(map[key]*bucket)}, nil
+}
+
+// Loads a limiter from a file, which holds a JSON object of the form
+// of a config, such as:
+//
+//	{"defaults": {"read": {"rate": 10, "burst": 20}},
+//	 "users": {"alice": {"read": {"rate": 100, "burst": 200}}}}
+func Load(file string) (*Limiter, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var config Config
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return nil, err
+	}
+	return New(config)
+}
+
+// Gets the rate of a kind of request for user, and whether it is limited.
+func (l *Limiter) rateOf(user string, kind string) (Rate, bool) {
+	rate, found := l.config.Users[user][kind]
+	if found {
+		return rate, true
+	}
+	rate, found = l.config.Defaults[kind]
+	return rate, found
+}
+
+// Takes a token from the bucket of user for a kind of request,
+// if there is one, deciding whether the request is allowed.
+func (l *Limiter) Take(user string, kind string) Decision {
+	rate, limited := l.rateOf(user, kind)
+	if !limited {
+		return Decision{Allowed: true}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Refill the bucket for the time since it was last used
+	now := time.Now()
+	b, found := l.buckets[key{user, kind}]
+	if !found {
+		b = &bucket{rate.Burst, now}
+		l.buckets[key{user, kind}] = b
+	}
+	b.tokens = math.Min(rate.Burst, b.tokens+now.Sub(b.last).Seconds()*rate.PerSecond)
+	b.last = now
+
+	decision := Decision{Limited: true, Limit: int(rate.Burst)}
+	if b.tokens >= 1 {
+		b.tokens--
+		decision.Allowed = true
+	} else {
+		decision.RetryAfter = time.Duration((1 - b.tokens) / rate.PerSecond * float64(time.Second))
+	}
+	decision.Remaining = int(b.tokens)
+	return decision
+}
@@ -0,0 +1,64 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+// Tests that buckets allow a burst, refill over time, and are kept per user and kind.
+func TestTake(t *testing.T) {
+	limiter, err := New(Config{
+		Defaults: map[string]Rate{KIND_WRITE: {PerSecond: 100, Burst: 2}},
+		Users:    map[string]map[string]Rate{"root": {KIND_WRITE: {PerSecond: 100, Burst: 3}}},
+	})
+	if err != nil {
+		t.Fatalf("expected no errors, got %s", err.Error())
+	}
+
+	data := []struct {
+		user      string
+		kind      string
+		allowed   bool
+		remaining int
+	}{
+		{"alice", KIND_WRITE, true, 1},
+		{"alice", KIND_WRITE, true, 0},
+		{"alice", KIND_WRITE, false, 0},
+		{"bob", KIND_WRITE, true, 1},
+		{"root", KIND_WRITE, true, 2},
+		{"alice", KIND_READ, true, 0},
+	}
+	for i, d := range data {
+		decision := limiter.Take(d.user, d.kind)
+		if decision.Allowed != d.allowed || decision.Remaining != d.remaining {
+			t.Errorf("Test %d: Expected allowed %v with %d remaining, got %v", i, d.allowed, d.remaining, decision)
+		}
+	}
+
+	decision := limiter.Take("alice", KIND_WRITE)
+	if decision.RetryAfter <= 0 || decision.RetryAfter > 10*time.Millisecond {
+		t.Errorf("Expected to retry within 10ms, got %s", decision.RetryAfter)
+	}
+	time.Sleep(decision.RetryAfter)
+	if !limiter.Take("alice", KIND_WRITE).Allowed {
+		t.Errorf("Expected the bucket to refill")
+	}
+	if limiter.Take("alice", KIND_READ).Limited {
+		t.Errorf("Expected reads not to be limited")
+	}
+}
+
+// Tests that bad configs are refused.
+func TestNew(t *testing.T) {
+	configs := []Config{
+		{Defaults: map[string]Rate{"delete": {PerSecond: 1, Burst: 1}}},
+		{Defaults: map[string]Rate{KIND_READ: {PerSecond: 0, Burst: 1}}},
+		{Users: map[string]map[string]Rate{"alice": {KIND_READ: {PerSecond: 1, Burst: 0}}}},
+	}
+	for i, config := range configs {
+		_, err := New(config)
+		if err == nil {
+			t.Errorf("Test %d: Expected an error", i)
+		}
+	}
+}
@@ -386,10 +386,11 @@ func (s SkipList[K, V]) Query(ctx context.Context, start K, end K) (results []Pa
 			return res, nil
 		}
 
-		// If deadline reached, then preemptively return
+		// If deadline reached, then preemptively return; otherwise retry
 		select {
 		case <-ctx.Done():
 			return nil, ctx.Err()
+		default:
 		}
 	}
 }
@@ -0,0 +1,398 @@
+// Package snapshot writes point-in-time snapshots of all the
+// databases to disk and loads them back on startup, so that only
+// the records of the write-ahead log written after the latest
+// snapshot need to be replayed.
+package snapshot
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/collection"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/document"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/interfaces"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/skiplist"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/structs"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/wal"
+)
+
+// The version of the on-disk snapshot format.
+const FORMAT_VERSION = 1
+
+// The prefix and suffix of snapshot file names.
+const (
+	SNAPSHOT_PREFIX = "snapshot-"
+	SNAPSHOT_SUFFIX = ".json"
+)
+
+// How long a snapshot may spend iterating the databases before giving up.
+const SNAPSHOT_TIMEOUT = time.Minute
+
+// A snapshot file holds every database at a point in the log.
+type snapshotFile struct {
+	Format    int         `json:"format"`    // The version of the snapshot format.
+	Seq       uint64      `json:"seq"`       // The last record of the log covered by this snapshot.
+	CreatedAt int64       `json:"createdAt"` // The time this snapshot was started.
+	Databases []collEntry `json:"databases"` // The top-level databases.
+}
+
+// A coll entry holds a database or collection and its documents.
+type collEntry struct {
+	Name      string              `json:"name"`              // The name of this collection.
+	Documents []docEntry          `json:"documents"`         // The documents of this collection, in name order.
+	Indexes   map[string]string   `json:"indexes,omitempty"` // The pointer of each index on this collection, by index name.
+	Schema    json.RawMessage     `json:"schema,omitempty"`  // The schema of this collection, if it has its own.
+	Owners    *structs.OwnerRules `json:"owners,omitempty"`  // The ownership rules of the documents of this collection, if any.
+	Quota     *structs.Quota      `json:"quota,omitempty"`   // The storage quota of this database, if any.
+}
+
+// A doc entry holds a document, its metadata and its collections.
+type docEntry struct {
+	Name        string          `json:"name"`              // The name of this document.
+	Resource    json.RawMessage `json:"resource"`          // The document and its metadata as output to clients.
+	History     json.RawMessage `json:"history,omitempty"` // The earlier revisions of this document, oldest first.
+	Collections []collEntry     `json:"collections"`       // The collections of this document, in name order.
+}
+
+// A snapshotter periodically snapshots the databases and
+// truncates the write-ahead log up to the snapshot.
+type Snapshotter struct {
+	mu   sync.Mutex                   // Ensures only one snapshot is taken at a time.
+	dir  string                       // The directory snapshots are written to.
+	log  *wal.Log                     // The log truncated after each snapshot.
+	root interfaces.ICollectionHolder // The databases to snapshot.
+	last uint64                       // The sequence number covered by the latest snapshot.
+	done chan struct{}                // Closed to stop the background loop.
+}
+
+// Creates a new snapshotter writing snapshots of root to dir. The
+// latest snapshot on disk covers the log up to the sequence number last.
+func New(dir string, log *wal.Log, root interfaces.ICollectionHolder, last uint64) *Snapshotter {
+	return &Snapshotter{dir: dir, log: log, root: root, last: last, done: make(chan struct{})}
+}
+
+// Starts taking a snapshot in the background once every interval.
+func (s *Snapshotter) Start(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-ticker.C:
+				err := s.Take()
+				if err != nil {
+					slog.Error("Snapshot failed", "error", err)
+				}
+			}
+		}
+	}()
+}
+
+// Stops taking snapshots in the background.
+func (s *Snapshotter) Stop() {
+	close(s.done)
+}
+
+// Takes a snapshot of the databases and truncates the log up to it.
+// Writers are not blocked while the snapshot is taken; any of their
+// changes not in the snapshot are replayed from the log.
+func (s *Snapshotter) Take() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Start a new log segment, so the old ones can be removed afterwards
+	seq, err := s.log.Rotate()
+	if err != nil {
+		return err
+	}
+	if seq == s.last {
+		slog.Debug("Snapshot: no changes since last snapshot", "seq", seq)
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), SNAPSHOT_TIMEOUT)
+	defer cancel()
+
+	snap := snapshotFile{Format: FORMAT_VERSION, Seq: seq, CreatedAt: time.Now().UnixMilli()}
+	snap.Databases, err = snapshotHolder(ctx, s.root)
+	if err != nil {
+		return err
+	}
+
+	err = write(s.dir, snap)
+	if err != nil {
+		return err
+	}
+	s.last = seq
+
+	// The snapshot is durable, so older snapshots and log segments are no longer needed
+	err = s.log.Truncate(seq)
+	if err != nil {
+		return err
+	}
+	removeOlder(s.dir, seq)
+
+	slog.Info("Took snapshot", "seq", seq)
+	return nil
+}
+
+// Loads the latest snapshot in dir into root, which should be empty.
+// Returns the sequence number covered by the snapshot, or 0 if there
+// is no snapshot.
+func Load(dir string, root interfaces.ICollectionHolder) (uint64, error) {
+	seqs, err := listSnapshots(dir)
+	if err != nil || len(seqs) == 0 {
+		if errors.Is(err, os.ErrNotExist) {
+			err = nil
+		}
+		return 0, err
+	}
+
+	latest := seqs[len(seqs)-1]
+	data, err := os.ReadFile(filepath.Join(dir, snapshotName(latest)))
+	if err != nil {
+		return 0, err
+	}
+
+	var snap snapshotFile
+	err = json.Unmarshal(data, &snap)
+	if err != nil {
+		return 0, err
+	}
+	if snap.Format != FORMAT_VERSION {
+		return 0, fmt.Errorf("unsupported snapshot format: %d", snap.Format)
+	}
+
+	err = restoreHolder(root, snap.Databases)
+	if err != nil {
+		return 0, err
+	}
+
+	slog.Info("Loaded snapshot", "seq", snap.Seq, "databases", len(snap.Databases))
+	return snap.Seq, nil
+}
+
+// Builds the entries of the collections held by holder.
+func snapshotHolder(ctx context.Context, holder interfaces.ICollectionHolder) ([]collEntry, error) {
+	pairs, err := holder.QueryCollections(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]collEntry, 0, len(pairs))
+	for _, pair := range pairs {
+		docs, err := snapshotCollection(ctx, pair.Value)
+		if err != nil {
+			return nil, err
+		}
+		entry := collEntry{Name: pair.Key, Documents: docs}
+		indexable, hasIndexes := interface{}(pair.Value).(interfaces.Indexable)
+		if hasIndexes {
+			entry.Indexes = indexable.Indexes()
+		}
+		schematized, hasSchema := interface{}(pair.Value).(interfaces.Schematized)
+		if hasSchema {
+			_, entry.Schema = schematized.GetSchema()
+		}
+		owned, hasOwners := interface{}(pair.Value).(interfaces.Owned)
+		if hasOwners && owned.GetOwnerRules() != (structs.OwnerRules{}) {
+			rules := owned.GetOwnerRules()
+			entry.Owners = &rules
+		}
+		metered, hasQuota := interface{}(pair.Value).(interfaces.Metered)
+		if hasQuota && metered.GetQuota() != (structs.Quota{}) {
+			limits := metered.GetQuota()
+			entry.Quota = &limits
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// Builds the entries of the documents held by coll.
+func snapshotCollection(ctx context.Context, coll interfaces.ICollection) ([]docEntry, error) {
+	pairs, err := coll.QueryDocuments(ctx, skiplist.STRING_MIN, skiplist.STRING_MAX)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]docEntry, 0, len(pairs))
+	for _, pair := range pairs {
+		resource, err := json.Marshal(pair.Value.GetRawBody())
+		if err != nil {
+			return nil, err
+		}
+
+		entry := docEntry{Name: pair.Key, Resource: resource, Collections: make([]collEntry, 0)}
+		versioned, hasHistory := interface{}(pair.Value).(interfaces.Versioned)
+		if hasHistory {
+			entry.History, err = versioned.GetHistoryJSON()
+			if err != nil {
+				return nil, err
+			}
+		}
+		holder, hasCollection := interface{}(pair.Value).(interfaces.ICollectionHolder)
+		if hasCollection {
+			entry.Collections, err = snapshotHolder(ctx, holder)
+			if err != nil {
+				return nil, err
+			}
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// Recreates the collections of entries inside holder.
+func restoreHolder(holder interfaces.ICollectionHolder, entries []collEntry) error {
+	for _, entry := range entries {
+		coll := collection.New()
+		if entry.Schema != nil {
+			err := coll.SetSchema(entry.Schema)
+			if err != nil {
+				return fmt.Errorf("invalid schema of collection %s: %w", entry.Name, err)
+			}
+		}
+		if entry.Owners != nil {
+			coll.SetOwnerRules(*entry.Owners)
+		}
+		if entry.Quota != nil {
+			coll.SetQuota(*entry.Quota)
+		}
+		holder.RestoreCollection(entry.Name, &coll)
+
+		for _, child := range entry.Documents {
+			doc, err := document.Restore(child.Resource)
+			if err != nil {
+				return fmt.Errorf("invalid document %s: %w", child.Name, err)
+			}
+			if len(child.History) > 0 {
+				err = doc.RestoreHistory(child.History)
+				if err != nil {
+					return fmt.Errorf("invalid history of document %s: %w", child.Name, err)
+				}
+			}
+			coll.RestoreDocument(child.Name, &doc)
+
+			err = restoreHolder(&doc, child.Collections)
+			if err != nil {
+				return err
+			}
+		}
+
+		// Indexes are built once all the documents are in place
+		for name, field := range entry.Indexes {
+			_, err := coll.PutIndex(context.Background(), name, field)
+			if err != nil {
+				return fmt.Errorf("invalid index %s: %w", name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Durably writes snap to dir, replacing any snapshot with the same
+// sequence number only once the new one is complete.
+func write(dir string, snap snapshotFile) error {
+	name := filepath.Join(dir, snapshotName(snap.Seq))
+	tmp := name + ".tmp"
+
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(file)
+	err = json.NewEncoder(writer).Encode(snap)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	err = os.Rename(tmp, name)
+	if err != nil {
+		return err
+	}
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Removes the snapshots in dir older than the one at seq.
+func removeOlder(dir string, seq uint64) {
+	seqs, err := listSnapshots(dir)
+	if err != nil {
+		slog.Error("Snapshot: could not list old snapshots", "error", err)
+		return
+	}
+
+	for _, old := range seqs {
+		if old < seq {
+			err = os.Remove(filepath.Join(dir, snapshotName(old)))
+			if err != nil {
+				slog.Error("Snapshot: could not remove old snapshot", "seq", old, "error", err)
+			}
+		}
+	}
+}
+
+// Returns the file name of the snapshot covering the log up to seq.
+func snapshotName(seq uint64) string {
+	return fmt.Sprintf("%s%020d%s", SNAPSHOT_PREFIX, seq, SNAPSHOT_SUFFIX)
+}
+
+// Returns the sequence numbers of the snapshots in dir, in order.
+func listSnapshots(dir string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	seqs := make([]uint64, 0)
+	for _, entry := range entries {
+		name, found := strings.CutPrefix(entry.Name(), SNAPSHOT_PREFIX)
+		name, suffixed := strings.CutSuffix(name, SNAPSHOT_SUFFIX)
+		if !found || !suffixed {
+			continue
+		}
+
+		var seq uint64
+		_, err := fmt.Sscanf(name, "%d", &seq)
+		if err == nil {
+			seqs = append(seqs, seq)
+		}
+	}
+
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs, nil
+}
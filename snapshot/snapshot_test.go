@@ -0,0 +1,110 @@
+package snapshot
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/collection"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/collectionholder"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/document"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/interfaces"
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/wal"
+)
+
+// Tests that a snapshot is loaded back into an identical hierarchy
+// and that the log is truncated up to it.
+func TestTakeLoad(t *testing.T) {
+	dir := t.TempDir()
+	log, err := wal.Open(dir, wal.SYNC_NEVER)
+	if err != nil {
+		t.Fatalf("expected no errors, got %s", err.Error())
+	}
+	defer log.Close()
+
+	// Build /db/doc/col/nested
+	root := collectionholder.New()
+	db := collection.New()
+	root.RestoreCollection("db", &db)
+	doc := document.New("/doc", "charlie", map[string]interface{}{"prop": 1.0})
+	db.RestoreDocument("doc", &doc)
+	col := collection.New()
+	col.SetSchema([]byte("{\"type\":\"string\"}"))
+	doc.RestoreCollection("col", &col)
+	nested := document.New("/doc/col/nested", "charlie", "old")
+	nested.OverwriteBody("nested", "charlie")
+	col.RestoreDocument("nested", &nested)
+	db.PutIndex(context.Background(), "byProp", "/doc/prop")
+	log.Append(wal.Record{Op: wal.OP_PUT_COLLECTION, Path: "/v1/db"})
+
+	snapshotter := New(dir, log, &root, 0)
+	err = snapshotter.Take()
+	if err != nil {
+		t.Fatalf("expected no errors, got %s", err.Error())
+	}
+
+	// The first segment is covered by the snapshot
+	_, err = os.Stat(filepath.Join(dir, "wal-00000000000000000001.log"))
+	if !os.IsNotExist(err) {
+		t.Errorf("expected first log segment to be removed, got %v", err)
+	}
+
+	loaded := collectionholder.New()
+	seq, err := Load(dir, &loaded)
+	if err != nil || seq != 1 {
+		t.Fatalf("expected seq 1 and no errors, got %d, %v", seq, err)
+	}
+
+	loadedDB, found := loaded.GetCollection("db")
+	if !found {
+		t.Fatal("expected database db")
+	}
+	if interface{}(loadedDB).(interfaces.Indexable).Indexes()["byProp"] != "/doc/prop" {
+		t.Error("expected index byProp to be restored")
+	}
+	loadedDoc, found := loadedDB.FindDocument("doc")
+	if !found || loadedDoc.GetJSONDoc().(map[string]interface{})["prop"] != 1.0 {
+		t.Fatal("expected document doc")
+	}
+	loadedCol, found := interface{}(loadedDoc).(interfaces.ICollectionHolder).GetCollection("col")
+	if !found {
+		t.Fatal("expected collection col")
+	}
+	if _, source := interface{}(loadedCol).(interfaces.Schematized).GetSchema(); string(source) != "{\"type\":\"string\"}" {
+		t.Errorf("expected schema of col to be restored, got %s", source)
+	}
+	loadedNested, found := loadedCol.FindDocument("nested")
+	if !found || loadedNested.GetJSONDoc() != "nested" {
+		t.Fatal("expected document nested")
+	}
+	if interface{}(loadedNested).(interfaces.HasMetadata).GetOriginalAuthor() != "charlie" {
+		t.Error("expected metadata to be restored")
+	}
+	revision, found := interface{}(loadedNested).(interfaces.Versioned).GetRevision(1)
+	if !found || revision != "old" {
+		t.Errorf("expected history to be restored, got %v", revision)
+	}
+}
+
+// Tests that nothing is written when there are no changes.
+func TestTakeNoChanges(t *testing.T) {
+	dir := t.TempDir()
+	log, _ := wal.Open(dir, wal.SYNC_NEVER)
+	defer log.Close()
+
+	root := collectionholder.New()
+	snapshotter := New(dir, log, &root, 0)
+	snapshotter.Take()
+
+	seqs, _ := listSnapshots(dir)
+	if len(seqs) != 0 {
+		t.Errorf("expected no snapshots, got %v", seqs)
+	}
+
+	// Loading with no snapshot starts from the beginning of the log
+	seq, err := Load(dir, &root)
+	if seq != 0 || err != nil {
+		t.Errorf("expected seq 0 and no errors, got %d, %v", seq, err)
+	}
+}
@@ -2,13 +2,20 @@
 // not associated with a file (not created by New).
 package structs
 
-import "github.com/RICE-COMP318-FALL23/owldb-p1group20/subscribe"
+import (
+	"encoding/json"
+
+	"github.com/RICE-COMP318-FALL23/owldb-p1group20/patcher"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
 
 // A PatchResponse stores the response from a Patch operation
 type PatchResponse struct {
-	Uri         string `json:"uri"`         // The URI at which this patch was applied.
-	PatchFailed bool   `json:"patchFailed"` // A boolean indicating whether this patch failed.
-	Message     string `json:"message"`     // A message indicating why a patch failed or "patches applied."
+	Uri         string `json:"uri"`                // The URI at which this patch was applied.
+	PatchFailed bool   `json:"patchFailed"`        // A boolean indicating whether this patch failed.
+	Message     string `json:"message"`            // A message indicating why a patch failed or "patches applied."
+	FailedOp    *int   `json:"failedOp,omitempty"` // The index of the patch operation which failed, if one did.
+	Invalid     error  `json:"-"`                  // The error from validating the patched document, if it did not conform to the schema.
 }
 
 // A PutOutput stores the response to a put request.
@@ -16,9 +23,143 @@ type PutOutput struct {
 	Uri string `json:"uri"` // The URI of the successful put operation.
 }
 
-// A CollSub is a wrapper for a subscriber to a collection.
-type CollSub struct {
-	Subscriber    subscribe.Subscriber // The subscriber object.
-	IntervalStart string               // The start of the interval for this subscribers query.
-	IntervalEnd   string               // The end of the interval for this subscribers query.
+// An IndexSpec describes a secondary index on a collection.
+type IndexSpec struct {
+	Name  string `json:"name,omitempty"` // The name of the index.
+	Field string `json:"field"`          // The JSON pointer into document outputs the index is on.
+}
+
+// A RoleSpec is the role of a user on a database.
+type RoleSpec struct {
+	User string `json:"user,omitempty"` // The user with the role.
+	Role string `json:"role"`           // The role: reader, writer or admin.
+}
+
+// A SessionOutput describes a session of a logged in user.
+type SessionOutput struct {
+	Id         string `json:"id"`                   // The id of the session, the SHA-256 hash of its token.
+	User       string `json:"user"`                 // The user the session belongs to.
+	CreatedAt  int64  `json:"createdAt"`            // The time the session was created.
+	ExpiresAt  int64  `json:"expiresAt"`            // The time the session expires.
+	LastUsedAt int64  `json:"lastUsedAt,omitempty"` // The time the session was last used, if it has been.
+}
+
+// A RevokeOutput stores the response to revoking the sessions of a user.
+type RevokeOutput struct {
+	Sessions      int `json:"sessions"`      // The number of sessions revoked.
+	RefreshTokens int `json:"refreshTokens"` // The number of refresh tokens revoked.
+}
+
+// A TransactionOp is one operation of a transaction.
+type TransactionOp struct {
+	Op             string          `json:"op"`                       // The operation, "put", "patch" or "delete".
+	Path           string          `json:"path"`                     // The path of the document inside the database, such as "/doc/col/doc".
+	Doc            interface{}     `json:"doc,omitempty"`            // The new document of a put.
+	Patches        []patcher.Patch `json:"patches,omitempty"`        // The patches of a patch.
+	LastModifiedAt *int64          `json:"lastModifiedAt,omitempty"` // If set, the lastModifiedAt the document must have before the transaction.
+}
+
+// A TransactionInput stores the body of a transaction request.
+type TransactionInput struct {
+	Operations []TransactionOp `json:"operations"` // The operations to apply, in order.
+}
+
+// A TransactionResult stores the outcome of a transaction for one document.
+type TransactionResult struct {
+	Uri     string `json:"uri"`     // The URI of the document.
+	Deleted bool   `json:"deleted"` // Whether the document was deleted, rather than written.
+}
+
+// A TransactionOutput stores the response to a committed transaction.
+type TransactionOutput struct {
+	Uri     string              `json:"uri"`     // The URI of the transaction endpoint.
+	Results []TransactionResult `json:"results"` // The documents changed by the transaction, in order of first change.
+}
+
+// A CollectionSpec is the body of a request creating a database or collection.
+type CollectionSpec struct {
+	Schema json.RawMessage `json:"schema,omitempty"` // The schema of the documents below it, or absent to inherit one.
+	Owners *OwnerRules     `json:"owners,omitempty"` // The ownership rules of its documents, or absent for none.
+	Quota  *Quota          `json:"quota,omitempty"`  // The storage quota of a database, or absent for none.
+}
+
+// An OwnerRules holds the ownership rules of the documents of a
+// database or collection, which restrict them to the user who
+// created them (meta.createdBy) and admins of the database.
+type OwnerRules struct {
+	OwnerWrite bool `json:"ownerWrite,omitempty"` // Whether only the creator may overwrite, patch or delete a document.
+	OwnerRead  bool `json:"ownerRead,omitempty"`  // Whether only the creator may read a document.
+}
+
+// A Quota holds the storage limits of a database, each of
+// which is unlimited if zero.
+type Quota struct {
+	MaxDocuments int64 `json:"maxDocuments,omitempty"` // The number of documents the database may hold.
+	MaxBytes     int64 `json:"maxBytes,omitempty"`     // The number of bytes of JSON its documents may take up.
+	MaxDepth     int   `json:"maxDepth,omitempty"`     // How many collections deep it may nest, counting the database itself.
+}
+
+// A UsageOutput stores the response to a request for the storage used by a database.
+type UsageOutput struct {
+	Uri       string `json:"uri"`       // The URI of the usage endpoint.
+	Documents int64  `json:"documents"` // The number of documents in the database.
+	Bytes     int64  `json:"bytes"`     // The number of bytes of JSON its documents take up.
+	Quota     Quota  `json:"quota"`     // The limits of the database.
+}
+
+// A CollectionEntry is a database or collection in a listing.
+type CollectionEntry struct {
+	Name      string `json:"name"`                // The name of the database or collection.
+	Uri       string `json:"uri"`                 // The URI of the database or collection.
+	Documents *int   `json:"documents,omitempty"` // The number of documents directly in it, if counts were asked for.
+}
+
+// A CollectionsOutput stores the response to a request for the collections of a document, or the databases.
+type CollectionsOutput struct {
+	Uri         string            `json:"uri"`         // The URI of the listing.
+	Collections []CollectionEntry `json:"collections"` // The databases or collections, sorted by name.
+}
+
+// A SchemaOutput stores the response to a request for the schema of a database or collection.
+type SchemaOutput struct {
+	Uri       string          `json:"uri"`       // The URI of the database or collection.
+	Schema    json.RawMessage `json:"schema"`    // The schema of the documents below it, or null for the server's schema.
+	Inherited bool            `json:"inherited"` // Whether the schema is inherited from an enclosing collection or the server.
+}
+
+// A SchemaViolation is a stored document which does not conform to a new schema.
+type SchemaViolation struct {
+	Path   string                  `json:"path"`   // The path of the document.
+	Errors []jsonschema.BasicError `json:"errors"` // Where and why the document does not conform.
+}
+
+// A MigrationReport stores the response to a request to replace the schema of the server.
+type MigrationReport struct {
+	Uri           string            `json:"uri"`           // The URI of the schema endpoint.
+	Applied       bool              `json:"applied"`       // Whether the new schema replaced the old one.
+	Checked       int               `json:"checked"`       // The number of documents checked against the new schema.
+	NonConforming int               `json:"nonConforming"` // The number of documents which do not conform to the new schema.
+	Violations    []SchemaViolation `json:"violations"`    // The documents which do not conform, up to a limit.
+}
+
+// A WSRequest is a message from a client on a WebSocket connection.
+type WSRequest struct {
+	Type        string `json:"type"`                     // The type of message: subscribe, unsubscribe or ack.
+	Id          string `json:"id"`                       // The client's id for the subscription.
+	Path        string `json:"path,omitempty"`           // The document or collection to subscribe to.
+	Interval    string `json:"interval,omitempty"`       // The interval of document names to subscribe to.
+	Filter      string `json:"filter,omitempty"`         // The filter documents must match to be sent.
+	LastEventId string `json:"lastEventId,omitempty"`    // The last event received, to resume after.
+	EventId     uint64 `json:"eventId,string,omitempty"` // The event acknowledged.
+}
+
+// A WSMessage is a message to a client on a WebSocket connection.
+type WSMessage struct {
+	Type    string          `json:"type"`                     // The type of message: subscribed, unsubscribed, resync, update, delete or error.
+	Id      string          `json:"id,omitempty"`             // The client's id for the subscription.
+	EventId uint64          `json:"eventId,string,omitempty"` // The id of the event.
+	Data    json.RawMessage `json:"data,omitempty"`           // The updated document.
+	Path    string          `json:"path,omitempty"`           // The deleted document.
+	Resumed bool            `json:"resumed,omitempty"`        // Whether the subscription resumed after lastEventId.
+	Message string          `json:"message,omitempty"`        // The error.
 }
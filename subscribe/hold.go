@@ -0,0 +1,66 @@
+package subscribe
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// A hold keeps back the events published and the streams closed
+// while it is held, so that a change can be undone before any
+// subscriber learns of it.
+type Hold struct {
+	mu      *sync.Mutex // Guards pending.
+	pending []func()    // The publishes and closes held back, in order.
+}
+
+// The hold currently held, or nil if there is none.
+var held atomic.Pointer[Hold]
+
+// Holds back every event published and every stream closed until the
+// hold is released or discarded. Holds may not overlap.
+func NewHold() *Hold {
+	hold := &Hold{&sync.Mutex{}, make([]func(), 0)}
+	held.Store(hold)
+	return hold
+}
+
+// Publishes the events and closes the streams held back, in order.
+func (h *Hold) Release() {
+	held.CompareAndSwap(h, nil)
+
+	h.mu.Lock()
+	pending := h.pending
+	h.pending = nil
+	h.mu.Unlock()
+
+	for _, action := range pending {
+		action()
+	}
+}
+
+// Drops the events and closes held back.
+func (h *Hold) Discard() {
+	held.CompareAndSwap(h, nil)
+
+	h.mu.Lock()
+	h.pending = nil
+	h.mu.Unlock()
+}
+
+// Keeps action back until the current hold is released. Returns
+// false if there is no hold, so action must be run at once.
+func holdBack(action func()) bool {
+	hold := held.Load()
+	if hold == nil {
+		return false
+	}
+
+	hold.mu.Lock()
+	defer hold.mu.Unlock()
+	if hold.pending == nil {
+		// Released or discarded since it was loaded
+		return false
+	}
+	hold.pending = append(hold.pending, action)
+	return true
+}
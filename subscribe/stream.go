@@ -0,0 +1,163 @@
+package subscribe
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The kinds of events sent to subscribers.
+const (
+	EVENT_UPDATE = "update"
+	EVENT_DELETE = "delete"
+)
+
+// The number of recent events each stream keeps for resuming subscribers.
+const EVENT_BUFFER = 256
+
+// The last event id given out. Ids are shared by every stream, so they
+// increase within each resource and are never reused by a resource which
+// is deleted and created again. They start from the time the server
+// started, so ids from before a restart are older than every new id.
+var lastId atomic.Uint64
+
+func init() {
+	lastId.Store(uint64(time.Now().UnixNano()))
+}
+
+// An event is a change to a resource, as sent to subscribers.
+type Event struct {
+	Id   uint64 // The id of this event, increasing within each resource, or 0 for none.
+	Kind string // EVENT_UPDATE or EVENT_DELETE.
+	Data []byte // The JSON output of the updated document, or the path of the deleted one.
+	Name string // The name of the changed document within a collection, or "" for any.
+}
+
+// A stream numbers the events of a resource, delivers them to its
+// subscribers and keeps the most recent ones, so that subscribers
+// which reconnect with the id of the last event they saw receive
+// every event they missed.
+type Stream struct {
+	mu          *sync.Mutex                // Guards the fields below, so events are delivered in order.
+	base        uint64                     // No event with an id after base is missing from buffer.
+	buffer      []Event                    // The most recent events, oldest first.
+	subscribers map[*Subscriber]MatchEvent // The current subscribers and the events they want.
+	closed      bool                       // Whether the resource of this stream was deleted.
+}
+
+// A MatchEvent function tells if a subscriber wants an event.
+type MatchEvent func(event Event) bool
+
+// A subscription is a subscriber registered on a stream.
+type Subscription struct {
+	*Subscriber         // Receives the events published after subscribing.
+	Backlog     []Event // The events missed since Last-Event-ID, if resumed.
+	Resumed     bool    // Whether the subscription resumes after Last-Event-ID.
+	Since       uint64  // The id to give events for the state of the resource when subscribing.
+	stream      *Stream // The stream subscribed to.
+}
+
+// Creates a new stream without events.
+func NewStream() Stream {
+	return Stream{&sync.Mutex{}, lastId.Load(), make([]Event, 0), make(map[*Subscriber]MatchEvent), false}
+}
+
+// Publishes an event of the given kind, on the document name
+// ("" for any), to the subscribers which want it.
+func (st *Stream) Publish(kind string, name string, data []byte) {
+	if holdBack(func() { st.Publish(kind, name, data) }) {
+		return
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	event := Event{lastId.Add(1), kind, data, name}
+	st.buffer = append(st.buffer, event)
+	if len(st.buffer) > EVENT_BUFFER {
+		st.base = st.buffer[0].Id
+		st.buffer = st.buffer[1:]
+	}
+
+	for sub, match := range st.subscribers {
+		if match == nil || match(event) {
+			sub.send(event)
+		}
+	}
+}
+
+// Closes this stream once its resource is deleted, ending every
+// subscription to it after the events already published. Later
+// subscriptions end at once.
+func (st *Stream) Close() {
+	if holdBack(st.Close) {
+		return
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.closed = true
+	for sub := range st.subscribers {
+		sub.end()
+	}
+	st.subscribers = make(map[*Subscriber]MatchEvent)
+}
+
+// Subscribes to the events which match wants (all of them if match
+// is nil). If lastEventID is the id of an event of this stream which
+// is recent enough, the subscription resumes after it, and its backlog
+// holds the wanted events since then. Otherwise the caller must send
+// the current state of the resource, as created by Updates.
+//
+// The subscription must be cancelled when it is no longer served.
+func (st *Stream) Subscribe(match MatchEvent, lastEventID string) *Subscription {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	sub := New()
+	if st.closed {
+		sub.end()
+	} else {
+		st.subscribers[&sub] = match
+	}
+	subscription := &Subscription{Subscriber: &sub, Since: lastId.Load(), stream: st}
+
+	after, err := strconv.ParseUint(lastEventID, 10, 64)
+	if err != nil || after < st.base || after > subscription.Since {
+		return subscription
+	}
+
+	subscription.Resumed = true
+	subscription.Backlog = make([]Event, 0)
+	for _, event := range st.buffer {
+		if event.Id > after && (match == nil || match(event)) {
+			subscription.Backlog = append(subscription.Backlog, event)
+		}
+	}
+	return subscription
+}
+
+// Removes this subscription from its stream.
+func (s *Subscription) Cancel() {
+	s.stream.mu.Lock()
+	defer s.stream.mu.Unlock()
+
+	delete(s.stream.subscribers, s.Subscriber)
+}
+
+// Creates update events for the state of the resource when subscribing,
+// one for each JSON output in data. Only the last carries an id, Since,
+// so a client which reconnects before receiving all of them is sent
+// them all again rather than resuming part way through.
+func (s *Subscription) Updates(data [][]byte) []Event {
+	events := make([]Event, 0, len(data))
+	for _, output := range data {
+		events = append(events, Event{Kind: EVENT_UPDATE, Data: output})
+	}
+	if len(events) > 0 {
+		events[len(events)-1].Id = s.Since
+	}
+	return events
+}
@@ -0,0 +1,178 @@
+package subscribe
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Tests that subscribers resume after the last event they saw,
+// and only when no event since then has been dropped.
+func TestResume(t *testing.T) {
+	stream := NewStream()
+	first := stream.Subscribe(nil, "")
+	defer first.Cancel()
+	if first.Resumed {
+		t.Fatal("expected a subscription without Last-Event-ID not to resume")
+	}
+
+	stream.Publish(EVENT_UPDATE, "a", []byte("1"))
+	stream.Publish(EVENT_DELETE, "b", []byte("/v1/db/b"))
+	stream.Publish(EVENT_UPDATE, "c", []byte("3"))
+
+	seen := <-first.EventCh
+	if seen.Id <= first.Since || string(seen.Data) != "1" {
+		t.Fatalf("expected first event after %d, got %+v", first.Since, seen)
+	}
+
+	// Resume after the first event, wanting only updates
+	onlyUpdates := func(event Event) bool {
+		return event.Kind == EVENT_UPDATE
+	}
+	resumed := stream.Subscribe(onlyUpdates, strconv.FormatUint(seen.Id, 10))
+	defer resumed.Cancel()
+	if !resumed.Resumed || len(resumed.Backlog) != 1 || string(resumed.Backlog[0].Data) != "3" {
+		t.Fatalf("expected to resume with event 3, got %+v", resumed)
+	}
+
+	// Ids from the future, or which are not ids, are not resumed
+	for _, lastEventID := range []string{strconv.FormatUint(resumed.Since+1, 10), "x"} {
+		sub := stream.Subscribe(nil, lastEventID)
+		if sub.Resumed {
+			t.Errorf("expected %q not to resume", lastEventID)
+		}
+		sub.Cancel()
+	}
+
+	// Once events are dropped from the buffer, older ids are not resumed
+	for i := 0; i < EVENT_BUFFER; i++ {
+		stream.Publish(EVENT_UPDATE, "a", []byte("1"))
+	}
+	late := stream.Subscribe(nil, strconv.FormatUint(seen.Id, 10))
+	defer late.Cancel()
+	if late.Resumed {
+		t.Error("expected a dropped event id not to resume")
+	}
+}
+
+// Tests that a subscriber which falls behind is disconnected
+// rather than blocking the stream.
+func TestLagged(t *testing.T) {
+	stream := NewStream()
+	sub := stream.Subscribe(nil, "")
+	defer sub.Cancel()
+
+	for i := 0; i <= SUBSCRIBER_BUFFER; i++ {
+		stream.Publish(EVENT_UPDATE, "", []byte("{}"))
+	}
+
+	select {
+	case <-sub.lagged:
+	default:
+		t.Error("expected subscriber to be marked as lagged")
+	}
+}
+
+// Tests that closing a stream ends its subscriptions after the
+// events already published, and ends later ones at once.
+func TestClose(t *testing.T) {
+	stream := NewStream()
+	sub := stream.Subscribe(nil, "")
+	defer sub.Cancel()
+
+	stream.Publish(EVENT_DELETE, "", []byte("/v1/db/a"))
+	stream.Close()
+
+	select {
+	case <-sub.Ended():
+	default:
+		t.Fatal("expected subscriber to be ended")
+	}
+	pending := sub.Pending()
+	if len(pending) != 1 || pending[0].Kind != EVENT_DELETE {
+		t.Errorf("expected the delete event to be pending, got %+v", pending)
+	}
+
+	// Events after closing reach nobody
+	stream.Publish(EVENT_UPDATE, "", []byte("{}"))
+	if pending = sub.Pending(); len(pending) != 0 {
+		t.Errorf("expected no events after closing, got %+v", pending)
+	}
+
+	late := stream.Subscribe(nil, "")
+	defer late.Cancel()
+	select {
+	case <-late.Ended():
+	default:
+		t.Error("expected a subscription to a closed stream to be ended")
+	}
+}
+
+// Tests that a client cut off part way through the initial state of a
+// resource is not resumed, but one which received all of it is.
+func TestResumeAfterInitial(t *testing.T) {
+	stream := NewStream()
+	sub := stream.Subscribe(nil, "")
+	defer sub.Cancel()
+
+	initial := sub.Updates([][]byte{[]byte("1"), []byte("2"), []byte("3")})
+	if len(initial) != 3 || initial[0].Id != 0 || initial[1].Id != 0 || initial[2].Id != sub.Since {
+		t.Fatalf("expected only the last initial event to have an id, got %+v", initial)
+	}
+	if strings.Contains(writeEvent(initial[0]), "id:") || !strings.Contains(writeEvent(initial[2]), "id:") {
+		t.Errorf("expected only events with ids to be written with them")
+	}
+
+	// A client which received the first events has no id to resume from
+	partial := stream.Subscribe(nil, "")
+	defer partial.Cancel()
+	if partial.Resumed {
+		t.Error("expected a client cut off during the initial events not to resume")
+	}
+
+	// A client which received all of them resumes after them
+	stream.Publish(EVENT_UPDATE, "", []byte("4"))
+	complete := stream.Subscribe(nil, strconv.FormatUint(initial[2].Id, 10))
+	defer complete.Cancel()
+	if !complete.Resumed || len(complete.Backlog) != 1 || string(complete.Backlog[0].Data) != "4" {
+		t.Errorf("expected to resume with event 4, got %+v", complete)
+	}
+}
+
+// Tests that events published and streams closed while held back are
+// sent once the hold is released, and dropped if it is discarded.
+func TestHold(t *testing.T) {
+	stream := NewStream()
+	sub := stream.Subscribe(nil, "")
+	defer sub.Cancel()
+
+	hold := NewHold()
+	stream.Publish(EVENT_UPDATE, "a", []byte("1"))
+	stream.Close()
+	hold.Discard()
+	if events := sub.Pending(); len(events) != 0 {
+		t.Fatalf("expected no events after a discarded hold, got %d", len(events))
+	}
+	select {
+	case <-sub.Ended():
+		t.Fatal("expected the subscription not to end after a discarded hold")
+	default:
+	}
+
+	hold = NewHold()
+	stream.Publish(EVENT_UPDATE, "a", []byte("2"))
+	stream.Close()
+	if events := sub.Pending(); len(events) != 0 {
+		t.Fatalf("expected no events while held, got %d", len(events))
+	}
+	hold.Release()
+	events := sub.Pending()
+	if len(events) != 1 || string(events[0].Data) != "2" {
+		t.Fatalf("expected the held event once released, got %v", events)
+	}
+	select {
+	case <-sub.Ended():
+	default:
+		t.Fatal("expected the subscription to end once released")
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"log/slog"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/RICE-COMP318-FALL23/owldb-p1group20/errorMessage"
@@ -21,41 +22,93 @@ type writeFlusher interface {
 	http.Flusher
 }
 
-// A subscriber has channels for supporting sending
-// messages concurrently from documents and collections
+// The number of events a subscriber may fall behind by before it is
+// disconnected. A disconnected EventSource reconnects with the id of
+// the last event it received, and resumes from there.
+const SUBSCRIBER_BUFFER = 64
+
+// A subscriber has a channel for supporting sending
+// events concurrently from documents and collections
 // to a subscriber.
 type Subscriber struct {
-	UpdateCh chan []byte // A channel to which we write updates.
-	DeleteCh chan string // A channel to which we write deletions.
+	EventCh chan Event    // A channel to which we write events.
+	lagged  chan struct{} // Closed when the subscriber falls too far behind.
+	once    *sync.Once    // Closes lagged once.
+	ended   chan struct{} // Closed when the resource subscribed to is deleted.
+	endOnce *sync.Once    // Closes ended once.
 }
 
 // New creates a new subscriber.
 func New() Subscriber {
 	return Subscriber{
-		UpdateCh: make(chan []byte),
-		DeleteCh: make(chan string),
+		EventCh: make(chan Event, SUBSCRIBER_BUFFER),
+		lagged:  make(chan struct{}),
+		once:    &sync.Once{},
+		ended:   make(chan struct{}),
+		endOnce: &sync.Once{},
 	}
 }
 
-// Writes delete event when a document or collection is deleted.
-func writeDelete(path string) string {
-	// Create event
-	var event bytes.Buffer
-	now := time.Now()
-	millisecondsSinceEpoch := now.UnixMilli()
-	event.WriteString(fmt.Sprintf("event: delete\ndata: \"%s\"\nid: %d\n\n", path, millisecondsSinceEpoch))
-	slog.Info("Sending", "msg", event.String())
+// Sends an event to this subscriber without blocking,
+// disconnecting it if it has fallen too far behind.
+func (s Subscriber) send(event Event) {
+	select {
+	case s.EventCh <- event:
+	default:
+		s.once.Do(func() {
+			close(s.lagged)
+		})
+	}
+}
 
-	return event.String()
+// Lagged is closed when this subscriber falls so far behind that
+// events were dropped.
+func (s Subscriber) Lagged() <-chan struct{} {
+	return s.lagged
+}
+
+// Ends this subscriber once the resource it subscribed to is deleted.
+// The events already sent to it are still delivered.
+func (s Subscriber) end() {
+	s.endOnce.Do(func() {
+		close(s.ended)
+	})
+}
+
+// Ended is closed when the resource this subscriber subscribed to is
+// deleted, after its last events were sent.
+func (s Subscriber) Ended() <-chan struct{} {
+	return s.ended
+}
+
+// Takes the events sent to this subscriber which it has not yet
+// received, without waiting for more.
+func (s Subscriber) Pending() []Event {
+	events := make([]Event, 0)
+	for {
+		select {
+		case event := <-s.EventCh:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
 }
 
-// Writes update event when a document or collection is updated.
-func writeUpdate(jsonObj []byte) string {
+// Writes an update or delete event. Events without an id leave the
+// last event id of the client as it was.
+func writeEvent(e Event) string {
 	// Create event
 	var event bytes.Buffer
-	now := time.Now()
-	millisecondsSinceEpoch := now.UnixMilli()
-	event.WriteString(fmt.Sprintf("event: update\ndata: %s\nid: %d\n\n", jsonObj, millisecondsSinceEpoch))
+	if e.Kind == EVENT_DELETE {
+		event.WriteString(fmt.Sprintf("event: delete\ndata: \"%s\"\n", e.Data))
+	} else {
+		event.WriteString(fmt.Sprintf("event: update\ndata: %s\n", e.Data))
+	}
+	if e.Id != 0 {
+		event.WriteString(fmt.Sprintf("id: %d\n", e.Id))
+	}
+	event.WriteString("\n")
 	slog.Info("Sending", "msg", event.String())
 
 	return event.String()
@@ -73,13 +126,14 @@ func writeComment() string {
 
 // ServeSubscriber runs in a goroutine sending
 // events to a subscriber regarding the elements
-// of a database that they have subscribed to.
-func (s Subscriber) ServeSubscriber(w http.ResponseWriter, r *http.Request) {
+// of a database that they have subscribed to,
+// starting with the initial events.
+func (s Subscriber) ServeSubscriber(w http.ResponseWriter, r *http.Request, initial []Event) {
 	// Convert ResponseWriter to a writeFlusher
 	wf, ok := w.(writeFlusher)
 	if !ok {
 		slog.Info("Couldn't convert to write flusher")
-		errorMessage.ErrorResponse(w, "streaming unsupported", http.StatusInternalServerError)
+		errorMessage.Respond(w, r, "streaming unsupported", http.StatusInternalServerError)
 		return
 	}
 
@@ -96,6 +150,11 @@ func (s Subscriber) ServeSubscriber(w http.ResponseWriter, r *http.Request) {
 
 	slog.Info("Sent headers")
 
+	for _, event := range initial {
+		wf.Write([]byte(writeEvent(event)))
+	}
+	wf.Flush()
+
 	for {
 		select {
 		case <-r.Context().Done():
@@ -106,11 +165,19 @@ func (s Subscriber) ServeSubscriber(w http.ResponseWriter, r *http.Request) {
 			// Send comments every 15 seconds to keep the connection
 			wf.Write([]byte(writeComment()))
 			wf.Flush()
-		case jsonObj := <-s.UpdateCh:
-			wf.Write([]byte(writeUpdate(jsonObj)))
+		case <-s.lagged:
+			slog.Info("Subscribe: Client fell behind, closing connection")
+			return
+		case <-s.ended:
+			// Send the last events, such as the deletion, before closing
+			for _, event := range s.Pending() {
+				wf.Write([]byte(writeEvent(event)))
+			}
 			wf.Flush()
-		case path := <-s.DeleteCh:
-			wf.Write([]byte(writeDelete(path)))
+			slog.Info("Subscribe: Resource deleted, closing connection")
+			return
+		case event := <-s.EventCh:
+			wf.Write([]byte(writeEvent(event)))
 			wf.Flush()
 		}
 	}
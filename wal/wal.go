@@ -0,0 +1,369 @@
+// Package wal implements a durable write-ahead log of the
+// mutations applied to the owlDB, so that the databases
+// can be rebuilt when the server is restarted.
+//
+// The log is split into segment files named after the sequence
+// number of their first record. Once a snapshot covers every
+// record of a segment, the segment can be removed with Truncate.
+package wal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The operations that may be recorded in the log.
+const (
+	OP_PUT_COLLECTION = "putCollection" // A database or collection was created.
+	OP_PUT_DOCUMENT   = "putDocument"   // A document was created or overwritten.
+	OP_PUT_INDEX      = "putIndex"      // An index was created or replaced.
+	OP_DELETE         = "delete"        // A database, collection, document or index was deleted.
+	OP_TRANSACTION    = "transaction"   // Several records, in Doc, were applied atomically.
+)
+
+// The fsync policies supported by the log.
+const (
+	SYNC_ALWAYS   = "always"   // Fsync after every appended record.
+	SYNC_INTERVAL = "interval" // Fsync in the background once every SYNC_PERIOD.
+	SYNC_NEVER    = "never"    // Leave flushing to the operating system.
+)
+
+// How often the log is flushed to disk under SYNC_INTERVAL.
+const SYNC_PERIOD = time.Second
+
+// The prefix and suffix of segment file names.
+const (
+	SEGMENT_PREFIX = "wal-"
+	SEGMENT_SUFFIX = ".log"
+)
+
+// A record is a single entry of the write-ahead log.
+type Record struct {
+	Seq  uint64          `json:"seq"`           // The sequence number of this record, starting at 1.
+	Op   string          `json:"op"`            // The operation that was applied.
+	Path string          `json:"path"`          // The request path of the resource that was changed.
+	Doc  json.RawMessage `json:"doc,omitempty"` // For documents, the document and its metadata.
+}
+
+// A log is an append-only sequence of records.
+type Log struct {
+	mu       sync.Mutex    // Guards the fields below.
+	dir      string        // The directory holding the segment files.
+	file     *os.File      // The open current (last) segment.
+	segments []uint64      // The first sequence numbers of the segments, in order.
+	policy   string        // The fsync policy of this log.
+	seq      uint64        // The sequence number of the last record in the log.
+	done     chan struct{} // Closed to stop the background syncer.
+}
+
+// Opens (or creates) the log stored in the directory dir with the
+// given fsync policy. A torn record at the end of the log, left
+// by a crash in the middle of a write, is discarded.
+func Open(dir string, policy string) (*Log, error) {
+	if policy != SYNC_ALWAYS && policy != SYNC_INTERVAL && policy != SYNC_NEVER {
+		return nil, fmt.Errorf("unknown fsync policy: %s", policy)
+	}
+
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+
+	segments, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) == 0 {
+		segments = append(segments, 1)
+	}
+
+	// Find the end of the last valid record of the current segment
+	current := segments[len(segments)-1]
+	last := current - 1
+	name := filepath.Join(dir, segmentName(current))
+	end, err := scan(name, func(rec Record) error {
+		last = rec.Seq
+		return nil
+	})
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	// Drop anything after it and open for appending
+	file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	err = file.Truncate(end)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	l := &Log{dir: dir, file: file, segments: segments, policy: policy, seq: last, done: make(chan struct{})}
+	if policy == SYNC_INTERVAL {
+		go l.syncer()
+	}
+
+	slog.Info("Opened write-ahead log", "dir", dir, "segments", len(segments), "seq", last, "policy", policy)
+	return l, nil
+}
+
+// Appends a record to the log, assigning it the next sequence number.
+// Returns once the record is written according to the fsync policy.
+func (l *Log) Append(rec Record) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	rec.Seq = l.seq + 1
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return 0, err
+	}
+
+	// Each line is the checksum of the record followed by the record
+	line := fmt.Sprintf("%08x %s\n", crc32.ChecksumIEEE(data), data)
+	_, err = l.file.WriteString(line)
+	if err != nil {
+		return 0, err
+	}
+
+	if l.policy == SYNC_ALWAYS {
+		err = l.file.Sync()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	l.seq = rec.Seq
+	return rec.Seq, nil
+}
+
+// Returns the sequence number of the last record in the log.
+func (l *Log) Seq() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.seq
+}
+
+// Calls apply on every record in the log with a sequence
+// number greater than after, in order.
+func (l *Log) Replay(after uint64, apply func(rec Record) error) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for i, start := range l.segments {
+		// Skip segments that only hold records up to after
+		if i+1 < len(l.segments) && l.segments[i+1] <= after+1 {
+			continue
+		}
+
+		_, err := scan(filepath.Join(l.dir, segmentName(start)), func(rec Record) error {
+			if rec.Seq <= after {
+				return nil
+			}
+			return apply(rec)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Closes the current segment and starts a new one, so that the
+// closed segments can later be truncated. Returns the sequence
+// number of the last record before the new segment.
+func (l *Log) Rotate() (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Nothing to rotate if the current segment is empty
+	if l.seq+1 == l.segments[len(l.segments)-1] {
+		return l.seq, nil
+	}
+
+	err := l.file.Sync()
+	if err != nil {
+		return 0, err
+	}
+
+	file, err := os.OpenFile(filepath.Join(l.dir, segmentName(l.seq+1)), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return 0, err
+	}
+	err = syncDir(l.dir)
+	if err != nil {
+		file.Close()
+		return 0, err
+	}
+
+	l.file.Close()
+	l.file = file
+	l.segments = append(l.segments, l.seq+1)
+	slog.Info("Rotated write-ahead log", "seq", l.seq)
+	return l.seq, nil
+}
+
+// Removes the segments that only hold records with sequence numbers
+// up to upto. The current segment is never removed.
+func (l *Log) Truncate(upto uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for len(l.segments) > 1 && l.segments[1] <= upto+1 {
+		err := os.Remove(filepath.Join(l.dir, segmentName(l.segments[0])))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		slog.Info("Truncated write-ahead log segment", "start", l.segments[0])
+		l.segments = l.segments[1:]
+	}
+
+	return syncDir(l.dir)
+}
+
+// Flushes and closes the log.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	close(l.done)
+	err := l.file.Sync()
+	if err != nil {
+		l.file.Close()
+		return err
+	}
+	return l.file.Close()
+}
+
+// Periodically flushes the log to disk under SYNC_INTERVAL.
+func (l *Log) syncer() {
+	ticker := time.NewTicker(SYNC_PERIOD)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+			l.mu.Lock()
+			err := l.file.Sync()
+			l.mu.Unlock()
+			if err != nil {
+				slog.Error("Write-ahead log: fsync failed", "error", err)
+			}
+		}
+	}
+}
+
+// Returns the file name of the segment starting at start.
+func segmentName(start uint64) string {
+	return fmt.Sprintf("%s%020d%s", SEGMENT_PREFIX, start, SEGMENT_SUFFIX)
+}
+
+// Returns the first sequence numbers of the segments in dir, in order.
+func listSegments(dir string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	segments := make([]uint64, 0)
+	for _, entry := range entries {
+		name, found := strings.CutPrefix(entry.Name(), SEGMENT_PREFIX)
+		name, suffixed := strings.CutSuffix(name, SEGMENT_SUFFIX)
+		if !found || !suffixed {
+			continue
+		}
+
+		var start uint64
+		_, err := fmt.Sscanf(name, "%d", &start)
+		if err == nil && start > 0 {
+			segments = append(segments, start)
+		}
+	}
+
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return segments, nil
+}
+
+// Reads the records of the segment file name from the beginning,
+// calling apply on each. Returns the offset of the end of the last
+// valid record.
+func scan(name string, apply func(rec Record) error) (int64, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				slog.Warn("Write-ahead log: discarding torn record", "segment", name, "offset", offset)
+			}
+			return offset, nil
+		} else if err != nil {
+			return offset, err
+		}
+
+		rec, err := decode(line)
+		if err != nil {
+			slog.Warn("Write-ahead log: discarding invalid record", "segment", name, "offset", offset, "error", err)
+			return offset, nil
+		}
+
+		err = apply(rec)
+		if err != nil {
+			return offset, err
+		}
+		offset += int64(len(line))
+	}
+}
+
+// Decodes and verifies a single line of the log.
+func decode(line []byte) (Record, error) {
+	var rec Record
+
+	sum, data, found := bytes.Cut(bytes.TrimSuffix(line, []byte("\n")), []byte(" "))
+	if !found {
+		return rec, errors.New("missing checksum")
+	}
+
+	var expected uint32
+	_, err := fmt.Sscanf(string(sum), "%08x", &expected)
+	if err != nil || crc32.ChecksumIEEE(data) != expected {
+		return rec, errors.New("checksum mismatch")
+	}
+
+	err = json.Unmarshal(data, &rec)
+	return rec, err
+}
+
+// Flushes the entries of the directory dir to disk.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
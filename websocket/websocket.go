@@ -0,0 +1,378 @@
+// Package websocket implements the WebSocket protocol (RFC 6455) on
+// the standard library: the opening handshake, and the framing of
+// text, binary and control messages. Servers upgrade HTTP requests
+// with Upgrade; Dial connects as a client.
+//
+// Messages of a connection may be written concurrently, but must
+// be read by a single goroutine.
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The GUID appended to handshake keys, as defined by RFC 6455.
+const ACCEPT_GUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// The opcodes of frames.
+const (
+	OP_CONTINUATION byte = 0x0
+	OP_TEXT         byte = 0x1
+	OP_BINARY       byte = 0x2
+	OP_CLOSE        byte = 0x8
+	OP_PING         byte = 0x9
+	OP_PONG         byte = 0xA
+)
+
+// The status codes of close frames.
+const (
+	CLOSE_NORMAL         = 1000
+	CLOSE_PROTOCOL_ERROR = 1002
+	CLOSE_TOO_BIG        = 1009
+)
+
+// The largest message accepted, in bytes.
+const MAX_MESSAGE = 1 << 20
+
+// How long a write may block before the connection is given up on.
+const WRITE_TIMEOUT = 10 * time.Second
+
+// Returned when reading or writing a closed connection.
+var ErrClosed = errors.New("websocket: connection closed")
+
+// Returned when the peer breaks the protocol.
+var errProtocol = errors.New("websocket: protocol error")
+
+// Returned when the peer sends a message larger than MAX_MESSAGE.
+var errTooBig = errors.New("websocket: message too big")
+
+// A connection is one end of a WebSocket.
+type Conn struct {
+	conn    net.Conn      // The underlying connection.
+	reader  *bufio.Reader // Buffers reads from conn, including any read during the handshake.
+	client  bool          // Whether this is the client end, which masks the frames it writes.
+	writeMu *sync.Mutex   // Serializes writes, and guards closed.
+	closed  bool          // Whether a close frame has been written.
+}
+
+// Computes the Sec-WebSocket-Accept value for a Sec-WebSocket-Key.
+func AcceptKey(key string) string {
+	hash := sha1.Sum([]byte(key + ACCEPT_GUID))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// Tells if the comma separated header name of h lists value.
+func headerContains(h http.Header, name string, value string) bool {
+	for _, line := range h.Values(name) {
+		for _, token := range strings.Split(line, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Upgrades an HTTP request to a WebSocket connection, taking over the
+// underlying connection. On error, nothing has been written to w.
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	if r.Method != http.MethodGet {
+		return nil, fmt.Errorf("handshake must be a GET, not %s", r.Method)
+	}
+	if !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") {
+		return nil, errors.New("not a WebSocket handshake")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		return nil, errors.New("unsupported WebSocket version, expected 13")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		return nil, errors.New("missing Sec-WebSocket-Key")
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, errors.New("connection cannot be upgraded")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	rw.WriteString("Upgrade: websocket\r\n")
+	rw.WriteString("Connection: Upgrade\r\n")
+	rw.WriteString("Sec-WebSocket-Accept: " + AcceptKey(key) + "\r\n\r\n")
+	err = rw.Flush()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &Conn{conn, rw.Reader, false, &sync.Mutex{}, false}, nil
+}
+
+// Connects to the WebSocket at rawURL (ws://host/path), sending
+// header with the handshake.
+func Dial(rawURL string, header http.Header) (*Conn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "ws" {
+		return nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+
+	nonce := make([]byte, 16)
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	u.Scheme = "http"
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+
+	conn, err := net.Dial("tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	err = req.Write(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		conn.Close()
+		return nil, fmt.Errorf("handshake failed with status %d: %s", resp.StatusCode, body)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != AcceptKey(key) {
+		conn.Close()
+		return nil, errors.New("handshake failed: bad Sec-WebSocket-Accept")
+	}
+
+	return &Conn{conn, reader, true, &sync.Mutex{}, false}, nil
+}
+
+// Reads the next text or binary message, answering pings and
+// joining fragments. Returns the opcode and payload of the message.
+// Returns ErrClosed once the peer has closed the connection.
+func (c *Conn) ReadMessage() (byte, []byte, error) {
+	var opcode byte
+	var message []byte
+	started := false
+
+	for {
+		fin, op, payload, err := c.readFrame()
+		if errors.Is(err, errProtocol) {
+			c.CloseWith(CLOSE_PROTOCOL_ERROR)
+			return 0, nil, err
+		} else if errors.Is(err, errTooBig) {
+			c.CloseWith(CLOSE_TOO_BIG)
+			return 0, nil, err
+		} else if err != nil {
+			c.conn.Close()
+			return 0, nil, err
+		}
+
+		switch op {
+		case OP_PING:
+			c.writeFrame(OP_PONG, payload)
+			continue
+		case OP_PONG:
+			continue
+		case OP_CLOSE:
+			// Echo the status code of the peer
+			code := CLOSE_NORMAL
+			if len(payload) >= 2 {
+				code = int(binary.BigEndian.Uint16(payload))
+			}
+			c.CloseWith(code)
+			return 0, nil, ErrClosed
+		case OP_TEXT, OP_BINARY:
+			if started {
+				c.CloseWith(CLOSE_PROTOCOL_ERROR)
+				return 0, nil, fmt.Errorf("%w: new message inside a fragmented one", errProtocol)
+			}
+			opcode = op
+			started = true
+		case OP_CONTINUATION:
+			if !started {
+				c.CloseWith(CLOSE_PROTOCOL_ERROR)
+				return 0, nil, fmt.Errorf("%w: continuation without a message", errProtocol)
+			}
+		default:
+			c.CloseWith(CLOSE_PROTOCOL_ERROR)
+			return 0, nil, fmt.Errorf("%w: unknown opcode %d", errProtocol, op)
+		}
+
+		if len(message)+len(payload) > MAX_MESSAGE {
+			c.CloseWith(CLOSE_TOO_BIG)
+			return 0, nil, errTooBig
+		}
+		message = append(message, payload...)
+		if fin {
+			return opcode, message, nil
+		}
+	}
+}
+
+// Reads a single frame. Returns whether it is the final fragment
+// of its message, its opcode and its unmasked payload.
+func (c *Conn) readFrame() (bool, byte, []byte, error) {
+	header := make([]byte, 2)
+	_, err := io.ReadFull(c.reader, header)
+	if err != nil {
+		return false, 0, nil, err
+	}
+
+	fin := header[0]&0x80 != 0
+	op := header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7F)
+	if header[0]&0x70 != 0 {
+		return false, 0, nil, fmt.Errorf("%w: reserved bits set", errProtocol)
+	}
+	// Clients mask every frame, servers none
+	if masked == c.client {
+		return false, 0, nil, fmt.Errorf("%w: bad masking", errProtocol)
+	}
+
+	switch length {
+	case 126:
+		extended := make([]byte, 2)
+		_, err = io.ReadFull(c.reader, extended)
+		length = uint64(binary.BigEndian.Uint16(extended))
+	case 127:
+		extended := make([]byte, 8)
+		_, err = io.ReadFull(c.reader, extended)
+		length = binary.BigEndian.Uint64(extended)
+	}
+	if err != nil {
+		return false, 0, nil, err
+	}
+	if op >= OP_CLOSE && (!fin || length > 125) {
+		return false, 0, nil, fmt.Errorf("%w: bad control frame", errProtocol)
+	}
+	if length > MAX_MESSAGE {
+		return false, 0, nil, errTooBig
+	}
+
+	var mask []byte
+	if masked {
+		mask = make([]byte, 4)
+		_, err = io.ReadFull(c.reader, mask)
+		if err != nil {
+			return false, 0, nil, err
+		}
+	}
+	payload := make([]byte, length)
+	_, err = io.ReadFull(c.reader, payload)
+	if err != nil {
+		return false, 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+
+	return fin, op, payload, nil
+}
+
+// Writes a message with the given opcode as a single frame.
+func (c *Conn) WriteMessage(opcode byte, data []byte) error {
+	return c.writeFrame(opcode, data)
+}
+
+// Writes a single final frame.
+func (c *Conn) writeFrame(opcode byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.closed {
+		return ErrClosed
+	}
+	if opcode == OP_CLOSE {
+		c.closed = true
+	}
+
+	frame := []byte{0x80 | opcode}
+	maskBit := byte(0)
+	if c.client {
+		maskBit = 0x80
+	}
+	switch {
+	case len(payload) <= 125:
+		frame = append(frame, maskBit|byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+
+	if c.client {
+		mask := make([]byte, 4)
+		_, err := rand.Read(mask)
+		if err != nil {
+			return err
+		}
+		frame = append(frame, mask...)
+		start := len(frame)
+		frame = append(frame, payload...)
+		for i := start; i < len(frame); i++ {
+			frame[i] ^= mask[(i-start)%4]
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(WRITE_TIMEOUT))
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// Closes the connection with a normal close frame.
+func (c *Conn) Close() error {
+	return c.CloseWith(CLOSE_NORMAL)
+}
+
+// Closes the connection with a close frame of the given status code.
+func (c *Conn) CloseWith(code int) error {
+	c.writeFrame(OP_CLOSE, binary.BigEndian.AppendUint16(nil, uint16(code)))
+	return c.conn.Close()
+}
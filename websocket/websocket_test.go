@@ -0,0 +1,71 @@
+package websocket
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Tests the accept key against the example of RFC 6455.
+func TestAcceptKey(t *testing.T) {
+	accept := AcceptKey("dGhlIHNhbXBsZSBub25jZQ==")
+	if accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("expected s3pPLMBiTxaQ9kYGzzhZRbK+xOo=, got %s", accept)
+	}
+}
+
+// Tests that messages of every length make it to an echo server and back.
+func TestEcho(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrade(w, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer conn.Close()
+		for {
+			opcode, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			conn.WriteMessage(opcode, data)
+		}
+	}))
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+	conn, err := Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("expected no errors, got %s", err.Error())
+	}
+
+	for _, size := range []int{0, 5, 125, 126, 65535, 65536} {
+		message := bytes.Repeat([]byte("a"), size)
+		err = conn.WriteMessage(OP_TEXT, message)
+		if err != nil {
+			t.Fatalf("size %d: expected no errors, got %s", size, err.Error())
+		}
+		// Pings are answered without reaching the reader
+		conn.WriteMessage(OP_PING, []byte("ping"))
+
+		opcode, data, err := conn.ReadMessage()
+		if err != nil || opcode != OP_TEXT || !bytes.Equal(data, message) {
+			t.Errorf("size %d: expected the message back, got %d bytes, %v", size, len(data), err)
+		}
+	}
+
+	conn.WriteMessage(OP_CLOSE, []byte{0x03, 0xE8})
+	_, _, err = conn.ReadMessage()
+	if !errors.Is(err, ErrClosed) {
+		t.Errorf("expected the close to be echoed, got %v", err)
+	}
+
+	// Plain requests are not upgraded
+	resp, err := http.Get(server.URL)
+	if err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected a plain request to fail, got %v", err)
+	}
+}